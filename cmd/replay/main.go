@@ -0,0 +1,119 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Command replay replays HAR files through the plugin with a given configuration,
+// reporting the rules matched and the requests that would have been blocked:
+//
+//	go run ./cmd/replay -config config.json capture.har
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/coraza-proxy-wasm/replay"
+)
+
+func main() {
+	configPath := flag.String("config", "", "path to the plugin configuration (JSON)")
+	jsonOutput := flag.Bool("json", false, "print a JSON result per line")
+	verbose := flag.Bool("v", false, "print the plugin logs")
+	flag.Parse()
+
+	if *configPath == "" || flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: replay -config <config.json> [-json] [-v] <file.har>...")
+		os.Exit(2)
+	}
+
+	if err := run(*configPath, flag.Args(), *jsonOutput, *verbose); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(configPath string, harPaths []string, jsonOutput, verbose bool) error {
+	if !verbose {
+		// The host emulator prints the plugin logs through the standard logger
+		log.SetOutput(io.Discard)
+	}
+
+	config, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	r, err := replay.New(config)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var total, blocked, matched int
+	enc := json.NewEncoder(os.Stdout)
+	for _, path := range harPaths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		exchanges, err := replay.LoadHAR(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+
+		for _, e := range exchanges {
+			res, err := r.Replay(e)
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+
+			total++
+			if res.Blocked {
+				blocked++
+			}
+			if len(res.RuleIDs) > 0 {
+				matched++
+			}
+
+			if jsonOutput {
+				if err := enc.Encode(res); err != nil {
+					return err
+				}
+				continue
+			}
+			fmt.Println(formatResult(res))
+		}
+	}
+
+	if !jsonOutput {
+		fmt.Printf("\n%d requests, %d would be blocked, %d matched rules\n", total, blocked, matched)
+	}
+	return nil
+}
+
+func formatResult(res replay.Result) string {
+	var sb strings.Builder
+	if res.Blocked {
+		sb.WriteString(fmt.Sprintf("BLOCK %d %s ", res.StatusCode, res.Phase))
+	} else {
+		sb.WriteString("PASS  ")
+	}
+	sb.WriteString(res.Method)
+	sb.WriteByte(' ')
+	sb.WriteString(res.URL)
+	if len(res.RuleIDs) > 0 {
+		ids := make([]string, 0, len(res.RuleIDs))
+		for _, id := range res.RuleIDs {
+			ids = append(ids, strconv.Itoa(id))
+		}
+		sb.WriteString(" rules=")
+		sb.WriteString(strings.Join(ids, ","))
+	}
+	return sb.String()
+}
@@ -0,0 +1,138 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package ftwtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Envoy is a target sending the requests to a running Envoy loading the built wasm,
+// e.g. the e2e environment. The plugin logs are not collected: as in the go-ftw cloud
+// mode, only the status codes and the metrics are checked.
+type Envoy struct {
+	// URL is the base URL of the Envoy listener, e.g. "http://localhost:8080".
+	URL string
+	// AdminURL is the base URL of the Envoy admin interface, e.g. "http://localhost:8082".
+	AdminURL string
+	Client   *http.Client
+}
+
+var _ Target = (*Envoy)(nil)
+
+// NewEnvoy returns a target for the Envoy listening on url, exposing the admin
+// interface on adminURL.
+func NewEnvoy(url, adminURL string) *Envoy {
+	return &Envoy{
+		URL:      strings.TrimSuffix(url, "/"),
+		AdminURL: strings.TrimSuffix(adminURL, "/"),
+		Client: &http.Client{
+			Timeout: 10 * time.Second,
+			// Redirects are part of the response under test
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (e *Envoy) Do(req Request) (Response, error) {
+	r, err := http.NewRequest(req.Method, e.URL+req.URI, bytes.NewReader(req.Body))
+	if err != nil {
+		return Response{}, err
+	}
+	for _, h := range req.Headers {
+		if http.CanonicalHeaderKey(h[0]) == "Host" {
+			r.Host = h[1]
+			continue
+		}
+		r.Header.Add(h[0], h[1])
+	}
+
+	resp, err := e.Client.Do(r)
+	if err != nil {
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	return Response{Status: resp.StatusCode}, nil
+}
+
+// CounterMetric reads the counter from the admin interface, by its full name as
+// defined by the plugin (before the extraction of the tags).
+func (e *Envoy) CounterMetric(name string) (uint64, error) {
+	resp, err := e.Client.Get(e.AdminURL + "/stats?format=json&usedonly&filter=" + url.QueryEscape("^"+regexp.QuoteMeta(name)+"$"))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var stats struct {
+		Stats []struct {
+			Name  string `json:"name"`
+			Value uint64 `json:"value"`
+		} `json:"stats"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return 0, err
+	}
+	for _, s := range stats.Stats {
+		if s.Name == name {
+			return s.Value, nil
+		}
+	}
+	return 0, fmt.Errorf("counter %q not found", name)
+}
+
+// StartEnvoy starts the Envoy environment described by the docker compose file (e.g.
+// e2e/docker-compose.yml, loading build/main.wasm) and waits for Envoy to be ready.
+// The returned function tears the environment down.
+func StartEnvoy(composeFile string, adminURL string) (stop func(), err error) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return nil, errors.New("docker is required to start Envoy")
+	}
+
+	stop = func() {
+		_ = compose(composeFile, "down", "-v")
+	}
+	if err := compose(composeFile, "up", "-d", "envoy"); err != nil {
+		stop()
+		return nil, err
+	}
+
+	adminURL = strings.TrimSuffix(adminURL, "/")
+	deadline := time.Now().Add(time.Minute)
+	for {
+		resp, err := http.Get(adminURL + "/ready")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return stop, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			stop()
+			return nil, fmt.Errorf("envoy not ready after a minute: %v", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func compose(composeFile string, args ...string) error {
+	cmd := exec.Command("docker", append([]string{"compose", "--file", composeFile}, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,209 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package ftwtest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FTWFile is a go-ftw test file, see https://github.com/coreruleset/ftw-tests-schema.
+type FTWFile struct {
+	Meta struct {
+		Name    string `yaml:"name"`
+		Enabled *bool  `yaml:"enabled"`
+	} `yaml:"meta"`
+	Tests []FTWTest `yaml:"tests"`
+}
+
+// FTWTest is a go-ftw test, made of stages run in order.
+type FTWTest struct {
+	Title  string     `yaml:"test_title"`
+	Stages []FTWStage `yaml:"stages"`
+}
+
+// FTWStage is a request and the expected outcome. Both the current layout and the
+// legacy one, nesting input and output under "stage", are supported.
+type FTWStage struct {
+	Input  FTWInput  `yaml:"input"`
+	Output FTWOutput `yaml:"output"`
+	Stage  *struct {
+		Input  FTWInput  `yaml:"input"`
+		Output FTWOutput `yaml:"output"`
+	} `yaml:"stage"`
+}
+
+type FTWInput struct {
+	Method  *string           `yaml:"method"`
+	URI     *string           `yaml:"uri"`
+	Version *string           `yaml:"version"`
+	Headers map[string]string `yaml:"headers"`
+	Data    *string           `yaml:"data"`
+	// EncodedRequest and RawRequest bypass the request building, they are not supported.
+	EncodedRequest string `yaml:"encoded_request"`
+	RawRequest     string `yaml:"raw_request"`
+}
+
+type FTWOutput struct {
+	Status        statusList `yaml:"status"`
+	LogContains   string     `yaml:"log_contains"`
+	NoLogContains string     `yaml:"no_log_contains"`
+	ExpectError   bool       `yaml:"expect_error"`
+	Log           struct {
+		ExpectIDs   []int `yaml:"expect_ids"`
+		NoExpectIDs []int `yaml:"no_expect_ids"`
+	} `yaml:"log"`
+}
+
+// statusList is the expected status, either a single code or a list of codes.
+type statusList []int
+
+func (s *statusList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		var codes []int
+		if err := value.Decode(&codes); err != nil {
+			return err
+		}
+		*s = codes
+		return nil
+	}
+	var code int
+	if err := value.Decode(&code); err != nil {
+		return err
+	}
+	*s = statusList{code}
+	return nil
+}
+
+func (s statusList) contains(code int) bool {
+	for _, c := range s {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadFTW parses a go-ftw test file.
+func LoadFTW(r io.Reader) (FTWFile, error) {
+	var f FTWFile
+	if err := yaml.NewDecoder(r).Decode(&f); err != nil {
+		return f, fmt.Errorf("invalid ftw test file: %v", err)
+	}
+	return f, nil
+}
+
+// RunFTW runs the go-ftw test files matching the glob pattern against the target,
+// each test as a subtest named after the file and the test title.
+func RunFTW(t *testing.T, target Target, pattern string) {
+	t.Helper()
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatalf("invalid pattern %q: %v", pattern, err)
+	}
+	if len(paths) == 0 {
+		t.Fatalf("no ftw test file matching %q", pattern)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := LoadFTW(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			RunFTWFile(t, target, file)
+		})
+	}
+}
+
+// RunFTWFile runs the tests of a go-ftw test file against the target.
+func RunFTWFile(t *testing.T, target Target, file FTWFile) {
+	t.Helper()
+	if file.Meta.Enabled != nil && !*file.Meta.Enabled {
+		t.Skip("disabled")
+	}
+	for _, test := range file.Tests {
+		t.Run(test.Title, func(t *testing.T) {
+			for i, stage := range test.Stages {
+				if err := stage.run(target); err != nil {
+					if errors.Is(err, errUnsupportedStage) {
+						t.Skipf("stage %d: %v", i, err)
+					}
+					t.Fatalf("stage %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+var errUnsupportedStage = errors.New("encoded and raw requests are not supported")
+
+func (s FTWStage) run(target Target) error {
+	input, output := s.Input, s.Output
+	if s.Stage != nil {
+		input, output = s.Stage.Input, s.Stage.Output
+	}
+	if input.EncodedRequest != "" || input.RawRequest != "" {
+		return errUnsupportedStage
+	}
+
+	req := Request{Method: "GET", URI: "/", Version: "HTTP/1.1"}
+	if input.Method != nil {
+		req.Method = *input.Method
+	}
+	if input.URI != nil {
+		req.URI = *input.URI
+	}
+	if input.Version != nil {
+		req.Version = *input.Version
+	}
+	if input.Data != nil {
+		req.Body = []byte(*input.Data)
+	}
+	// Sorted for the requests to be reproducible
+	names := make([]string, 0, len(input.Headers))
+	for name := range input.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		req.Headers = append(req.Headers, [2]string{name, input.Headers[name]})
+	}
+	if input.Data != nil && input.Headers["Content-Length"] == "" {
+		req.Headers = append(req.Headers, [2]string{"Content-Length", strconv.Itoa(len(req.Body))})
+	}
+
+	resp, err := target.Do(req)
+	if err != nil {
+		if output.ExpectError {
+			return nil
+		}
+		return err
+	}
+	if output.ExpectError {
+		return errors.New("expected an error")
+	}
+
+	if len(output.Status) > 0 && !output.Status.contains(resp.Status) {
+		return fmt.Errorf("unexpected status, want %v, have %d", []int(output.Status), resp.Status)
+	}
+	if resp.HasLogs {
+		return checkLogs(resp, output.Log.ExpectIDs, output.Log.NoExpectIDs, output.LogContains, output.NoLogContains)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Package ftwtest runs end-to-end tests against the plugin as Go tests: go-ftw YAML
+// test suites (e.g. the CRS regression tests) and custom scenarios are replayed against
+// a Target, either the plugin loaded in-process in the proxy-wasm host emulator with
+// a given plugin configuration, or a running Envoy loading the built wasm:
+//
+//	func TestCRS(t *testing.T) {
+//		target, err := ftwtest.NewInProcess(pluginConfig)
+//		require.NoError(t, err)
+//		defer target.Close()
+//		ftwtest.RunFTW(t, target, "testdata/crs-tests/*/*.yaml")
+//	}
+package ftwtest
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+)
+
+// Request is the request sent to the target.
+type Request struct {
+	Method string
+	// URI is the request target, e.g. "/anything?arg=1".
+	URI     string
+	Version string
+	Headers [][2]string
+	Body    []byte
+}
+
+// Response is the response observed from the target.
+type Response struct {
+	// Status is the status code returned downstream, the one of the interruption
+	// if the request was blocked.
+	Status int
+	// HasLogs is true if the target reports the plugin logs, Logs and RuleIDs are empty otherwise.
+	HasLogs bool
+	// Logs are the plugin logs emitted while serving the request.
+	Logs []string
+	// RuleIDs are the IDs of the logged rules matched by the request.
+	RuleIDs []int
+}
+
+// Target serves the requests through the plugin.
+type Target interface {
+	Do(req Request) (Response, error)
+	// CounterMetric returns the value of a counter defined by the plugin.
+	CounterMetric(name string) (uint64, error)
+}
+
+// Scenario is a custom test case.
+type Scenario struct {
+	Name    string
+	Request Request
+	// ExpectStatus is the expected status code, not checked if zero.
+	ExpectStatus int
+	// ExpectRuleIDs and NoExpectRuleIDs are the rules expected to match, and not to match.
+	ExpectRuleIDs   []int
+	NoExpectRuleIDs []int
+	// LogContains and NoLogContains are regular expressions matched against the plugin logs.
+	LogContains   string
+	NoLogContains string
+	// ExpectCounters are the expected increments of the counters, by name.
+	ExpectCounters map[string]uint64
+}
+
+// Run runs the scenarios against the target, each as a subtest.
+func Run(t *testing.T, target Target, scenarios ...Scenario) {
+	t.Helper()
+	for _, s := range scenarios {
+		t.Run(s.Name, func(t *testing.T) {
+			if err := s.run(target); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func (s Scenario) run(target Target) error {
+	before := map[string]uint64{}
+	for name := range s.ExpectCounters {
+		// Counters are defined on first use
+		before[name], _ = target.CounterMetric(name)
+	}
+
+	resp, err := target.Do(s.Request)
+	if err != nil {
+		return err
+	}
+
+	if s.ExpectStatus != 0 && resp.Status != s.ExpectStatus {
+		return fmt.Errorf("unexpected status, want %d, have %d", s.ExpectStatus, resp.Status)
+	}
+
+	if resp.HasLogs {
+		if err := checkLogs(resp, s.ExpectRuleIDs, s.NoExpectRuleIDs, s.LogContains, s.NoLogContains); err != nil {
+			return err
+		}
+	}
+
+	for name, increment := range s.ExpectCounters {
+		value, err := target.CounterMetric(name)
+		if err != nil {
+			return fmt.Errorf("failed to get counter %q: %v", name, err)
+		}
+		if value-before[name] != increment {
+			return fmt.Errorf("unexpected increment of counter %q, want %d, have %d", name, increment, value-before[name])
+		}
+	}
+	return nil
+}
+
+func checkLogs(resp Response, expectIDs, noExpectIDs []int, logContains, noLogContains string) error {
+	matched := map[int]bool{}
+	for _, id := range resp.RuleIDs {
+		matched[id] = true
+	}
+	for _, id := range expectIDs {
+		if !matched[id] {
+			return fmt.Errorf("expected rule %d to match, matched %v", id, resp.RuleIDs)
+		}
+	}
+	for _, id := range noExpectIDs {
+		if matched[id] {
+			return fmt.Errorf("expected rule %d not to match, matched %v", id, resp.RuleIDs)
+		}
+	}
+
+	if logContains != "" {
+		ok, err := logsMatch(resp.Logs, logContains)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("expected logs to contain %q", logContains)
+		}
+	}
+	if noLogContains != "" {
+		ok, err := logsMatch(resp.Logs, noLogContains)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return fmt.Errorf("expected logs not to contain %q", noLogContains)
+		}
+	}
+	return nil
+}
+
+func logsMatch(logs []string, pattern string) (bool, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, fmt.Errorf("invalid log pattern %q: %v", pattern, err)
+	}
+	for _, l := range logs {
+		if re.MatchString(l) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
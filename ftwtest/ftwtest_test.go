@@ -0,0 +1,87 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package ftwtest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInProcess(t *testing.T) {
+	target, err := NewInProcess([]byte(`
+	{
+		"directives_map": {"default": [
+			"SecRuleEngine On",
+			"SecRequestBodyAccess On",
+			"SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,log,deny\"",
+			"SecRule ARGS_POST \"@contains suspicious\" \"id:102,phase:2,log,pass\""
+		]},
+		"default_directives": "default"
+	}`))
+	require.NoError(t, err)
+	defer target.Close()
+
+	RunFTW(t, target, "testdata/*.yaml")
+
+	Run(t, target,
+		Scenario{
+			Name:            "benign",
+			Request:         Request{Method: "GET", URI: "/anything?arg=1"},
+			ExpectStatus:    200,
+			NoExpectRuleIDs: []int{101, 102},
+			ExpectCounters:  map[string]uint64{"waf_filter.tx.total": 1},
+		},
+		Scenario{
+			Name:          "blocked",
+			Request:       Request{Method: "GET", URI: "/admin"},
+			ExpectStatus:  403,
+			ExpectRuleIDs: []int{101},
+			ExpectCounters: map[string]uint64{
+				"waf_filter.tx.interruptions_ruleid=101_phase=http_request_headers": 1,
+			},
+		},
+	)
+}
+
+func TestScenarioFailures(t *testing.T) {
+	target, err := NewInProcess([]byte(`
+	{
+		"directives_map": {"default": [
+			"SecRuleEngine On",
+			"SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,log,deny\""
+		]},
+		"default_directives": "default"
+	}`))
+	require.NoError(t, err)
+	defer target.Close()
+
+	tests := []struct {
+		name        string
+		scenario    Scenario
+		expectedErr string
+	}{
+		{
+			name:        "status",
+			scenario:    Scenario{Request: Request{Method: "GET", URI: "/admin"}, ExpectStatus: 200},
+			expectedErr: "unexpected status, want 200, have 403",
+		},
+		{
+			name:        "expected rule",
+			scenario:    Scenario{Request: Request{Method: "GET", URI: "/"}, ExpectRuleIDs: []int{101}},
+			expectedErr: "expected rule 101 to match, matched []",
+		},
+		{
+			name:        "log contains",
+			scenario:    Scenario{Request: Request{Method: "GET", URI: "/admin"}, NoLogContains: `id "101"`},
+			expectedErr: `expected logs not to contain "id \"101\""`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.EqualError(t, tt.scenario.run(target), tt.expectedErr)
+		})
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package ftwtest
+
+import (
+	"net/http"
+
+	"github.com/corazawaf/coraza-proxy-wasm/replay"
+)
+
+// InProcess is a target running the plugin natively linked in the proxy-wasm host
+// emulator. The upstream answers every request not blocked with a 200 and an empty body.
+type InProcess struct {
+	r *replay.Replayer
+}
+
+var _ Target = (*InProcess)(nil)
+
+// NewInProcess starts the plugin with the given plugin configuration. As for the
+// replay package, only one InProcess target can be used at a time.
+func NewInProcess(pluginConfig []byte) (*InProcess, error) {
+	r, err := replay.New(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &InProcess{r: r}, nil
+}
+
+// Close stops the plugin.
+func (p *InProcess) Close() {
+	p.r.Close()
+}
+
+func (p *InProcess) Do(req Request) (Response, error) {
+	authority := "localhost"
+	var headers [][2]string
+	for _, h := range req.Headers {
+		if http.CanonicalHeaderKey(h[0]) == "Host" {
+			authority = h[1]
+			continue
+		}
+		headers = append(headers, h)
+	}
+
+	res, err := p.r.Replay(replay.Exchange{
+		Method:         req.Method,
+		URL:            "http://" + authority + req.URI,
+		Protocol:       req.Version,
+		RequestHeaders: headers,
+		RequestBody:    req.Body,
+		StatusCode:     http.StatusOK,
+	})
+	if err != nil {
+		return Response{}, err
+	}
+
+	status := http.StatusOK
+	if res.Blocked {
+		status = res.StatusCode
+	}
+	return Response{
+		Status:  status,
+		HasLogs: true,
+		Logs:    p.r.Logs(),
+		RuleIDs: res.RuleIDs,
+	}, nil
+}
+
+func (p *InProcess) CounterMetric(name string) (uint64, error) {
+	return p.r.CounterMetric(name)
+}
@@ -0,0 +1,274 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Package hostadapter abstracts the differences between the proxy-wasm hosts the
+// plugin can be loaded into: property paths, metric naming and encoding quirks.
+package hostadapter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+// Property is a host-agnostic identifier of a request or connection attribute.
+type Property int
+
+const (
+	RequestHost Property = iota
+	RequestMethod
+	RequestPath
+	RequestProtocol
+	ResponseCode
+	SourceAddress
+	SourcePort
+	DestinationAddress
+	DestinationPort
+	RouteName
+	TLSVersion
+	TLSServerName
+	PeerCertSubject
+	PeerCertURISAN
+	PeerCertDNSSAN
+	PeerCertFingerprint
+	ListenerDirection
+	IstioNamespace
+	IstioWorkload
+	IstioMeshID
+	IstioPeerNamespace
+	IstioPeerWorkload
+	IstioPeerApp
+	IstioPeerVersion
+	IstioPeerCluster
+	// NodeID identifies the proxy instance in the fleet.
+	NodeID
+	// RouteMetadata is the metadata of the route selected for the request.
+	RouteMetadata
+)
+
+// ErrUnsupportedProperty is returned when the host does not expose the requested property.
+var ErrUnsupportedProperty = errors.New("property not supported by the host")
+
+// Adapter maps the plugin needs to the specifics of a proxy-wasm host.
+type Adapter interface {
+	// Name returns the name of the host, as accepted by New.
+	Name() string
+	// PropertyPath returns the host path of the property, or nil if the host does not expose it.
+	PropertyPath(p Property) []string
+	// ParsePort decodes a port property as returned by the host.
+	ParsePort(b []byte) (int, error)
+	// MetricName adapts a fully qualified metric name to the naming constraints of the host.
+	MetricName(fqn string) string
+	// Capabilities reports the optional proxy-wasm APIs the host implements.
+	Capabilities() Capabilities
+}
+
+// Capabilities lists the optional proxy-wasm APIs the plugin relies on, so that
+// features depending on a missing one can degrade instead of failing the plugin start.
+type Capabilities struct {
+	// Ticks is true if the host implements proxy_set_tick_period_milliseconds.
+	Ticks bool
+	// SharedData is true if the host implements proxy_get_shared_data and proxy_set_shared_data.
+	SharedData bool
+	// SharedQueues is true if the host implements the proxy_*_shared_queue calls.
+	SharedQueues bool
+	// Metrics is true if the host implements proxy_define_metric and the related calls.
+	Metrics bool
+}
+
+// New returns the adapter for the given host name, defaulting to Envoy when empty.
+func New(name string) (Adapter, error) {
+	switch name {
+	case "", envoyName:
+		return Envoy, nil
+	case nginxName:
+		return Nginx, nil
+	case atsName:
+		return ATS, nil
+	default:
+		return nil, fmt.Errorf("unsupported host: %q", name)
+	}
+}
+
+// GetProperty retrieves the property from the host through the adapter.
+func GetProperty(a Adapter, p Property) ([]byte, error) {
+	path := a.PropertyPath(p)
+	if path == nil {
+		return nil, ErrUnsupportedProperty
+	}
+	return proxywasm.GetProperty(path)
+}
+
+const (
+	envoyName = "envoy"
+	nginxName = "nginx"
+	atsName   = "ats"
+)
+
+// Envoy is the adapter for Envoy and Envoy based hosts (e.g. Istio).
+// Ref: https://www.envoyproxy.io/docs/envoy/latest/intro/arch_overview/advanced/attributes
+var Envoy Adapter = envoy{}
+
+type envoy struct{}
+
+var envoyProperties = map[Property][]string{
+	RequestHost:         {"request", "host"},
+	RequestMethod:       {"request", "method"},
+	RequestPath:         {"request", "path"},
+	RequestProtocol:     {"request", "protocol"},
+	ResponseCode:        {"response", "code"},
+	SourceAddress:       {"source", "address"},
+	SourcePort:          {"source", "port"},
+	DestinationAddress:  {"destination", "address"},
+	DestinationPort:     {"destination", "port"},
+	RouteName:           {"route_name"},
+	TLSVersion:          {"connection", "tls_version"},
+	TLSServerName:       {"connection", "requested_server_name"},
+	PeerCertSubject:     {"connection", "subject_peer_certificate"},
+	PeerCertURISAN:      {"connection", "uri_san_peer_certificate"},
+	PeerCertDNSSAN:      {"connection", "dns_san_peer_certificate"},
+	PeerCertFingerprint: {"connection", "sha256_peer_certificate_digest"},
+	ListenerDirection:   {"listener_direction"},
+	// Istio node metadata, see https://github.com/istio/api/blob/master/annotation/annotations.yaml
+	IstioNamespace: {"node", "metadata", "NAMESPACE"},
+	IstioWorkload:  {"node", "metadata", "WORKLOAD_NAME"},
+	IstioMeshID:    {"node", "metadata", "MESH_ID"},
+	// Metadata of the downstream workload, as populated by the Istio metadata exchange filter
+	IstioPeerNamespace: {"downstream_peer", "namespace"},
+	IstioPeerWorkload:  {"downstream_peer", "workload"},
+	IstioPeerApp:       {"downstream_peer", "app"},
+	IstioPeerVersion:   {"downstream_peer", "version"},
+	IstioPeerCluster:   {"downstream_peer", "cluster"},
+	NodeID:             {"node", "id"},
+	RouteMetadata:      {"xds", "route_metadata"},
+}
+
+func (envoy) Name() string { return envoyName }
+
+func (envoy) PropertyPath(p Property) []string { return envoyProperties[p] }
+
+// ParsePort converts port, retrieved as little-endian bytes, into int
+func (envoy) ParsePort(b []byte) (int, error) {
+	// Port attribute ({"source", "port"}) is populated as uint64 (8 byte)
+	// Ref: https://github.com/envoyproxy/envoy/blob/1b3da361279a54956f01abba830fc5d3a5421828/source/common/network/utility.cc#L201
+	if len(b) < 8 {
+		return 0, errors.New("port bytes not found")
+	}
+	// 0 < Port number <= 65535, therefore the retrieved value should never exceed 16 bits
+	// and correctly fit int (at least 32 bits in size)
+	unsignedInt := binary.LittleEndian.Uint64(b)
+	if unsignedInt > math.MaxInt32 {
+		return 0, errors.New("port conversion error")
+	}
+	return int(unsignedInt), nil
+}
+
+// MetricName returns the name unchanged, tags are extracted from it by the Envoy stats config.
+func (envoy) MetricName(fqn string) string { return fqn }
+
+func (envoy) Capabilities() Capabilities {
+	return Capabilities{Ticks: true, SharedData: true, SharedQueues: true, Metrics: true}
+}
+
+// Nginx is the adapter for ngx_wasm_module (nginx and OpenResty). Properties are read
+// from the nginx variables exposed under the "ngx" namespace, which are always populated,
+// unlike the partially supported Envoy attributes.
+// Ref: https://github.com/Kong/ngx_wasm_module/blob/main/docs/PROXY_WASM.md
+var Nginx Adapter = nginx{}
+
+type nginx struct{}
+
+// nginxMaxMetricNameLength is the default max_metric_name_length of ngx_wasm_module,
+// longer names make the metric definition fail.
+const nginxMaxMetricNameLength = 256
+
+var nginxProperties = map[Property][]string{
+	RequestHost:         {"ngx", "host"},
+	RequestMethod:       {"ngx", "request_method"},
+	RequestPath:         {"ngx", "request_uri"},
+	RequestProtocol:     {"ngx", "server_protocol"},
+	ResponseCode:        {"ngx", "status"},
+	SourceAddress:       {"ngx", "remote_addr"},
+	SourcePort:          {"ngx", "remote_port"},
+	DestinationAddress:  {"ngx", "server_addr"},
+	DestinationPort:     {"ngx", "server_port"},
+	TLSVersion:          {"ngx", "ssl_protocol"},
+	TLSServerName:       {"ngx", "ssl_server_name"},
+	PeerCertSubject:     {"ngx", "ssl_client_s_dn"},
+	PeerCertFingerprint: {"ngx", "ssl_client_fingerprint"},
+	NodeID:              {"ngx", "hostname"},
+}
+
+func (nginx) Name() string { return nginxName }
+
+func (nginx) PropertyPath(p Property) []string { return nginxProperties[p] }
+
+// ParsePort converts port, retrieved as a decimal string, into int.
+func (nginx) ParsePort(b []byte) (int, error) {
+	port, err := strconv.Atoi(string(b))
+	if err != nil || port < 0 || port > math.MaxUint16 {
+		return 0, errors.New("port conversion error")
+	}
+	return port, nil
+}
+
+func (nginx) Capabilities() Capabilities {
+	return Capabilities{Ticks: true, SharedData: true, SharedQueues: true, Metrics: true}
+}
+
+// MetricName truncates names exceeding the host limit, suffixing them with a hash
+// of the full name so that distinct metrics do not collapse into the same one.
+func (nginx) MetricName(fqn string) string {
+	if len(fqn) <= nginxMaxMetricNameLength {
+		return fqn
+	}
+	h := fnv.New32a()
+	h.Write([]byte(fqn))
+	suffix := fmt.Sprintf("_%08x", h.Sum32())
+	return fqn[:nginxMaxMetricNameLength-len(suffix)] + suffix
+}
+
+// ATS is the adapter for the Apache Traffic Server wasm plugin. It exposes a subset of
+// the Envoy attributes and does not implement ticks.
+// Ref: https://docs.trafficserver.apache.org/en/latest/admin-guide/plugins/wasm.en.html
+var ATS Adapter = ats{}
+
+type ats struct{}
+
+var atsProperties = map[Property][]string{
+	RequestHost:        {"request", "host"},
+	RequestMethod:      {"request", "method"},
+	RequestPath:        {"request", "path"},
+	RequestProtocol:    {"request", "protocol"},
+	ResponseCode:       {"response", "code"},
+	SourceAddress:      {"source", "address"},
+	SourcePort:         {"source", "port"},
+	DestinationAddress: {"destination", "address"},
+	DestinationPort:    {"destination", "port"},
+	TLSVersion:         {"connection", "tls_version"},
+	TLSServerName:      {"connection", "requested_server_name"},
+}
+
+func (ats) Name() string { return atsName }
+
+func (ats) PropertyPath(p Property) []string { return atsProperties[p] }
+
+// ParsePort accepts both the Envoy encoding (little-endian uint64) and a decimal string,
+// depending on the ATS release the port is returned either way.
+func (ats) ParsePort(b []byte) (int, error) {
+	if len(b) == 8 {
+		return Envoy.ParsePort(b)
+	}
+	return Nginx.ParsePort(b)
+}
+
+func (ats) MetricName(fqn string) string { return fqn }
+
+func (ats) Capabilities() Capabilities {
+	return Capabilities{SharedData: true, SharedQueues: true, Metrics: true}
+}
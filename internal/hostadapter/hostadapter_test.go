@@ -0,0 +1,73 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package hostadapter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	for name, expected := range map[string]Adapter{"": Envoy, "envoy": Envoy, "nginx": Nginx, "ats": ATS} {
+		a, err := New(name)
+		require.NoError(t, err)
+		require.Equal(t, expected, a)
+	}
+
+	_, err := New("haproxy")
+	require.EqualError(t, err, `unsupported host: "haproxy"`)
+}
+
+func TestParsePort(t *testing.T) {
+	port, err := Envoy.ParsePort([]byte{5, 10, 0, 0, 0, 0, 0, 0})
+	require.NoError(t, err)
+	require.Equal(t, 2565, port)
+
+	_, err = Envoy.ParsePort([]byte("8080"))
+	require.Error(t, err)
+
+	port, err = Nginx.ParsePort([]byte("8080"))
+	require.NoError(t, err)
+	require.Equal(t, 8080, port)
+
+	_, err = Nginx.ParsePort([]byte("70000"))
+	require.Error(t, err)
+
+	for _, b := range [][]byte{{5, 10, 0, 0, 0, 0, 0, 0}, []byte("2565")} {
+		port, err = ATS.ParsePort(b)
+		require.NoError(t, err)
+		require.Equal(t, 2565, port)
+	}
+}
+
+func TestNginxMetricName(t *testing.T) {
+	short := "waf_filter.tx.total"
+	require.Equal(t, short, Nginx.MetricName(short))
+
+	long1 := "waf_filter.tx.interruptions_" + strings.Repeat("a", 300)
+	long2 := "waf_filter.tx.interruptions_" + strings.Repeat("a", 299) + "b"
+	require.Len(t, Nginx.MetricName(long1), nginxMaxMetricNameLength)
+	require.NotEqual(t, Nginx.MetricName(long1), Nginx.MetricName(long2))
+
+	require.Equal(t, long1, Envoy.MetricName(long1))
+}
+
+func TestRouteNameUnsupportedByNginx(t *testing.T) {
+	_, err := GetProperty(Nginx, RouteName)
+	require.ErrorIs(t, err, ErrUnsupportedProperty)
+}
+
+func TestCapabilities(t *testing.T) {
+	all := Envoy.Capabilities()
+	require.Equal(t, int64(15), all.Bitmap())
+	require.Empty(t, all.Missing())
+
+	ats := ATS.Capabilities()
+	require.Equal(t, int64(14), ats.Bitmap())
+	require.Equal(t, []string{"ticks"}, ats.Missing())
+
+	require.Equal(t, []string{"ticks", "shared_data", "shared_queues", "metrics"}, Capabilities{}.Missing())
+}
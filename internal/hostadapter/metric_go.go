@@ -0,0 +1,21 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !tinygo
+
+package hostadapter
+
+import (
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+// defineGauge defines the gauge through the host emulator, reporting false if the host does
+// not support metrics: the SDK panics when the definition fails.
+func defineGauge(name string) (gauge proxywasm.MetricGauge, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	return proxywasm.DefineGaugeMetric(name), true
+}
@@ -0,0 +1,32 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build tinygo
+
+package hostadapter
+
+import (
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+// metricTypeGauge is the gauge metric type of the proxy-wasm ABI.
+const metricTypeGauge = 1
+
+// proxyDefineMetric is called directly rather than through the SDK, which panics when the
+// definition fails: panics cannot be recovered from with the scheduler disabled.
+//
+//export proxy_define_metric
+func proxyDefineMetric(metricType uint32, metricNameData *byte, metricNameSize int, returnMetricIDPtr *uint32) uint32
+
+// defineGauge defines the gauge, reporting false if the host does not support metrics.
+func defineGauge(name string) (proxywasm.MetricGauge, bool) {
+	if name == "" {
+		return 0, false
+	}
+	var id uint32
+	data := []byte(name)
+	if status := proxyDefineMetric(metricTypeGauge, &data[0], len(data), &id); status != 0 {
+		return 0, false
+	}
+	return proxywasm.MetricGauge(id), true
+}
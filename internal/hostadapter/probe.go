@@ -0,0 +1,78 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package hostadapter
+
+import (
+	"errors"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// capabilityProbeKey is the shared data key and shared queue name looked up when
+// probing, they are never written.
+const capabilityProbeKey = "coraza.capability_probe"
+
+// CapabilitiesMetricName is the name of the gauge reporting the capabilities
+// bitmap, see Capabilities.Bitmap.
+const CapabilitiesMetricName = "waf_filter.capabilities"
+
+// Bitmap encodes the capabilities as a bitmap: ticks (1), shared data (2),
+// shared queues (4) and metrics (8).
+func (c Capabilities) Bitmap() int64 {
+	var bitmap int64
+	for i, available := range []bool{c.Ticks, c.SharedData, c.SharedQueues, c.Metrics} {
+		if available {
+			bitmap |= 1 << i
+		}
+	}
+	return bitmap
+}
+
+// Missing returns the names of the capabilities the host does not implement.
+func (c Capabilities) Missing() []string {
+	var missing []string
+	for _, capability := range []struct {
+		name      string
+		available bool
+	}{
+		{"ticks", c.Ticks},
+		{"shared_data", c.SharedData},
+		{"shared_queues", c.SharedQueues},
+		{"metrics", c.Metrics},
+	} {
+		if !capability.available {
+			missing = append(missing, capability.name)
+		}
+	}
+	return missing
+}
+
+// Probe refines the capabilities declared by the adapter by calling the host, so
+// that unimplemented APIs are detected at plugin start rather than at first use.
+// It has to be called from the plugin context, before the tick period is set as
+// probing resets it. When metrics are available, the resulting bitmap is reported
+// by the CapabilitiesMetricName gauge.
+func Probe(a Adapter) Capabilities {
+	c := a.Capabilities()
+	if c.Ticks {
+		c.Ticks = proxywasm.SetTickPeriodMilliSeconds(0) == nil
+	}
+	if c.SharedData {
+		_, _, err := proxywasm.GetSharedData(capabilityProbeKey)
+		c.SharedData = err == nil || errors.Is(err, types.ErrorStatusNotFound)
+	}
+	if c.SharedQueues {
+		_, err := proxywasm.ResolveSharedQueue("", capabilityProbeKey)
+		c.SharedQueues = err == nil || errors.Is(err, types.ErrorStatusNotFound)
+	}
+	if c.Metrics {
+		var gauge proxywasm.MetricGauge
+		if gauge, c.Metrics = defineGauge(a.MetricName(CapabilitiesMetricName)); c.Metrics {
+			// Gauges are shared by the VMs, the bitmap is set rather than added
+			gauge.Add(c.Bitmap() - gauge.Value())
+		}
+	}
+	return c
+}
@@ -0,0 +1,46 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package hostadapter
+
+// Resolver resolves host-agnostic properties for the current request.
+type Resolver interface {
+	// Property returns the raw value of the property.
+	Property(p Property) ([]byte, error)
+	// ParsePort decodes a port property according to the host encoding.
+	ParsePort(b []byte) (int, error)
+}
+
+// NewResolver returns a Resolver reading properties through the given adapter.
+// Properties, including the failures to retrieve them, are cached for the lifetime
+// of the resolver: it is meant to be created per HTTP context, so that connection and
+// TLS attributes are read from the host at most once per request.
+func NewResolver(a Adapter) Resolver {
+	return &cachingResolver{adapter: a}
+}
+
+type cachedProperty struct {
+	value []byte
+	err   error
+}
+
+type cachingResolver struct {
+	adapter Adapter
+	cache   map[Property]cachedProperty
+}
+
+func (r *cachingResolver) Property(p Property) ([]byte, error) {
+	if c, ok := r.cache[p]; ok {
+		return c.value, c.err
+	}
+	value, err := GetProperty(r.adapter, p)
+	if r.cache == nil {
+		r.cache = make(map[Property]cachedProperty)
+	}
+	r.cache[p] = cachedProperty{value: value, err: err}
+	return value, err
+}
+
+func (r *cachingResolver) ParsePort(b []byte) (int, error) {
+	return r.adapter.ParsePort(b)
+}
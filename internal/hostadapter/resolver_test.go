@@ -0,0 +1,32 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package hostadapter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
+)
+
+func TestResolverCachesProperties(t *testing.T) {
+	host, reset := proxytest.NewHostEmulator(proxytest.NewEmulatorOption())
+	defer reset()
+
+	require.NoError(t, host.SetProperty([]string{"connection", "tls_version"}, []byte("TLSv1.3")))
+
+	r := NewResolver(Envoy)
+	v, err := r.Property(TLSVersion)
+	require.NoError(t, err)
+	require.Equal(t, "TLSv1.3", string(v))
+
+	// Subsequent reads are served from the cache
+	require.NoError(t, host.SetProperty([]string{"connection", "tls_version"}, []byte("TLSv1.2")))
+	v, err = r.Property(TLSVersion)
+	require.NoError(t, err)
+	require.Equal(t, "TLSv1.3", string(v))
+
+	_, err = NewResolver(Nginx).Property(RouteName)
+	require.ErrorIs(t, err, ErrUnsupportedProperty)
+}
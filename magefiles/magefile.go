@@ -4,6 +4,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -188,11 +189,24 @@ func Build() error {
 	}
 
 	buildTags := []string{
-		"custommalloc",     // https://github.com/wasilibs/nottinygc#usage
-		"nottinygc_envoy",  // https://github.com/wasilibs/nottinygc#using-with-envoy
 		"no_fs_access",     // https://github.com/corazawaf/coraza#build-tags
 		"memoize_builders", // https://github.com/corazawaf/coraza#build-tags
 	}
+	// By default the nottinygc collector is used. The leaking allocator of TinyGo
+	// is a bump allocator never freeing memory, only fitting VMs recycled by the host
+	// before their memory is exhausted.
+	gc := "custom"
+	switch allocator := os.Getenv("ALLOCATOR"); allocator {
+	case "", "nottinygc":
+		buildTags = append(buildTags,
+			"custommalloc",    // https://github.com/wasilibs/nottinygc#usage
+			"nottinygc_envoy", // https://github.com/wasilibs/nottinygc#using-with-envoy
+		)
+	case "leaking":
+		gc = "leaking"
+	default:
+		return fmt.Errorf("unsupported allocator: %q", allocator)
+	}
 	// By default multiphase evaluation is enabled
 	if os.Getenv("MULTIPHASE_EVAL") != "false" {
 		buildTags = append(buildTags, "coraza.rule.multiphase_evaluation")
@@ -203,6 +217,16 @@ func Build() error {
 	if os.Getenv("MEMSTATS") == "true" {
 		buildTags = append(buildTags, "memstats")
 	}
+	if os.Getenv("BENCHMARK") == "true" {
+		buildTags = append(buildTags, "benchmark")
+	}
+	if manifest := os.Getenv("SIZE_PROFILE"); manifest != "" {
+		tags, err := sizeProfileTags(manifest)
+		if err != nil {
+			return err
+		}
+		buildTags = append(buildTags, tags...)
+	}
 
 	buildTagArg := fmt.Sprintf("-tags='%s'", strings.Join(buildTags, " "))
 
@@ -217,13 +241,141 @@ func Build() error {
 	}
 
 	// TODO: from tinygo 0.32.0 -target=wasi is replaced by GOOS=wasip1. See https://github.com/tinygo-org/tinygo/pull/3861
-	if err := sh.RunV("tinygo", "build", "-gc=custom", "-opt=2", "-o", filepath.Join("build", "mainraw.wasm"), "-scheduler=none", "-target=wasi", buildTagArg); err != nil {
+	if err := sh.RunV("tinygo", "build", "-gc="+gc, "-opt=2", "-o", filepath.Join("build", "mainraw.wasm"), "-scheduler=none", "-target=wasi", buildTagArg); err != nil {
 		return err
 	}
 
 	return patchWasm(filepath.Join("build", "mainraw.wasm"), filepath.Join("build", "main.wasm"), initialPages)
 }
 
+// sizeProfile is the manifest of a size optimized build, listing what the deployed
+// configuration does not need.
+type sizeProfile struct {
+	// DisabledOperators are the names of the operators left out of the build, e.g. "geoLookup".
+	DisabledOperators []string `json:"disabled_operators"`
+	// DisabledBodyProcessors are the names of the body processors of the filter left out of
+	// the build, among cbor, msgpack, graphql and grpc.
+	DisabledBodyProcessors []string `json:"disabled_body_processors"`
+	// ExcludeCRS leaves the CRS rules and data files out of the build.
+	ExcludeCRS bool `json:"exclude_crs"`
+}
+
+// optionalBodyProcessors are the body processors of the filter a size profile can leave out.
+var optionalBodyProcessors = map[string]bool{"cbor": true, "msgpack": true, "graphql": true, "grpc": true}
+
+// sizeProfileTags returns the build tags implementing the size profile manifest.
+func sizeProfileTags(manifest string) ([]string, error) {
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		return nil, err
+	}
+	var profile sizeProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("invalid size profile %s: %v", manifest, err)
+	}
+
+	var tags []string
+	for _, op := range profile.DisabledOperators {
+		if strings.TrimSpace(op) == "" || strings.ContainsAny(op, " '") {
+			return nil, fmt.Errorf("invalid operator in size profile %s: %q", manifest, op)
+		}
+		// https://github.com/corazawaf/coraza#build-tags
+		tags = append(tags, "coraza.disabled_operators."+op)
+	}
+	for _, bp := range profile.DisabledBodyProcessors {
+		if !optionalBodyProcessors[bp] {
+			return nil, fmt.Errorf("invalid body processor in size profile %s: %q", manifest, bp)
+		}
+		tags = append(tags, "no_body_processor_"+bp)
+	}
+	if profile.ExcludeCRS {
+		tags = append(tags, "no_crs")
+	}
+	return tags, nil
+}
+
+// crsPlugins are the official CRS plugins fetched by CrsPlugins, by name.
+// See https://github.com/coreruleset/plugin-registry.
+var crsPlugins = map[string]string{
+	"wordpress-rule-exclusions": "https://github.com/coreruleset/wordpress-rule-exclusions-plugin",
+	"nextcloud-rule-exclusions": "https://github.com/coreruleset/nextcloud-rule-exclusions-plugin",
+	"drupal-rule-exclusions":    "https://github.com/coreruleset/drupal-rule-exclusions-plugin",
+	"fake-bot":                  "https://github.com/coreruleset/fake-bot-plugin",
+}
+
+// CrsPlugins fetches the official CRS plugins into the embedded rules. Requires git.
+func CrsPlugins() error {
+	dst := filepath.Join("wasmplugin", "rules", "crs-plugins")
+	for name, repo := range crsPlugins {
+		tmp, err := os.MkdirTemp("", "crs-plugin")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+
+		if err := sh.RunV("git", "clone", "--depth", "1", repo, tmp); err != nil {
+			return fmt.Errorf("failed to fetch CRS plugin %s: %v", name, err)
+		}
+		files, err := filepath.Glob(filepath.Join(tmp, "plugins", "*.conf"))
+		if err != nil {
+			return err
+		}
+		// Data files referenced by the rules, e.g. by @pmFromFile
+		dataFiles, _ := filepath.Glob(filepath.Join(tmp, "plugins", "*.data"))
+		files = append(files, dataFiles...)
+		if len(files) == 0 {
+			return fmt.Errorf("no plugin files found for CRS plugin %s", name)
+		}
+		for _, f := range files {
+			if err := sh.Copy(filepath.Join(dst, filepath.Base(f)), f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CrsVersion fetches the CRS release set by CRS_VERSION (e.g. 4.7.0) into the embedded rules,
+// next to the default one, to be pinned through crs_version. The release is downloaded as
+// packaged for Coraza by github.com/corazawaf/coraza-coreruleset, through the Go module proxy.
+func CrsVersion() error {
+	version := os.Getenv("CRS_VERSION")
+	if version == "" {
+		return errors.New("CRS_VERSION is required")
+	}
+
+	out, err := sh.Output("go", "mod", "download", "-json", "github.com/corazawaf/coraza-coreruleset/v4@v"+version)
+	if err != nil {
+		return fmt.Errorf("failed to fetch CRS %s: %v", version, err)
+	}
+	var module struct{ Dir string }
+	if err := json.Unmarshal([]byte(out), &module); err != nil {
+		return err
+	}
+	src := filepath.Join(module.Dir, "rules")
+
+	dst := filepath.Join("wasmplugin", "rules", "crs-versions", version)
+	if err := os.MkdirAll(filepath.Join(dst, "rules"), 0755); err != nil {
+		return err
+	}
+	if err := sh.Copy(filepath.Join(dst, "crs-setup.conf.example"), filepath.Join(src, "@crs-setup.conf.example")); err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(src, "@owasp_crs", "*"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if ext := filepath.Ext(f); ext != ".conf" && ext != ".data" && !strings.HasSuffix(f, ".conf.example") {
+			continue
+		}
+		if err := sh.Copy(filepath.Join(dst, "rules", filepath.Base(f)), f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // E2e runs e2e tests with a built plugin against the example deployment. Requires docker.
 func E2e() error {
 	var err error
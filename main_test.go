@@ -5,18 +5,27 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+	"github.com/tidwall/gjson"
+	"golang.org/x/text/encoding/japanese"
 
 	"github.com/corazawaf/coraza-proxy-wasm/internal/auditlog"
 	"github.com/corazawaf/coraza-proxy-wasm/wasmplugin"
@@ -721,6 +730,16 @@ func TestPerAuthorityDirectives(t *testing.T) {
 			conf:                    `{"directives_map": {"default": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,t:lowercase,deny\""], "rs1": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /rs1\" \"id:101,phase:1,t:lowercase,deny\""]}, "default_directives": "default", "per_authority_directives":{"foo.example.com":"rs1"}}`,
 			localResponseStatusCode: 403,
 		},
+		{
+			name: "authority matching a wildcard on per_authority_directives",
+			reqHdrs: [][2]string{
+				{":path", "/rs1"},
+				{":method", "GET"},
+				{":authority", "foo.example.com:8080"},
+			},
+			conf:                    `{"directives_map": {"default": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,t:lowercase,deny\""], "rs1": ["SecRuleEngine On","SecRule REQUEST_URI \"@streq /rs1\" \"id:101,phase:1,t:lowercase,deny\""]}, "default_directives": "default", "per_authority_directives":{"*.example.com":"rs1"}}`,
+			localResponseStatusCode: 403,
+		},
 		{
 			name: "authority exist on per_authority_directives but calling allowed path",
 			reqHdrs: [][2]string{
@@ -1409,23 +1428,3763 @@ func TestHttpConnectRequest(t *testing.T) {
 	})
 }
 
-func vmTest(t *testing.T, f func(*testing.T, types.VMContext)) {
-	t.Helper()
+func TestProblemJSONInterruption(t *testing.T) {
+	reqHdrs := [][2]string{
+		{":path", "/admin"},
+		{":method", "GET"},
+		{":authority", "localhost"},
+	}
 
-	t.Run("go", func(t *testing.T) {
-		auditlog.RegisterProxyWasmSerialWriter()
-		f(t, wasmplugin.NewVMContext())
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `{"directives_map": {"default": ["SecRuleEngine On", "SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\""]}, "default_directives": "default", "interruption_body": "problem+json"}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		id := host.InitializeHttpContext()
+		action := host.CallOnRequestHeaders(id, reqHdrs, false)
+		require.Equal(t, types.ActionPause, action)
+
+		pluginResp := host.GetSentLocalResponse(id)
+		require.NotNil(t, pluginResp)
+		require.EqualValues(t, 403, pluginResp.StatusCode)
+		require.Contains(t, pluginResp.Headers, [2]string{"content-type", "application/problem+json"})
+
+		body := gjson.ParseBytes(pluginResp.Data)
+		require.Equal(t, "Forbidden", body.Get("title").String())
+		require.EqualValues(t, 403, body.Get("status").Int())
+		incidentID := body.Get("incident_id").String()
+		require.NotEmpty(t, incidentID)
+
+		logs := strings.Join(host.GetInfoLogs(), "\n")
+		require.Contains(t, logs, incidentID)
 	})
+}
 
-	t.Run("wasm", func(t *testing.T) {
-		buildPath := filepath.Join("build", "mainraw.wasm")
-		wasm, err := os.ReadFile(buildPath)
-		if err != nil {
-			t.Fatal("wasm not found")
+func TestDenyPages(t *testing.T) {
+	tests := []struct {
+		name                string
+		accept              string
+		expectedContentType string
+		expectedBody        string
+	}{
+		{
+			name:                "html",
+			accept:              "text/html,application/xhtml+xml,*/*;q=0.8",
+			expectedContentType: "text/html",
+			expectedBody:        "<p>Blocked by rule 101</p>",
+		},
+		{
+			name:                "json",
+			accept:              "application/json",
+			expectedContentType: "application/json",
+			expectedBody:        `{"status": 403, "rule_id": "101"}`,
+		},
+		{
+			name:                "no accept",
+			expectedContentType: "text/html",
+			expectedBody:        "<p>Blocked by rule 101</p>",
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				conf := `{
+					"directives_map": {"default": ["SecRuleEngine On", "SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\""]},
+					"default_directives": "default",
+					"deny_pages": [
+						{"content_type": "text/html", "body": "<p>Blocked by rule {{rule_id}}</p>"},
+						{"content_type": "application/json", "body": "{\"status\": {{status}}, \"rule_id\": \"{{rule_id}}\"}"}
+					]
+				}`
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				reqHdrs := [][2]string{
+					{":path", "/admin"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}
+				if tt.accept != "" {
+					reqHdrs = append(reqHdrs, [2]string{"accept", tt.accept})
+				}
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, reqHdrs, false)
+				require.Equal(t, types.ActionPause, action)
+
+				pluginResp := host.GetSentLocalResponse(id)
+				require.NotNil(t, pluginResp)
+				require.EqualValues(t, 403, pluginResp.StatusCode)
+				require.Contains(t, pluginResp.Headers, [2]string{"content-type", tt.expectedContentType})
+				require.Equal(t, tt.expectedBody, string(pluginResp.Data))
+			})
 		}
-		v, err := proxytest.NewWasmVMContext(wasm)
+	})
+}
+
+func TestInterruptionHeaders(t *testing.T) {
+	tests := []struct {
+		name         string
+		path         string
+		expectedRule string
+		expectedCode uint32
+	}{
+		{
+			name:         "rule interruption",
+			path:         "/admin",
+			expectedRule: "101",
+			expectedCode: 403,
+		},
+		{
+			name:         "failure policy",
+			path:         "/",
+			expectedCode: 413,
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				conf := `{
+					"directives_map": {"default": ["SecRuleEngine On", "SecRequestBodyAccess On", "SecRequestBodyLimit 2", "SecRequestBodyLimitAction ProcessPartial", "SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\""]},
+					"default_directives": "default",
+					"failure_policy": {"body_limit": "closed"},
+					"interruption_headers": {"event_id": "x-waf-event-id", "rule_id": "x-waf-rule-id"}
+				}`
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", tt.path},
+					{":method", "POST"},
+					{":authority", "localhost"},
+				}, false)
+				if tt.expectedRule == "" {
+					require.Equal(t, types.ActionContinue, action)
+					action = host.CallOnRequestBody(id, []byte("body"), true)
+				}
+				require.Equal(t, types.ActionPause, action)
+
+				pluginResp := host.GetSentLocalResponse(id)
+				require.NotNil(t, pluginResp)
+				require.Equal(t, tt.expectedCode, pluginResp.StatusCode)
+
+				headers := map[string]string{}
+				for _, h := range pluginResp.Headers {
+					headers[h[0]] = h[1]
+				}
+				require.NotEmpty(t, headers["x-waf-event-id"])
+				require.Contains(t, strings.Join(host.GetInfoLogs(), "\n"), headers["x-waf-event-id"])
+				require.Equal(t, tt.expectedRule, headers["x-waf-rule-id"])
+			})
+		}
+	})
+}
+
+func TestDropInterruption(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `{"directives_map": {"default": ["SecRuleEngine On", "SecRule REQUEST_HEADERS:User-Agent \"@pm nikto\" \"id:101,phase:1,drop\""]}, "default_directives": "default"}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		id := host.InitializeHttpContext()
+		action := host.CallOnRequestHeaders(id, [][2]string{
+			{":path", "/"},
+			{":method", "GET"},
+			{":authority", "localhost"},
+			{"user-agent", "Mozilla/5.00 (Nikto/2.1.6)"},
+		}, false)
+		require.Equal(t, types.ActionPause, action)
+		require.Nil(t, host.GetSentLocalResponse(id))
+
+		logs := strings.Join(host.GetInfoLogs(), "\n")
+		require.Contains(t, logs, `action="drop"`)
+	})
+}
+
+func TestVerdictHeader(t *testing.T) {
+	tests := []struct {
+		name                string
+		path                string
+		target              string
+		expectLocalResponse bool
+		expectReqVerdict    string
+		expectRespVerdict   string
+	}{
+		{
+			name:              "pass on response",
+			path:              "/hello",
+			target:            "response",
+			expectRespVerdict: "pass",
+		},
+		{
+			name:             "detect on request",
+			path:             "/detect",
+			target:           "request",
+			expectReqVerdict: "detect;102",
+		},
+		{
+			name:                "block on local response",
+			path:                "/admin",
+			target:              "both",
+			expectLocalResponse: true,
+			expectRespVerdict:   "block;101",
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(tt.name, func(t *testing.T) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {
+						"default": [
+							"SecRuleEngine On",
+							"SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\"",
+							"SecRule REQUEST_URI \"@streq /detect\" \"id:102,phase:1,log,pass\""
+						]
+					},
+					"default_directives": "default",
+					"verdict_header": {"target": %q}
+				}`, tt.target)
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				host.CallOnRequestHeaders(id, [][2]string{
+					{":path", tt.path},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, false)
+
+				if tt.expectLocalResponse {
+					pluginResp := host.GetSentLocalResponse(id)
+					require.NotNil(t, pluginResp)
+					require.Contains(t, pluginResp.Headers, [2]string{"x-coraza-verdict", tt.expectRespVerdict})
+					return
+				}
+
+				if tt.expectReqVerdict != "" {
+					require.Contains(t, host.GetCurrentRequestHeaders(id), [2]string{"x-coraza-verdict", tt.expectReqVerdict})
+				}
+
+				host.CallOnResponseHeaders(id, [][2]string{{":status", "200"}}, false)
+				if tt.expectRespVerdict != "" {
+					require.Contains(t, host.GetCurrentResponseHeaders(id), [2]string{"x-coraza-verdict", tt.expectRespVerdict})
+				}
+			})
+		}
+	})
+}
+
+func TestDynamicMetricLabels(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": ["SecRuleEngine On", "SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\""]},
+			"default_directives": "default",
+			"dynamic_metric_labels": [{"name": "tenant", "source": "header:x-tenant-id", "max_values": 1}]
+		}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		for _, tenant := range []string{"foo", "bar", "foo"} {
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{
+				{":path", "/admin"},
+				{":method", "GET"},
+				{":authority", "localhost"},
+				{"x-tenant-id", tenant},
+			}, false)
+			host.CompleteHttpContext(id)
+		}
+
+		value, err := host.GetCounterMetric("waf_filter.tx.interruptions_ruleid=101_phase=http_request_headers_tenant=foo")
 		require.NoError(t, err)
-		defer v.Close()
-		f(t, v)
+		require.Equal(t, uint64(2), value)
+
+		// max_values reached, further values are counted in the "other" bucket
+		value, err = host.GetCounterMetric("waf_filter.tx.interruptions_ruleid=101_phase=http_request_headers_tenant=other")
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), value)
+	})
+}
+
+func TestStatusEndpoint(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": ["SecRuleEngine On"], "monitor": ["SecRuleEngine DetectionOnly"]},
+			"default_directives": "default",
+			"per_authority_directives": {"monitor.example.com": "monitor"},
+			"status_endpoint": {"path": "/.coraza/status", "hmac_secret": "s3cr3t"}
+		}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte("s3cr3t"))
+		mac.Write([]byte(ts + ":/.coraza/status"))
+		validSignature := fmt.Sprintf("t=%s,sig=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+
+		tests := []struct {
+			name           string
+			signature      string
+			expectedStatus uint32
+		}{
+			{name: "missing signature", expectedStatus: 401},
+			{name: "invalid signature", signature: fmt.Sprintf("t=%s,sig=deadbeef", ts), expectedStatus: 401},
+			{name: "valid signature", signature: validSignature, expectedStatus: 200},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				id := host.InitializeHttpContext()
+				headers := [][2]string{
+					{":path", "/.coraza/status"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}
+				if tt.signature != "" {
+					headers = append(headers, [2]string{"x-coraza-status-signature", tt.signature})
+				}
+				action := host.CallOnRequestHeaders(id, headers, true)
+				require.Equal(t, types.ActionPause, action)
+
+				resp := host.GetSentLocalResponse(id)
+				require.NotNil(t, resp)
+				require.Equal(t, tt.expectedStatus, resp.StatusCode)
+				if tt.expectedStatus == 200 {
+					body := gjson.ParseBytes(resp.Data)
+					require.Len(t, body.Get("ruleset_version").String(), 12)
+					require.Equal(t, "default", body.Get("default_rule_set").String())
+					require.Equal(t, "On", body.Get("rule_engines.default").String())
+					require.Equal(t, "DetectionOnly", body.Get("rule_engines.monitor").String())
+					require.False(t, body.Get("remote_rules_sha256").Exists())
+					require.NotZero(t, body.Get("heap.heap_sys").Uint())
+					require.True(t, body.Get("heap.heap_released").Exists())
+					require.InDelta(t, 0.5, body.Get("heap.free_ratio").Float(), 0.5)
+				}
+				host.CompleteHttpContext(id)
+			})
+		}
+
+		// Status requests are not accounted as transactions.
+		_, err := host.GetCounterMetric("waf_filter.tx.total")
+		require.Error(t, err)
+	})
+}
+
+func TestTLSVariables(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": [
+				"SecRuleEngine On",
+				"SecRule TX:tls_version \"@streq TLSv1.1\" \"id:101,phase:1,deny\"",
+				"SecRule TX:tls_server_name \"@streq blocked.example.com\" \"id:102,phase:1,deny\""
+			]},
+			"default_directives": "default"
+		}`
+		tests := []struct {
+			name           string
+			tlsVersion     string
+			serverName     string
+			expectedAction types.Action
+		}{
+			{name: "allowed", tlsVersion: "TLSv1.3", serverName: "example.com", expectedAction: types.ActionContinue},
+			{name: "denied tls version", tlsVersion: "TLSv1.1", serverName: "example.com", expectedAction: types.ActionPause},
+			{name: "denied server name", tlsVersion: "TLSv1.3", serverName: "blocked.example.com", expectedAction: types.ActionPause},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				require.NoError(t, host.SetProperty([]string{"connection", "tls_version"}, []byte(tt.tlsVersion)))
+				require.NoError(t, host.SetProperty([]string{"connection", "requested_server_name"}, []byte(tt.serverName)))
+
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true)
+				require.Equal(t, tt.expectedAction, action)
+			})
+		}
+	})
+}
+
+func TestIstioScopedDirectives(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {
+				"default": ["SecRuleEngine On"],
+				"strict": ["SecRuleEngine On", "SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\""]
+			},
+			"default_directives": "default",
+			"istio": {"per_namespace_directives": {"payments": "strict"}, "metric_labels": true}
+		}`
+		tests := []struct {
+			namespace      string
+			expectedAction types.Action
+		}{
+			{namespace: "payments", expectedAction: types.ActionPause},
+			{namespace: "catalog", expectedAction: types.ActionContinue},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.namespace, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.NoError(t, host.SetProperty([]string{"node", "metadata", "NAMESPACE"}, []byte(tt.namespace)))
+				require.NoError(t, host.SetProperty([]string{"node", "metadata", "WORKLOAD_NAME"}, []byte("api")))
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/admin"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true)
+				require.Equal(t, tt.expectedAction, action)
+
+				if tt.expectedAction == types.ActionPause {
+					value, err := host.GetCounterMetric("waf_filter.tx.interruptions_ruleid=101_phase=http_request_headers_namespace=payments_workload=api")
+					require.NoError(t, err)
+					require.Equal(t, uint64(1), value)
+				}
+			})
+		}
+	})
+}
+
+func TestPolicyConfiguration(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"apiVersion": "waf.coraza.io/v1alpha1",
+			"kind": "WAFPolicy",
+			"spec": {
+				"ruleSets": [{"name": "default", "mode": "Enforce", "directives": ["SecRule ARGS \"@contains attack\" \"id:101,phase:2,deny\""]}],
+				"defaultRuleSet": "default",
+				"exceptions": [{"ruleIDs": [101], "pathPrefix": "/search"}]
+			}
+		}`
+		tests := []struct {
+			path           string
+			expectedAction types.Action
+		}{
+			{path: "/search?q=attack", expectedAction: types.ActionContinue},
+			{path: "/admin?q=attack", expectedAction: types.ActionPause},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.path, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				host.CallOnRequestHeaders(id, [][2]string{
+					{":path", tt.path},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true)
+				action := host.CallOnRequestBody(id, nil, true)
+				require.Equal(t, tt.expectedAction, action)
+			})
+		}
+	})
+}
+
+func TestOversizedBodyHandoff(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": [
+				"SecRuleEngine On",
+				"SecRequestBodyAccess On",
+				"SecRule REQUEST_HEADERS:x-scan \"@streq 1\" \"id:101,phase:1,log,pass\"",
+				"SecRule REQUEST_BODY \"@contains attack\" \"id:102,phase:2,deny\""
+			]},
+			"default_directives": "default",
+			"oversized_body_handoff": {"limit": 10}
+		}`
+		tests := []struct {
+			name            string
+			body            string
+			expectedHandoff string
+			expectedAction  types.Action
+		}{
+			{name: "small body is inspected", body: "q=attack", expectedAction: types.ActionPause},
+			{name: "oversized body is handed off", body: "q=attack+attack", expectedHandoff: "detect;101", expectedAction: types.ActionContinue},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/upload"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", "application/x-www-form-urlencoded"},
+					{"content-length", strconv.Itoa(len(tt.body))},
+					{"x-scan", "1"},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				handoff := ""
+				for _, h := range host.GetCurrentRequestHeaders(id) {
+					if h[0] == "x-coraza-handoff" {
+						handoff = h[1]
+					}
+				}
+				require.Equal(t, tt.expectedHandoff, handoff)
+
+				action = host.CallOnRequestBody(id, []byte(tt.body), true)
+				require.Equal(t, tt.expectedAction, action)
+			})
+		}
+	})
+}
+
+func TestMetadataVariables(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": [
+				"SecRuleEngine On",
+				"SecRule TX:authz_role \"!@streq admin\" \"id:101,phase:1,deny,chain\"",
+				"SecRule REQUEST_URI \"@beginsWith /admin\" \"\""
+			]},
+			"default_directives": "default",
+			"metadata_variables": [
+				{"name": "authz_role", "path": ["metadata", "filter_metadata", "envoy.filters.http.ext_authz", "role"]}
+			]
+		}`
+		tests := []struct {
+			role           string
+			expectedAction types.Action
+		}{
+			{role: "admin", expectedAction: types.ActionContinue},
+			{role: "viewer", expectedAction: types.ActionPause},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.role, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				require.NoError(t, host.SetProperty([]string{"metadata", "filter_metadata", "envoy.filters.http.ext_authz", "role"}, []byte(tt.role)))
+
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/admin/users"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true)
+				require.Equal(t, tt.expectedAction, action)
+			})
+		}
+	})
+}
+
+func TestDecisionMetadata(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": [
+				"SecRuleEngine On",
+				"SecRule REQUEST_HEADERS:user-agent \"@contains scanner\" \"id:101,phase:1,log,pass,setvar:tx.blocking_inbound_anomaly_score=+5\""
+			]},
+			"default_directives": "default",
+			"decision_metadata": {"score_buckets": [5, 10]}
+		}`
+		tests := []struct {
+			userAgent        string
+			expectedBucket   string
+			expectedOffender string
+		}{
+			{userAgent: "curl", expectedBucket: "0-4", expectedOffender: "false"},
+			{userAgent: "scanner", expectedBucket: "5-9", expectedOffender: "true"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.userAgent, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+					{"user-agent", tt.userAgent},
+				}, true)
+				require.Equal(t, types.ActionContinue, action)
+
+				headers := map[string]string{}
+				for _, h := range host.GetCurrentRequestHeaders(id) {
+					headers[h[0]] = h[1]
+				}
+				require.Equal(t, tt.expectedBucket, headers["x-waf-score-bucket"])
+				require.Equal(t, tt.expectedOffender, headers["x-waf-offender"])
+
+				bucket, err := host.GetProperty([]string{"waf_score_bucket"})
+				require.NoError(t, err)
+				require.Equal(t, tt.expectedBucket, string(bucket))
+				offender, err := host.GetProperty([]string{"waf_offender"})
+				require.NoError(t, err)
+				require.Equal(t, tt.expectedOffender, string(offender))
+			})
+		}
+	})
+}
+
+func TestClientCertificateVariables(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": [
+				"SecRuleEngine On",
+				"SecRule TX:client_spiffe_id \"!@streq spiffe://cluster.local/ns/payments/sa/checkout\" \"id:101,phase:1,deny,chain\"",
+				"SecRule REQUEST_URI \"@beginsWith /payments\" \"\"",
+				"SecRule &TX:client_spiffe_id \"@eq 0\" \"id:102,phase:1,deny,chain\"",
+				"SecRule REQUEST_URI \"@beginsWith /payments\" \"\""
+			]},
+			"default_directives": "default"
+		}`
+		tests := []struct {
+			name           string
+			uriSAN         string
+			expectedAction types.Action
+		}{
+			{name: "allowed workload", uriSAN: "spiffe://cluster.local/ns/payments/sa/checkout", expectedAction: types.ActionContinue},
+			{name: "other workload", uriSAN: "spiffe://cluster.local/ns/catalog/sa/default", expectedAction: types.ActionPause},
+			{name: "not a spiffe id", uriSAN: "https://example.com", expectedAction: types.ActionPause},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				require.NoError(t, host.SetProperty([]string{"connection", "uri_san_peer_certificate"}, []byte(tt.uriSAN)))
+
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/payments/charge"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+				}, true)
+				require.Equal(t, tt.expectedAction, action)
+			})
+		}
+	})
+}
+
+func TestPerDirectionDirectives(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {
+				"ingress": ["SecRuleEngine On", "SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\""],
+				"egress": ["SecRuleEngine On", "SecRule REQUEST_URI \"@streq /exfiltrate\" \"id:102,phase:1,deny\""]
+			},
+			"default_directives": "ingress",
+			"per_direction_directives": {"outbound": "egress"}
+		}`
+		tests := []struct {
+			name           string
+			direction      uint64
+			path           string
+			expectedAction types.Action
+		}{
+			{name: "inbound uses default", direction: 1, path: "/admin", expectedAction: types.ActionPause},
+			{name: "outbound allowed", direction: 2, path: "/admin", expectedAction: types.ActionContinue},
+			{name: "outbound denied", direction: 2, path: "/exfiltrate", expectedAction: types.ActionPause},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				direction := make([]byte, 8)
+				binary.LittleEndian.PutUint64(direction, tt.direction)
+				require.NoError(t, host.SetProperty([]string{"listener_direction"}, direction))
+
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", tt.path},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true)
+				require.Equal(t, tt.expectedAction, action)
+			})
+		}
+	})
+}
+
+func TestVerdictContract(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": [
+				"SecRuleEngine On",
+				"SecRule REQUEST_HEADERS:user-agent \"@contains scanner\" \"id:101,phase:1,log,pass,setvar:tx.blocking_inbound_anomaly_score=+5\"",
+				"SecRule REQUEST_URI \"@beginsWith /admin\" \"id:102,phase:1,log,deny,status:401\""
+			]},
+			"default_directives": "default",
+			"verdict_contract": {}
+		}`
+		tests := []struct {
+			name            string
+			path            string
+			userAgent       string
+			expectedVerdict string
+		}{
+			{
+				name:            "pass",
+				path:            "/",
+				userAgent:       "curl",
+				expectedVerdict: `{"version":"coraza.verdict/v1","connector":"coraza-proxy-wasm","transaction_id":"%s","action":"pass","rule_ids":[]}`,
+			},
+			{
+				name:            "detect",
+				path:            "/",
+				userAgent:       "scanner",
+				expectedVerdict: `{"version":"coraza.verdict/v1","connector":"coraza-proxy-wasm","transaction_id":"%s","action":"detect","rule_ids":[101],"anomaly_score":5}`,
+			},
+			{
+				name:            "block",
+				path:            "/admin",
+				userAgent:       "scanner",
+				expectedVerdict: `{"version":"coraza.verdict/v1","connector":"coraza-proxy-wasm","transaction_id":"%s","action":"block","status":401,"phase":"http_request_headers","rule_ids":[101,102],"anomaly_score":5}`,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				host.CallOnRequestHeaders(id, [][2]string{
+					{":path", tt.path},
+					{":method", "GET"},
+					{":authority", "localhost"},
+					{"user-agent", tt.userAgent},
+				}, true)
+				host.CompleteHttpContext(id)
+
+				verdict, err := host.GetProperty([]string{"coraza_verdict"})
+				require.NoError(t, err)
+				txID := gjson.GetBytes(verdict, "transaction_id").String()
+				require.NotEmpty(t, txID)
+				expected := fmt.Sprintf(tt.expectedVerdict, txID)
+				require.JSONEq(t, expected, string(verdict))
+				require.Contains(t, host.GetInfoLogs(), "coraza-verdict: "+expected)
+			})
+		}
+	})
+}
+
+func TestEgressAllowedDestinations(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {
+				"ingress": ["SecRuleEngine On"],
+				"egress": ["SecRuleEngine On"]
+			},
+			"default_directives": "ingress",
+			"per_authority_directives": {"*.internal": "ingress"},
+			"per_direction_directives": {"outbound": "egress"},
+			"egress_allowed_destinations": ["api.example.com", "*.googleapis.com"]
+		}`
+		tests := []struct {
+			name           string
+			direction      uint64
+			authority      string
+			expectedAction types.Action
+		}{
+			{name: "inbound not restricted", direction: 1, authority: "169.254.169.254", expectedAction: types.ActionContinue},
+			{name: "outbound allowed", direction: 2, authority: "api.example.com:443", expectedAction: types.ActionContinue},
+			{name: "outbound allowed wildcard", direction: 2, authority: "Storage.GoogleAPIs.com", expectedAction: types.ActionContinue},
+			{name: "outbound wildcard does not match apex", direction: 2, authority: "googleapis.com", expectedAction: types.ActionPause},
+			{name: "outbound metadata endpoint", direction: 2, authority: "169.254.169.254", expectedAction: types.ActionPause},
+			// The authority selects the ingress rule set, taking precedence over the direction
+			{name: "outbound to an authority rule set", direction: 2, authority: "metadata.internal", expectedAction: types.ActionPause},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				direction := make([]byte, 8)
+				binary.LittleEndian.PutUint64(direction, tt.direction)
+				require.NoError(t, host.SetProperty([]string{"listener_direction"}, direction))
+
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/"},
+					{":method", "GET"},
+					{":authority", tt.authority},
+				}, true)
+				require.Equal(t, tt.expectedAction, action)
+				if tt.expectedAction == types.ActionPause {
+					require.EqualValues(t, 403, host.GetSentLocalResponse(id).StatusCode)
+				}
+			})
+		}
+	})
+}
+
+func TestCapabilitiesGauge(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		tests := []struct {
+			host            string
+			expectedBitmap  uint64
+			expectedWarning string
+		}{
+			{host: "envoy", expectedBitmap: 15},
+			{host: "ats", expectedBitmap: 14, expectedWarning: "Host does not support ticks, repeated matches will be reported on the next match"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.host, func(t *testing.T) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": ["SecRuleEngine On"]},
+					"default_directives": "default",
+					"match_log_dedup_window": "1s",
+					"host": %q
+				}`, tt.host)
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				bitmap, err := host.GetGaugeMetric("waf_filter.capabilities")
+				require.NoError(t, err)
+				require.Equal(t, tt.expectedBitmap, bitmap)
+				if tt.expectedWarning != "" {
+					require.Contains(t, host.GetWarnLogs(), tt.expectedWarning)
+				} else {
+					require.Empty(t, host.GetWarnLogs())
+				}
+			})
+		}
+	})
+}
+
+func TestIstioPeerVariables(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": [
+				"SecRuleEngine On",
+				"SecRule TX:peer_namespace \"!@streq payments\" \"id:101,phase:1,deny,chain\"",
+				"SecRule REQUEST_URI \"@beginsWith /refunds\" \"\"",
+				"SecRule &TX:peer_namespace \"@eq 0\" \"id:102,phase:1,deny,chain\"",
+				"SecRule REQUEST_URI \"@beginsWith /refunds\" \"\""
+			]},
+			"default_directives": "default",
+			"istio": {"peer_variables": true}
+		}`
+		tests := []struct {
+			name           string
+			peerNamespace  string
+			expectedAction types.Action
+		}{
+			{name: "same namespace", peerNamespace: "payments", expectedAction: types.ActionContinue},
+			{name: "other namespace", peerNamespace: "storefront", expectedAction: types.ActionPause},
+			{name: "outside the mesh", expectedAction: types.ActionPause},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				if tt.peerNamespace != "" {
+					require.NoError(t, host.SetProperty([]string{"downstream_peer", "namespace"}, []byte(tt.peerNamespace)))
+				}
+
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/refunds"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+				}, true)
+				require.Equal(t, tt.expectedAction, action)
+			})
+		}
+	})
+}
+
+func TestWarmup(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": [
+				"Include @demo-conf",
+				"SecRuleEngine On",
+				"SecResponseBodyAccess On",
+				"SecResponseBodyMimeType application/json",
+				"Include @crs-setup-conf",
+				"Include @owasp_crs/*.conf",
+				"SecRule ARGS:arg \"@streq attack\" \"id:101,phase:1,deny\""
+			]},
+			"default_directives": "default",
+			"warmup": true
+		}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		// Warmup transactions are neither counted nor reported
+		_, err := host.GetCounterMetric("waf_filter.tx.total")
+		require.Error(t, err)
+		require.Empty(t, host.GetErrorLogs())
+		require.Empty(t, host.GetWarnLogs())
+
+		id := host.InitializeHttpContext()
+		action := host.CallOnRequestHeaders(id, [][2]string{
+			{":path", "/?arg=attack"},
+			{":method", "GET"},
+			{":authority", "localhost"},
+		}, true)
+		require.Equal(t, types.ActionPause, action)
+		checkTXMetric(t, host, 1)
+	})
+}
+
+func TestFailurePolicy(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		tests := []struct {
+			name           string
+			policy         string
+			contentType    string
+			body           string
+			expectedAction types.Action
+			expectedStatus uint32
+			expectedMetric string
+		}{
+			{
+				name:           "body limit open",
+				policy:         `{"body_limit": "open"}`,
+				contentType:    "application/x-www-form-urlencoded",
+				body:           "q=0123456789abcdef",
+				expectedAction: types.ActionContinue,
+				expectedMetric: "waf_filter.tx.failures_class=body_limit_policy=open",
+			},
+			{
+				name:           "body limit closed",
+				policy:         `{"body_limit": "closed"}`,
+				contentType:    "application/x-www-form-urlencoded",
+				body:           "q=0123456789abcdef",
+				expectedAction: types.ActionPause,
+				expectedStatus: 413,
+				expectedMetric: "waf_filter.tx.failures_class=body_limit_policy=closed",
+			},
+			{
+				name:           "parse error closed",
+				policy:         `{"parse_error": "closed"}`,
+				contentType:    "multipart/form-data; boundary=x",
+				body:           "--x\r\nbroken",
+				expectedAction: types.ActionPause,
+				expectedStatus: 400,
+				expectedMetric: "waf_filter.tx.failures_class=parse_error_policy=closed",
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": [
+						"SecRuleEngine On",
+						"SecRequestBodyAccess On",
+						"SecRequestBodyLimit 16",
+						"SecRequestBodyLimitAction ProcessPartial"
+					]},
+					"default_directives": "default",
+					"failure_policy": %s
+				}`, tt.policy)
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", tt.contentType},
+					{"content-length", strconv.Itoa(len(tt.body))},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				action = host.CallOnRequestBody(id, []byte(tt.body), true)
+				require.Equal(t, tt.expectedAction, action)
+				if tt.expectedStatus != 0 {
+					require.Equal(t, tt.expectedStatus, host.GetSentLocalResponse(id).StatusCode)
+				}
+
+				value, err := host.GetCounterMetric(tt.expectedMetric)
+				require.NoError(t, err)
+				require.Equal(t, uint64(1), value)
+			})
+		}
+	})
+}
+
+func TestMemoryPressure(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		tests := []struct {
+			name           string
+			policy         string
+			routePolicy    string
+			expectedAction types.Action
+			expectedMetric string
+		}{
+			{
+				name:           "open",
+				policy:         "open",
+				expectedAction: types.ActionContinue,
+				expectedMetric: "waf_filter.tx.failures_class=memory_pressure_policy=open",
+			},
+			{
+				name:           "closed",
+				policy:         "closed",
+				expectedAction: types.ActionPause,
+				expectedMetric: "waf_filter.tx.failures_class=memory_pressure_policy=closed",
+			},
+			{
+				name:           "open for the route",
+				policy:         "closed",
+				routePolicy:    "body_limit:closed, memory_pressure:open",
+				expectedAction: types.ActionContinue,
+				expectedMetric: "waf_filter.tx.failures_class=memory_pressure_policy=open",
+			},
+			{
+				name:           "invalid policy for the route",
+				policy:         "closed",
+				routePolicy:    "memory_pressure:ajar",
+				expectedAction: types.ActionPause,
+				expectedMetric: "waf_filter.tx.failures_class=memory_pressure_policy=closed",
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				// Any heap in use exceeds a 1 byte threshold
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": ["SecRuleEngine On"]},
+					"default_directives": "default",
+					"failure_policy": {"memory_pressure": %q},
+					"memory_pressure_threshold": 1,
+					"route_metadata": {}
+				}`, tt.policy)
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				if tt.routePolicy != "" {
+					require.NoError(t, host.SetProperty([]string{"xds", "route_metadata", "filter_metadata", "coraza", "failure_policy"}, []byte(tt.routePolicy)))
+				}
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true)
+				require.Equal(t, tt.expectedAction, action)
+				if tt.expectedAction == types.ActionPause {
+					require.EqualValues(t, 503, host.GetSentLocalResponse(id).StatusCode)
+				}
+				host.CompleteHttpContext(id)
+
+				value, err := host.GetCounterMetric(tt.expectedMetric)
+				require.NoError(t, err)
+				require.Equal(t, uint64(1), value)
+			})
+		}
+	})
+}
+
+func TestEvaluationDeadline(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		tests := []struct {
+			policy         string
+			expectedAction types.Action
+		}{
+			{policy: "open", expectedAction: types.ActionContinue},
+			{policy: "closed", expectedAction: types.ActionPause},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.policy, func(t *testing.T) {
+				// Any evaluation exceeds a 1ns deadline
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": [
+						"SecRuleEngine On",
+						"SecRule RESPONSE_HEADERS:x-leak \"@streq secret\" \"id:101,phase:3,deny\""
+					]},
+					"default_directives": "default",
+					"evaluation_deadline": "1ns",
+					"failure_policy": {"deadline": %q},
+					"verdict_contract": {"filter_state": false}
+				}`, tt.policy)
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true)
+				require.Equal(t, tt.expectedAction, action)
+
+				value, err := host.GetCounterMetric("waf_filter.tx.failures_class=deadline_policy=" + tt.policy)
+				require.NoError(t, err)
+				require.Equal(t, uint64(1), value)
+
+				if tt.policy == "closed" {
+					require.EqualValues(t, 503, host.GetSentLocalResponse(id).StatusCode)
+				} else {
+					// The rules of the following phases are skipped
+					action = host.CallOnResponseHeaders(id, [][2]string{
+						{":status", "200"},
+						{"x-leak", "secret"},
+					}, false)
+					require.Equal(t, types.ActionContinue, action)
+				}
+				host.CompleteHttpContext(id)
+
+				skipped := "http_request_body,http_response_headers,http_response_body"
+				require.Contains(t, strings.Join(host.GetWarnLogs(), "\n"), `skipped_phases="`+skipped+`"`)
+				require.Contains(t, strings.Join(host.GetInfoLogs(), "\n"),
+					`"skipped_phases":["http_request_body","http_response_headers","http_response_body"]`)
+			})
+		}
+	})
+}
+
+func TestGracefulDrain(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": [
+				"SecRuleEngine On",
+				"SecRule REQUEST_URI \"@streq /repeated\" \"id:101,phase:1,log,pass,severity:3\"",
+				"SecRule REQUEST_URI \"@streq /inflight\" \"id:102,phase:5,log,pass,severity:3\""
+			]},
+			"default_directives": "default",
+			"match_log_dedup_window": "1h",
+			"verdict_contract": {"filter_state": false}
+		}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		for i := 0; i < 2; i++ {
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{
+				{":path", "/repeated"},
+				{":method", "GET"},
+				{":authority", "localhost"},
+			}, true)
+			host.CompleteHttpContext(id)
+		}
+
+		// The stream of this request is never done
+		id := host.InitializeHttpContext()
+		host.CallOnRequestHeaders(id, [][2]string{
+			{":path", "/inflight"},
+			{":method", "GET"},
+			{":authority", "localhost"},
+		}, true)
+
+		logs := strings.Join(host.GetErrorLogs(), "\n")
+		require.NotContains(t, logs, "[repeated")
+		require.NotContains(t, strings.Join(host.GetInfoLogs(), "\n"), `"rule_ids":[102]`)
+
+		host.FinishVM()
+
+		logs = strings.Join(host.GetErrorLogs(), "\n")
+		require.Contains(t, logs, `[repeated "1"]`)
+		require.Contains(t, logs, `[id "102"]`)
+
+		infoLogs := strings.Join(host.GetInfoLogs(), "\n")
+		require.Contains(t, infoLogs, "Finishing 1 in-flight transactions")
+		require.Contains(t, infoLogs, `"rule_ids":[102]`)
+	})
+}
+
+func TestLiveTransactionsGauge(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": [
+				"SecRuleEngine On",
+				"SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\""
+			]},
+			"default_directives": "default"
+		}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		liveTX := func() uint64 {
+			value, err := host.GetGaugeMetric("waf_filter.tx.live")
+			require.NoError(t, err)
+			return value
+		}
+
+		var ids []uint32
+		for _, path := range []string{"/", "/admin", "/"} {
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{
+				{":path", path},
+				{":method", "GET"},
+				{":authority", "localhost"},
+			}, false)
+			ids = append(ids, id)
+		}
+		require.Equal(t, uint64(3), liveTX())
+
+		// The interrupted stream is done after the local reply
+		host.CompleteHttpContext(ids[1])
+		require.Equal(t, uint64(2), liveTX())
+
+		// The stream is reset before the request body
+		host.CompleteHttpContext(ids[0])
+		require.Equal(t, uint64(1), liveTX())
+
+		host.FinishVM()
+		require.Equal(t, uint64(0), liveTX())
+	})
+}
+
+func TestHeapGauges(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": ["SecRuleEngine On"]},
+			"default_directives": "default"
+		}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		id := host.InitializeHttpContext()
+		host.CallOnRequestHeaders(id, [][2]string{
+			{":path", "/"},
+			{":method", "GET"},
+			{":authority", "localhost"},
+		}, true)
+		host.CompleteHttpContext(id)
+
+		for _, name := range []string{"waf_filter.heap.size", "waf_filter.heap.allocated_total", "waf_filter.memory.sys"} {
+			value, err := host.GetGaugeMetric(name)
+			require.NoError(t, err, name)
+			require.NotZero(t, value, name)
+		}
+		_, err := host.GetGaugeMetric("waf_filter.heap.free")
+		require.NoError(t, err)
+	})
+}
+
+func TestGCWhenIdle(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": ["SecRuleEngine On"]},
+			"default_directives": "default",
+			"gc_when_idle": true
+		}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		var ids []uint32
+		for i := 0; i < 2; i++ {
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{
+				{":path", "/"},
+				{":method", "GET"},
+				{":authority", "localhost"},
+			}, true)
+			ids = append(ids, id)
+		}
+
+		// A stream is still in flight
+		host.CompleteHttpContext(ids[0])
+		_, err := host.GetCounterMetric("waf_filter.gc.idle_collections")
+		require.Error(t, err)
+
+		host.CompleteHttpContext(ids[1])
+		collections, err := host.GetCounterMetric("waf_filter.gc.idle_collections")
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), collections)
+	})
+}
+
+func TestInternalRedirects(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		tests := []struct {
+			mode                          string
+			expectedRequestHeadersAction  types.Action
+			expectedResponseHeadersAction types.Action
+		}{
+			{mode: "reinspect", expectedRequestHeadersAction: types.ActionPause},
+			{mode: "skip_request", expectedRequestHeadersAction: types.ActionContinue, expectedResponseHeadersAction: types.ActionPause},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.mode, func(t *testing.T) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": [
+						"SecRuleEngine On",
+						"SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\"",
+						"SecRule RESPONSE_HEADERS:x-leak \"@streq secret\" \"id:102,phase:3,deny\""
+					]},
+					"default_directives": "default",
+					"internal_redirects": %q
+				}`, tt.mode)
+				filterState := &envoyFilterState{spans: map[string]uint64{}}
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				host.RegisterForeignFunction("declare_property", filterState.declareProperty)
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				// Requests not coming from an internal redirect are always inspected, even if
+				// they carry the header Envoy sets on the redirected requests
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/admin"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+					{"x-envoy-original-url", "http://localhost/login"},
+				}, true)
+				require.Equal(t, types.ActionPause, action)
+
+				// The request of the original stream passes, then its response is redirected
+				id = host.InitializeHttpContext()
+				action = host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/login"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true)
+				require.Equal(t, types.ActionContinue, action)
+				redirectOpt := filterState.carryOver(host, proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf)))
+				reset()
+
+				// Envoy recreates the stream, only with the filter state of the request life span
+				host, reset = proxytest.NewHostEmulator(redirectOpt)
+				defer reset()
+				host.RegisterForeignFunction("declare_property", filterState.declareProperty)
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id = host.InitializeHttpContext()
+				action = host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/admin"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+					{"x-envoy-original-url", "http://localhost/login"},
+				}, true)
+				require.Equal(t, tt.expectedRequestHeadersAction, action)
+				if action == types.ActionPause {
+					return
+				}
+
+				action = host.CallOnResponseHeaders(id, [][2]string{
+					{":status", "200"},
+					{"x-leak", "secret"},
+				}, false)
+				require.Equal(t, tt.expectedResponseHeadersAction, action)
+			})
+		}
+	})
+}
+
+// envoyFilterState emulates the life spans of the filter state objects of Envoy, declared
+// through the declare_property foreign function. Only the objects of the request or
+// connection life spans are carried over to the streams recreated by internal redirects,
+// the ones set without being declared living as long as the filter chain.
+type envoyFilterState struct {
+	spans map[string]uint64
+}
+
+// declareProperty decodes the name (1) and the span (5) of the DeclarePropertyArguments.
+func (s *envoyFilterState) declareProperty(args []byte) []byte {
+	var (
+		name string
+		span uint64
+	)
+	for len(args) > 0 {
+		key, n := binary.Uvarint(args)
+		if n <= 0 {
+			break
+		}
+		args = args[n:]
+		v, n := binary.Uvarint(args)
+		if n <= 0 {
+			break
+		}
+		args = args[n:]
+		switch key {
+		case 1<<3 | 2:
+			name, args = string(args[:v]), args[v:]
+		case 5 << 3:
+			span = v
+		}
+	}
+	s.spans[name] = span
+	return []byte{0}
+}
+
+// carryOver adds to opt the properties of the filter state of host carried over to the
+// redirected streams.
+func (s *envoyFilterState) carryOver(host proxytest.HostEmulator, opt *proxytest.EmulatorOption) *proxytest.EmulatorOption {
+	for name, span := range s.spans {
+		if span == 0 {
+			continue
+		}
+		if value, err := host.GetProperty([]string{name}); err == nil {
+			opt = opt.WithProperty([]string{name}, value)
+		}
+	}
+	return opt
+}
+
+func TestResponseOnly(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": [
+				"SecRuleEngine On",
+				"SecRequestBodyAccess On",
+				"SecResponseBodyAccess On",
+				"SecResponseBodyMimeType text/plain",
+				"SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\"",
+				"SecRule REQUEST_BODY \"@contains attack\" \"id:102,phase:2,deny\"",
+				"SecRule RESPONSE_BODY \"@contains secret\" \"id:103,phase:4,deny\""
+			]},
+			"default_directives": "default",
+			"response_only": true
+		}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		id := host.InitializeHttpContext()
+		action := host.CallOnRequestHeaders(id, [][2]string{
+			{":path", "/admin"},
+			{":method", "POST"},
+			{":authority", "localhost"},
+			{"content-type", "text/plain"},
+		}, false)
+		require.Equal(t, types.ActionContinue, action)
+
+		action = host.CallOnRequestBody(id, []byte("attack"), true)
+		require.Equal(t, types.ActionContinue, action)
+
+		action = host.CallOnResponseHeaders(id, [][2]string{
+			{":status", "200"},
+			{"content-type", "text/plain"},
+		}, false)
+		require.Equal(t, types.ActionContinue, action)
+
+		action = host.CallOnResponseBody(id, []byte("the secret"), true)
+		require.Equal(t, types.ActionContinue, action)
+
+		// The response body is blanked by the interruption
+		body := host.GetCurrentResponseBody(id)
+		require.EqualValues(t, bytes.Repeat([]byte("\x00"), len("the secret")), body)
+	})
+}
+
+func TestSampling(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		tests := []struct {
+			percentage             int
+			expectedDecision       string
+			expectedRequestHeaders types.Action
+			expectedRequestBody    types.Action
+		}{
+			{percentage: 100, expectedDecision: "full", expectedRequestHeaders: types.ActionContinue, expectedRequestBody: types.ActionPause},
+			{percentage: 0, expectedDecision: "headers_only", expectedRequestHeaders: types.ActionPause},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.expectedDecision, func(t *testing.T) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {
+						"default": [
+							"SecRuleEngine On",
+							"SecRequestBodyAccess On",
+							"SecRule REQUEST_BODY \"@contains attack\" \"id:101,phase:2,deny\""
+						],
+						"headers": [
+							"SecRuleEngine On",
+							"SecRequestBodyAccess On",
+							"SecRule TX:sampling_decision \"@streq headers_only\" \"id:102,phase:1,deny\""
+						]
+					},
+					"default_directives": "default",
+					"sampling": {"full_inspection_percentage": %d, "headers_only_directives": "headers"}
+				}`, tt.percentage)
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", "application/x-www-form-urlencoded"},
+				}, false)
+				require.Equal(t, tt.expectedRequestHeaders, action)
+
+				value, err := host.GetCounterMetric("waf_filter.tx.sampling_decision=" + tt.expectedDecision)
+				require.NoError(t, err)
+				require.Equal(t, uint64(1), value)
+
+				if action == types.ActionPause {
+					return
+				}
+
+				action = host.CallOnRequestBody(id, []byte("q=attack"), true)
+				require.Equal(t, tt.expectedRequestBody, action)
+			})
+		}
+	})
+}
+
+func TestUniqueID(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		tests := []struct {
+			generator       string
+			expectedIDRegex string
+		}{
+			{generator: "uuidv4", expectedIDRegex: `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+			{generator: "uuidv7", expectedIDRegex: `^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+			{generator: "snowflake", expectedIDRegex: `^[0-9]+$`},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.generator, func(t *testing.T) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": [
+						"SecRuleEngine On",
+						"SecRule UNIQUE_ID \"@rx %s\" \"id:101,phase:1,log,pass\""
+					]},
+					"default_directives": "default",
+					"unique_id": {"generator": %q},
+					"verdict_contract": {"filter_state": false}
+				}`, tt.expectedIDRegex, tt.generator)
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.NoError(t, host.SetProperty([]string{"node", "id"}, []byte("sidecar~10.0.0.1~app.default")))
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true)
+				host.CompleteHttpContext(id)
+
+				// The generated ID is the UNIQUE_ID variable and the ID of the verdict
+				var verdict string
+				for _, log := range host.GetInfoLogs() {
+					if v, ok := strings.CutPrefix(log, "coraza-verdict: "); ok {
+						verdict = v
+					}
+				}
+				require.Equal(t, "detect", gjson.Get(verdict, "action").String())
+				require.Regexp(t, tt.expectedIDRegex, gjson.Get(verdict, "transaction_id").String())
+			})
+		}
+	})
+}
+
+func vmTest(t *testing.T, f func(*testing.T, types.VMContext)) {
+	t.Helper()
+
+	t.Run("go", func(t *testing.T) {
+		auditlog.RegisterProxyWasmSerialWriter()
+		f(t, wasmplugin.NewVMContext())
+	})
+
+	t.Run("wasm", func(t *testing.T) {
+		buildPath := filepath.Join("build", "mainraw.wasm")
+		wasm, err := os.ReadFile(buildPath)
+		if err != nil {
+			t.Fatal("wasm not found")
+		}
+		v, err := proxytest.NewWasmVMContext(wasm)
+		require.NoError(t, err)
+		defer v.Close()
+		f(t, v)
+	})
+}
+
+func TestRouteMetadata(t *testing.T) {
+	conf := `
+	{
+		"directives_map": {
+			"default": [
+				"SecRuleEngine On",
+				"SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\"",
+				"SecRule TX:blocking_paranoia_level \"@eq 3\" \"id:103,phase:1,deny,status:429\""
+			],
+			"api": [
+				"SecRuleEngine On",
+				"SecRule REQUEST_URI \"@streq /internal\" \"id:102,phase:1,deny\""
+			]
+		},
+		"default_directives": "default",
+		"route_metadata": {}
+	}`
+
+	paranoiaLevel3 := make([]byte, 8)
+	binary.LittleEndian.PutUint64(paranoiaLevel3, math.Float64bits(3))
+
+	tests := []struct {
+		name           string
+		path           string
+		metadata       map[string][]byte
+		expectedStatus uint32
+	}{
+		{
+			name:           "no route metadata",
+			path:           "/admin",
+			expectedStatus: 403,
+		},
+		{
+			name:     "rule set selected by the route",
+			path:     "/admin",
+			metadata: map[string][]byte{"directives": []byte("api")},
+		},
+		{
+			name:           "rule set selected by the route blocking",
+			path:           "/internal",
+			metadata:       map[string][]byte{"directives": []byte("api")},
+			expectedStatus: 403,
+		},
+		{
+			name:     "detection only route",
+			path:     "/internal",
+			metadata: map[string][]byte{"directives": []byte("api"), "mode": []byte("detect")},
+		},
+		{
+			name:           "unknown rule set",
+			path:           "/admin",
+			metadata:       map[string][]byte{"directives": []byte("legacy")},
+			expectedStatus: 403,
+		},
+		{
+			name:           "paranoia level",
+			path:           "/",
+			metadata:       map[string][]byte{"paranoia_level": paranoiaLevel3},
+			expectedStatus: 429,
+		},
+		{
+			name:     "invalid paranoia level",
+			path:     "/",
+			metadata: map[string][]byte{"paranoia_level": []byte("7")},
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tc := range tests {
+			tt := tc
+			t.Run(tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				for key, value := range tt.metadata {
+					require.NoError(t, host.SetProperty([]string{"xds", "route_metadata", "filter_metadata", "coraza", key}, value))
+				}
+
+				id := host.InitializeHttpContext()
+				host.CallOnRequestHeaders(id, [][2]string{
+					{":path", tt.path},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true)
+
+				resp := host.GetSentLocalResponse(id)
+				if tt.expectedStatus == 0 {
+					require.Nil(t, resp)
+				} else {
+					require.NotNil(t, resp)
+					require.EqualValues(t, tt.expectedStatus, resp.StatusCode)
+				}
+				host.CompleteHttpContext(id)
+			})
+		}
+	})
+}
+
+func TestRemoteRules(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		bundle := []byte(`
+		{
+			"directives": ["Include @remote/*.conf"],
+			"files": {
+				"admin.conf": "SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\""
+			}
+		}`)
+		sum := sha256.Sum256(bundle)
+
+		tests := []struct {
+			name           string
+			sha256         string
+			response       [][2]string
+			expectedStatus uint32
+		}{
+			{
+				name:           "loaded",
+				sha256:         hex.EncodeToString(sum[:]),
+				response:       [][2]string{{":status", "200"}},
+				expectedStatus: 403,
+			},
+			{
+				name:           "checksum mismatch",
+				sha256:         strings.Repeat("0", 64),
+				response:       [][2]string{{":status", "200"}},
+				expectedStatus: 503,
+			},
+			{
+				name:           "unexpected status",
+				sha256:         hex.EncodeToString(sum[:]),
+				response:       [][2]string{{":status", "404"}},
+				expectedStatus: 503,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {"default": ["SecRuleEngine On"]},
+					"default_directives": "default",
+					"rules_remote": {"cluster": "rules_server", "path": "/rules.json", "sha256": %q},
+					"failure_policy": {"rules_unavailable": "closed"}
+				}`, tt.sha256)
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				callouts := host.GetCalloutAttributesFromContext(proxytest.PluginContextID)
+				require.Len(t, callouts, 1)
+				require.Equal(t, "rules_server", callouts[0].Upstream)
+				require.Contains(t, callouts[0].Headers, [2]string{":path", "/rules.json"})
+
+				request := [][2]string{
+					{":path", "/admin"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}
+
+				// The rules are not loaded yet
+				id := host.InitializeHttpContext()
+				require.Equal(t, types.ActionPause, host.CallOnRequestHeaders(id, request, true))
+				require.Equal(t, uint32(503), host.GetSentLocalResponse(id).StatusCode)
+
+				host.CallOnHttpCallResponse(callouts[0].CalloutID, tt.response, nil, bundle)
+
+				id = host.InitializeHttpContext()
+				require.Equal(t, types.ActionPause, host.CallOnRequestHeaders(id, request, true))
+				require.Equal(t, tt.expectedStatus, host.GetSentLocalResponse(id).StatusCode)
+			})
+		}
+	})
+}
+
+func TestRemoteRulesRefresh(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": ["SecRuleEngine On"]},
+			"default_directives": "default",
+			"rules_remote": {"cluster": "rules_server", "path": "/rules.json", "refresh_interval": "1ms"}
+		}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		bundle := func(path string) []byte {
+			return []byte(fmt.Sprintf(`{"directives": ["SecRule REQUEST_URI \"@streq %s\" \"id:101,phase:1,deny\""]}`, path))
+		}
+		statusOf := func(path string) uint32 {
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{
+				{":path", path},
+				{":method", "GET"},
+				{":authority", "localhost"},
+			}, true)
+			if resp := host.GetSentLocalResponse(id); resp != nil {
+				return resp.StatusCode
+			}
+			return 0
+		}
+		// refresh ticks once the refresh interval elapsed, returning the request of the refresh
+		refresh := func() proxytest.HttpCalloutAttribute {
+			time.Sleep(2 * time.Millisecond)
+			host.Tick()
+			callouts := host.GetCalloutAttributesFromContext(proxytest.PluginContextID)
+			require.NotEmpty(t, callouts)
+			return callouts[len(callouts)-1]
+		}
+		refreshes := func(result string) uint64 {
+			value, err := host.GetCounterMetric("waf_filter.rules.refreshes_result=" + result)
+			if err != nil {
+				return 0
+			}
+			return value
+		}
+
+		callouts := host.GetCalloutAttributesFromContext(proxytest.PluginContextID)
+		require.Len(t, callouts, 1)
+		host.CallOnHttpCallResponse(callouts[0].CalloutID, [][2]string{{":status", "200"}, {"etag", `"v1"`}}, nil, bundle("/admin"))
+		require.Equal(t, uint32(403), statusOf("/admin"))
+
+		// The refresh is conditional, the rules are kept if not modified
+		callout := refresh()
+		require.Contains(t, callout.Headers, [2]string{"if-none-match", `"v1"`})
+		host.CallOnHttpCallResponse(callout.CalloutID, [][2]string{{":status", "304"}}, nil, nil)
+		require.Equal(t, uint64(1), refreshes("not_modified"))
+		require.Equal(t, uint32(403), statusOf("/admin"))
+
+		// A stream started before the swap keeps its rules
+		inflight := host.InitializeHttpContext()
+
+		callout = refresh()
+		host.CallOnHttpCallResponse(callout.CalloutID, [][2]string{{":status", "200"}, {"etag", `"v2"`}}, nil, bundle("/internal"))
+		require.Equal(t, uint64(2), refreshes("loaded"))
+		require.Equal(t, uint32(0), statusOf("/admin"))
+		require.Equal(t, uint32(403), statusOf("/internal"))
+
+		host.CallOnRequestHeaders(inflight, [][2]string{
+			{":path", "/admin"},
+			{":method", "GET"},
+			{":authority", "localhost"},
+		}, true)
+		require.Equal(t, uint32(403), host.GetSentLocalResponse(inflight).StatusCode)
+
+		// Invalid rules are not swapped in
+		callout = refresh()
+		host.CallOnHttpCallResponse(callout.CalloutID, [][2]string{{":status", "200"}}, nil, []byte(`{"directives": ["SecRule"]}`))
+		require.Equal(t, uint64(1), refreshes("failed"))
+		require.Equal(t, uint32(403), statusOf("/internal"))
+	})
+}
+
+func TestStatusEndpointRemoteRules(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": ["SecRuleEngine On"]},
+			"default_directives": "default",
+			"rules_remote": {"cluster": "rules_server", "path": "/rules.json", "refresh_interval": "1ms"},
+			"status_endpoint": {"path": "/.coraza/status", "hmac_secret": "s3cr3t"}
+		}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		status := func() gjson.Result {
+			ts := strconv.FormatInt(time.Now().Unix(), 10)
+			mac := hmac.New(sha256.New, []byte("s3cr3t"))
+			mac.Write([]byte(ts + ":/.coraza/status"))
+			id := host.InitializeHttpContext()
+			host.CallOnRequestHeaders(id, [][2]string{
+				{":path", "/.coraza/status"},
+				{":method", "GET"},
+				{":authority", "localhost"},
+				{"x-coraza-status-signature", fmt.Sprintf("t=%s,sig=%s", ts, hex.EncodeToString(mac.Sum(nil)))},
+			}, true)
+			resp := host.GetSentLocalResponse(id)
+			require.Equal(t, uint32(200), resp.StatusCode)
+			return gjson.ParseBytes(resp.Data)
+		}
+		load := func(bundle []byte) {
+			callouts := host.GetCalloutAttributesFromContext(proxytest.PluginContextID)
+			require.NotEmpty(t, callouts)
+			host.CallOnHttpCallResponse(callouts[len(callouts)-1].CalloutID, [][2]string{{":status", "200"}}, nil, bundle)
+		}
+
+		bundle := []byte(`{"directives": ["SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\""]}`)
+		load(bundle)
+		sum := sha256.Sum256(bundle)
+		loaded := status()
+		require.Equal(t, hex.EncodeToString(sum[:]), loaded.Get("remote_rules_sha256").String())
+
+		// A new bundle changes the version of the rule sets
+		time.Sleep(2 * time.Millisecond)
+		host.Tick()
+		bundle = []byte(`{"directives": ["SecRule REQUEST_URI \"@streq /internal\" \"id:101,phase:1,deny\""]}`)
+		load(bundle)
+		sum = sha256.Sum256(bundle)
+		refreshed := status()
+		require.Equal(t, hex.EncodeToString(sum[:]), refreshed.Get("remote_rules_sha256").String())
+		require.NotEqual(t, loaded.Get("ruleset_version").String(), refreshed.Get("ruleset_version").String())
+	})
+}
+
+func TestStructuredRules(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {
+				"default": [
+					"SecRuleEngine On",
+					{"id": 1, "phase": 1, "actions": ["pass", "nolog", "setvar:tx.admin_path=/admin"]},
+					{
+						"id": 101,
+						"phase": 1,
+						"variables": ["REQUEST_URI"],
+						"operator": "@beginsWith %{tx.admin_path}",
+						"actions": ["deny", "status:403", "msg:'Access to \"admin\"'"],
+						"chain": {"variables": ["REQUEST_HEADERS:X-Admin-Token"], "operator": "!@streq secret"}
+					}
+				]
+			},
+			"default_directives": "default"
+		}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		tests := []struct {
+			name           string
+			path           string
+			token          string
+			expectedAction types.Action
+		}{
+			{name: "other path", path: "/", token: "none", expectedAction: types.ActionContinue},
+			{name: "admin without token", path: "/admin", token: "none", expectedAction: types.ActionPause},
+			{name: "admin with token", path: "/admin", token: "secret", expectedAction: types.ActionContinue},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", tt.path},
+					{":method", "GET"},
+					{":authority", "localhost"},
+					{"x-admin-token", tt.token},
+				}, true)
+				require.Equal(t, tt.expectedAction, action)
+			})
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {
+				"default": ["SecRuleEngine On", "SecRule ARGS \"@rx foo\" \"id:101,phase:1,deny\""],
+				"legacy": ["SecRuleEngine On", "SecRule ARGS \"@rx foo\" \"id:101,phase:1,deny\"\nSecRule ARGS \"@foo bar\" \"id:102,phase:1,deny\""],
+				"unused": ["SecFoo bar"]
+			},
+			"default_directives": "default",
+			"per_authority_directives": {"legacy.example.com": "legacy"},
+			"validate": true
+		}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusFailed, host.StartPlugin())
+
+		// Every error is reported, even of the rule sets not referenced
+		logs := host.GetCriticalLogs()
+		require.Len(t, logs, 2)
+		require.Contains(t, logs[0], `invalid directives "legacy", entry 1, line 2, rule 102: failed to compile the directive "secrule": operator foo not found`)
+		require.Contains(t, logs[1], `invalid directives "unused", entry 0, line 1: unknown directive "secfoo"`)
+
+		errors, err := host.GetCounterMetric("waf_filter.config.errors")
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), errors)
+	})
+}
+
+func TestUnknownConfigurationField(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"dierctives_map": {
+				"default": ["SecRuleEngine On", "SecRule ARGS \"@rx foo\" \"id:101,phase:1,deny\""]
+			},
+			"default_directives": "default"
+		}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusFailed, host.StartPlugin())
+
+		logs := host.GetCriticalLogs()
+		require.Len(t, logs, 1)
+		require.Contains(t, logs[0], `invalid plugin configuration: unknown field "dierctives_map", did you mean "directives_map"?`)
+
+		errors, err := host.GetCounterMetric("waf_filter.config.errors")
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), errors)
+	})
+}
+
+func TestCompressedDirectives(t *testing.T) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte("SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\""))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := fmt.Sprintf(`
+		{
+			"directives_map": {"default": ["SecRuleEngine On"]},
+			"directives_map_gzip": {"default": %q},
+			"default_directives": "default"
+		}`, base64.StdEncoding.EncodeToString(buf.Bytes()))
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		id := host.InitializeHttpContext()
+		action := host.CallOnRequestHeaders(id, [][2]string{
+			{":path", "/admin"},
+			{":method", "GET"},
+			{":authority", "localhost"},
+		}, true)
+		require.Equal(t, types.ActionPause, action)
+		require.Equal(t, uint32(403), host.GetSentLocalResponse(id).StatusCode)
+	})
+}
+
+func TestVMConfigurationDefaults(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		defaults := `
+		{
+			"directives_map": {
+				"default": ["SecRuleEngine On", "SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\""]
+			},
+			"default_directives": "default"
+		}`
+		conf := `
+		{
+			"directives_map": {
+				"api": ["SecRuleEngine On", "SecRule REQUEST_URI \"@streq /internal\" \"id:102,phase:1,deny\""]
+			},
+			"per_authority_directives": {"api.example.com": "api"}
+		}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithVMConfiguration([]byte(defaults)).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnVMStartStatusOK, host.StartVM())
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		tests := []struct {
+			authority string
+			path      string
+			denied    bool
+		}{
+			{authority: "www.example.com", path: "/admin", denied: true},
+			{authority: "www.example.com", path: "/internal", denied: false},
+			{authority: "api.example.com", path: "/admin", denied: false},
+			{authority: "api.example.com", path: "/internal", denied: true},
+		}
+		for _, tt := range tests {
+			id := host.InitializeHttpContext()
+			action := host.CallOnRequestHeaders(id, [][2]string{
+				{":path", tt.path},
+				{":method", "GET"},
+				{":authority", tt.authority},
+			}, true)
+			if tt.denied {
+				require.Equal(t, types.ActionPause, action, tt)
+				require.Equal(t, uint32(403), host.GetSentLocalResponse(id).StatusCode, tt)
+			} else {
+				require.Equal(t, types.ActionContinue, action, tt)
+			}
+			host.CompleteHttpContext(id)
+		}
+	})
+}
+
+func TestResponseBodyInterruption(t *testing.T) {
+	tests := []struct {
+		name         string
+		interruption string
+		responseBody []byte
+	}{
+		{
+			name:         "zero",
+			interruption: `{"action": "zero"}`,
+			responseBody: bytes.Repeat([]byte("\x00"), len("The password is hunter2")),
+		},
+		{
+			name:         "replace",
+			interruption: `{"action": "replace", "body": "Content removed"}`,
+			responseBody: []byte("Content removed"),
+		},
+		{
+			name:         "truncate",
+			interruption: `{"action": "truncate"}`,
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {
+						"default": [
+							"SecRuleEngine On",
+							"SecResponseBodyAccess On",
+							"SecResponseBodyMimeType text/plain",
+							"SecRule RESPONSE_BODY \"@contains password\" \"id:101,phase:4,deny\""
+						]
+					},
+					"default_directives": "default",
+					"response_body_interruption": %s
+				}`, tt.interruption)
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/account"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true)
+				require.Equal(t, types.ActionContinue, action)
+
+				action = host.CallOnResponseHeaders(id, [][2]string{
+					{":status", "200"},
+					{"content-type", "text/plain"},
+					{"content-length", "23"},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				// The content-length is removed when the body length may change
+				hasContentLength := false
+				for _, h := range host.GetCurrentResponseHeaders(id) {
+					hasContentLength = hasContentLength || h[0] == "content-length"
+				}
+				require.Equal(t, tt.name == "zero", hasContentLength)
+
+				action = host.CallOnResponseBody(id, []byte("The password is hunter2"), true)
+				require.Equal(t, types.ActionContinue, action)
+				require.Equal(t, string(tt.responseBody), string(host.GetCurrentResponseBody(id)))
+			})
+		}
+	})
+}
+
+func TestRequestBodyStreaming(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {
+				"default": [
+					"SecRuleEngine On",
+					"SecRequestBodyAccess On",
+					"SecRequestBodyLimit 32",
+					"SecRequestBodyLimitAction Reject",
+					"SecRule REQUEST_BODY \"@contains hunter2\" \"id:101,phase:2,deny\""
+				]
+			},
+			"default_directives": "default",
+			"request_body_streaming": true
+		}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		tests := []struct {
+			name   string
+			chunks []string
+			status uint32
+		}{
+			{name: "legit", chunks: []string{"user=", "pooh&", "food=honey"}},
+			{name: "match across chunks", chunks: []string{"user=", "pooh&pass=hun", "ter2"}, status: 403},
+			{name: "limit exceeded", chunks: []string{"user=pooh&", "food=honey&", "drink=water&", "more=food"}, status: 413},
+		}
+		for _, tt := range tests {
+			id := host.InitializeHttpContext()
+			action := host.CallOnRequestHeaders(id, [][2]string{
+				{":path", "/login"},
+				{":method", "POST"},
+				{":authority", "localhost"},
+				{"content-type", "application/x-www-form-urlencoded"},
+			}, false)
+			require.Equal(t, types.ActionContinue, action, tt.name)
+
+			for i, chunk := range tt.chunks {
+				action = host.CallOnRequestBody(id, []byte(chunk), i == len(tt.chunks)-1)
+				if action == types.ActionPause {
+					break
+				}
+				// Each chunk is released upstream, nothing is left buffered
+				require.Equal(t, chunk, string(host.GetCurrentRequestBody(id)), tt.name)
+			}
+			if tt.status == 0 {
+				require.Equal(t, types.ActionContinue, action, tt.name)
+				require.Nil(t, host.GetSentLocalResponse(id), tt.name)
+			} else {
+				require.Equal(t, types.ActionPause, action, tt.name)
+				require.Equal(t, tt.status, host.GetSentLocalResponse(id).StatusCode, tt.name)
+			}
+			host.CompleteHttpContext(id)
+		}
+	})
+}
+
+func TestRequestBodyDecompression(t *testing.T) {
+	gzipped := func(body string) []byte {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, _ = w.Write([]byte(body))
+		_ = w.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name          string
+		encoding      string
+		body          []byte
+		status        uint32
+		failureMetric string
+	}{
+		{name: "legit", encoding: "gzip", body: gzipped("user=pooh&food=honey")},
+		{name: "attack", encoding: "gzip", body: gzipped("user=pooh&pass=hunter2"), status: 403},
+		{name: "identity", body: []byte("user=pooh&pass=hunter2"), status: 403},
+		{name: "unsupported encoding", encoding: "br", body: gzipped("user=pooh&pass=hunter2")},
+		{
+			name:          "decompressed body too large",
+			encoding:      "gzip",
+			body:          gzipped("user=pooh&food=" + strings.Repeat("honey", 100) + "&pass=hunter2"),
+			failureMetric: "waf_filter.tx.failures_class=body_limit_policy=open",
+		},
+		{
+			name:          "corrupt body",
+			encoding:      "gzip",
+			body:          []byte("user=pooh&pass=hunter2"),
+			failureMetric: "waf_filter.tx.failures_class=parse_error_policy=open",
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				conf := `
+				{
+					"directives_map": {
+						"default": [
+							"SecRuleEngine On",
+							"SecRequestBodyAccess On",
+							"SecRule ARGS_POST:pass \"@streq hunter2\" \"id:101,phase:2,deny\""
+						]
+					},
+					"default_directives": "default",
+					"request_body_decompression": {"max_size": 256}
+				}`
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				headers := [][2]string{
+					{":path", "/login"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", "application/x-www-form-urlencoded"},
+				}
+				if tt.encoding != "" {
+					headers = append(headers, [2]string{"content-encoding", tt.encoding})
+				}
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, headers, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				// The body is sent in two chunks, buffered until the end of the stream
+				half := len(tt.body) / 2
+				action = host.CallOnRequestBody(id, tt.body[:half], false)
+				require.Equal(t, types.ActionPause, action)
+				action = host.CallOnRequestBody(id, tt.body[half:], true)
+
+				if tt.status != 0 {
+					require.Equal(t, types.ActionPause, action)
+					require.Equal(t, tt.status, host.GetSentLocalResponse(id).StatusCode)
+					return
+				}
+				require.Equal(t, types.ActionContinue, action)
+				require.Nil(t, host.GetSentLocalResponse(id))
+				// The body is sent upstream still encoded
+				require.Equal(t, tt.body, host.GetCurrentRequestBody(id))
+
+				if tt.failureMetric != "" {
+					value, err := host.GetCounterMetric(tt.failureMetric)
+					require.NoError(t, err)
+					require.Equal(t, uint64(1), value)
+				}
+			})
+		}
+	})
+}
+
+func TestResponseBodyDecompression(t *testing.T) {
+	gzipped := func(body string) []byte {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, _ = w.Write([]byte(body))
+		_ = w.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		leak     bool
+	}{
+		{name: "legit", encoding: "gzip", body: gzipped("Hello, pooh")},
+		{name: "leak", encoding: "gzip", body: gzipped("The password is hunter2"), leak: true},
+		{name: "leak past the maximum size", encoding: "gzip", body: gzipped(strings.Repeat("honey", 100) + "hunter2")},
+		{name: "corrupt body inspected as it is", encoding: "gzip", body: []byte("The password is hunter2"), leak: true},
+		{name: "unsupported encoding", encoding: "br", body: gzipped(strings.Repeat("The password is hunter2. ", 10))},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				conf := `
+				{
+					"directives_map": {
+						"default": [
+							"SecRuleEngine On",
+							"SecResponseBodyAccess On",
+							"SecResponseBodyMimeType text/plain",
+							"SecRule RESPONSE_BODY \"@contains hunter2\" \"id:101,phase:4,deny\""
+						]
+					},
+					"default_directives": "default",
+					"response_body_decompression": {"max_size": 256}
+				}`
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true)
+				require.Equal(t, types.ActionContinue, action)
+
+				action = host.CallOnResponseHeaders(id, [][2]string{
+					{":status", "200"},
+					{"content-type", "text/plain"},
+					{"content-encoding", tt.encoding},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				// The body is sent in two chunks, buffered until the end of the stream
+				half := len(tt.body) / 2
+				action = host.CallOnResponseBody(id, tt.body[:half], false)
+				require.Equal(t, types.ActionPause, action)
+				action = host.CallOnResponseBody(id, tt.body[half:], true)
+				require.Equal(t, types.ActionContinue, action)
+
+				if tt.leak {
+					require.Equal(t, make([]byte, len(tt.body)), host.GetCurrentResponseBody(id))
+				} else {
+					// The body is sent downstream still encoded
+					require.Equal(t, tt.body, host.GetCurrentResponseBody(id))
+				}
+			})
+		}
+	})
+}
+
+func TestMultipartFiles(t *testing.T) {
+	part := func(name, filename, content string) string {
+		disposition := fmt.Sprintf("form-data; name=%q", name)
+		if filename != "" {
+			disposition += fmt.Sprintf("; filename=%q", filename)
+		}
+		return "--x\r\nContent-Disposition: " + disposition + "\r\n\r\n" + content + "\r\n"
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status uint32
+	}{
+		{name: "legit upload", body: part("user", "", "pooh") + part("avatar", "pooh.png", "honey") + "--x--\r\n"},
+		{name: "forbidden extension", body: part("avatar", "shell.php", "<?php") + "--x--\r\n", status: 401},
+		{name: "file too large", body: part("avatar", "pooh.png", strings.Repeat("honey", 10)) + "--x--\r\n", status: 402},
+		{name: "too many files", body: part("a", "a.png", "a") + part("b", "b.png", "b") + part("c", "c.png", "c") + "--x--\r\n", status: 403},
+		{name: "data after the closing boundary", body: part("user", "", "pooh") + "--x--\r\nhidden", status: 403},
+		{name: "field too large", body: part("user", "", strings.Repeat("pooh", 10)) + "--x--\r\n", status: 403},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				conf := `
+				{
+					"directives_map": {
+						"default": [
+							"SecRuleEngine On",
+							"SecRequestBodyAccess On",
+							"SecRule FILES \"@rx \\.php$\" \"id:101,phase:2,deny,status:401\"",
+							"SecRule FILES_SIZES \"@gt 32\" \"id:102,phase:2,deny,status:402\"",
+							"SecRule TX:multipart_strict_error \"!@eq 0\" \"id:103,phase:2,deny,status:403\""
+						]
+					},
+					"default_directives": "default",
+					"multipart": {"max_part_size": 16, "max_files": 2}
+				}`
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/upload"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", "multipart/form-data; boundary=x"},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				action = host.CallOnRequestBody(id, []byte(tt.body), true)
+				if tt.status == 0 {
+					require.Equal(t, types.ActionContinue, action)
+					require.Nil(t, host.GetSentLocalResponse(id))
+					return
+				}
+				require.Equal(t, types.ActionPause, action)
+				require.Equal(t, tt.status, host.GetSentLocalResponse(id).StatusCode)
+			})
+		}
+	})
+}
+
+func TestJSONBodyArgs(t *testing.T) {
+	jsonConfig := `, "json": {"max_depth": 3, "max_elements": 4, "reject_invalid": true}`
+	tests := []struct {
+		name   string
+		json   string
+		body   string
+		status uint32
+	}{
+		{name: "legit", json: jsonConfig, body: `{"user": {"name": "pooh", "roles": ["reader"]}}`},
+		{name: "deep injection", json: jsonConfig, body: `{"user": {"name": "pooh", "roles": ["reader", {"scope": "1' OR '1'='1"}]}}`, status: 403},
+		{name: "injection past the maximum depth", json: jsonConfig, body: `{"a": {"b": {"c": {"d": "1' OR '1'='1"}}}}`, status: 403},
+		{name: "too many elements", json: jsonConfig, body: `{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5}`, status: 413},
+		{name: "invalid body", json: jsonConfig, body: `{"user": `, status: 400},
+		// Accepted by Coraza, which flattens what it can parse
+		{name: "invalid body without json", body: `{"user": "pooh",}`},
+		{name: "injection in an invalid body without json", body: `{"user": "1' OR '1'='1",}`, status: 403},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {
+						"default": [
+							"SecRuleEngine On",
+							"SecRequestBodyAccess On",
+							"SecRule REQUEST_HEADERS:Content-Type \"^application/json\" \"id:100,phase:1,pass,nolog,ctl:requestBodyProcessor=JSON\"",
+							"SecRule REQBODY_ERROR \"!@eq 0\" \"id:101,phase:2,deny,status:400\"",
+							"SecRule ARGS \"@contains ' OR '\" \"id:102,phase:2,deny,status:403\"",
+							"SecRule TX:json_limit_exceeded \"@eq 1\" \"id:103,phase:2,deny,status:413\""
+						]
+					},
+					"default_directives": "default"%s
+				}`, tt.json)
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/api"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", "application/json"},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				action = host.CallOnRequestBody(id, []byte(tt.body), true)
+				if tt.status == 0 {
+					require.Equal(t, types.ActionContinue, action)
+					require.Nil(t, host.GetSentLocalResponse(id))
+					return
+				}
+				require.Equal(t, types.ActionPause, action)
+				require.Equal(t, tt.status, host.GetSentLocalResponse(id).StatusCode)
+			})
+		}
+	})
+}
+
+func TestXMLBodyPaths(t *testing.T) {
+	envelope := func(login string) string {
+		return `<?xml version="1.0"?><soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">` +
+			`<soap:Body>` + login + `</soap:Body></soap:Envelope>`
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status uint32
+	}{
+		{name: "legit", body: envelope(`<login><user>pooh</user></login>`)},
+		{name: "injection in the addressed element", body: envelope(`<login><user>admin'--</user></login>`), status: 401},
+		{name: "injection in any attribute", body: envelope(`<login role="admin'--"><user>pooh</user></login>`), status: 403},
+		{name: "entity declaration", body: `<?xml version="1.0"?><!DOCTYPE x [<!ENTITY a "admin'--">]><x>&a;</x>`, status: 400},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				conf := `
+				{
+					"directives_map": {
+						"default": [
+							"SecRuleEngine On",
+							"SecRequestBodyAccess On",
+							"SecRule REQUEST_HEADERS:Content-Type \"^text/xml\" \"id:100,phase:1,pass,nolog,ctl:requestBodyProcessor=XML\"",
+							"SecRule REQBODY_ERROR \"!@eq 0\" \"id:101,phase:2,deny,status:400\"",
+							"SecRule XML:/Envelope/Body/login/user \"@contains '--\" \"id:102,phase:2,deny,status:401\"",
+							"SecRule XML://@* \"@contains '--\" \"id:103,phase:2,deny,status:403\""
+						]
+					},
+					"default_directives": "default"
+				}`
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/soap"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", "text/xml"},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				action = host.CallOnRequestBody(id, []byte(tt.body), true)
+				if tt.status == 0 {
+					require.Equal(t, types.ActionContinue, action)
+					require.Nil(t, host.GetSentLocalResponse(id))
+					return
+				}
+				require.Equal(t, types.ActionPause, action)
+				require.Equal(t, tt.status, host.GetSentLocalResponse(id).StatusCode)
+			})
+		}
+	})
+}
+
+func TestGRPCBody(t *testing.T) {
+	// grpcMessage frames a message whose field 1 is the string user
+	grpcMessage := func(user string) []byte {
+		message := append([]byte{0x0a, byte(len(user))}, user...)
+		return append([]byte{0, 0, 0, 0, byte(len(message))}, message...)
+	}
+
+	tests := []struct {
+		name   string
+		body   []byte
+		status uint32
+	}{
+		{name: "legit", body: grpcMessage("pooh")},
+		{name: "injection", body: grpcMessage("admin'--"), status: 403},
+		{name: "truncated frame", body: grpcMessage("pooh")[:6], status: 400},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				conf := `
+				{
+					"directives_map": {
+						"default": [
+							"SecRuleEngine On",
+							"SecRequestBodyAccess On",
+							"SecRule REQBODY_ERROR \"!@eq 0\" \"id:101,phase:2,deny,status:400\"",
+							"SecRule ARGS:grpc.1 \"@contains '--\" \"id:102,phase:2,deny,status:403\""
+						]
+					},
+					"default_directives": "default",
+					"grpc": {}
+				}`
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/shop.Auth/SignIn"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", "application/grpc"},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				action = host.CallOnRequestBody(id, tt.body, true)
+				if tt.status == 0 {
+					require.Equal(t, types.ActionContinue, action)
+					require.Nil(t, host.GetSentLocalResponse(id))
+					return
+				}
+				require.Equal(t, types.ActionPause, action)
+				require.Equal(t, tt.status, host.GetSentLocalResponse(id).StatusCode)
+			})
+		}
+	})
+}
+
+func TestGraphQLBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		body        string
+		recommended bool
+		status      uint32
+	}{
+		{
+			name:        "legit",
+			path:        "/graphql",
+			contentType: "application/json",
+			body:        `{"query": "query User($id: ID!) { user(id: $id) { name } }", "variables": {"id": "1"}}`,
+		},
+		{
+			name:        "injection in variables",
+			path:        "/graphql",
+			contentType: "application/json",
+			body:        `{"query": "query User($id: ID!) { user(id: $id) { name } }", "variables": {"id": "1'--"}}`,
+			status:      403,
+		},
+		{
+			name:        "injection in arguments",
+			path:        "/graphql?debug=1",
+			contentType: "application/graphql",
+			body:        `{ user(id: "1'--") { name } }`,
+			status:      403,
+		},
+		{
+			name:        "too deep",
+			path:        "/graphql",
+			contentType: "application/json",
+			body:        `{"query": "{ user { friends { friends { name } } } }"}`,
+			status:      400,
+		},
+		{
+			name:        "invalid query",
+			path:        "/graphql",
+			contentType: "application/json",
+			body:        `{"query": "{ user { name }"}`,
+			status:      400,
+		},
+		{
+			// Rule 200001 of @recommended-conf selects the JSON body processor in phase 1
+			name:        "too deep with the recommended configuration",
+			path:        "/graphql",
+			contentType: "application/json",
+			body:        `{"query": "{ user { friends { friends { name } } } }"}`,
+			recommended: true,
+			status:      400,
+		},
+		{
+			name:        "injection in variables with the recommended configuration",
+			path:        "/graphql",
+			contentType: "application/json",
+			body:        `{"query": "query User($id: ID!) { user(id: $id) { name } }", "variables": {"id": "1'--"}}`,
+			recommended: true,
+			status:      403,
+		},
+		{
+			name:        "other path",
+			path:        "/api",
+			contentType: "application/json",
+			body:        `{"query": "{ user { friends { friends { name } } } }"}`,
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				recommended := ""
+				if tt.recommended {
+					recommended = `"Include @recommended-conf",`
+				}
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {
+						"default": [
+							%s
+							"SecRuleEngine On",
+							"SecRequestBodyAccess On",
+							"SecRule REQBODY_ERROR \"!@eq 0\" \"id:101,phase:2,deny,status:400\"",
+							"SecRule ARGS:/^graphql\\.(variables|arguments)/ \"@contains '--\" \"id:102,phase:2,deny,status:403\""
+						]
+					},
+					"default_directives": "default",
+					"graphql": {"max_depth": 3}
+				}`, recommended)
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", tt.path},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", tt.contentType},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				action = host.CallOnRequestBody(id, []byte(tt.body), true)
+				if tt.status == 0 {
+					require.Equal(t, types.ActionContinue, action)
+					require.Nil(t, host.GetSentLocalResponse(id))
+					return
+				}
+				require.Equal(t, types.ActionPause, action)
+				require.Equal(t, tt.status, host.GetSentLocalResponse(id).StatusCode)
+			})
+		}
+	})
+}
+
+func TestTrailers(t *testing.T) {
+	conf := `
+	{
+		"directives_map": {
+			"default": [
+				"SecRuleEngine On",
+				"SecRequestBodyAccess On",
+				"SecResponseBodyAccess On",
+				"SecResponseBodyMimeType text/plain",
+				"SecRule TX:request_trailer_x-checksum \"@streq bad\" \"id:101,phase:2,deny,status:401\"",
+				"SecRule REQUEST_BODY \"@contains evil\" \"id:102,phase:2,deny,status:403\"",
+				"SecRule TX:response_trailer_grpc-status \"@eq 13\" \"id:103,phase:4,deny\"",
+				"SecRule RESPONSE_BODY \"@contains secret\" \"id:104,phase:4,deny\""
+			]
+		},
+		"default_directives": "default"
+	}`
+
+	requestTests := []struct {
+		name     string
+		body     string
+		trailers [][2]string
+		status   uint32
+	}{
+		{name: "legit", body: "q=hello", trailers: [][2]string{{"x-checksum", "good"}}},
+		{name: "denied trailer", body: "q=hello", trailers: [][2]string{{"x-checksum", "bad"}}, status: 401},
+		{name: "body inspected at trailers", body: "q=evil", trailers: [][2]string{{"x-checksum", "good"}}, status: 403},
+	}
+
+	responseTests := []struct {
+		name     string
+		body     string
+		trailers [][2]string
+		leak     bool
+	}{
+		{name: "legit", body: "hello", trailers: [][2]string{{"grpc-status", "0"}}},
+		{name: "denied trailer", body: "hello", trailers: [][2]string{{"grpc-status", "13"}}, leak: true},
+		{name: "body inspected at trailers", body: "secret", trailers: [][2]string{{"grpc-status", "0"}}, leak: true},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tt := range requestTests {
+			t.Run("request "+tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", "application/x-www-form-urlencoded"},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				// The body does not end the stream, the trailers do
+				action = host.CallOnRequestBody(id, []byte(tt.body), false)
+				require.Equal(t, types.ActionPause, action)
+
+				action = host.CallOnRequestTrailers(id, tt.trailers)
+				if tt.status == 0 {
+					require.Equal(t, types.ActionContinue, action)
+					require.Nil(t, host.GetSentLocalResponse(id))
+					return
+				}
+				require.Equal(t, types.ActionPause, action)
+				require.Equal(t, tt.status, host.GetSentLocalResponse(id).StatusCode)
+			})
+		}
+
+		for _, tt := range responseTests {
+			t.Run("response "+tt.name, func(t *testing.T) {
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/"},
+					{":method", "GET"},
+					{":authority", "localhost"},
+				}, true)
+				require.Equal(t, types.ActionContinue, action)
+
+				action = host.CallOnResponseHeaders(id, [][2]string{
+					{":status", "200"},
+					{"content-type", "text/plain"},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				action = host.CallOnResponseBody(id, []byte(tt.body), false)
+				require.Equal(t, types.ActionPause, action)
+
+				action = host.CallOnResponseTrailers(id, tt.trailers)
+				require.Equal(t, types.ActionContinue, action)
+				if tt.leak {
+					require.Equal(t, make([]byte, len(tt.body)), host.GetCurrentResponseBody(id))
+				} else {
+					require.Equal(t, tt.body, string(host.GetCurrentResponseBody(id)))
+				}
+			})
+		}
+	})
+}
+
+func TestBodyProcessorsMapping(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      uint32
+	}{
+		{
+			name:        "json as text/plain",
+			contentType: "text/plain; charset=utf-8",
+			body:        `{"user": {"name": "1'--"}}`,
+			status:      403,
+		},
+		{
+			name:        "json as vendor type",
+			contentType: "application/vnd.example+json",
+			body:        `{"user": {"name": "1'--"}}`,
+			status:      403,
+		},
+		{
+			name:        "invalid json as text/plain",
+			contentType: "text/plain",
+			body:        `{"user": `,
+			status:      400,
+		},
+		{
+			name:        "unmapped content type",
+			contentType: "text/csv",
+			body:        `{"user": {"name": "1'--"}}`,
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				conf := `
+				{
+					"directives_map": {
+						"default": [
+							"SecRuleEngine On",
+							"SecRequestBodyAccess On",
+							"SecRule REQBODY_ERROR \"!@eq 0\" \"id:101,phase:2,deny,status:400\"",
+							"SecRule ARGS:json.user.name \"@contains '--\" \"id:102,phase:2,deny,status:403\""
+						]
+					},
+					"default_directives": "default",
+					"body_processors": {"text/plain": "JSON", "application/vnd.*+json": "JSON"},
+					"json": {"reject_invalid": true}
+				}`
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/api"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", tt.contentType},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				action = host.CallOnRequestBody(id, []byte(tt.body), true)
+				if tt.status == 0 {
+					require.Equal(t, types.ActionContinue, action)
+					require.Nil(t, host.GetSentLocalResponse(id))
+					return
+				}
+				require.Equal(t, types.ActionPause, action)
+				require.Equal(t, tt.status, host.GetSentLocalResponse(id).StatusCode)
+			})
+		}
+	})
+}
+
+func TestMsgpackAndCBORBodies(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      uint32
+	}{
+		{
+			name:        "msgpack legit",
+			contentType: "application/msgpack",
+			body:        "\x81\xa4user\x81\xa4name\xa4pooh",
+		},
+		{
+			name:        "msgpack injection",
+			contentType: "application/msgpack",
+			body:        "\x81\xa4user\x81\xa4name\xa41'--",
+			status:      403,
+		},
+		{
+			name:        "cbor injection",
+			contentType: "application/cbor",
+			body:        "\xa1\x64user\xa1\x64name\x641'--",
+			status:      403,
+		},
+		{
+			name:        "invalid cbor",
+			contentType: "application/cbor",
+			body:        "\xa1\x64user",
+			status:      400,
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				conf := `
+				{
+					"directives_map": {
+						"default": [
+							"SecRuleEngine On",
+							"SecRequestBodyAccess On",
+							"SecRule REQBODY_ERROR \"!@eq 0\" \"id:101,phase:2,deny,status:400\"",
+							"SecRule ARGS:/\\.user\\.name$/ \"@contains '--\" \"id:102,phase:2,deny,status:403\""
+						]
+					},
+					"default_directives": "default",
+					"body_processors": {"application/msgpack": "MSGPACK", "application/cbor": "CBOR"}
+				}`
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/api"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", tt.contentType},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				action = host.CallOnRequestBody(id, []byte(tt.body), true)
+				if tt.status == 0 {
+					require.Equal(t, types.ActionContinue, action)
+					require.Nil(t, host.GetSentLocalResponse(id))
+					return
+				}
+				require.Equal(t, types.ActionPause, action)
+				require.Equal(t, tt.status, host.GetSentLocalResponse(id).StatusCode)
+			})
+		}
+	})
+}
+
+func TestURLEncodedNestedFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status uint32
+	}{
+		{name: "legit", body: "user[roles][]=reader&user[roles][]=writer"},
+		{name: "appended index", body: "user[roles][]=reader&user[roles][]=admin", status: 403},
+		{name: "normalized name", body: "user.role=admin", status: 403},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				conf := `
+				{
+					"directives_map": {
+						"default": [
+							"SecRuleEngine On",
+							"SecRequestBodyAccess On",
+							"SecRule ARGS:user[roles][1]|ARGS:user_role \"@streq admin\" \"id:101,phase:2,deny,status:403\""
+						]
+					},
+					"default_directives": "default",
+					"urlencoded": {"nested_fields": true}
+				}`
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/api"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", "application/x-www-form-urlencoded"},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				action = host.CallOnRequestBody(id, []byte(tt.body), true)
+				if tt.status == 0 {
+					require.Equal(t, types.ActionContinue, action)
+					require.Nil(t, host.GetSentLocalResponse(id))
+					return
+				}
+				require.Equal(t, types.ActionPause, action)
+				require.Equal(t, tt.status, host.GetSentLocalResponse(id).StatusCode)
+			})
+		}
+	})
+}
+
+func TestCharsetConversion(t *testing.T) {
+	shiftJIS, err := japanese.ShiftJIS.NewEncoder().String("name=テスト")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		contentType   string
+		body          string
+		status        uint32
+		failureMetric string
+	}{
+		{
+			name:        "shift_jis",
+			contentType: "application/x-www-form-urlencoded; charset=Shift_JIS",
+			body:        shiftJIS,
+			status:      403,
+		},
+		{
+			name:        "default charset",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "name=caf\xe9",
+			status:      403,
+		},
+		{
+			name:        "utf-8",
+			contentType: "application/x-www-form-urlencoded; charset=utf-8",
+			body:        "name=user",
+		},
+		{
+			name:          "invalid body",
+			contentType:   "application/x-www-form-urlencoded; charset=Shift_JIS",
+			body:          "name=\x83 ",
+			status:        400,
+			failureMetric: "waf_filter.tx.charset_failures_reason=invalid",
+		},
+		{
+			name:          "unsupported charset",
+			contentType:   "application/x-www-form-urlencoded; charset=utf-7",
+			body:          "name=user",
+			status:        400,
+			failureMetric: "waf_filter.tx.charset_failures_reason=unsupported",
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				conf := `
+				{
+					"directives_map": {
+						"default": [
+							"SecRuleEngine On",
+							"SecRequestBodyAccess On",
+							"SecRule TX:charset_conversion_error \"@eq 1\" \"id:101,phase:2,deny,status:400\"",
+							"SecRule ARGS:name \"@rx ^(テスト|café)$\" \"id:102,phase:2,deny,status:403\""
+						]
+					},
+					"default_directives": "default",
+					"charset_conversion": {"default_charset": "iso-8859-1"},
+					"body_processors": {"application/x-www-form-urlencoded": "URLENCODED"}
+				}`
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/api"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", tt.contentType},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				action = host.CallOnRequestBody(id, []byte(tt.body), true)
+				if tt.failureMetric != "" {
+					value, err := host.GetCounterMetric(tt.failureMetric)
+					require.NoError(t, err)
+					require.Equal(t, uint64(1), value)
+				}
+				if tt.status == 0 {
+					require.Equal(t, types.ActionContinue, action)
+					require.Nil(t, host.GetSentLocalResponse(id))
+					return
+				}
+				require.Equal(t, types.ActionPause, action)
+				require.Equal(t, tt.status, host.GetSentLocalResponse(id).StatusCode)
+			})
+		}
+	})
+}
+
+func TestBodyLimitAction(t *testing.T) {
+	tests := []struct {
+		name          string
+		engine        string
+		limitAction   string
+		failurePolicy string
+		chunks        []string
+		status        uint32
+		responseBody  string
+	}{
+		{
+			name:        "reject at the limit",
+			engine:      "On",
+			limitAction: "Reject",
+			chunks:      []string{"user=pooh&", "food=honey&", "drink=water"},
+			status:      413,
+		},
+		{
+			name:         "reject not enforced in detection only",
+			engine:       "DetectionOnly",
+			limitAction:  "Reject",
+			chunks:       []string{"user=pooh&", "food=honey&", "drink=water"},
+			responseBody: "The password is hunter2",
+		},
+		{
+			name:          "request denied by the failure policy in detection only",
+			engine:        "DetectionOnly",
+			limitAction:   "Reject",
+			failurePolicy: "closed",
+			chunks:        []string{"user=pooh&", "food=honey&", "drink=water"},
+			status:        413,
+		},
+		{
+			name:          "response not denied by the failure policy in detection only",
+			engine:        "DetectionOnly",
+			limitAction:   "Reject",
+			failurePolicy: "closed",
+			chunks:        []string{"user=pooh"},
+			responseBody:  "The password is hunter2",
+		},
+		{
+			name:        "partial body inspected",
+			engine:      "On",
+			limitAction: "ProcessPartial",
+			chunks:      []string{"user=pooh&", "pass=x&", "drink=water"},
+			status:      401,
+		},
+		{
+			name:        "partial body flagged",
+			engine:      "On",
+			limitAction: "ProcessPartial",
+			chunks:      []string{"user=pooh&", "food=honey&", "drink=water"},
+			status:      402,
+		},
+	}
+
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				failurePolicy := tt.failurePolicy
+				if failurePolicy == "" {
+					failurePolicy = "open"
+				}
+				conf := fmt.Sprintf(`
+				{
+					"directives_map": {
+						"default": [
+							"SecRuleEngine %s",
+							"SecRequestBodyAccess On",
+							"SecRequestBodyLimit 20",
+							"SecRequestBodyLimitAction %s",
+							"SecResponseBodyAccess On",
+							"SecResponseBodyMimeType text/plain",
+							"SecResponseBodyLimit 8",
+							"SecResponseBodyLimitAction %s",
+							"SecRule ARGS_POST:pass \"@streq x\" \"id:101,phase:2,deny,status:401\"",
+							"SecRule INBOUND_DATA_ERROR \"@eq 1\" \"id:102,phase:2,deny,status:402\""
+						]
+					},
+					"default_directives": "default",
+					"failure_policy": {"body_limit": %q}
+				}`, tt.engine, tt.limitAction, tt.limitAction, failurePolicy)
+				opt := proxytest.
+					NewEmulatorOption().
+					WithVMContext(vm).
+					WithPluginConfiguration([]byte(conf))
+
+				host, reset := proxytest.NewHostEmulator(opt)
+				defer reset()
+
+				require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", "/login"},
+					{":method", "POST"},
+					{":authority", "localhost"},
+					{"content-type", "application/x-www-form-urlencoded"},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+
+				for i, chunk := range tt.chunks {
+					action = host.CallOnRequestBody(id, []byte(chunk), i == len(tt.chunks)-1)
+					if host.GetSentLocalResponse(id) != nil {
+						break
+					}
+				}
+				if tt.status != 0 {
+					require.Equal(t, types.ActionPause, action)
+					require.Equal(t, tt.status, host.GetSentLocalResponse(id).StatusCode)
+					return
+				}
+				require.Equal(t, types.ActionContinue, action)
+				require.Nil(t, host.GetSentLocalResponse(id))
+
+				action = host.CallOnResponseHeaders(id, [][2]string{
+					{":status", "200"},
+					{"content-type", "text/plain"},
+				}, false)
+				require.Equal(t, types.ActionContinue, action)
+				action = host.CallOnResponseBody(id, []byte(tt.responseBody), true)
+				require.Equal(t, types.ActionContinue, action)
+				require.Equal(t, tt.responseBody, string(host.GetCurrentResponseBody(id)))
+			})
+		}
+	})
+}
+
+func TestRuleSetSelection(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {
+				"default": ["SecRuleEngine On", "SecRule REQUEST_URI \"@streq /default\" \"id:101,phase:1,deny\""],
+				"api": ["SecRuleEngine On", "SecRule REQUEST_URI \"@streq /api\" \"id:102,phase:1,deny\""],
+				"strict": ["SecRuleEngine On", "SecRule REQUEST_URI \"@streq /strict\" \"id:103,phase:1,deny\""],
+				"legacy": ["SecRuleEngine On", "SecRule REQUEST_URI \"@streq /legacy\" \"id:104,phase:1,deny\""]
+			},
+			"default_directives": "default",
+			"per_authority_directives": {"legacy.example.com": "legacy"},
+			"per_sni_directives": {"*.api.example.com": "api"},
+			"directives_header": {"name": "x-waf-rule-set", "allowed": ["strict"]}
+		}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		tests := []struct {
+			name       string
+			authority  string
+			serverName string
+			ruleSet    string
+			// deniedPath is the path denied by the selected rule set
+			deniedPath string
+		}{
+			{name: "default", authority: "www.example.com", serverName: "www.example.com", deniedPath: "/default"},
+			{name: "server name", authority: "www.example.com", serverName: "v1.api.example.com", deniedPath: "/api"},
+			{name: "authority over server name", authority: "legacy.example.com", serverName: "v1.api.example.com", deniedPath: "/legacy"},
+			{name: "header", authority: "www.example.com", serverName: "www.example.com", ruleSet: "strict", deniedPath: "/strict"},
+			// The header cannot replace a rule set selected by the stream
+			{name: "header with authority", authority: "legacy.example.com", serverName: "www.example.com", ruleSet: "strict", deniedPath: "/legacy"},
+			{name: "header with server name", authority: "www.example.com", serverName: "v1.api.example.com", ruleSet: "strict", deniedPath: "/api"},
+			{name: "header not allowed", authority: "www.example.com", serverName: "www.example.com", ruleSet: "api", deniedPath: "/default"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				require.NoError(t, host.SetProperty([]string{"connection", "requested_server_name"}, []byte(tt.serverName)))
+				for _, path := range []string{"/default", "/api", "/strict", "/legacy"} {
+					id := host.InitializeHttpContext()
+					headers := [][2]string{
+						{":path", path},
+						{":method", "GET"},
+						{":authority", tt.authority},
+					}
+					if tt.ruleSet != "" {
+						headers = append(headers, [2]string{"x-waf-rule-set", tt.ruleSet})
+					}
+					action := host.CallOnRequestHeaders(id, headers, true)
+					if path == tt.deniedPath {
+						require.Equal(t, types.ActionPause, action, path)
+					} else {
+						require.Equal(t, types.ActionContinue, action, path)
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestPresets(t *testing.T) {
+	vmTest(t, func(t *testing.T, vm types.VMContext) {
+		conf := `
+		{
+			"directives_map": {"default": [
+				"SecRuleEngine On",
+				"SecRuleRemoveById 920350",
+				"SecRule ARGS:arg \"@streq attack\" \"id:101,phase:1,deny\""
+			]},
+			"default_directives": "default",
+			"include_recommended": true,
+			"include_crs": true
+		}`
+		opt := proxytest.
+			NewEmulatorOption().
+			WithVMContext(vm).
+			WithPluginConfiguration([]byte(conf))
+
+		host, reset := proxytest.NewHostEmulator(opt)
+		defer reset()
+
+		require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+		tests := []struct {
+			name           string
+			path           string
+			userAgent      string
+			expectedAction types.Action
+		}{
+			// 920350 (host header is a numeric IP) is excluded
+			{name: "benign", path: "/?arg=value", userAgent: "Mozilla/5.0", expectedAction: types.ActionContinue},
+			{name: "custom rule", path: "/?arg=attack", userAgent: "Mozilla/5.0", expectedAction: types.ActionPause},
+			// 913100, early blocked
+			{name: "crs rule", path: "/", userAgent: "nikto", expectedAction: types.ActionPause},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				id := host.InitializeHttpContext()
+				action := host.CallOnRequestHeaders(id, [][2]string{
+					{":path", tt.path},
+					{":method", "GET"},
+					{":authority", "127.0.0.1"},
+					{"user-agent", tt.userAgent},
+					{"accept", "*/*"},
+				}, true)
+				require.Equal(t, tt.expectedAction, action)
+			})
+		}
 	})
 }
@@ -0,0 +1,89 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Exchange is a recorded request, optionally paired with its response.
+type Exchange struct {
+	Method          string
+	URL             string
+	Protocol        string
+	RequestHeaders  [][2]string
+	RequestBody     []byte
+	StatusCode      int
+	ResponseHeaders [][2]string
+	ResponseBody    []byte
+}
+
+type har struct {
+	Log struct {
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	Request struct {
+		Method      string      `json:"method"`
+		URL         string      `json:"url"`
+		HTTPVersion string      `json:"httpVersion"`
+		Headers     []harHeader `json:"headers"`
+		PostData    *struct {
+			Text string `json:"text"`
+		} `json:"postData"`
+	} `json:"request"`
+	Response *struct {
+		Status  int         `json:"status"`
+		Headers []harHeader `json:"headers"`
+		Content struct {
+			Text string `json:"text"`
+		} `json:"content"`
+	} `json:"response"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func harHeaders(hs []harHeader) [][2]string {
+	headers := make([][2]string, 0, len(hs))
+	for _, h := range hs {
+		headers = append(headers, [2]string{h.Name, h.Value})
+	}
+	return headers
+}
+
+// LoadHAR reads the exchanges recorded in a HAR (HTTP Archive) file.
+func LoadHAR(r io.Reader) ([]Exchange, error) {
+	var h har
+	if err := json.NewDecoder(r).Decode(&h); err != nil {
+		return nil, fmt.Errorf("invalid HAR: %v", err)
+	}
+
+	exchanges := make([]Exchange, 0, len(h.Log.Entries))
+	for _, e := range h.Log.Entries {
+		ex := Exchange{
+			Method:         e.Request.Method,
+			URL:            e.Request.URL,
+			Protocol:       e.Request.HTTPVersion,
+			RequestHeaders: harHeaders(e.Request.Headers),
+		}
+		if e.Request.PostData != nil {
+			ex.RequestBody = []byte(e.Request.PostData.Text)
+		}
+		// Entries of aborted requests have no response status
+		if e.Response != nil && e.Response.Status > 0 {
+			ex.StatusCode = e.Response.Status
+			ex.ResponseHeaders = harHeaders(e.Response.Headers)
+			ex.ResponseBody = []byte(e.Response.Content.Text)
+		}
+		exchanges = append(exchanges, ex)
+	}
+	return exchanges, nil
+}
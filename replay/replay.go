@@ -0,0 +1,197 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+// Package replay replays recorded traffic through the plugin, natively linked and
+// loaded in the proxy-wasm host emulator, reporting the rules matched and the requests
+// that would have been blocked. It allows to tune rules against production captures
+// without running a proxy.
+package replay
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/auditlog"
+	"github.com/corazawaf/coraza-proxy-wasm/wasmplugin"
+)
+
+// Result is the outcome of the replay of an exchange.
+type Result struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	// Blocked is true if the exchange would have been interrupted, in which case
+	// Phase and StatusCode describe the interruption.
+	Blocked    bool   `json:"blocked"`
+	Phase      string `json:"phase,omitempty"`
+	StatusCode int    `json:"status_code,omitempty"`
+	// RuleIDs are the IDs of the logged rules matched by the exchange.
+	RuleIDs []int `json:"rule_ids"`
+}
+
+// Replayer replays exchanges through a plugin instance.
+type Replayer struct {
+	host  proxytest.HostEmulator
+	reset func()
+	// logsRead is the number of logs already collected per level.
+	logsRead map[string]int
+	// lastLogs are the logs emitted by the last replayed exchange.
+	lastLogs []string
+}
+
+// New starts a plugin instance with the given plugin configuration. Only one Replayer
+// can be used at a time, as they share the host emulator.
+func New(pluginConfig []byte) (*Replayer, error) {
+	auditlog.RegisterProxyWasmSerialWriter()
+
+	opt := proxytest.
+		NewEmulatorOption().
+		WithVMContext(wasmplugin.NewVMContext()).
+		WithPluginConfiguration(pluginConfig)
+	host, reset := proxytest.NewHostEmulator(opt)
+
+	if status := host.StartPlugin(); status != types.OnPluginStartStatusOK {
+		logs := host.GetCriticalLogs()
+		reset()
+		return nil, fmt.Errorf("failed to start plugin: %s", strings.Join(logs, "; "))
+	}
+	return &Replayer{host: host, reset: reset, logsRead: map[string]int{}}, nil
+}
+
+// Logs returns the plugin logs emitted by the last replayed exchange.
+func (r *Replayer) Logs() []string {
+	return r.lastLogs
+}
+
+// CounterMetric returns the value of the counter defined by the plugin.
+func (r *Replayer) CounterMetric(name string) (uint64, error) {
+	return r.host.GetCounterMetric(name)
+}
+
+// Close releases the plugin instance.
+func (r *Replayer) Close() {
+	r.reset()
+}
+
+// Replay replays an exchange, the response phases being skipped if no response has
+// been recorded or if the request would have been blocked.
+func (r *Replayer) Replay(e Exchange) (Result, error) {
+	res := Result{Method: e.Method, URL: e.URL}
+
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return res, fmt.Errorf("invalid URL %q: %v", e.URL, err)
+	}
+	requestHeaders := [][2]string{
+		{":method", e.Method},
+		{":path", u.RequestURI()},
+		{":authority", u.Host},
+		{":scheme", u.Scheme},
+	}
+	requestHeaders = append(requestHeaders, regularHeaders(e.RequestHeaders)...)
+
+	id := r.host.InitializeHttpContext()
+	defer r.host.CompleteHttpContext(id)
+
+	if e.Protocol != "" {
+		_ = r.host.SetProperty([]string{"request", "protocol"}, []byte(e.Protocol))
+	}
+
+	steps := []step{
+		{"http_request_headers", func() types.Action {
+			return r.host.CallOnRequestHeaders(id, requestHeaders, len(e.RequestBody) == 0)
+		}},
+	}
+	if len(e.RequestBody) > 0 {
+		steps = append(steps, step{"http_request_body", func() types.Action {
+			return r.host.CallOnRequestBody(id, e.RequestBody, true)
+		}})
+	}
+	if e.StatusCode > 0 {
+		responseHeaders := append([][2]string{{":status", strconv.Itoa(e.StatusCode)}}, regularHeaders(e.ResponseHeaders)...)
+		steps = append(steps, step{"http_response_headers", func() types.Action {
+			return r.host.CallOnResponseHeaders(id, responseHeaders, len(e.ResponseBody) == 0)
+		}})
+		if len(e.ResponseBody) > 0 {
+			steps = append(steps, step{"http_response_body", func() types.Action {
+				return r.host.CallOnResponseBody(id, e.ResponseBody, true)
+			}})
+		}
+	}
+
+	for _, s := range steps {
+		s.call()
+		if resp := r.host.GetSentLocalResponse(id); resp != nil {
+			res.Blocked = true
+			res.Phase = s.phase
+			res.StatusCode = int(resp.StatusCode)
+			break
+		}
+		// Response headers are already sent when the response body is inspected,
+		// an interruption replaces the body instead.
+		if s.phase == "http_response_body" && !bytes.Equal(r.host.GetCurrentResponseBody(id), e.ResponseBody) {
+			res.Blocked = true
+			res.Phase = s.phase
+			res.StatusCode = e.StatusCode
+		}
+	}
+
+	res.RuleIDs = r.matchedRuleIDs()
+	return res, nil
+}
+
+// step is a phase of the exchange replay.
+type step struct {
+	phase string
+	call  func() types.Action
+}
+
+// regularHeaders filters out the pseudo-headers, built from the recorded request line.
+func regularHeaders(headers [][2]string) [][2]string {
+	var hs [][2]string
+	for _, h := range headers {
+		if !strings.HasPrefix(h[0], ":") {
+			hs = append(hs, [2]string{strings.ToLower(h[0]), h[1]})
+		}
+	}
+	return hs
+}
+
+var ruleIDRegex = regexp.MustCompile(`\[id "(\d+)"\]`)
+
+// matchedRuleIDs collects the IDs of the rules reported by the match logs emitted since
+// the previous call.
+func (r *Replayer) matchedRuleIDs() []int {
+	ids := []int{}
+	seen := map[int]struct{}{}
+	r.lastLogs = nil
+	for level, get := range map[string]func() []string{
+		"debug":    r.host.GetDebugLogs,
+		"info":     r.host.GetInfoLogs,
+		"warn":     r.host.GetWarnLogs,
+		"error":    r.host.GetErrorLogs,
+		"critical": r.host.GetCriticalLogs,
+	} {
+		logs := get()
+		for _, l := range logs[r.logsRead[level]:] {
+			r.lastLogs = append(r.lastLogs, l)
+			for _, m := range ruleIDRegex.FindAllStringSubmatch(l, -1) {
+				id, _ := strconv.Atoi(m[1])
+				if _, ok := seen[id]; !ok {
+					seen[id] = struct{}{}
+					ids = append(ids, id)
+				}
+			}
+		}
+		r.logsRead[level] = len(logs)
+	}
+	sort.Ints(ids)
+	return ids
+}
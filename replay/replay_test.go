@@ -0,0 +1,79 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package replay
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testHAR = `
+{
+	"log": {
+		"entries": [
+			{
+				"request": {"method": "GET", "url": "http://localhost/anything?arg=1", "httpVersion": "HTTP/1.1", "headers": [{"name": "User-Agent", "value": "curl"}]},
+				"response": {"status": 200, "headers": [], "content": {"text": "hello"}}
+			},
+			{
+				"request": {"method": "GET", "url": "http://localhost/admin", "httpVersion": "HTTP/1.1", "headers": []},
+				"response": {"status": 200, "headers": [], "content": {"text": "hello"}}
+			},
+			{
+				"request": {
+					"method": "POST", "url": "http://localhost/anything", "httpVersion": "HTTP/1.1",
+					"headers": [{"name": "Content-Type", "value": "application/x-www-form-urlencoded"}],
+					"postData": {"text": "q=suspicious"}
+				},
+				"response": {"status": 200, "headers": [], "content": {"text": "hello"}}
+			},
+			{
+				"request": {"method": "GET", "url": "http://localhost/leak", "httpVersion": "HTTP/1.1", "headers": []},
+				"response": {"status": 200, "headers": [{"name": "Content-Type", "value": "text/plain"}], "content": {"text": "secret"}}
+			}
+		]
+	}
+}
+`
+
+func TestReplay(t *testing.T) {
+	exchanges, err := LoadHAR(strings.NewReader(testHAR))
+	require.NoError(t, err)
+	require.Len(t, exchanges, 4)
+
+	r, err := New([]byte(`
+	{
+		"directives_map": {"default": [
+			"SecRuleEngine On",
+			"SecRequestBodyAccess On",
+			"SecResponseBodyAccess On",
+			"SecResponseBodyMimeType text/plain",
+			"SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,log,deny\"",
+			"SecRule ARGS_POST \"@contains suspicious\" \"id:102,phase:2,log,pass\"",
+			"SecRule RESPONSE_BODY \"@contains secret\" \"id:103,phase:4,log,deny\""
+		]},
+		"default_directives": "default"
+	}`))
+	require.NoError(t, err)
+	defer r.Close()
+
+	expected := []Result{
+		{Method: "GET", URL: "http://localhost/anything?arg=1", RuleIDs: []int{}},
+		{Method: "GET", URL: "http://localhost/admin", Blocked: true, Phase: "http_request_headers", StatusCode: 403, RuleIDs: []int{101}},
+		{Method: "POST", URL: "http://localhost/anything", RuleIDs: []int{102}},
+		{Method: "GET", URL: "http://localhost/leak", Blocked: true, Phase: "http_response_body", StatusCode: 200, RuleIDs: []int{103}},
+	}
+	for i, e := range exchanges {
+		res, err := r.Replay(e)
+		require.NoError(t, err)
+		require.Equal(t, expected[i], res)
+	}
+}
+
+func TestNewInvalidConfiguration(t *testing.T) {
+	_, err := New([]byte(`{"directives_map": {"default": ["SecRuleEngine Maybe"]}, "default_directives": "default"}`))
+	require.Error(t, err)
+}
@@ -0,0 +1,12 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !benchmark
+
+package wasmplugin
+
+import "github.com/corazawaf/coraza/v3"
+
+func runBenchmark(string, coraza.WAF) {
+	// no-op without build tag
+}
@@ -0,0 +1,132 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build benchmark
+
+package wasmplugin
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+// benchmarkCorpora holds the requests replayed through each rule set at plugin start,
+// one per line as "<method> <uri>[ <urlencoded body>]".
+//
+//go:embed benchmark/*.txt
+var benchmarkCorpora embed.FS
+
+// benchmarkIterations is the number of times each corpus is replayed.
+const benchmarkIterations = 10
+
+// runBenchmark replays the embedded corpora through the rule set and reports the
+// throughput, the allocations and the GC cycles per corpus.
+func runBenchmark(name string, waf coraza.WAF) {
+	entries, err := benchmarkCorpora.ReadDir("benchmark")
+	if err != nil {
+		proxywasm.LogErrorf("Failed to read benchmark corpora: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		corpus, err := benchmarkCorpora.ReadFile("benchmark/" + entry.Name())
+		if err != nil {
+			proxywasm.LogErrorf("Failed to read benchmark corpus %q: %v", entry.Name(), err)
+			continue
+		}
+		requests := parseBenchmarkCorpus(corpus)
+
+		before := runtime.MemStats{}
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		interrupted := 0
+		for i := 0; i < benchmarkIterations; i++ {
+			for _, r := range requests {
+				if benchmarkTransaction(waf, r) {
+					interrupted++
+				}
+			}
+		}
+		elapsed := time.Since(start)
+		after := runtime.MemStats{}
+		runtime.ReadMemStats(&after)
+
+		txs := len(requests) * benchmarkIterations
+		if txs == 0 {
+			continue
+		}
+		proxywasm.LogInfof(
+			"Benchmark of rule set %q with corpus %q: %d transactions (%d interrupted) in %s, %.0f tx/s, %d bytes and %d allocations per tx, %d GC cycles",
+			name, strings.TrimSuffix(entry.Name(), ".txt"), txs, interrupted, elapsed,
+			float64(txs)/elapsed.Seconds(),
+			(after.TotalAlloc-before.TotalAlloc)/uint64(txs),
+			(after.Mallocs-before.Mallocs)/uint64(txs),
+			after.NumGC-before.NumGC)
+	}
+}
+
+type benchmarkRequest struct {
+	method string
+	uri    string
+	body   []byte
+}
+
+func parseBenchmarkCorpus(corpus []byte) []benchmarkRequest {
+	var requests []benchmarkRequest
+	scanner := bufio.NewScanner(bytes.NewReader(corpus))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 2 {
+			continue
+		}
+		r := benchmarkRequest{method: fields[0], uri: fields[1]}
+		if len(fields) == 3 {
+			r.body = []byte(fields[2])
+		}
+		requests = append(requests, r)
+	}
+	return requests
+}
+
+// benchmarkTransaction evaluates the request phases of a transaction, reporting whether it
+// has been interrupted.
+func benchmarkTransaction(waf coraza.WAF, r benchmarkRequest) bool {
+	tx := waf.NewTransaction()
+	defer func() {
+		tx.ProcessLogging()
+		_ = tx.Close()
+	}()
+
+	tx.ProcessConnection("127.0.0.1", 32000, "127.0.0.1", 8080)
+	tx.ProcessURI(r.uri, r.method, "HTTP/1.1")
+	tx.AddRequestHeader("Host", "benchmark.local")
+	tx.AddRequestHeader("User-Agent", "coraza-benchmark")
+	tx.AddRequestHeader("Accept", "*/*")
+	if len(r.body) > 0 {
+		tx.AddRequestHeader("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if it := tx.ProcessRequestHeaders(); it != nil {
+		return true
+	}
+	if len(r.body) > 0 && tx.IsRequestBodyAccessible() {
+		it, _, err := tx.WriteRequestBody(r.body)
+		if err != nil {
+			return false
+		}
+		if it != nil {
+			return true
+		}
+	}
+	it, err := tx.ProcessRequestBody()
+	return it != nil && err == nil
+}
@@ -0,0 +1,220 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/corazawaf/coraza/v3/collection"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+)
+
+// binaryBodyMaxDepth bounds the nesting of the MessagePack and CBOR bodies, whatever the
+// json max_depth, the bodies nested deeper being invalid.
+const binaryBodyMaxDepth = 128
+
+var (
+	errTruncatedBody     = errors.New("truncated body")
+	errBinaryBodyTooDeep = errors.New("body nested too deeply")
+)
+
+// The kinds of the items of the MessagePack and CBOR bodies.
+const (
+	binaryScalar = iota
+	binaryArray
+	binaryMap
+)
+
+// binaryItem is the head of an item of a MessagePack or CBOR body: the value of a scalar, or
+// the number of entries of an array or a map, -1 if they are terminated by a break.
+type binaryItem struct {
+	kind   int
+	value  string
+	length int
+}
+
+func scalarItem(value string) (binaryItem, error) {
+	return binaryItem{kind: binaryScalar, value: value}, nil
+}
+
+// binaryReader reads the items of a MessagePack or CBOR body.
+type binaryReader interface {
+	// readItem reads the head of the next item, the entries of the arrays and maps following it.
+	readItem() (binaryItem, error)
+	// readBreak reads the break ending the arrays and maps of unknown length, if next.
+	readBreak() bool
+	// offset is the offset in the body of the next item.
+	offset() int
+}
+
+// binaryBuffer is the body read by the MessagePack and CBOR readers.
+type binaryBuffer struct {
+	b   []byte
+	off int
+}
+
+func (r *binaryBuffer) offset() int {
+	return r.off
+}
+
+func (r *binaryBuffer) next(n uint64) ([]byte, error) {
+	if n > uint64(len(r.b)-r.off) {
+		return nil, errTruncatedBody
+	}
+	b := r.b[r.off : r.off+int(n)]
+	r.off += int(n)
+	return b, nil
+}
+
+// uint reads a big endian unsigned integer of n bytes.
+func (r *binaryBuffer) uint(n int) (uint64, error) {
+	b, err := r.next(uint64(n))
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, err
+}
+
+// container returns the head of an array or a map of length entries, each one taking at
+// least a byte, so that the lengths exceeding the body are rejected upfront.
+func (r *binaryBuffer) container(kind int, length uint64) (binaryItem, error) {
+	if length > uint64(len(r.b)-r.off) {
+		return binaryItem{}, errTruncatedBody
+	}
+	return binaryItem{kind: kind, length: int(length)}, nil
+}
+
+// flattenBinary flattens the body, a single MessagePack or CBOR item read by the reader
+// returned by newReader, into col under prefix, as flattenJSON does.
+func flattenBinary(reader io.Reader, newReader func([]byte) binaryReader, prefix string, v plugintypes.TransactionVariables, col collection.Map) error {
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	f := binaryFlattener{
+		r:           newReader(body),
+		body:        body,
+		col:         col,
+		maxDepth:    txLimit(v, jsonMaxDepthVar),
+		maxElements: txLimit(v, jsonMaxElementsVar),
+	}
+	item, err := f.r.readItem()
+	if err != nil {
+		return err
+	}
+	if item.kind == binaryScalar {
+		col.SetIndex(prefix, 0, item.value)
+	} else if err := f.flatten(item, []byte(prefix), 1); err != nil {
+		return err
+	}
+	if f.r.offset() != len(body) {
+		return errors.New("unexpected data after the body")
+	}
+	v.TX().Set(jsonLimitExceeded, []string{flagValue(f.limitExceeded)})
+	return nil
+}
+
+type binaryFlattener struct {
+	r             binaryReader
+	body          []byte
+	col           collection.Map
+	maxDepth      int
+	maxElements   int
+	elements      int
+	limitExceeded bool
+}
+
+// flatten sets the entries of the array or map item under the prefix key, the item being
+// at the given depth. The entries beyond the limits are still read, to validate the body.
+func (f *binaryFlattener) flatten(item binaryItem, key []byte, depth int) error {
+	if depth > binaryBodyMaxDepth {
+		return errBinaryBodyTooDeep
+	}
+	arrayLen := 0
+	for i := 0; item.length < 0 || i < item.length; i++ {
+		if item.length < 0 && f.r.readBreak() {
+			break
+		}
+		// A single buffer is kept for the keys, each one appended to its parent
+		parentLen := len(key)
+		key = append(key, '.')
+		if item.kind == binaryMap {
+			k, err := f.r.readItem()
+			if err != nil {
+				return err
+			}
+			if k.kind != binaryScalar {
+				return errors.New("unsupported map key")
+			}
+			key = append(key, k.value...)
+		} else {
+			key = strconv.AppendInt(key, int64(i), 10)
+		}
+
+		start := f.r.offset()
+		value, err := f.r.readItem()
+		if err != nil {
+			return err
+		}
+		switch {
+		case f.maxElements > 0 && f.elements >= f.maxElements:
+			f.limitExceeded = true
+			err = f.skip(value, depth+1)
+		case value.kind != binaryScalar && (f.maxDepth == 0 || depth < f.maxDepth):
+			err = f.flatten(value, key, depth+1)
+			arrayLen++
+		case value.kind != binaryScalar:
+			// Too deep, the rules still inspect the raw value
+			f.limitExceeded = true
+			if err = f.skip(value, depth+1); err == nil {
+				f.col.SetIndex(string(key), 0, string(f.body[start:f.r.offset()]))
+				f.elements++
+				arrayLen++
+			}
+		default:
+			f.col.SetIndex(string(key), 0, value.value)
+			f.elements++
+			arrayLen++
+		}
+		key = key[:parentLen]
+		if err != nil {
+			return err
+		}
+	}
+	if item.kind == binaryArray && arrayLen > 0 {
+		f.col.SetIndex(string(key), 0, strconv.Itoa(arrayLen))
+	}
+	return nil
+}
+
+// skip reads the entries of the item, at the given depth, without flattening them.
+func (f *binaryFlattener) skip(item binaryItem, depth int) error {
+	if item.kind == binaryScalar {
+		return nil
+	}
+	if depth > binaryBodyMaxDepth {
+		return errBinaryBodyTooDeep
+	}
+	entries := item.length
+	if item.kind == binaryMap && entries > 0 {
+		entries *= 2
+	}
+	for i := 0; entries < 0 || i < entries; i++ {
+		if entries < 0 && f.r.readBreak() {
+			return nil
+		}
+		value, err := f.r.readItem()
+		if err != nil {
+			return err
+		}
+		if err := f.skip(value, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
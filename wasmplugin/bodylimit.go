@@ -0,0 +1,52 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"net/http"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// isBodyLimitInterruption returns whether the interruption was raised by Coraza for a body
+// exceeding SecRequestBodyLimit or SecResponseBodyLimit with the Reject action, rather than
+// by a rule.
+func isBodyLimitInterruption(interruption *ctypes.Interruption) bool {
+	return interruption.RuleID == 0 && interruption.Status == http.StatusRequestEntityTooLarge &&
+		interruption.Action == "deny"
+}
+
+// enforcesInterruptions returns whether the rule engine of the transaction is On. Coraza
+// raises the body limit interruptions with the engine in DetectionOnly as well, while only
+// an engine On honors a new interruption of the transaction, equivalent to the raised one.
+func enforcesInterruptions(tx ctypes.Transaction) bool {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return true
+	}
+	probe := &ctypes.Interruption{Status: http.StatusRequestEntityTooLarge, Action: "deny"}
+	state.Interrupt(probe)
+	return tx.Interruption() == probe
+}
+
+// handleBodyLimitInterruption denies the request exceeding the body limit, as soon as the
+// limit is reached, unless the rule engine is in DetectionOnly. The transaction, interrupted
+// anyway, is not inspected anymore then, and the body limit failure policy is applied to the
+// requests. The responses, whose headers are sent already, are let through.
+func (ctx *httpContext) handleBodyLimitInterruption(phase interruptionPhase, interruption *ctypes.Interruption) types.Action {
+	if enforcesInterruptions(ctx.tx) {
+		ctx.logger.Info().Str("body_limit_action", "Reject").Msg("Body limit exceeded")
+		return ctx.handleInterruption(phase, interruption)
+	}
+	ctx.logger.Info().
+		Str("body_limit_action", "Reject").
+		Msg("Body limit exceeded in DetectionOnly mode, skipping the rules of the following phases")
+	ctx.inspectionStopped = true
+	if phase == interruptionPhaseHttpResponseBody {
+		return types.ActionContinue
+	}
+	return ctx.handleFailure(phase, failureBodyLimit)
+}
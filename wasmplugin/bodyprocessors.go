@@ -0,0 +1,104 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tidwall/gjson"
+)
+
+// mappableBodyProcessors are the body processors the content types can be mapped to.
+var mappableBodyProcessors = map[string]bool{
+	"JSON":       true,
+	"XML":        true,
+	"URLENCODED": true,
+	"MULTIPART":  true,
+	"RAW":        true,
+	"MSGPACK":    true,
+	"CBOR":       true,
+}
+
+// optionalBodyProcessors are the body processors of the filter a size profile can leave out of
+// the build, through the no_body_processor_<name> build tags, true when built in.
+var optionalBodyProcessors = map[string]bool{
+	"CBOR":    false,
+	"MSGPACK": false,
+	"GRAPHQL": false,
+	"GRPC":    false,
+}
+
+// checkBodyProcessorBuilt returns an error if the body processor was left out of the build.
+func checkBodyProcessorBuilt(processor string) error {
+	if built, optional := optionalBodyProcessors[processor]; optional && !built {
+		return fmt.Errorf("body processor left out of the build: %q", processor)
+	}
+	return nil
+}
+
+// bodyProcessorMapping maps the content types matching pattern, a media type possibly
+// with wildcards such as application/*+json, to a body processor.
+type bodyProcessorMapping struct {
+	pattern   string
+	processor string
+}
+
+// bodyProcessorsConfig are the mappings of the content types to body processors, in the
+// order of the configuration, the first matching one being applied.
+type bodyProcessorsConfig []bodyProcessorMapping
+
+func parseBodyProcessors(bodyProcessors gjson.Result) (bodyProcessorsConfig, error) {
+	if !bodyProcessors.IsObject() {
+		return nil, fmt.Errorf("invalid body_processors: %s", bodyProcessors.Raw)
+	}
+	var c bodyProcessorsConfig
+	var err error
+	bodyProcessors.ForEach(func(key, value gjson.Result) bool {
+		pattern := strings.ToLower(key.String())
+		if _, err = path.Match(pattern, ""); err != nil || !strings.Contains(pattern, "/") {
+			err = fmt.Errorf("invalid body_processors content type: %q", key.String())
+			return false
+		}
+		processor := strings.ToUpper(value.String())
+		if value.Type != gjson.String || !mappableBodyProcessors[processor] {
+			err = fmt.Errorf("invalid body_processors processor for %q: %s", key.String(), value.Raw)
+			return false
+		}
+		if err = checkBodyProcessorBuilt(processor); err != nil {
+			return false
+		}
+		c = append(c, bodyProcessorMapping{pattern: pattern, processor: processor})
+		return true
+	})
+	return c, err
+}
+
+// selectBodyProcessor selects the body processor mapped to the content type of the request,
+// before the phase 1 rules which may still select another one.
+func (c bodyProcessorsConfig) selectBodyProcessor(tx ctypes.Transaction, contentType string) {
+	if len(c) == 0 {
+		return
+	}
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return
+	}
+	for _, m := range c {
+		if matched, _ := path.Match(m.pattern, mediaType); matched {
+			if s, ok := state.Variables().RequestBodyProcessor().(interface{ Set(string) }); ok {
+				s.Set(m.processor)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+func TestBodyProcessorsSelection(t *testing.T) {
+	c, err := parseBodyProcessors(gjson.Parse(`{
+		"text/plain": "JSON",
+		"application/vnd.*+json": "JSON",
+		"application/*": "RAW"
+	}`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		contentType string
+		expected    string
+	}{
+		{contentType: "text/plain; charset=utf-8", expected: "JSON"},
+		{contentType: "Application/Vnd.Api+JSON", expected: "JSON"},
+		{contentType: "application/octet-stream", expected: "RAW"},
+		{contentType: "text/html", expected: ""},
+		{contentType: "invalid;;", expected: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			waf, err := coraza.NewWAF(coraza.NewWAFConfig())
+			require.NoError(t, err)
+			tx := waf.NewTransaction()
+			c.selectBodyProcessor(tx, tt.contentType)
+			require.Equal(t, tt.expected, tx.(plugintypes.TransactionState).Variables().RequestBodyProcessor().Get())
+		})
+	}
+}
+
+func TestBodyProcessorsLeftOut(t *testing.T) {
+	for _, processor := range []string{"CBOR", "GRAPHQL"} {
+		defer func(processor string, built bool) { optionalBodyProcessors[processor] = built }(processor, optionalBodyProcessors[processor])
+		optionalBodyProcessors[processor] = false
+	}
+
+	_, err := parseBodyProcessors(gjson.Parse(`{"application/cbor": "CBOR"}`))
+	require.Equal(t, errors.New(`body processor left out of the build: "CBOR"`), err)
+	_, err = parseBodyProcessors(gjson.Parse(`{"application/msgpack": "MSGPACK"}`))
+	require.NoError(t, err)
+	_, err = parsePluginConfiguration([]byte(`{"graphql": {}}`), func(string) {})
+	require.Equal(t, errors.New(`body processor left out of the build: "GRAPHQL"`), err)
+}
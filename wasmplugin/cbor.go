@@ -0,0 +1,194 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+)
+
+// The major types of the CBOR items.
+const (
+	cborUint = iota
+	cborNegInt
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+// cborIndefinite is the additional information of the items of unknown length, and the break ending them.
+const cborIndefinite = 31
+
+var errInvalidCBOR = errors.New("invalid CBOR body")
+
+// cborBodyProcessor flattens the CBOR bodies into ARGS_POST, or RESPONSE_ARGS, as the JSON body
+// processor does, under the cbor prefix, e.g. cbor.user.name. The byte strings are exposed as
+// strings, and the tags are ignored, the tagged items being flattened as untagged.
+type cborBodyProcessor struct{}
+
+func (cborBodyProcessor) ProcessRequest(reader io.Reader, v plugintypes.TransactionVariables, _ plugintypes.BodyProcessorOptions) error {
+	return flattenBinary(reader, newCBORReader, "cbor", v, v.ArgsPost())
+}
+
+func (cborBodyProcessor) ProcessResponse(reader io.Reader, v plugintypes.TransactionVariables, _ plugintypes.BodyProcessorOptions) error {
+	return flattenBinary(reader, newCBORReader, "cbor", v, v.ResponseArgs())
+}
+
+type cborReader struct {
+	binaryBuffer
+}
+
+func newCBORReader(b []byte) binaryReader {
+	return &cborReader{binaryBuffer{b: b}}
+}
+
+func (r *cborReader) readBreak() bool {
+	if r.off < len(r.b) && r.b[r.off] == 0xff {
+		r.off++
+		return true
+	}
+	return false
+}
+
+func (r *cborReader) readItem() (binaryItem, error) {
+	for {
+		b, err := r.next(1)
+		if err != nil {
+			return binaryItem{}, err
+		}
+		major, info := int(b[0]>>5), b[0]&0x1f
+		if major == cborSimple {
+			return r.simple(info)
+		}
+
+		if info == cborIndefinite {
+			switch major {
+			case cborBytes, cborText:
+				return r.chunkedStr(major)
+			case cborArray:
+				return binaryItem{kind: binaryArray, length: -1}, nil
+			case cborMap:
+				return binaryItem{kind: binaryMap, length: -1}, nil
+			}
+			return binaryItem{}, errInvalidCBOR
+		}
+		arg, err := r.argument(info)
+		if err != nil {
+			return binaryItem{}, err
+		}
+
+		switch major {
+		case cborUint:
+			return scalarItem(strconv.FormatUint(arg, 10))
+		case cborNegInt:
+			if arg == math.MaxUint64 {
+				return scalarItem("-18446744073709551616")
+			}
+			return scalarItem("-" + strconv.FormatUint(arg+1, 10))
+		case cborBytes, cborText:
+			s, err := r.next(arg)
+			if err != nil {
+				return binaryItem{}, err
+			}
+			return scalarItem(string(s))
+		case cborArray:
+			return r.container(binaryArray, arg)
+		case cborMap:
+			return r.container(binaryMap, arg)
+		}
+		// A tag, followed by the tagged item
+	}
+}
+
+// argument reads the argument of an item given its additional information.
+func (r *cborReader) argument(info byte) (uint64, error) {
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info <= 27:
+		return r.uint(1 << (info - 24))
+	}
+	return 0, errInvalidCBOR
+}
+
+// chunkedStr reads the definite length chunks of a string of unknown length until the break.
+func (r *cborReader) chunkedStr(major int) (binaryItem, error) {
+	var s []byte
+	for !r.readBreak() {
+		b, err := r.next(1)
+		if err != nil {
+			return binaryItem{}, err
+		}
+		if int(b[0]>>5) != major || b[0]&0x1f == cborIndefinite {
+			return binaryItem{}, errInvalidCBOR
+		}
+		n, err := r.argument(b[0] & 0x1f)
+		if err != nil {
+			return binaryItem{}, err
+		}
+		chunk, err := r.next(n)
+		if err != nil {
+			return binaryItem{}, err
+		}
+		s = append(s, chunk...)
+	}
+	return scalarItem(string(s))
+}
+
+func (r *cborReader) simple(info byte) (binaryItem, error) {
+	switch info {
+	case 20:
+		return scalarItem("false")
+	case 21:
+		return scalarItem("true")
+	case 22, 23: // null, undefined
+		return scalarItem("")
+	case 24:
+		v, err := r.uint(1)
+		return binaryItem{kind: binaryScalar, value: strconv.FormatUint(v, 10)}, err
+	case 25:
+		v, err := r.uint(2)
+		return binaryItem{kind: binaryScalar, value: strconv.FormatFloat(halfFloat(uint16(v)), 'g', -1, 32)}, err
+	case 26:
+		v, err := r.uint(4)
+		return binaryItem{kind: binaryScalar, value: strconv.FormatFloat(float64(math.Float32frombits(uint32(v))), 'g', -1, 32)}, err
+	case 27:
+		v, err := r.uint(8)
+		return binaryItem{kind: binaryScalar, value: strconv.FormatFloat(math.Float64frombits(v), 'g', -1, 64)}, err
+	}
+	if info < 20 {
+		return scalarItem(strconv.Itoa(int(info)))
+	}
+	// The reserved values, and the breaks outside of the items of unknown length
+	return binaryItem{}, errInvalidCBOR
+}
+
+// halfFloat converts an IEEE 754 half precision float.
+func halfFloat(h uint16) float64 {
+	exp, mant := int(h>>10)&0x1f, float64(h&0x3ff)
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			v = math.Inf(1)
+		} else {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(mant+0x400, exp-25)
+	}
+	if h&0x8000 != 0 {
+		v = -v
+	}
+	return v
+}
@@ -0,0 +1,18 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !no_body_processor_cbor
+
+package wasmplugin
+
+import (
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+)
+
+func init() {
+	plugins.RegisterBodyProcessor("cbor", func() plugintypes.BodyProcessor {
+		return cborBodyProcessor{}
+	})
+	optionalBodyProcessors["CBOR"] = true
+}
@@ -0,0 +1,91 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCBORBodyProcessor(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected map[string]string
+	}{
+		{
+			name: "definite length",
+			// {"user": {"name": "pooh", "roles": ["admin", {"scope": "honey"}]}, "count": 2, "note": null}
+			body: "\xa3\x64user\xa2\x64name\x64pooh\x65roles\x82\x65admin\xa1\x65scope\x65honey\x65count\x02\x64note\xf6",
+			expected: map[string]string{
+				"cbor.user.name":          "pooh",
+				"cbor.user.roles.0":       "admin",
+				"cbor.user.roles.1.scope": "honey",
+				"cbor.user.roles":         "2",
+				"cbor.count":              "2",
+				"cbor.note":               "",
+			},
+		},
+		{
+			name: "indefinite length",
+			// {_ "user": {_ "name": (_ "po", "oh"), "roles": [_ "admin"]}}
+			body: "\xbf\x64user\xbf\x64name\x7f\x62po\x62oh\xff\x65roles\x9f\x65admin\xff\xff\xff",
+			expected: map[string]string{
+				"cbor.user.name":    "pooh",
+				"cbor.user.roles.0": "admin",
+				"cbor.user.roles":   "1",
+			},
+		},
+		{
+			name: "scalars",
+			// {"neg": -500, "half": 1.5, "f32": 0.25, "tagged": 0("2024-01-01"), "bytes": h'0102', "ok": false}
+			body: "\xa6\x63neg\x39\x01\xf3\x64half\xf9\x3e\x00\x63f32\xfa\x3e\x80\x00\x00\x66tagged\xc0\x6a2024-01-01" +
+				"\x65bytes\x42\x01\x02\x62ok\xf4",
+			expected: map[string]string{
+				"cbor.neg":    "-500",
+				"cbor.half":   "1.5",
+				"cbor.f32":    "0.25",
+				"cbor.tagged": "2024-01-01",
+				"cbor.bytes":  "\x01\x02",
+				"cbor.ok":     "false",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waf, err := coraza.NewWAF(coraza.NewWAFConfig())
+			require.NoError(t, err)
+			v := waf.NewTransaction().(plugintypes.TransactionState).Variables()
+
+			require.NoError(t, cborBodyProcessor{}.ProcessRequest(strings.NewReader(tt.body), v, plugintypes.BodyProcessorOptions{}))
+
+			args := map[string]string{}
+			for _, arg := range v.ArgsPost().FindAll() {
+				args[arg.Key()] = arg.Value()
+			}
+			require.Equal(t, tt.expected, args)
+			require.Equal(t, []string{"0"}, v.TX().Get(jsonLimitExceeded))
+		})
+	}
+
+	for name, body := range map[string]string{
+		"truncated":         "\xa1\x64user",
+		"unterminated":      "\x9f\x01",
+		"stray break":       "\xff",
+		"mixed chunks":      "\x7f\x41a\xff",
+		"reserved argument": "\x1c",
+		"too deeply nested": strings.Repeat("\x9f", binaryBodyMaxDepth+1),
+	} {
+		t.Run(name, func(t *testing.T) {
+			waf, err := coraza.NewWAF(coraza.NewWAFConfig())
+			require.NoError(t, err)
+			v := waf.NewTransaction().(plugintypes.TransactionState).Variables()
+			require.Error(t, cborBodyProcessor{}.ProcessRequest(strings.NewReader(body), v, plugintypes.BodyProcessorOptions{}))
+		})
+	}
+}
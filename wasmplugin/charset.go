@@ -0,0 +1,186 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tidwall/gjson"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/transform"
+)
+
+// charsetConversionErrorVar is the TX variable set to 1 if the charset of a body is not supported,
+// or if the body is not valid in its charset.
+const charsetConversionErrorVar = "charset_conversion_error"
+
+// The reasons of the charset conversion failures.
+const (
+	charsetUnsupported = "unsupported"
+	charsetInvalid     = "invalid"
+)
+
+// charsets are the charsets converted to UTF-8, by their lowercase names and aliases, the
+// UTF-8 and ASCII ones being inspected as they are.
+var charsets = map[string]encoding.Encoding{
+	"utf-8":        nil,
+	"utf8":         nil,
+	"us-ascii":     nil,
+	"ascii":        nil,
+	"shift_jis":    japanese.ShiftJIS,
+	"shift-jis":    japanese.ShiftJIS,
+	"sjis":         japanese.ShiftJIS,
+	"x-sjis":       japanese.ShiftJIS,
+	"windows-31j":  japanese.ShiftJIS,
+	"cp932":        japanese.ShiftJIS,
+	"euc-jp":       japanese.EUCJP,
+	"iso-2022-jp":  japanese.ISO2022JP,
+	"gbk":          simplifiedchinese.GBK,
+	"gb2312":       simplifiedchinese.GBK,
+	"cp936":        simplifiedchinese.GBK,
+	"gb18030":      simplifiedchinese.GB18030,
+	"big5":         traditionalchinese.Big5,
+	"euc-kr":       korean.EUCKR,
+	"iso-8859-1":   charmap.ISO8859_1,
+	"latin1":       charmap.ISO8859_1,
+	"iso-8859-15":  charmap.ISO8859_15,
+	"windows-1252": charmap.Windows1252,
+	"cp1252":       charmap.Windows1252,
+	"windows-1251": charmap.Windows1251,
+	"koi8-r":       charmap.KOI8R,
+}
+
+// charsetConversionConfig enables the conversion to UTF-8 of the bodies declaring another
+// charset in their content type, inspected converted. The bodies are still forwarded as they are.
+type charsetConversionConfig struct {
+	enabled bool
+	// defaultCharset is the charset of the bodies not declaring one, UTF-8 if empty.
+	defaultCharset string
+}
+
+func parseCharsetConversion(conversion gjson.Result) (charsetConversionConfig, error) {
+	c := charsetConversionConfig{enabled: true}
+	if defaultCharset := conversion.Get("default_charset"); defaultCharset.Exists() {
+		c.defaultCharset = strings.ToLower(defaultCharset.String())
+		if _, ok := charsets[c.defaultCharset]; defaultCharset.Type != gjson.String || !ok {
+			return c, fmt.Errorf("invalid charset_conversion default_charset: %s", defaultCharset.Raw)
+		}
+	}
+	return c, nil
+}
+
+// bodyCharset returns the charset of the body of the given content type, and its encoding if
+// the body is to be converted. ok is false if the charset is not supported.
+func (c charsetConversionConfig) bodyCharset(contentType string) (charset string, enc encoding.Encoding, ok bool) {
+	charset = c.defaultCharset
+	if _, params, err := mime.ParseMediaType(contentType); err == nil && params["charset"] != "" {
+		charset = strings.ToLower(strings.TrimSpace(params["charset"]))
+	}
+	if charset == "" {
+		return "", nil, true
+	}
+	enc, ok = charsets[charset]
+	return charset, enc, ok
+}
+
+// newCharsetDecoder returns the decoder converting the body of the given content type, if any,
+// nil if the body is inspected as it is. An unsupported charset is reported as a conversion failure.
+func (ctx *httpContext) newCharsetDecoder(contentType string, _ error) *charsetDecoder {
+	if !ctx.charsetConversion.enabled {
+		return nil
+	}
+	charset, enc, ok := ctx.charsetConversion.bodyCharset(contentType)
+	if !ok {
+		ctx.logger.Info().Str("charset", charset).Msg("Unsupported body charset, inspecting the body as it is")
+		ctx.reportCharsetFailure(charsetUnsupported)
+		return nil
+	}
+	if enc == nil {
+		return nil
+	}
+	return &charsetDecoder{charset: charset, t: enc.NewDecoder()}
+}
+
+// finishCharsetConversion reports the failure of the conversion of the body once it was entirely
+// converted, before the body rules run.
+func (ctx *httpContext) finishCharsetConversion(d *charsetDecoder) {
+	if d == nil || !d.failed() {
+		return
+	}
+	ctx.logger.Info().Str("charset", d.charset).Msg("Body holds invalid characters for its charset")
+	ctx.reportCharsetFailure(charsetInvalid)
+}
+
+func (ctx *httpContext) reportCharsetFailure(reason string) {
+	ctx.metrics.CountCharsetFailure(reason, ctx.metricLabelsKV)
+	setCharsetConversionError(ctx.tx)
+}
+
+func setCharsetConversionError(tx ctypes.Transaction) {
+	if state, ok := tx.(plugintypes.TransactionState); ok {
+		state.Variables().TX().Set(charsetConversionErrorVar, []string{"1"})
+	}
+}
+
+var replacementChar = []byte(string(utf8.RuneError))
+
+// charsetDecoder converts the chunks of a body to UTF-8, the invalid sequences being replaced
+// by U+FFFD.
+type charsetDecoder struct {
+	charset string
+	t       transform.Transformer
+	// pending are the first bytes of a character split across chunks.
+	pending []byte
+	invalid bool
+}
+
+// convert converts the chunk, holding the bytes of its last character until the next chunk if
+// the character is incomplete. A nil decoder returns the chunk as it is.
+func (d *charsetDecoder) convert(chunk []byte) []byte {
+	if d == nil {
+		return chunk
+	}
+	src := chunk
+	if len(d.pending) > 0 {
+		src = append(d.pending, chunk...)
+		d.pending = nil
+	}
+	// A byte converts to at most 3 bytes, the 4 bytes characters taking at least 2 bytes
+	dst := make([]byte, 3*len(src)+utf8.UTFMax)
+	n := 0
+	for {
+		nDst, nSrc, err := d.t.Transform(dst[n:], src, false)
+		n += nDst
+		src = src[nSrc:]
+		if err == transform.ErrShortDst {
+			dst = append(dst, make([]byte, len(dst))...)
+			continue
+		}
+		if err == transform.ErrShortSrc {
+			d.pending = append([]byte(nil), src...)
+		}
+		break
+	}
+	if !d.invalid && bytes.Contains(dst[:n], replacementChar) {
+		d.invalid = true
+	}
+	return dst[:n]
+}
+
+// failed returns whether the body converted was invalid: holding invalid sequences, or ending
+// with an incomplete character which is dropped.
+func (d *charsetDecoder) failed() bool {
+	return d.invalid || len(d.pending) > 0
+}
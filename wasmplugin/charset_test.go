@@ -0,0 +1,80 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+	"golang.org/x/text/encoding/japanese"
+)
+
+func TestBodyCharset(t *testing.T) {
+	tests := []struct {
+		contentType     string
+		defaultCharset  string
+		expectedCharset string
+		converted       bool
+		supported       bool
+	}{
+		{contentType: "text/plain; charset=Shift_JIS", expectedCharset: "shift_jis", converted: true, supported: true},
+		{contentType: `application/x-www-form-urlencoded; charset="gbk"`, expectedCharset: "gbk", converted: true, supported: true},
+		{contentType: "application/json; charset=utf-8", expectedCharset: "utf-8", supported: true},
+		{contentType: "application/json", supported: true},
+		{contentType: "application/json", defaultCharset: "iso-8859-1", expectedCharset: "iso-8859-1", converted: true, supported: true},
+		{contentType: "text/plain; charset=utf-7", expectedCharset: "utf-7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			c := charsetConversionConfig{enabled: true, defaultCharset: tt.defaultCharset}
+			charset, enc, ok := c.bodyCharset(tt.contentType)
+			require.Equal(t, tt.expectedCharset, charset)
+			require.Equal(t, tt.converted, enc != nil)
+			require.Equal(t, tt.supported, ok)
+		})
+	}
+}
+
+func TestCharsetDecoder(t *testing.T) {
+	body, err := japanese.ShiftJIS.NewEncoder().Bytes([]byte("name=テスト"))
+	require.NoError(t, err)
+
+	t.Run("split characters", func(t *testing.T) {
+		d := &charsetDecoder{t: japanese.ShiftJIS.NewDecoder()}
+		var converted []byte
+		for _, b := range body {
+			converted = append(converted, d.convert([]byte{b})...)
+		}
+		require.Equal(t, "name=テスト", string(converted))
+		require.False(t, d.failed())
+	})
+
+	t.Run("truncated character", func(t *testing.T) {
+		d := &charsetDecoder{t: japanese.ShiftJIS.NewDecoder()}
+		require.Equal(t, "name=テス", string(d.convert(body[:len(body)-1])))
+		require.True(t, d.failed())
+	})
+
+	t.Run("invalid sequence", func(t *testing.T) {
+		d := &charsetDecoder{t: japanese.ShiftJIS.NewDecoder()}
+		d.convert([]byte("a\x83 b"))
+		require.True(t, d.failed())
+	})
+
+	t.Run("nil decoder", func(t *testing.T) {
+		var d *charsetDecoder
+		require.Equal(t, body, d.convert(body))
+	})
+}
+
+func TestParseCharsetConversion(t *testing.T) {
+	c, err := parseCharsetConversion(gjson.Parse(`{"default_charset": "Shift_JIS"}`))
+	require.NoError(t, err)
+	require.Equal(t, charsetConversionConfig{enabled: true, defaultCharset: "shift_jis"}, c)
+
+	_, err = parseCharsetConversion(gjson.Parse(`{"default_charset": "utf-7"}`))
+	require.Equal(t, errors.New(`invalid charset_conversion default_charset: "utf-7"`), err)
+}
@@ -0,0 +1,67 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tidwall/gjson"
+)
+
+// maxCompressedDirectivesSize bounds the size of the decompressed directives, guarding the
+// heap of the VM against compression bombs.
+const maxCompressedDirectivesSize = 16 << 20
+
+// appendCompressedDirectives appends the base64 encoded gzip directives of directives_map_gzip
+// to the rule sets, creating the ones missing from directives_map. A rule set is given one
+// blob or an array of blobs, each appended as an entry of the rule set.
+func appendCompressedDirectives(compressed gjson.Result, directivesMap DirectivesMap) error {
+	if !compressed.IsObject() {
+		return fmt.Errorf("invalid directives_map_gzip: %s", compressed.Raw)
+	}
+	var err error
+	compressed.ForEach(func(key, value gjson.Result) bool {
+		name := key.String()
+		blobs := []gjson.Result{value}
+		if value.IsArray() {
+			blobs = value.Array()
+		}
+		for _, blob := range blobs {
+			var directives string
+			if directives, err = decompressDirectives(blob.String()); err != nil {
+				err = fmt.Errorf("invalid directives_map_gzip for directives %q: %v", name, err)
+				return false
+			}
+			directivesMap[name] = append(directivesMap[name], directives)
+		}
+		return true
+	})
+	return err
+}
+
+func decompressDirectives(blob string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil {
+		return "", err
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	directives, err := io.ReadAll(io.LimitReader(r, maxCompressedDirectivesSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(directives) > maxCompressedDirectivesSize {
+		return "", errors.New("decompressed directives exceed 16MiB")
+	}
+	return string(directives), nil
+}
@@ -0,0 +1,52 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+func gzipDirectives(t *testing.T, directives string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte(directives))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestCompressedDirectives(t *testing.T) {
+	crs := "Include @crs-setup-conf\nInclude @owasp_crs/*.conf"
+	exclusions := `SecRuleRemoveById 920350`
+
+	directivesMap := DirectivesMap{"default": {"SecRuleEngine On"}}
+	err := appendCompressedDirectives(gjson.Parse(`{
+		"default": ["`+gzipDirectives(t, crs)+`", "`+gzipDirectives(t, exclusions)+`"],
+		"other": "`+gzipDirectives(t, crs)+`"
+	}`), directivesMap)
+	require.NoError(t, err)
+	require.Equal(t, DirectivesMap{
+		"default": {"SecRuleEngine On", crs, exclusions},
+		"other":   {crs},
+	}, directivesMap)
+
+	err = appendCompressedDirectives(gjson.Parse(`{"default": "not base64"}`), directivesMap)
+	require.Equal(t, errors.New(`invalid directives_map_gzip for directives "default": illegal base64 data at input byte 3`), err)
+
+	err = appendCompressedDirectives(gjson.Parse(`{"default": "`+base64.StdEncoding.EncodeToString([]byte(crs))+`"}`), directivesMap)
+	require.Equal(t, errors.New(`invalid directives_map_gzip for directives "default": gzip: invalid header`), err)
+
+	bomb := gzipDirectives(t, strings.Repeat("#", maxCompressedDirectivesSize+1))
+	err = appendCompressedDirectives(gjson.Parse(`{"default": "`+bomb+`"}`), directivesMap)
+	require.Equal(t, errors.New(`invalid directives_map_gzip for directives "default": decompressed directives exceed 16MiB`), err)
+}
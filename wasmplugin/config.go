@@ -5,35 +5,90 @@ package wasmplugin
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/tidwall/gjson"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/hostadapter"
 )
 
 // pluginConfiguration is a type to represent an example configuration for this wasm plugin.
 type pluginConfiguration struct {
 	directivesMap          DirectivesMap
 	metricLabels           map[string]string
+	dynamicMetricLabels    []dynamicMetricLabel
 	defaultDirectives      string
 	perAuthorityDirectives map[string]string
+	perDirectionDirectives map[string]string
+	// perServerNameDirectives are the rule sets per TLS server name (SNI).
+	perServerNameDirectives map[string]string
+	directivesHeader        directivesHeaderConfig
+	// egressAllowlist is true if the outbound requests are checked against the allowed
+	// egress destinations.
+	egressAllowlist           bool
+	interruptionBody          string
+	denyPages                 denyPagesConfig
+	interruptionHeaders       interruptionHeadersConfig
+	responseBodyInterruption  responseBodyInterruptionConfig
+	verdictHeader             verdictHeaderConfig
+	matchLogDedupWindow       time.Duration
+	statusEndpoint            statusEndpointConfig
+	host                      hostadapter.Adapter
+	istio                     istioConfig
+	bodyHandoff               bodyHandoffConfig
+	metadataVariables         []metadataVariable
+	decisionMetadata          decisionMetadataConfig
+	verdictContract           verdictContractConfig
+	warmup                    bool
+	validate                  bool
+	failurePolicy             failurePolicy
+	memoryPressureThreshold   uint64
+	evaluationDeadline        time.Duration
+	internalRedirects         internalRedirectsMode
+	responseOnly              bool
+	sampling                  samplingConfig
+	uniqueID                  uniqueIDConfig
+	gcWhenIdle                bool
+	requestBodyStreaming      bool
+	bodyDecompression         bodyDecompressionConfig
+	responseBodyDecompression bodyDecompressionConfig
+	charsetConversion         charsetConversionConfig
+	multipart                 multipartConfig
+	json                      jsonConfig
+	urlencoded                urlencodedConfig
+	grpc                      grpcConfig
+	graphql                   graphqlConfig
+	bodyProcessors            bodyProcessorsConfig
+	routeMetadata             routeMetadataConfig
+	remoteRules               remoteRulesConfig
+	// crsVersions are the CRS versions pinned per rule set, the others using the default one.
+	crsVersions map[string]string
 }
 
 type DirectivesMap map[string][]string
 
 func parsePluginConfiguration(data []byte, infoLogger func(string)) (pluginConfiguration, error) {
-	config := pluginConfiguration{}
+	config := pluginConfiguration{host: hostadapter.Envoy}
 
 	data = bytes.TrimSpace(data)
 	if len(data) == 0 {
 		return config, nil
 	}
 
-	if !gjson.ValidBytes(data) {
-		return config, fmt.Errorf("invalid json: %q", data)
+	jsonData, err := configurationJSON(data)
+	if err != nil {
+		return config, err
+	}
+
+	if err := checkSchema(jsonData, pluginConfigurationSchema, ""); err != nil {
+		return config, fmt.Errorf("invalid plugin configuration: %v", err)
 	}
 
-	jsonData := gjson.ParseBytes(data)
 	config.directivesMap = make(DirectivesMap)
+	var structuredRuleErr error
 	jsonData.Get("directives_map").ForEach(func(key, value gjson.Result) bool {
 		directiveName := key.String()
 		if _, ok := config.directivesMap[directiveName]; ok {
@@ -42,13 +97,91 @@ func parsePluginConfiguration(data []byte, infoLogger func(string)) (pluginConfi
 
 		var directive []string
 		value.ForEach(func(_, value gjson.Result) bool {
+			// Rules can be given as JSON objects besides SecLang
+			if value.IsObject() {
+				rule, err := parseStructuredRule(value)
+				if err != nil {
+					structuredRuleErr = fmt.Errorf("invalid structured rule in directives %q: %v", directiveName, err)
+					return false
+				}
+				directive = append(directive, rule)
+				return true
+			}
 			directive = append(directive, value.String())
 			return true
 		})
 
 		config.directivesMap[directiveName] = directive
-		return true
+		return structuredRuleErr == nil
 	})
+	if structuredRuleErr != nil {
+		return config, structuredRuleErr
+	}
+
+	// Large rule sets can be compressed to fit the configuration size limits of the control planes
+	if compressed := jsonData.Get("directives_map_gzip"); compressed.Exists() {
+		if err := appendCompressedDirectives(compressed, config.directivesMap); err != nil {
+			return config, err
+		}
+	}
+
+	// The deprecated rules field stands for the default rule set, before the rule sets are
+	// amended by the presets and referenced by the following fields
+	if len(config.directivesMap) == 0 {
+		rules := jsonData.Get("rules")
+
+		if rules.Exists() {
+			infoLogger("Defaulting to deprecated 'rules' field")
+
+			config.defaultDirectives = "default"
+
+			var directive []string
+			rules.ForEach(func(_, value gjson.Result) bool {
+				directive = append(directive, value.String())
+				return true
+			})
+			config.directivesMap["default"] = directive
+		}
+	}
+
+	// The CRS preset is applied first, so that the recommended configuration precedes the CRS setup
+	if crs := jsonData.Get("include_crs"); crs.Exists() {
+		names, err := parsePresetRuleSets(crs, "include_crs", config.directivesMap)
+		if err != nil {
+			return config, err
+		}
+		for _, name := range names {
+			config.directivesMap[name] = applyCRSPreset(config.directivesMap[name])
+		}
+	}
+
+	if recommended := jsonData.Get("include_recommended"); recommended.Exists() {
+		names, err := parsePresetRuleSets(recommended, "include_recommended", config.directivesMap)
+		if err != nil {
+			return config, err
+		}
+		for _, name := range names {
+			config.directivesMap[name] = applyRecommendedPreset(config.directivesMap[name])
+		}
+	}
+
+	if crsVersion := jsonData.Get("crs_version"); crsVersion.Exists() {
+		versions, err := parseCRSVersions(crsVersion, config.directivesMap)
+		if err != nil {
+			return config, err
+		}
+		config.crsVersions = versions
+	}
+
+	if crsPlugins := jsonData.Get("crs_plugins"); crsPlugins.Exists() {
+		plugins, err := parseCRSPlugins(crsPlugins)
+		if err != nil {
+			return config, err
+		}
+		for name, directives := range config.directivesMap {
+			config.directivesMap[name] = applyCRSPlugins(directives, plugins)
+		}
+	}
 
 	config.metricLabels = make(map[string]string)
 	jsonData.Get("metric_labels").ForEach(func(key, value gjson.Result) bool {
@@ -56,6 +189,37 @@ func parsePluginConfiguration(data []byte, infoLogger func(string)) (pluginConfi
 		return true
 	})
 
+	var dynamicMetricLabelErr error
+	jsonData.Get("dynamic_metric_labels").ForEach(func(_, value gjson.Result) bool {
+		label := dynamicMetricLabel{
+			name:      value.Get("name").String(),
+			source:    value.Get("source").String(),
+			maxValues: defaultMaxMetricLabelValues,
+		}
+		if label.name == "" {
+			dynamicMetricLabelErr = errors.New("missing dynamic metric label name")
+			return false
+		}
+		if label.source == "" {
+			label.source = label.name
+		}
+		if dynamicMetricLabelErr = parseDynamicMetricLabelSource(label.source); dynamicMetricLabelErr != nil {
+			return false
+		}
+		if maxValues := value.Get("max_values"); maxValues.Exists() {
+			label.maxValues = int(maxValues.Int())
+			if label.maxValues <= 0 {
+				dynamicMetricLabelErr = fmt.Errorf("invalid max_values for metric label %q: %d", label.name, label.maxValues)
+				return false
+			}
+		}
+		config.dynamicMetricLabels = append(config.dynamicMetricLabels, label)
+		return true
+	})
+	if dynamicMetricLabelErr != nil {
+		return config, dynamicMetricLabelErr
+	}
+
 	defaultDirectives := jsonData.Get("default_directives")
 	if defaultDirectives.Exists() {
 		defaultDirectivesName := defaultDirectives.String()
@@ -73,25 +237,286 @@ func parsePluginConfiguration(data []byte, infoLogger func(string)) (pluginConfi
 	})
 
 	for authority, directiveName := range config.perAuthorityDirectives {
+		if strings.Contains(strings.TrimPrefix(authority, "*."), "*") {
+			return config, fmt.Errorf("invalid authority, wildcards are only supported as \"*.<domain>\": %q", authority)
+		}
 		if _, ok := config.directivesMap[directiveName]; !ok {
 			return config, fmt.Errorf("directive map not found for authority %s: %q", authority, directiveName)
 		}
 	}
 
-	if len(config.directivesMap) == 0 {
-		rules := jsonData.Get("rules")
+	for serverName, value := range jsonData.Get("per_sni_directives").Map() {
+		if strings.Contains(strings.TrimPrefix(serverName, "*."), "*") {
+			return config, fmt.Errorf("invalid server name, wildcards are only supported as \"*.<domain>\": %q", serverName)
+		}
+		if _, ok := config.directivesMap[value.String()]; !ok {
+			return config, fmt.Errorf("directive map not found for server name %s: %q", serverName, value.String())
+		}
+		if config.perServerNameDirectives == nil {
+			config.perServerNameDirectives = make(map[string]string)
+		}
+		config.perServerNameDirectives[serverName] = value.String()
+	}
 
-		if rules.Exists() {
-			infoLogger("Defaulting to deprecated 'rules' field")
+	if header := jsonData.Get("directives_header"); header.Exists() {
+		var err error
+		if config.directivesHeader, err = parseDirectivesHeader(header, config.directivesMap); err != nil {
+			return config, err
+		}
+	}
 
-			config.defaultDirectives = "default"
+	var perDirectionErr error
+	jsonData.Get("per_direction_directives").ForEach(func(key, value gjson.Result) bool {
+		if perDirectionErr = parseTrafficDirection(key.String()); perDirectionErr != nil {
+			return false
+		}
+		if _, ok := config.directivesMap[value.String()]; !ok {
+			perDirectionErr = fmt.Errorf("directive map not found for direction %s: %q", key.String(), value.String())
+			return false
+		}
+		if config.perDirectionDirectives == nil {
+			config.perDirectionDirectives = make(map[string]string)
+		}
+		config.perDirectionDirectives[key.String()] = value.String()
+		return true
+	})
+	if perDirectionErr != nil {
+		return config, perDirectionErr
+	}
 
-			var directive []string
-			rules.ForEach(func(_, value gjson.Result) bool {
-				directive = append(directive, value.String())
-				return true
-			})
-			config.directivesMap["default"] = directive
+	if err := appendEgressAllowlist(jsonData.Get("egress_allowed_destinations"), &config); err != nil {
+		return config, err
+	}
+
+	interruptionBody := jsonData.Get("interruption_body")
+	if interruptionBody.Exists() {
+		switch f := interruptionBody.String(); f {
+		case "", problemJSONBody:
+			config.interruptionBody = f
+		default:
+			return config, fmt.Errorf("unsupported interruption body: %q", f)
+		}
+	}
+	if denyPages := jsonData.Get("deny_pages"); denyPages.Exists() {
+		var err error
+		if config.denyPages, err = parseDenyPages(denyPages); err != nil {
+			return config, err
+		}
+		if config.interruptionBody != "" {
+			return config, errors.New("interruption_body and deny_pages are exclusive")
+		}
+	}
+
+	if interruptionHeaders := jsonData.Get("interruption_headers"); interruptionHeaders.Exists() {
+		var err error
+		if config.interruptionHeaders, err = parseInterruptionHeaders(interruptionHeaders); err != nil {
+			return config, err
+		}
+	}
+
+	if interruption := jsonData.Get("response_body_interruption"); interruption.Exists() {
+		var err error
+		if config.responseBodyInterruption, err = parseResponseBodyInterruption(interruption); err != nil {
+			return config, err
+		}
+	}
+
+	verdictHeader := jsonData.Get("verdict_header")
+	if verdictHeader.Exists() {
+		var err error
+		config.verdictHeader.request, config.verdictHeader.response, err = parseVerdictHeaderTarget(verdictHeader.Get("target").String())
+		if err != nil {
+			return config, err
+		}
+
+		config.verdictHeader.name = defaultVerdictHeaderName
+		if name := verdictHeader.Get("name").String(); name != "" {
+			config.verdictHeader.name = name
+		}
+	}
+
+	if matchLogDedupWindow := jsonData.Get("match_log_dedup_window"); matchLogDedupWindow.Exists() {
+		window, err := time.ParseDuration(matchLogDedupWindow.String())
+		if err != nil {
+			return config, fmt.Errorf("invalid match_log_dedup_window: %v", err)
+		}
+		if window < time.Millisecond {
+			return config, fmt.Errorf("match_log_dedup_window must be at least 1ms: %q", matchLogDedupWindow.String())
+		}
+		config.matchLogDedupWindow = window
+	}
+
+	if istio := jsonData.Get("istio"); istio.Exists() {
+		var err error
+		if config.istio, err = parseIstioConfig(istio, config.directivesMap); err != nil {
+			return config, err
+		}
+	}
+
+	if bodyHandoff := jsonData.Get("oversized_body_handoff"); bodyHandoff.Exists() {
+		config.bodyHandoff.limit = int(bodyHandoff.Get("limit").Int())
+		if config.bodyHandoff.limit <= 0 {
+			return config, fmt.Errorf("invalid oversized_body_handoff limit: %d", config.bodyHandoff.limit)
+		}
+		config.bodyHandoff.header = defaultBodyHandoffHeader
+		if header := bodyHandoff.Get("header").String(); header != "" {
+			config.bodyHandoff.header = header
+		}
+	}
+
+	metadataVariables, err := parseMetadataVariables(jsonData.Get("metadata_variables"))
+	if err != nil {
+		return config, err
+	}
+	config.metadataVariables = metadataVariables
+
+	if decisionMetadata := jsonData.Get("decision_metadata"); decisionMetadata.Exists() {
+		if config.decisionMetadata, err = parseDecisionMetadata(decisionMetadata); err != nil {
+			return config, err
+		}
+	}
+
+	if verdictContract := jsonData.Get("verdict_contract"); verdictContract.Exists() {
+		// Both sinks are enabled unless explicitly disabled
+		config.verdictContract.log = !verdictContract.Get("log").Exists() || verdictContract.Get("log").Bool()
+		config.verdictContract.filterState = !verdictContract.Get("filter_state").Exists() || verdictContract.Get("filter_state").Bool()
+	}
+
+	config.warmup = jsonData.Get("warmup").Bool()
+	config.validate = jsonData.Get("validate").Bool()
+
+	if config.failurePolicy, err = parseFailurePolicy(jsonData.Get("failure_policy")); err != nil {
+		return config, err
+	}
+	if threshold := jsonData.Get("memory_pressure_threshold"); threshold.Exists() {
+		config.memoryPressureThreshold = threshold.Uint()
+		if threshold.Type != gjson.Number || config.memoryPressureThreshold == 0 {
+			return config, fmt.Errorf("invalid memory_pressure_threshold: %s", threshold.Raw)
+		}
+	}
+
+	if evaluationDeadline := jsonData.Get("evaluation_deadline"); evaluationDeadline.Exists() {
+		deadline, err := time.ParseDuration(evaluationDeadline.String())
+		if err != nil {
+			return config, fmt.Errorf("invalid evaluation_deadline: %v", err)
+		}
+		if deadline <= 0 {
+			return config, fmt.Errorf("evaluation_deadline must be positive: %q", evaluationDeadline.String())
+		}
+		config.evaluationDeadline = deadline
+	}
+
+	if config.internalRedirects, err = parseInternalRedirectsMode(jsonData.Get("internal_redirects").String()); err != nil {
+		return config, err
+	}
+
+	config.responseOnly = jsonData.Get("response_only").Bool()
+
+	config.gcWhenIdle = jsonData.Get("gc_when_idle").Bool()
+	config.requestBodyStreaming = jsonData.Get("request_body_streaming").Bool()
+
+	if decompression := jsonData.Get("request_body_decompression"); decompression.Exists() {
+		if config.bodyDecompression, err = parseBodyDecompression("request_body_decompression", decompression); err != nil {
+			return config, err
+		}
+	}
+	if decompression := jsonData.Get("response_body_decompression"); decompression.Exists() {
+		if config.responseBodyDecompression, err = parseBodyDecompression("response_body_decompression", decompression); err != nil {
+			return config, err
+		}
+	}
+	if conversion := jsonData.Get("charset_conversion"); conversion.Exists() {
+		if config.charsetConversion, err = parseCharsetConversion(conversion); err != nil {
+			return config, err
+		}
+	}
+
+	if multipartJSON := jsonData.Get("multipart"); multipartJSON.Exists() {
+		if config.multipart, err = parseMultipart(multipartJSON); err != nil {
+			return config, err
+		}
+	}
+	if jsonJSON := jsonData.Get("json"); jsonJSON.Exists() {
+		if config.json, err = parseJSON(jsonJSON); err != nil {
+			return config, err
+		}
+	}
+	if urlencoded := jsonData.Get("urlencoded"); urlencoded.Exists() {
+		if config.urlencoded, err = parseURLEncoded(urlencoded); err != nil {
+			return config, err
+		}
+	}
+	if grpc := jsonData.Get("grpc"); grpc.Exists() {
+		if err := checkBodyProcessorBuilt("GRPC"); err != nil {
+			return config, err
+		}
+		if config.grpc, err = parseGRPC(grpc); err != nil {
+			return config, err
+		}
+		config.grpc.maxDecompressedSize = config.bodyDecompression.maxSize
+	}
+	if bodyProcessors := jsonData.Get("body_processors"); bodyProcessors.Exists() {
+		if config.bodyProcessors, err = parseBodyProcessors(bodyProcessors); err != nil {
+			return config, err
+		}
+	}
+	if graphql := jsonData.Get("graphql"); graphql.Exists() {
+		if err := checkBodyProcessorBuilt("GRAPHQL"); err != nil {
+			return config, err
+		}
+		if config.graphql, err = parseGraphQL(graphql); err != nil {
+			return config, err
+		}
+		for name, directives := range config.directivesMap {
+			config.directivesMap[name] = append(config.graphql.limitRules(), directives...)
+		}
+	}
+
+	if sampling := jsonData.Get("sampling"); sampling.Exists() {
+		if config.sampling, err = parseSampling(sampling, config.directivesMap); err != nil {
+			return config, err
+		}
+	}
+
+	if uniqueID := jsonData.Get("unique_id"); uniqueID.Exists() {
+		if config.uniqueID, err = parseUniqueID(uniqueID); err != nil {
+			return config, err
+		}
+	}
+
+	host, err := hostadapter.New(jsonData.Get("host").String())
+	if err != nil {
+		return config, err
+	}
+	config.host = host
+
+	if routeMetadata := jsonData.Get("route_metadata"); routeMetadata.Exists() {
+		if config.routeMetadata, err = parseRouteMetadata(routeMetadata, host); err != nil {
+			return config, err
+		}
+		for name, directives := range config.directivesMap {
+			config.directivesMap[name] = append(routeModeRules(), directives...)
+		}
+	}
+
+	if statusEndpoint := jsonData.Get("status_endpoint"); statusEndpoint.Exists() {
+		config.statusEndpoint.path = statusEndpoint.Get("path").String()
+		if !strings.HasPrefix(config.statusEndpoint.path, "/") {
+			return config, fmt.Errorf("invalid status endpoint path: %q", config.statusEndpoint.path)
+		}
+		config.statusEndpoint.secret = []byte(statusEndpoint.Get("hmac_secret").String())
+		if len(config.statusEndpoint.secret) == 0 {
+			return config, errors.New("missing status endpoint hmac_secret")
+		}
+		config.statusEndpoint.header = defaultStatusSignatureHeader
+		if header := statusEndpoint.Get("header").String(); header != "" {
+			config.statusEndpoint.header = header
+		}
+	}
+
+	if remoteRules := jsonData.Get("rules_remote"); remoteRules.Exists() {
+		if config.remoteRules, err = parseRemoteRules(remoteRules, &config); err != nil {
+			return config, err
 		}
 	}
 
@@ -6,10 +6,13 @@ package wasmplugin
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/corazawaf/coraza/v3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/hostadapter"
 )
 
 func TestParsePluginConfiguration(t *testing.T) {
@@ -206,6 +209,24 @@ func TestParsePluginConfiguration(t *testing.T) {
 				perAuthorityDirectives: map[string]string{},
 			},
 		},
+		{
+			name: "presets applied to rules",
+			config: `
+			{
+				"rules": ["SecRuleEngine On"],
+				"include_recommended": true,
+				"per_authority_directives": {"foo.example.com": "default"}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap: DirectivesMap{
+					"default": {"Include @recommended-conf", "SecRuleEngine On"},
+				},
+				defaultDirectives:      "default",
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{"foo.example.com": "default"},
+			},
+		},
 		{
 			name: "prefer directives instead of rules",
 			config: `
@@ -226,48 +247,1593 @@ func TestParsePluginConfiguration(t *testing.T) {
 				perAuthorityDirectives: map[string]string{},
 			},
 		},
-	}
-
-	for _, testCase := range testCases {
-		t.Run(testCase.name, func(t *testing.T) {
-			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
-			assert.Equal(t, testCase.expectErr, err)
-
-			if testCase.expectErr == nil {
-				assert.Equal(t, testCase.expectConfig.directivesMap, cfg.directivesMap)
-				assert.Equal(t, testCase.expectConfig.metricLabels, cfg.metricLabels)
-				assert.Equal(t, testCase.expectConfig.defaultDirectives, cfg.defaultDirectives)
-				assert.Equal(t, testCase.expectConfig.perAuthorityDirectives, cfg.perAuthorityDirectives)
+		{
+			name: "problem+json interruption body",
+			config: `
+			{
+				"directives_map": {
+					"default": ["SecRuleEngine On"]
+				},
+				"default_directives": "default",
+				"interruption_body": "problem+json"
 			}
-		})
-	}
-}
-
-func TestWAFMap(t *testing.T) {
-	w, _ := coraza.NewWAF(coraza.NewWAFConfig())
-
-	wm := newWAFMap(1)
-	err := wm.put("foo", w)
-	require.NoError(t, err)
-
-	t.Run("get unexisting WAF with no default", func(t *testing.T) {
-		_, _, err := wm.getWAFOrDefault("bar")
-		require.Error(t, err)
-	})
-
-	wm.setDefaultWAF(w)
-
-	t.Run("get existing WAF", func(t *testing.T) {
-		expecteWAF, isDefault, err := wm.getWAFOrDefault("foo")
-		require.NotNil(t, expecteWAF)
-		require.False(t, isDefault)
-		require.NoError(t, err)
-	})
-
-	t.Run("get unexisting WAF", func(t *testing.T) {
-		expecteWAF, isDefault, err := wm.getWAFOrDefault("bar")
-		require.NotNil(t, expecteWAF)
-		require.True(t, isDefault)
-		require.NoError(t, err)
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap: DirectivesMap{
+					"default": []string{"SecRuleEngine On"},
+				},
+				metricLabels:           map[string]string{},
+				defaultDirectives:      "default",
+				perAuthorityDirectives: map[string]string{},
+				interruptionBody:       "problem+json",
+			},
+		},
+		{
+			name: "unsupported interruption body",
+			config: `
+			{
+				"interruption_body": "xml"
+			}
+			`,
+			expectErr: errors.New("unsupported interruption body: \"xml\""),
+		},
+		{
+			name: "deny pages",
+			config: `
+			{
+				"deny_pages": [
+					{"content_type": "text/html; charset=utf-8", "body": "<p>{{request_id}}</p>"},
+					{"content_type": "application/json", "body": "{}"}
+				]
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				denyPages: denyPagesConfig{
+					{contentType: "text/html; charset=utf-8", mediaType: "text/html", body: "<p>{{request_id}}</p>"},
+					{contentType: "application/json", mediaType: "application/json", body: "{}"},
+				},
+			},
+		},
+		{
+			name: "invalid deny page content type",
+			config: `
+			{
+				"deny_pages": [{"content_type": "html", "body": ""}]
+			}
+			`,
+			expectErr: errors.New(`invalid deny_pages[0] content_type: "html"`),
+		},
+		{
+			name: "interruption headers",
+			config: `
+			{
+				"interruption_headers": {"event_id": "X-WAF-Event-ID", "rule_id": "x-waf-rule-id"}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				interruptionHeaders:    interruptionHeadersConfig{eventID: "x-waf-event-id", ruleID: "x-waf-rule-id"},
+			},
+		},
+		{
+			name: "invalid interruption header name",
+			config: `
+			{
+				"interruption_headers": {"rule_id": "x-waf rule"}
+			}
+			`,
+			expectErr: errors.New(`invalid interruption_headers rule_id: "x-waf rule"`),
+		},
+		{
+			name: "deny pages with interruption body",
+			config: `
+			{
+				"interruption_body": "problem+json",
+				"deny_pages": [{"content_type": "text/html", "body": ""}]
+			}
+			`,
+			expectErr: errors.New("interruption_body and deny_pages are exclusive"),
+		},
+		{
+			name: "verdict header",
+			config: `
+			{
+				"verdict_header": {"name": "x-waf-verdict", "target": "both"}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				verdictHeader: verdictHeaderConfig{
+					name:     "x-waf-verdict",
+					request:  true,
+					response: true,
+				},
+			},
+		},
+		{
+			name: "verdict header defaults",
+			config: `
+			{
+				"verdict_header": {}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				verdictHeader: verdictHeaderConfig{
+					name:     "x-coraza-verdict",
+					response: true,
+				},
+			},
+		},
+		{
+			name: "unsupported verdict header target",
+			config: `
+			{
+				"verdict_header": {"target": "upstream"}
+			}
+			`,
+			expectErr: errors.New("unsupported verdict header target: \"upstream\""),
+		},
+		{
+			name: "dynamic metric labels",
+			config: `
+			{
+				"dynamic_metric_labels": [
+					{"name": "authority", "max_values": 10},
+					{"name": "tenant", "source": "header:x-tenant-id"}
+				]
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				dynamicMetricLabels: []dynamicMetricLabel{
+					{name: "authority", source: "authority", maxValues: 10},
+					{name: "tenant", source: "header:x-tenant-id", maxValues: 100},
+				},
+			},
+		},
+		{
+			name: "unsupported dynamic metric label source",
+			config: `
+			{
+				"dynamic_metric_labels": [{"name": "tenant"}]
+			}
+			`,
+			expectErr: errors.New("unsupported metric label source: \"tenant\""),
+		},
+		{
+			name: "invalid dynamic metric label max values",
+			config: `
+			{
+				"dynamic_metric_labels": [{"name": "route", "source": "route_name", "max_values": 0}]
+			}
+			`,
+			expectErr: errors.New("invalid max_values for metric label \"route\": 0"),
+		},
+		{
+			name: "match log dedup window",
+			config: `
+			{
+				"match_log_dedup_window": "30s"
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				matchLogDedupWindow:    30 * time.Second,
+			},
+		},
+		{
+			name: "invalid match log dedup window",
+			config: `
+			{
+				"match_log_dedup_window": "0s"
+			}
+			`,
+			expectErr: errors.New("match_log_dedup_window must be at least 1ms: \"0s\""),
+		},
+		{
+			name: "status endpoint",
+			config: `
+			{
+				"status_endpoint": {"path": "/.coraza/status", "hmac_secret": "s3cr3t"}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				statusEndpoint: statusEndpointConfig{
+					path:   "/.coraza/status",
+					secret: []byte("s3cr3t"),
+					header: "x-coraza-status-signature",
+				},
+			},
+		},
+		{
+			name: "invalid status endpoint path",
+			config: `
+			{
+				"status_endpoint": {"path": "status", "hmac_secret": "s3cr3t"}
+			}
+			`,
+			expectErr: errors.New("invalid status endpoint path: \"status\""),
+		},
+		{
+			name: "missing status endpoint secret",
+			config: `
+			{
+				"status_endpoint": {"path": "/.coraza/status"}
+			}
+			`,
+			expectErr: errors.New("missing status endpoint hmac_secret"),
+		},
+		{
+			name: "nginx host",
+			config: `
+			{
+				"host": "nginx"
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				host:                   hostadapter.Nginx,
+			},
+		},
+		{
+			name: "ats host",
+			config: `
+			{
+				"host": "ats"
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				host:                   hostadapter.ATS,
+			},
+		},
+		{
+			name: "istio",
+			config: `
+			{
+				"directives_map": {"default": [], "strict": []},
+				"default_directives": "default",
+				"istio": {
+					"per_namespace_directives": {"payments": "strict"},
+					"per_workload_directives": {"checkout": "strict"},
+					"metric_labels": true,
+					"peer_variables": true
+				}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{"default": nil, "strict": nil},
+				metricLabels:           map[string]string{},
+				defaultDirectives:      "default",
+				perAuthorityDirectives: map[string]string{},
+				istio: istioConfig{
+					perNamespaceDirectives: map[string]string{"payments": "strict"},
+					perWorkloadDirectives:  map[string]string{"checkout": "strict"},
+					metricLabels:           true,
+					peerVariables:          true,
+				},
+			},
+		},
+		{
+			name: "istio directives not found",
+			config: `
+			{
+				"directives_map": {"default": []},
+				"istio": {"per_namespace_directives": {"payments": "strict"}}
+			}
+			`,
+			expectErr: errors.New("directive map not found for per_namespace_directives payments: \"strict\""),
+		},
+		{
+			name:   "json encoded as string",
+			config: `"{\"directives_map\": {\"default\": [\"SecRuleEngine On\"]}, \"default_directives\": \"default\"}"`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{"default": []string{"SecRuleEngine On"}},
+				metricLabels:           map[string]string{},
+				defaultDirectives:      "default",
+				perAuthorityDirectives: map[string]string{},
+			},
+		},
+		{
+			name: "presets",
+			config: `
+			{
+				"directives_map": {
+					"default": [
+						"SecRuleEngine On",
+						"SecRuleRemoveById 920350",
+						"SecAction \"id:900000,phase:1,pass,nolog,setvar:tx.blocking_paranoia_level=2\""
+					],
+					"custom": ["Include @crs-setup-conf", "Include @owasp_crs/REQUEST-942-APPLICATION-ATTACK-SQLI.conf"],
+					"egress": ["SecRuleEngine On"]
+				},
+				"default_directives": "default",
+				"include_recommended": true,
+				"include_crs": ["default", "custom"]
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap: DirectivesMap{
+					"default": {
+						"Include @recommended-conf",
+						"Include @crs-setup-conf",
+						"SecRuleEngine On",
+						"SecAction \"id:900000,phase:1,pass,nolog,setvar:tx.blocking_paranoia_level=2\"",
+						"Include @owasp_crs/*.conf",
+						"SecRuleRemoveById 920350",
+					},
+					"custom": {
+						"Include @recommended-conf",
+						"Include @crs-setup-conf",
+						"Include @owasp_crs/REQUEST-942-APPLICATION-ATTACK-SQLI.conf",
+					},
+					"egress": {"Include @recommended-conf", "SecRuleEngine On"},
+				},
+				metricLabels:           map[string]string{},
+				defaultDirectives:      "default",
+				perAuthorityDirectives: map[string]string{},
+			},
+		},
+		{
+			name:      "preset of unknown directives",
+			config:    `{"directives_map": {"default": []}, "include_crs": ["api"]}`,
+			expectErr: errors.New("directive map not found for include_crs: \"api\""),
+		},
+		{
+			name:      "invalid preset",
+			config:    `{"directives_map": {"default": []}, "include_recommended": "yes"}`,
+			expectErr: errors.New("invalid include_recommended: \"yes\""),
+		},
+		{
+			name: "structured rules",
+			config: `
+			{
+				"directives_map": {
+					"default": [
+						"SecRuleEngine On",
+						{"id": 1, "phase": 1, "actions": ["pass", "nolog", "setvar:tx.blocked_agents=curl"]},
+						{
+							"id": 101,
+							"phase": 1,
+							"variables": ["REQUEST_URI", "ARGS:path"],
+							"operator": "@beginsWith /admin",
+							"actions": ["deny", "status:403", "msg:'Access to \"admin\"'"],
+							"chain": {"variables": ["REMOTE_ADDR"], "operator": "!@ipMatch 10.0.0.0/8"}
+						}
+					]
+				},
+				"default_directives": "default"
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap: DirectivesMap{"default": {
+					"SecRuleEngine On",
+					"SecAction \"id:1,phase:1,pass,nolog,setvar:tx.blocked_agents=curl\"",
+					"SecRule REQUEST_URI|ARGS:path \"@beginsWith /admin\" \"id:101,phase:1,deny,status:403,msg:'Access to \\\"admin\\\"',chain\"\n" +
+						"SecRule REMOTE_ADDR \"!@ipMatch 10.0.0.0/8\"",
+				}},
+				metricLabels:           map[string]string{},
+				defaultDirectives:      "default",
+				perAuthorityDirectives: map[string]string{},
+			},
+		},
+		{
+			name:      "structured rule without id",
+			config:    `{"directives_map": {"default": [{"variables": ["ARGS"], "operator": "@rx foo"}]}}`,
+			expectErr: errors.New("invalid structured rule in directives \"default\": invalid rule id: "),
+		},
+		{
+			name:      "structured rule without operator",
+			config:    `{"directives_map": {"default": [{"id": 101, "variables": ["ARGS"]}]}}`,
+			expectErr: errors.New("invalid structured rule in directives \"default\": invalid rule 101: missing operator"),
+		},
+		{
+			name:      "structured rule with invalid phase",
+			config:    `{"directives_map": {"default": [{"id": 101, "phase": 6, "actions": ["pass"]}]}}`,
+			expectErr: errors.New("invalid structured rule in directives \"default\": invalid phase of rule 101: 6"),
+		},
+		{
+			name: "structured rule in policy",
+			config: `
+			{
+				"apiVersion": "waf.coraza.io/v1alpha1",
+				"kind": "WAFPolicy",
+				"spec": {
+					"ruleSets": [{"name": "default", "mode": "Enforce", "directives": [{"id": 101, "variables": ["ARGS"], "operator": "@rx foo"}]}],
+					"defaultRuleSet": "default"
+				}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{"default": {"SecRuleEngine On", "SecRule ARGS \"@rx foo\" \"id:101\""}},
+				metricLabels:           map[string]string{},
+				defaultDirectives:      "default",
+				perAuthorityDirectives: map[string]string{},
+			},
+		},
+		{
+			name: "policy",
+			config: `
+			{
+				"apiVersion": "waf.coraza.io/v1alpha1",
+				"kind": "WAFPolicy",
+				"metadata": {"name": "storefront"},
+				"spec": {
+					"ruleSets": [
+						{"name": "default", "mode": "Enforce", "directives": ["Include @owasp_crs/*.conf"]},
+						{"name": "relaxed", "mode": "Detect", "directives": ["Include @owasp_crs/*.conf"]}
+					],
+					"defaultRuleSet": "default",
+					"hosts": [{"hostname": "legacy.example.com", "ruleSet": "relaxed"}],
+					"exceptions": [
+						{"ruleSet": "default", "ruleIDs": [942100, 942110], "pathPrefix": "/search"},
+						{"ruleIDs": [920350]}
+					],
+					"options": {"metric_labels": {"owner": "storefront"}}
+				}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap: DirectivesMap{
+					"default": {
+						"SecRule REQUEST_FILENAME \"@beginsWith /search\" \"id:99900,phase:1,pass,nolog,ctl:ruleRemoveById=942100,ctl:ruleRemoveById=942110\"",
+						"SecRuleEngine On",
+						"Include @owasp_crs/*.conf",
+						"SecRuleRemoveById 920350",
+					},
+					"relaxed": {
+						"SecRuleEngine DetectionOnly",
+						"Include @owasp_crs/*.conf",
+						"SecRuleRemoveById 920350",
+					},
+				},
+				metricLabels:           map[string]string{"owner": "storefront"},
+				defaultDirectives:      "default",
+				perAuthorityDirectives: map[string]string{"legacy.example.com": "relaxed"},
+			},
+		},
+		{
+			name: "policy with egress",
+			config: `
+			{
+				"apiVersion": "waf.coraza.io/v1alpha1",
+				"kind": "WAFPolicy",
+				"spec": {
+					"ruleSets": [{"name": "default", "mode": "Enforce"}, {"name": "egress", "mode": "Enforce"}],
+					"defaultRuleSet": "default",
+					"egress": {"ruleSet": "egress", "allowedDestinations": ["*.example.com"]}
+				}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap: DirectivesMap{
+					"default": {
+						"SecRule TX:egress_outbound \"@eq 1\" \"id:99800,phase:1,t:none,deny,status:403,log,msg:'Egress destination not allowed',chain\"",
+						"SecRule SERVER_NAME \"!@rx ^(?:.+\\.example\\.com)$\" \"t:lowercase\"",
+						"SecRuleEngine On",
+					},
+					"egress": {
+						"SecRule TX:egress_outbound \"@eq 1\" \"id:99800,phase:1,t:none,deny,status:403,log,msg:'Egress destination not allowed',chain\"",
+						"SecRule SERVER_NAME \"!@rx ^(?:.+\\.example\\.com)$\" \"t:lowercase\"",
+						"SecRuleEngine On",
+					},
+				},
+				metricLabels:           map[string]string{},
+				defaultDirectives:      "default",
+				perAuthorityDirectives: map[string]string{},
+				perDirectionDirectives: map[string]string{"outbound": "egress"},
+				egressAllowlist:        true,
+			},
+		},
+		{
+			name: "unsupported policy kind",
+			config: `
+			{
+				"apiVersion": "waf.coraza.io/v1alpha1",
+				"kind": "RateLimitPolicy"
+			}
+			`,
+			expectErr: errors.New("unsupported policy kind: \"RateLimitPolicy\""),
+		},
+		{
+			name: "unsupported policy mode",
+			config: `
+			{
+				"apiVersion": "waf.coraza.io/v1alpha1",
+				"kind": "WAFPolicy",
+				"spec": {"ruleSets": [{"name": "default", "mode": "Block"}]}
+			}
+			`,
+			expectErr: errors.New("unsupported mode for rule set \"default\": \"Block\""),
+		},
+		{
+			name: "oversized body handoff",
+			config: `
+			{
+				"oversized_body_handoff": {"limit": 1048576}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				bodyHandoff:            bodyHandoffConfig{header: "x-coraza-handoff", limit: 1048576},
+			},
+		},
+		{
+			name: "invalid oversized body handoff limit",
+			config: `
+			{
+				"oversized_body_handoff": {"header": "x-handoff"}
+			}
+			`,
+			expectErr: errors.New("invalid oversized_body_handoff limit: 0"),
+		},
+		{
+			name: "metadata variables",
+			config: `
+			{
+				"metadata_variables": [
+					{"name": "jwt_sub", "path": ["metadata", "filter_metadata", "envoy.filters.http.jwt_authn", "jwt_payload", "sub"]}
+				]
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				metadataVariables: []metadataVariable{
+					{name: "jwt_sub", path: []string{"metadata", "filter_metadata", "envoy.filters.http.jwt_authn", "jwt_payload", "sub"}},
+				},
+			},
+		},
+		{
+			name: "missing metadata variable path",
+			config: `
+			{
+				"metadata_variables": [{"name": "jwt_sub"}]
+			}
+			`,
+			expectErr: errors.New("missing path for metadata variable \"jwt_sub\""),
+		},
+		{
+			name: "decision metadata",
+			config: `
+			{
+				"decision_metadata": {"score_buckets": [5, 10, 25], "filter_state": false}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				decisionMetadata: decisionMetadataConfig{
+					scoreBuckets: []int{5, 10, 25},
+					headerPrefix: "x-waf-",
+				},
+			},
+		},
+		{
+			name: "decreasing decision metadata score buckets",
+			config: `
+			{
+				"decision_metadata": {"score_buckets": [10, 5]}
+			}
+			`,
+			expectErr: errors.New("score_buckets must be positive and increasing: [10, 5]"),
+		},
+		{
+			name: "per direction directives",
+			config: `
+			{
+				"directives_map": {"default": [], "egress": []},
+				"default_directives": "default",
+				"per_direction_directives": {"outbound": "egress"}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{"default": nil, "egress": nil},
+				metricLabels:           map[string]string{},
+				defaultDirectives:      "default",
+				perAuthorityDirectives: map[string]string{},
+				perDirectionDirectives: map[string]string{"outbound": "egress"},
+			},
+		},
+		{
+			name: "unsupported direction",
+			config: `
+			{
+				"directives_map": {"default": []},
+				"per_direction_directives": {"sideways": "default"}
+			}
+			`,
+			expectErr: errors.New("unsupported traffic direction: \"sideways\""),
+		},
+		{
+			name: "egress allowed destinations",
+			config: `
+			{
+				"directives_map": {"default": [], "egress": ["SecRuleEngine On"]},
+				"default_directives": "default",
+				"per_direction_directives": {"outbound": "egress"},
+				"egress_allowed_destinations": ["api.example.com", "*.GoogleApis.com", "10.0.0.1"]
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap: DirectivesMap{
+					"default": {
+						"SecRule TX:egress_outbound \"@eq 1\" \"id:99800,phase:1,t:none,deny,status:403,log,msg:'Egress destination not allowed',chain\"",
+						"SecRule SERVER_NAME \"!@rx ^(?:api\\.example\\.com|.+\\.googleapis\\.com|10\\.0\\.0\\.1)$\" \"t:lowercase\"",
+					},
+					"egress": {
+						"SecRule TX:egress_outbound \"@eq 1\" \"id:99800,phase:1,t:none,deny,status:403,log,msg:'Egress destination not allowed',chain\"",
+						"SecRule SERVER_NAME \"!@rx ^(?:api\\.example\\.com|.+\\.googleapis\\.com|10\\.0\\.0\\.1)$\" \"t:lowercase\"",
+						"SecRuleEngine On",
+					},
+				},
+				metricLabels:           map[string]string{},
+				defaultDirectives:      "default",
+				perAuthorityDirectives: map[string]string{},
+				perDirectionDirectives: map[string]string{"outbound": "egress"},
+				egressAllowlist:        true,
+			},
+		},
+		{
+			name: "invalid egress destination",
+			config: `
+			{
+				"directives_map": {"egress": []},
+				"per_direction_directives": {"outbound": "egress"},
+				"egress_allowed_destinations": ["api.*.com"]
+			}
+			`,
+			expectErr: errors.New("invalid egress destination: \"api.*.com\""),
+		},
+		{
+			name: "verdict contract",
+			config: `
+			{
+				"verdict_contract": {"filter_state": false}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				verdictContract:        verdictContractConfig{log: true},
+			},
+		},
+		{
+			name: "warmup",
+			config: `
+			{
+				"warmup": true
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				warmup:                 true,
+			},
+		},
+		{
+			name: "validate",
+			config: `
+			{
+				"validate": true
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				validate:               true,
+			},
+		},
+		{
+			name: "default CRS version",
+			config: `
+			{
+				"directives_map": {"default": ["Include @owasp_crs/*.conf"]},
+				"default_directives": "default",
+				"crs_version": {"default": "4.3.0"}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{"default": []string{"Include @owasp_crs/*.conf"}},
+				metricLabels:           map[string]string{},
+				defaultDirectives:      "default",
+				perAuthorityDirectives: map[string]string{},
+				crsVersions:            map[string]string{},
+			},
+		},
+		{
+			name: "response body interruption",
+			config: `
+			{
+				"response_body_interruption": {"action": "replace", "body": "Content removed"}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:            DirectivesMap{},
+				metricLabels:             map[string]string{},
+				perAuthorityDirectives:   map[string]string{},
+				responseBodyInterruption: responseBodyInterruptionConfig{action: "replace", body: []byte("Content removed")},
+			},
+		},
+		{
+			name: "request body streaming",
+			config: `
+			{
+				"request_body_streaming": true
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				requestBodyStreaming:   true,
+			},
+		},
+		{
+			name: "request body decompression",
+			config: `
+			{
+				"request_body_decompression": {"max_size": 1048576}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				bodyDecompression:      bodyDecompressionConfig{maxSize: 1048576},
+			},
+		},
+		{
+			name: "request body decompression with the default maximum size",
+			config: `
+			{
+				"request_body_decompression": {}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				bodyDecompression:      bodyDecompressionConfig{maxSize: defaultDecompressedBodyLimit},
+			},
+		},
+		{
+			name: "response body decompression",
+			config: `
+			{
+				"response_body_decompression": {"max_size": 1048576}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:             DirectivesMap{},
+				metricLabels:              map[string]string{},
+				perAuthorityDirectives:    map[string]string{},
+				responseBodyDecompression: bodyDecompressionConfig{maxSize: 1048576},
+			},
+		},
+		{
+			name: "invalid response body decompression maximum size",
+			config: `
+			{
+				"response_body_decompression": {"max_size": -1}
+			}
+			`,
+			expectErr: errors.New(`invalid response_body_decompression max_size: -1`),
+		},
+		{
+			name: "multipart limits",
+			config: `
+			{
+				"multipart": {"max_part_size": 1048576, "max_files": 5}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				multipart:              multipartConfig{maxPartSize: 1048576, maxFiles: 5},
+			},
+		},
+		{
+			name: "json limits",
+			config: `
+			{
+				"json": {"max_depth": 8, "max_elements": 1000, "reject_invalid": true}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				json:                   jsonConfig{maxDepth: 8, maxElements: 1000, rejectInvalid: true},
+			},
+		},
+		{
+			name: "grpc",
+			config: `
+			{
+				"grpc": {}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				grpc:                   grpcConfig{enabled: true},
+			},
+		},
+		{
+			name: "grpc with request body decompression",
+			config: `
+			{
+				"grpc": {},
+				"request_body_decompression": {"max_size": 1048576}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				grpc:                   grpcConfig{enabled: true, maxDecompressedSize: 1048576},
+				bodyDecompression:      bodyDecompressionConfig{maxSize: 1048576},
+			},
+		},
+		{
+			name: "body processors",
+			config: `
+			{
+				"body_processors": {"text/plain": "json", "application/*+xml": "XML"}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				bodyProcessors: bodyProcessorsConfig{
+					{pattern: "text/plain", processor: "JSON"},
+					{pattern: "application/*+xml", processor: "XML"},
+				},
+			},
+		},
+		{
+			name: "invalid body processors content type",
+			config: `
+			{
+				"body_processors": {"application/[json": "JSON"}
+			}
+			`,
+			expectErr: errors.New(`invalid body_processors content type: "application/[json"`),
+		},
+		{
+			name: "invalid body processors processor",
+			config: `
+			{
+				"body_processors": {"text/plain": "YAML"}
+			}
+			`,
+			expectErr: errors.New(`invalid body_processors processor for "text/plain": "YAML"`),
+		},
+		{
+			name: "graphql",
+			config: `
+			{
+				"graphql": {}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				graphql:                graphqlConfig{paths: []string{"/graphql"}},
+			},
+		},
+		{
+			name: "graphql limits",
+			config: `
+			{
+				"directives_map": {"default": ["SecRuleEngine On"]},
+				"default_directives": "default",
+				"graphql": {"paths": ["/api/graphql"], "max_depth": 8, "max_fields": 100}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap: DirectivesMap{"default": {
+					"SecRule TX:graphql_depth \"@gt 8\" \"id:99600,phase:2,deny,status:400,log,msg:'GraphQL query depth exceeds 8'\"",
+					"SecRule TX:graphql_fields \"@gt 100\" \"id:99601,phase:2,deny,status:400,log,msg:'GraphQL query fields exceed 100'\"",
+					"SecRuleEngine On",
+				}},
+				metricLabels:           map[string]string{},
+				defaultDirectives:      "default",
+				perAuthorityDirectives: map[string]string{},
+				graphql:                graphqlConfig{paths: []string{"/api/graphql"}, maxDepth: 8, maxFields: 100},
+			},
+		},
+		{
+			name: "invalid graphql path",
+			config: `
+			{
+				"graphql": {"paths": ["graphql"]}
+			}
+			`,
+			expectErr: errors.New(`invalid graphql path: "graphql"`),
+		},
+		{
+			name: "charset conversion",
+			config: `
+			{
+				"charset_conversion": {"default_charset": "ISO-8859-1"}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				charsetConversion:      charsetConversionConfig{enabled: true, defaultCharset: "iso-8859-1"},
+			},
+		},
+		{
+			name: "urlencoded nested fields",
+			config: `
+			{
+				"urlencoded": {"nested_fields": true}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				urlencoded:             urlencodedConfig{nestedFields: true},
+			},
+		},
+		{
+			name: "invalid urlencoded nested fields",
+			config: `
+			{
+				"urlencoded": {"nested_fields": "yes"}
+			}
+			`,
+			expectErr: errors.New(`invalid urlencoded nested_fields: "yes"`),
+		},
+		{
+			name: "invalid request body decompression maximum size",
+			config: `
+			{
+				"request_body_decompression": {"max_size": "1MB"}
+			}
+			`,
+			expectErr: errors.New(`invalid request_body_decompression max_size: "1MB"`),
+		},
+		{
+			name: "failure policy",
+			config: `
+			{
+				"failure_policy": {"body_limit": "closed", "parse_error": "open"}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				failurePolicy:          failurePolicy{failureBodyLimit: failClosed, failureParseError: failOpen},
+			},
+		},
+		{
+			name: "unsupported failure class",
+			config: `
+			{
+				"failure_policy": {"disk_full": "closed"}
+			}
+			`,
+			expectErr: errors.New("unsupported failure class: \"disk_full\""),
+		},
+		{
+			name: "memory pressure",
+			config: `
+			{
+				"failure_policy": {"memory_pressure": "closed"},
+				"memory_pressure_threshold": 268435456
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:           DirectivesMap{},
+				metricLabels:            map[string]string{},
+				perAuthorityDirectives:  map[string]string{},
+				failurePolicy:           failurePolicy{failureMemoryPressure: failClosed},
+				memoryPressureThreshold: 268435456,
+			},
+		},
+		{
+			name: "invalid memory pressure threshold",
+			config: `
+			{
+				"memory_pressure_threshold": "256MiB"
+			}
+			`,
+			expectErr: errors.New(`invalid memory_pressure_threshold: "256MiB"`),
+		},
+		{
+			name: "unsupported failure policy",
+			config: `
+			{
+				"failure_policy": {"engine_error": "ajar"}
+			}
+			`,
+			expectErr: errors.New("unsupported failure policy for engine_error: \"ajar\""),
+		},
+		{
+			name: "evaluation deadline",
+			config: `
+			{
+				"evaluation_deadline": "20ms",
+				"failure_policy": {"deadline": "closed"}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				failurePolicy:          failurePolicy{failureDeadline: failClosed},
+				evaluationDeadline:     20 * time.Millisecond,
+			},
+		},
+		{
+			name: "negative evaluation deadline",
+			config: `
+			{
+				"evaluation_deadline": "-1ms"
+			}
+			`,
+			expectErr: errors.New("evaluation_deadline must be positive: \"-1ms\""),
+		},
+		{
+			name: "internal redirects",
+			config: `
+			{
+				"internal_redirects": "skip_request"
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				internalRedirects:      internalRedirectsSkipRequest,
+			},
+		},
+		{
+			name: "unsupported internal redirects mode",
+			config: `
+			{
+				"internal_redirects": "follow"
+			}
+			`,
+			expectErr: errors.New("unsupported internal_redirects mode: \"follow\""),
+		},
+		{
+			name: "response only",
+			config: `
+			{
+				"response_only": true
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				responseOnly:           true,
+			},
+		},
+		{
+			name: "gc when idle",
+			config: `
+			{
+				"gc_when_idle": true
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				gcWhenIdle:             true,
+			},
+		},
+		{
+			name: "route metadata",
+			config: `
+			{
+				"directives_map": {"default": ["SecRuleEngine On"]},
+				"route_metadata": {}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap: DirectivesMap{"default": {
+					"SecRule TX:route_mode \"@streq enforce\" \"id:99700,phase:1,pass,nolog,ctl:ruleEngine=On\"",
+					"SecRule TX:route_mode \"@streq detect\" \"id:99701,phase:1,pass,nolog,ctl:ruleEngine=DetectionOnly\"",
+					"SecRule TX:route_mode \"@streq off\" \"id:99702,phase:1,pass,nolog,ctl:ruleEngine=Off\"",
+					"SecRuleEngine On",
+				}},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				routeMetadata: routeMetadataConfig{
+					path: []string{"xds", "route_metadata", "filter_metadata", "coraza"},
+				},
+			},
+		},
+		{
+			name: "route metadata unsupported by the host",
+			config: `
+			{
+				"host": "nginx",
+				"route_metadata": {"namespace": "waf"}
+			}
+			`,
+			expectErr: errors.New("route_metadata is not supported by host \"nginx\""),
+		},
+		{
+			name: "remote rules",
+			config: `
+			{
+				"directives_map": {"default": ["SecRuleEngine On"], "edge": ["SecRuleEngine DetectionOnly"]},
+				"default_directives": "default",
+				"rules_remote": {
+					"cluster": "rules_server",
+					"path": "/bundles/edge.json",
+					"timeout": "2s",
+					"sha256": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+					"directives": "edge"
+				}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{"default": {"SecRuleEngine On"}, "edge": {"SecRuleEngine DetectionOnly"}},
+				metricLabels:           map[string]string{},
+				defaultDirectives:      "default",
+				perAuthorityDirectives: map[string]string{},
+				remoteRules: remoteRulesConfig{
+					cluster:   "rules_server",
+					authority: "rules_server",
+					path:      "/bundles/edge.json",
+					timeout:   2 * time.Second,
+					sha256: []byte{
+						0xe3, 0xb0, 0xc4, 0x42, 0x98, 0xfc, 0x1c, 0x14, 0x9a, 0xfb, 0xf4, 0xc8, 0x99, 0x6f, 0xb9, 0x24,
+						0x27, 0xae, 0x41, 0xe4, 0x64, 0x9b, 0x93, 0x4c, 0xa4, 0x95, 0x99, 0x1b, 0x78, 0x52, 0xb8, 0x55,
+					},
+					directives: "edge",
+				},
+			},
+		},
+		{
+			name: "remote rules defaulting to the default directives",
+			config: `
+			{
+				"rules": ["SecRuleEngine On"],
+				"rules_remote": {"cluster": "rules_server", "authority": "rules.example.com", "path": "/rules", "refresh_interval": "5m"}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{"default": {"SecRuleEngine On"}},
+				metricLabels:           map[string]string{},
+				defaultDirectives:      "default",
+				perAuthorityDirectives: map[string]string{},
+				remoteRules: remoteRulesConfig{
+					cluster:         "rules_server",
+					authority:       "rules.example.com",
+					path:            "/rules",
+					timeout:         defaultRemoteRulesTimeout,
+					refreshInterval: 5 * time.Minute,
+					directives:      "default",
+				},
+			},
+		},
+		{
+			name:      "remote rules without cluster",
+			config:    `{"rules_remote": {"path": "/rules"}}`,
+			expectErr: errors.New("missing rules_remote cluster"),
+		},
+		{
+			name:      "remote rules with invalid path",
+			config:    `{"rules_remote": {"cluster": "rules_server", "path": "rules"}}`,
+			expectErr: errors.New("invalid rules_remote path: \"rules\""),
+		},
+		{
+			name:      "remote rules with invalid timeout",
+			config:    `{"rules_remote": {"cluster": "rules_server", "path": "/rules", "timeout": "0s"}}`,
+			expectErr: errors.New("invalid rules_remote timeout: \"0s\""),
+		},
+		{
+			name:      "remote rules with invalid refresh interval",
+			config:    `{"rules_remote": {"cluster": "rules_server", "path": "/rules", "refresh_interval": "5"}}`,
+			expectErr: errors.New("invalid rules_remote refresh_interval: \"5\""),
+		},
+		{
+			name:      "remote rules with invalid sha256",
+			config:    `{"rules_remote": {"cluster": "rules_server", "path": "/rules", "sha256": "e3b0c442"}}`,
+			expectErr: errors.New("invalid rules_remote sha256: \"e3b0c442\""),
+		},
+		{
+			name: "remote rules with unknown directives",
+			config: `
+			{
+				"directives_map": {"default": []},
+				"default_directives": "default",
+				"rules_remote": {"cluster": "rules_server", "path": "/rules", "directives": "edge"}
+			}
+			`,
+			expectErr: errors.New("directive map not found for rules_remote: \"edge\""),
+		},
+		{
+			name: "sampling",
+			config: `
+			{
+				"directives_map": {"default": [], "headers": []},
+				"default_directives": "default",
+				"sampling": {"full_inspection_percentage": 10, "headers_only_directives": "headers"}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{"default": nil, "headers": nil},
+				metricLabels:           map[string]string{},
+				defaultDirectives:      "default",
+				perAuthorityDirectives: map[string]string{},
+				sampling:               samplingConfig{configured: true, fullInspectionRatio: 0.1, headersOnlyDirectives: "headers"},
+			},
+		},
+		{
+			name: "sampling without percentage",
+			config: `
+			{
+				"sampling": {}
+			}
+			`,
+			expectErr: errors.New("missing sampling full_inspection_percentage"),
+		},
+		{
+			name: "sampling percentage out of range",
+			config: `
+			{
+				"sampling": {"full_inspection_percentage": 150}
+			}
+			`,
+			expectErr: errors.New("sampling full_inspection_percentage must be between 0 and 100: 150"),
+		},
+		{
+			name: "sampling unknown directives",
+			config: `
+			{
+				"directives_map": {"default": []},
+				"sampling": {"full_inspection_percentage": 10, "headers_only_directives": "headers"}
+			}
+			`,
+			expectErr: errors.New("directive map not found for sampling headers_only_directives: \"headers\""),
+		},
+		{
+			name: "unique id",
+			config: `
+			{
+				"unique_id": {"generator": "snowflake", "node_id": 12}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:          DirectivesMap{},
+				metricLabels:           map[string]string{},
+				perAuthorityDirectives: map[string]string{},
+				uniqueID:               uniqueIDConfig{generator: "snowflake", nodeID: 12},
+			},
+		},
+		{
+			name: "unsupported unique id generator",
+			config: `
+			{
+				"unique_id": {"generator": "ulid"}
+			}
+			`,
+			expectErr: errors.New("unsupported unique_id generator: \"ulid\""),
+		},
+		{
+			name: "unique id node id out of range",
+			config: `
+			{
+				"unique_id": {"generator": "snowflake", "node_id": 1024}
+			}
+			`,
+			expectErr: errors.New("unique_id node_id must be between 0 and 1023: 1024"),
+		},
+		{
+			name: "rule sets selected by server name and header",
+			config: `
+			{
+				"directives_map": {"default": [], "api": [], "strict": []},
+				"default_directives": "default",
+				"per_sni_directives": {"*.api.example.com": "api"},
+				"directives_header": {"name": "X-WAF-Rule-Set", "allowed": ["strict", "api"]}
+			}
+			`,
+			expectConfig: pluginConfiguration{
+				directivesMap:           DirectivesMap{"default": nil, "api": nil, "strict": nil},
+				metricLabels:            map[string]string{},
+				defaultDirectives:       "default",
+				perAuthorityDirectives:  map[string]string{},
+				perServerNameDirectives: map[string]string{"*.api.example.com": "api"},
+				directivesHeader: directivesHeaderConfig{
+					name:    "x-waf-rule-set",
+					allowed: map[string]struct{}{"strict": {}, "api": {}},
+				},
+			},
+		},
+		{
+			name:      "unknown server name directives",
+			config:    `{"directives_map": {"default": []}, "per_sni_directives": {"api.example.com": "api"}}`,
+			expectErr: errors.New("directive map not found for server name api.example.com: \"api\""),
+		},
+		{
+			name:      "invalid wildcard server name",
+			config:    `{"directives_map": {"api": []}, "per_sni_directives": {"api.*.com": "api"}}`,
+			expectErr: errors.New("invalid server name, wildcards are only supported as \"*.<domain>\": \"api.*.com\""),
+		},
+		{
+			name:      "directives header without allowed rule sets",
+			config:    `{"directives_map": {"default": []}, "directives_header": {"name": "x-waf-rule-set"}}`,
+			expectErr: errors.New("missing directives_header allowed rule sets"),
+		},
+		{
+			name:      "directives header with unknown rule set",
+			config:    `{"directives_map": {"default": []}, "directives_header": {"name": "x-waf-rule-set", "allowed": ["api"]}}`,
+			expectErr: errors.New("directive map not found for directives_header: \"api\""),
+		},
+		{
+			name: "invalid wildcard authority",
+			config: `
+			{
+				"directives_map": {"default": []},
+				"per_authority_directives": {"www.*.com": "default"}
+			}
+			`,
+			expectErr: errors.New("invalid authority, wildcards are only supported as \"*.<domain>\": \"www.*.com\""),
+		},
+		{
+			name: "unknown CRS plugin",
+			config: `
+			{
+				"directives_map": {"default": ["Include @owasp_crs/*.conf"]},
+				"crs_plugins": ["joomla-rule-exclusions"]
+			}
+			`,
+			expectErr: errors.New("CRS plugin not found: \"joomla-rule-exclusions\""),
+		},
+		{
+			name: "CRS version not embedded",
+			config: `
+			{
+				"directives_map": {"default": ["Include @owasp_crs/*.conf"]},
+				"crs_version": "3.3.5"
+			}
+			`,
+			expectErr: errors.New("CRS version not embedded: \"3.3.5\""),
+		},
+		{
+			name: "CRS version of unknown rule set",
+			config: `
+			{
+				"directives_map": {"default": ["Include @owasp_crs/*.conf"]},
+				"crs_version": {"other": "4.3.0"}
+			}
+			`,
+			expectErr: errors.New("directive map not found for crs_version: \"other\""),
+		},
+		{
+			name: "invalid CRS version",
+			config: `
+			{
+				"directives_map": {"default": ["Include @owasp_crs/*.conf"]},
+				"crs_version": 4.7
+			}
+			`,
+			expectErr: errors.New("invalid crs_version: 4.7"),
+		},
+		{
+			name: "unknown field",
+			config: `
+			{
+				"dierctives_map": {"default": ["SecRuleEngine On"]}
+			}
+			`,
+			expectErr: errors.New("invalid plugin configuration: unknown field \"dierctives_map\", did you mean \"directives_map\"?"),
+		},
+		{
+			name: "unknown nested field",
+			config: `
+			{
+				"verdict_header": {"target": "response", "nmae": "x-waf-verdict"}
+			}
+			`,
+			expectErr: errors.New("invalid plugin configuration: unknown field \"verdict_header.nmae\", did you mean \"verdict_header.name\"?"),
+		},
+		{
+			name: "unknown field of array item",
+			config: `
+			{
+				"dynamic_metric_labels": [{"name": "authority"}, {"name": "route", "max": 10}]
+			}
+			`,
+			expectErr: errors.New("invalid plugin configuration: unknown field \"dynamic_metric_labels[1].max\""),
+		},
+		{
+			name: "invalid compressed directives",
+			config: `
+			{
+				"directives_map_gzip": ["H4sIAAAAAAAA"]
+			}
+			`,
+			expectErr: errors.New("invalid directives_map_gzip: [\"H4sIAAAAAAAA\"]"),
+		},
+		{
+			name: "unsupported response body interruption action",
+			config: `
+			{
+				"response_body_interruption": {"action": "redact"}
+			}
+			`,
+			expectErr: errors.New("unsupported response_body_interruption action: \"redact\""),
+		},
+		{
+			name: "missing response body interruption body",
+			config: `
+			{
+				"response_body_interruption": {"action": "replace"}
+			}
+			`,
+			expectErr: errors.New("missing response_body_interruption body"),
+		},
+		{
+			name: "unsupported host",
+			config: `
+			{
+				"host": "haproxy"
+			}
+			`,
+			expectErr: errors.New("unsupported host: \"haproxy\""),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg, err := parsePluginConfiguration([]byte(testCase.config), func(string) {})
+			assert.Equal(t, testCase.expectErr, err)
+
+			if testCase.expectErr == nil {
+				assert.Equal(t, testCase.expectConfig.directivesMap, cfg.directivesMap)
+				assert.Equal(t, testCase.expectConfig.metricLabels, cfg.metricLabels)
+				assert.Equal(t, testCase.expectConfig.defaultDirectives, cfg.defaultDirectives)
+				assert.Equal(t, testCase.expectConfig.perAuthorityDirectives, cfg.perAuthorityDirectives)
+				assert.Equal(t, testCase.expectConfig.interruptionBody, cfg.interruptionBody)
+				assert.Equal(t, testCase.expectConfig.denyPages, cfg.denyPages)
+				assert.Equal(t, testCase.expectConfig.interruptionHeaders, cfg.interruptionHeaders)
+				assert.Equal(t, testCase.expectConfig.verdictHeader, cfg.verdictHeader)
+				assert.Equal(t, testCase.expectConfig.responseBodyInterruption, cfg.responseBodyInterruption)
+				assert.Equal(t, testCase.expectConfig.dynamicMetricLabels, cfg.dynamicMetricLabels)
+				assert.Equal(t, testCase.expectConfig.matchLogDedupWindow, cfg.matchLogDedupWindow)
+				assert.Equal(t, testCase.expectConfig.statusEndpoint, cfg.statusEndpoint)
+				assert.Equal(t, testCase.expectConfig.bodyHandoff, cfg.bodyHandoff)
+				assert.Equal(t, testCase.expectConfig.metadataVariables, cfg.metadataVariables)
+				assert.Equal(t, testCase.expectConfig.decisionMetadata, cfg.decisionMetadata)
+				assert.Equal(t, testCase.expectConfig.verdictContract, cfg.verdictContract)
+				assert.Equal(t, testCase.expectConfig.warmup, cfg.warmup)
+				assert.Equal(t, testCase.expectConfig.validate, cfg.validate)
+				assert.Equal(t, testCase.expectConfig.failurePolicy, cfg.failurePolicy)
+				assert.Equal(t, testCase.expectConfig.memoryPressureThreshold, cfg.memoryPressureThreshold)
+				assert.Equal(t, testCase.expectConfig.evaluationDeadline, cfg.evaluationDeadline)
+				assert.Equal(t, testCase.expectConfig.internalRedirects, cfg.internalRedirects)
+				assert.Equal(t, testCase.expectConfig.responseOnly, cfg.responseOnly)
+				assert.Equal(t, testCase.expectConfig.gcWhenIdle, cfg.gcWhenIdle)
+				assert.Equal(t, testCase.expectConfig.requestBodyStreaming, cfg.requestBodyStreaming)
+				assert.Equal(t, testCase.expectConfig.bodyDecompression, cfg.bodyDecompression)
+				assert.Equal(t, testCase.expectConfig.responseBodyDecompression, cfg.responseBodyDecompression)
+				assert.Equal(t, testCase.expectConfig.multipart, cfg.multipart)
+				assert.Equal(t, testCase.expectConfig.charsetConversion, cfg.charsetConversion)
+				assert.Equal(t, testCase.expectConfig.json, cfg.json)
+				assert.Equal(t, testCase.expectConfig.urlencoded, cfg.urlencoded)
+				assert.Equal(t, testCase.expectConfig.grpc, cfg.grpc)
+				assert.Equal(t, testCase.expectConfig.graphql, cfg.graphql)
+				assert.Equal(t, testCase.expectConfig.bodyProcessors, cfg.bodyProcessors)
+				assert.Equal(t, testCase.expectConfig.routeMetadata, cfg.routeMetadata)
+				assert.Equal(t, testCase.expectConfig.remoteRules, cfg.remoteRules)
+				assert.Equal(t, testCase.expectConfig.crsVersions, cfg.crsVersions)
+				assert.Equal(t, testCase.expectConfig.sampling, cfg.sampling)
+				assert.Equal(t, testCase.expectConfig.uniqueID, cfg.uniqueID)
+				assert.Equal(t, testCase.expectConfig.perDirectionDirectives, cfg.perDirectionDirectives)
+				assert.Equal(t, testCase.expectConfig.perServerNameDirectives, cfg.perServerNameDirectives)
+				assert.Equal(t, testCase.expectConfig.directivesHeader, cfg.directivesHeader)
+				assert.Equal(t, testCase.expectConfig.istio.perNamespaceDirectives, cfg.istio.perNamespaceDirectives)
+				assert.Equal(t, testCase.expectConfig.istio.perWorkloadDirectives, cfg.istio.perWorkloadDirectives)
+				assert.Equal(t, testCase.expectConfig.istio.metricLabels, cfg.istio.metricLabels)
+				assert.Equal(t, testCase.expectConfig.istio.peerVariables, cfg.istio.peerVariables)
+
+				expectedHost := testCase.expectConfig.host
+				if expectedHost == nil {
+					expectedHost = hostadapter.Envoy
+				}
+				assert.Equal(t, expectedHost, cfg.host)
+			}
+		})
+	}
+}
+
+func TestWAFMap(t *testing.T) {
+	w, _ := coraza.NewWAF(coraza.NewWAFConfig())
+
+	wm := newWAFMap(1)
+	err := wm.put("foo", w)
+	require.NoError(t, err)
+
+	t.Run("get unexisting WAF with no default", func(t *testing.T) {
+		_, _, err := wm.getWAFOrDefault("bar")
+		require.Error(t, err)
+	})
+
+	wm.setDefaultWAF(w)
+
+	t.Run("get existing WAF", func(t *testing.T) {
+		expecteWAF, isDefault, err := wm.getWAFOrDefault("foo")
+		require.NotNil(t, expecteWAF)
+		require.False(t, isDefault)
+		require.NoError(t, err)
+	})
+
+	t.Run("get unexisting WAF", func(t *testing.T) {
+		expecteWAF, isDefault, err := wm.getWAFOrDefault("bar")
+		require.NotNil(t, expecteWAF)
+		require.True(t, isDefault)
+		require.NoError(t, err)
+	})
+
+	wildcardWAF, _ := coraza.NewWAF(coraza.NewWAFConfig())
+	nestedWildcardWAF, _ := coraza.NewWAF(coraza.NewWAFConfig())
+	require.NoError(t, wm.put("*.example.com", wildcardWAF))
+	require.NoError(t, wm.put("*.api.example.com", nestedWildcardWAF))
+
+	t.Run("get WAF by authority", func(t *testing.T) {
+		for authority, expectedWAF := range map[string]coraza.WAF{
+			"foo:8080":             w,
+			"FOO":                  w,
+			"www.example.com":      wildcardWAF,
+			"www.example.com:8443": wildcardWAF,
+			"v1.api.example.com":   nestedWildcardWAF,
+			"api.example.com":      wildcardWAF,
+			"example.com":          w,
+			"www.example.com.evil": w,
+			"[::1]:8080":           w,
+			"wwwexample.com":       w,
+		} {
+			waf, _, err := wm.getWAFOrDefault(authority)
+			require.NoError(t, err)
+			require.Equal(t, expectedWAF, waf, authority)
+		}
 	})
 }
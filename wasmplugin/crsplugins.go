@@ -0,0 +1,116 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// crsPluginsAlias is the directory of the CRS plugins embedded in the rules filesystem,
+// laid out as the plugins directory of CRS: <name>-config.conf, <name>-before.conf and
+// <name>-after.conf, each being optional.
+// See https://coreruleset.org/docs/concepts/plugins/.
+const crsPluginsAlias = "@crs-plugins"
+
+// crsPluginStages are the files of a plugin, the config and before files being included
+// before the CRS rules, the after files after them.
+var (
+	crsPluginStagesBefore = []string{"config", "before"}
+	crsPluginStagesAfter  = []string{"after"}
+)
+
+// parseCRSPlugins returns the names of the enabled CRS plugins, checking they are embedded.
+func parseCRSPlugins(plugins gjson.Result) ([]string, error) {
+	var (
+		names []string
+		err   error
+	)
+	plugins.ForEach(func(_, value gjson.Result) bool {
+		name := value.String()
+		if !crsPluginExists(name) {
+			err = fmt.Errorf("CRS plugin not found: %q", name)
+			return false
+		}
+		names = append(names, name)
+		return true
+	})
+	return names, err
+}
+
+func crsPluginExists(name string) bool {
+	if name == "" || strings.ContainsAny(name, "/*?[") {
+		return false
+	}
+	for _, stage := range append(crsPluginStagesBefore, crsPluginStagesAfter...) {
+		if fileExists(crsPluginFile(name, stage)) {
+			return true
+		}
+	}
+	return false
+}
+
+func crsPluginFile(name, stage string) string {
+	return fmt.Sprintf("%s/%s-%s.conf", crsPluginsAlias, name, stage)
+}
+
+// applyCRSPlugins includes the plugins around the CRS rules included by the directives,
+// following the CRS plugins ordering: the config and before files of all the plugins
+// are included before the first CRS rules file, the after files after the last one.
+// Directives not including the CRS rules are returned unchanged.
+func applyCRSPlugins(directives []string, plugins []string) []string {
+	var lines []string
+	for _, d := range directives {
+		lines = append(lines, strings.Split(d, "\n")...)
+	}
+
+	first, last := -1, -1
+	for i, l := range lines {
+		if isCRSRulesInclude(l) {
+			if first == -1 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first == -1 {
+		return directives
+	}
+
+	result := make([]string, 0, len(lines)+3*len(plugins))
+	result = append(result, lines[:first]...)
+	result = append(result, crsPluginIncludes(plugins, crsPluginStagesBefore)...)
+	result = append(result, lines[first:last+1]...)
+	result = append(result, crsPluginIncludes(plugins, crsPluginStagesAfter)...)
+	result = append(result, lines[last+1:]...)
+	return result
+}
+
+func isCRSRulesInclude(line string) bool {
+	fields := strings.Fields(line)
+	return len(fields) == 2 && strings.EqualFold(fields[0], "Include") &&
+		strings.HasPrefix(strings.Trim(fields[1], `"`), "@owasp_crs/")
+}
+
+// crsPluginIncludes returns the includes of the existing files of the given stages,
+// stage by stage so that the config files of all the plugins precede their rules.
+func crsPluginIncludes(plugins []string, stages []string) []string {
+	var includes []string
+	for _, stage := range stages {
+		for _, name := range plugins {
+			if f := crsPluginFile(name, stage); fileExists(f) {
+				includes = append(includes, "Include "+f)
+			}
+		}
+	}
+	return includes
+}
+
+func fileExists(name string) bool {
+	_, err := fs.Stat(root, name)
+	return err == nil
+}
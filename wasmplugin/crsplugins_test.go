@@ -0,0 +1,85 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+func TestCRSPlugins(t *testing.T) {
+	defer func(r fs.FS) { root = r }(root)
+	root = &rulesFS{
+		fstest.MapFS{
+			"crs-plugins/wordpress-rule-exclusions-config.conf": {},
+			"crs-plugins/wordpress-rule-exclusions-before.conf": {},
+			"crs-plugins/fake-bot-before.conf":                  {},
+			"crs-plugins/fake-bot-after.conf":                   {},
+		},
+		nil,
+		map[string]string{crsPluginsAlias: "crs-plugins"},
+	}
+
+	plugins, err := parseCRSPlugins(gjson.Parse(`["wordpress-rule-exclusions", "fake-bot"]`))
+	require.NoError(t, err)
+	require.Equal(t, []string{"wordpress-rule-exclusions", "fake-bot"}, plugins)
+
+	_, err = parseCRSPlugins(gjson.Parse(`["joomla-rule-exclusions"]`))
+	require.Equal(t, errors.New(`CRS plugin not found: "joomla-rule-exclusions"`), err)
+
+	directives := applyCRSPlugins([]string{
+		"SecRuleEngine On",
+		"Include @crs-setup-conf\nInclude @owasp_crs/REQUEST-901-INITIALIZATION.conf",
+		"Include @owasp_crs/REQUEST-942-APPLICATION-ATTACK-SQLI.conf",
+		`SecRule REQUEST_URI "@streq /admin" "id:101,phase:1,deny"`,
+	}, plugins)
+	require.Equal(t, []string{
+		"SecRuleEngine On",
+		"Include @crs-setup-conf",
+		"Include @crs-plugins/wordpress-rule-exclusions-config.conf",
+		"Include @crs-plugins/wordpress-rule-exclusions-before.conf",
+		"Include @crs-plugins/fake-bot-before.conf",
+		"Include @owasp_crs/REQUEST-901-INITIALIZATION.conf",
+		"Include @owasp_crs/REQUEST-942-APPLICATION-ATTACK-SQLI.conf",
+		"Include @crs-plugins/fake-bot-after.conf",
+		`SecRule REQUEST_URI "@streq /admin" "id:101,phase:1,deny"`,
+	}, directives)
+
+	// Rule sets not including the CRS are left unchanged
+	directives = []string{"SecRuleEngine On"}
+	require.Equal(t, directives, applyCRSPlugins(directives, plugins))
+}
+
+func TestCRSPluginLoads(t *testing.T) {
+	// The plugin is loaded next to the embedded CRS, its rule ID being defined twice failing
+	// the compilation
+	rules := fstest.MapFS{
+		"crs-plugins/fake-bot-before.conf": {Data: []byte(`SecAction "id:9504110,phase:1,pass,nolog"`)},
+	}
+	require.NoError(t, fs.WalkDir(root, "crs", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(root, path)
+		rules[path] = &fstest.MapFile{Data: data}
+		return err
+	}))
+	setup, err := fs.ReadFile(root, "crs-setup.conf.example")
+	require.NoError(t, err)
+	rules["crs-setup.conf.example"] = &fstest.MapFile{Data: setup}
+
+	defer func(r fs.FS) { root = r }(root)
+	root = newRulesFS(rules)
+
+	plugins, err := parseCRSPlugins(gjson.Parse(`["fake-bot"]`))
+	require.NoError(t, err)
+	directives := applyCRSPlugins([]string{"Include @crs-setup-conf\nInclude @owasp_crs/*.conf"}, plugins)
+	require.NoError(t, compileDirectives(directives, root))
+	require.Error(t, compileDirectives(append(directives, `SecAction "id:9504110,phase:1,pass,nolog"`), root))
+}
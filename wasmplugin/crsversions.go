@@ -0,0 +1,99 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// defaultCRSVersion is the version of the CRS embedded under @owasp_crs.
+const defaultCRSVersion = "4.3.0"
+
+// crsVersionsDir is the directory of the other embedded CRS releases, each laid out as
+// <version>/crs-setup.conf.example and <version>/rules/.
+const crsVersionsDir = "crs-versions"
+
+// parseCRSVersions returns the CRS versions pinned by the rule sets, by name. A version
+// applies to all the rule sets, an object maps rule sets to versions. The rule sets using
+// the default version are left out.
+func parseCRSVersions(crsVersion gjson.Result, directivesMap DirectivesMap) (map[string]string, error) {
+	versions := map[string]string{}
+	switch {
+	case crsVersion.Type == gjson.String:
+		for name := range directivesMap {
+			versions[name] = crsVersion.String()
+		}
+	case crsVersion.IsObject():
+		for name, version := range crsVersion.Map() {
+			if _, ok := directivesMap[name]; !ok {
+				return nil, fmt.Errorf("directive map not found for crs_version: %q", name)
+			}
+			versions[name] = version.String()
+		}
+	default:
+		return nil, fmt.Errorf("invalid crs_version: %s", crsVersion.Raw)
+	}
+
+	for name, version := range versions {
+		if version == defaultCRSVersion {
+			delete(versions, name)
+			continue
+		}
+		if !crsVersionExists(version) {
+			return nil, fmt.Errorf("CRS version not embedded: %q", version)
+		}
+	}
+	return versions, nil
+}
+
+func crsVersionExists(version string) bool {
+	if version == "" || version == "." || version == ".." || strings.ContainsAny(version, "/*?[") {
+		return false
+	}
+	return fileExists(fmt.Sprintf("%s/%s/rules", crsVersionsDir, version))
+}
+
+// crsRootFS returns the filesystem of the rule set, serving the pinned CRS version if any.
+func crsRootFS(rootFS fs.FS, crsVersions map[string]string, name string) fs.FS {
+	version, ok := crsVersions[name]
+	if !ok {
+		return rootFS
+	}
+	return crsVersionFS{base: rootFS, dir: fmt.Sprintf("%s/%s", crsVersionsDir, version)}
+}
+
+// crsVersionFS serves a pinned CRS release under the aliases of the default one.
+type crsVersionFS struct {
+	base fs.FS
+	dir  string
+}
+
+func (c crsVersionFS) Open(name string) (fs.File, error) {
+	return c.base.Open(c.mapPath(name))
+}
+
+func (c crsVersionFS) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(c.base, c.mapPath(name))
+}
+
+func (c crsVersionFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(c.base, c.mapPath(name))
+}
+
+func (c crsVersionFS) mapPath(name string) string {
+	switch name {
+	case "@owasp_crs":
+		return c.dir + "/rules"
+	case "@crs-setup-conf", "@crs-setup-demo-conf":
+		return c.dir + "/crs-setup.conf.example"
+	}
+	if file, ok := strings.CutPrefix(name, "@owasp_crs/"); ok {
+		return c.dir + "/rules/" + file
+	}
+	return name
+}
@@ -0,0 +1,72 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+func TestCRSVersions(t *testing.T) {
+	defer func(r fs.FS) { root = r }(root)
+	root = newRulesFS(fstest.MapFS{
+		"crs-setup.conf.example":                                   {Data: []byte(`SecAction "id:900990,phase:1,pass,nolog,setvar:tx.crs_setup_version=430"`)},
+		"crs/REQUEST-901-INITIALIZATION.conf":                      {Data: []byte(`SecAction "id:901001,phase:1,pass,nolog"`)},
+		"crs-versions/4.9.0/crs-setup.conf.example":                {Data: []byte(`SecAction "id:900990,phase:1,pass,nolog,setvar:tx.crs_setup_version=490"`)},
+		"crs-versions/4.9.0/rules/REQUEST-901-INITIALIZATION.conf": {Data: []byte(`SecAction "id:901002,phase:1,pass,nolog"`)},
+	})
+
+	directivesMap := DirectivesMap{
+		"current": {"Include @crs-setup-conf", "Include @owasp_crs/*.conf"},
+		"next":    {"Include @crs-setup-conf", "Include @owasp_crs/*.conf"},
+	}
+
+	versions, err := parseCRSVersions(gjson.Parse(`{"current": "4.3.0", "next": "4.9.0"}`), directivesMap)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"next": "4.9.0"}, versions)
+
+	_, err = parseCRSVersions(gjson.Parse(`"4.8.0"`), directivesMap)
+	require.Equal(t, errors.New(`CRS version not embedded: "4.8.0"`), err)
+
+	_, err = parseCRSVersions(gjson.Parse(`"../crs-versions/4.9.0"`), directivesMap)
+	require.Equal(t, errors.New(`CRS version not embedded: "../crs-versions/4.9.0"`), err)
+
+	// Each rule set loads the rules of its CRS version under the same aliases, a rule ID
+	// defined twice failing the compilation
+	for name, ruleID := range map[string]string{"current": "901001", "next": "901002"} {
+		rootFS := crsRootFS(root, versions, name)
+		require.NoError(t, compileDirectives(directivesMap[name], rootFS), name)
+		require.Error(t, compileDirectives(append(directivesMap[name],
+			`SecAction "id:`+ruleID+`,phase:1,pass,nolog"`), rootFS), name)
+	}
+
+	setup, err := fs.ReadFile(crsRootFS(root, versions, "next"), "@crs-setup-conf")
+	require.NoError(t, err)
+	require.Contains(t, string(setup), "crs_setup_version=490")
+}
+
+func TestEmbeddedCRSVersion(t *testing.T) {
+	directivesMap := DirectivesMap{
+		"pinned": {"Include @crs-setup-conf", "Include @owasp_crs/*.conf"},
+	}
+
+	versions, err := parseCRSVersions(gjson.Parse(`"4.7.0"`), directivesMap)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"pinned": "4.7.0"}, versions)
+
+	rootFS := crsRootFS(root, versions, "pinned")
+	require.NoError(t, compileDirectives(directivesMap["pinned"], rootFS))
+
+	setup, err := fs.ReadFile(rootFS, "@crs-setup-conf")
+	require.NoError(t, err)
+	require.Contains(t, string(setup), "OWASP_CRS/4.7.0")
+	rules, err := fs.ReadFile(rootFS, "@owasp_crs/REQUEST-901-INITIALIZATION.conf")
+	require.NoError(t, err)
+	require.Contains(t, string(rules), "OWASP_CRS/4.7.0")
+}
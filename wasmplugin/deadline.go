@@ -0,0 +1,52 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// phaseStart returns the start time of the evaluation of a phase, or the zero time if
+// no evaluation deadline is configured.
+func (ctx *httpContext) phaseStart() time.Time {
+	if ctx.evaluationDeadline == 0 {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// checkDeadline stops the inspection of the transaction if the evaluation of the phase
+// exceeded the deadline, the rules of the following phases being skipped. Coraza can not
+// abort the evaluation of a phase, hence the deadline bounds the latency added by the
+// following phases only. The failure policy of the deadline class is then applied.
+func (ctx *httpContext) checkDeadline(phase interruptionPhase, start time.Time) (types.Action, bool) {
+	if ctx.evaluationDeadline == 0 {
+		return types.ActionContinue, false
+	}
+	elapsed := time.Since(start)
+	if elapsed <= ctx.evaluationDeadline {
+		return types.ActionContinue, false
+	}
+	ctx.skippedPhases = skippedPhases(phase)
+	ctx.logger.Warn().
+		Str("phase", phase.String()).
+		Str("elapsed", elapsed.String()).
+		Str("skipped_phases", strings.Join(ctx.skippedPhases, ",")).
+		Msg("Evaluation deadline exceeded, skipping the rules of the following phases")
+	ctx.inspectionStopped = true
+	return ctx.handleFailure(phase, failureDeadline), true
+}
+
+// skippedPhases returns the phases following the given one, whose rules are skipped once
+// the inspection is stopped. The logging phase still runs.
+func skippedPhases(phase interruptionPhase) []string {
+	var phases []string
+	for p := phase + 1; p <= interruptionPhaseHttpResponseBody; p++ {
+		phases = append(phases, p.String())
+	}
+	return phases
+}
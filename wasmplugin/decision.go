@@ -0,0 +1,99 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tidwall/gjson"
+)
+
+const defaultDecisionHeaderPrefix = "x-waf-"
+
+// decisionMetadataConfig configures the structured decisions published after the request
+// headers phase for the filters running after the WAF ("WAF scores, Envoy enforces"):
+//   - as request headers, e.g. consumed by the ratelimit filter request_headers descriptor
+//     action or by RBAC header matchers;
+//   - as filter state objects (wasm.waf_score_bucket and wasm.waf_offender in Envoy),
+//     e.g. consumed by RBAC filter_state matchers.
+type decisionMetadataConfig struct {
+	// scoreBuckets are the lower bounds of the anomaly score buckets, in increasing order.
+	scoreBuckets []int
+	headerPrefix string
+	filterState  bool
+}
+
+func (c decisionMetadataConfig) enabled() bool {
+	return len(c.scoreBuckets) > 0
+}
+
+func parseDecisionMetadata(decision gjson.Result) (decisionMetadataConfig, error) {
+	config := decisionMetadataConfig{
+		headerPrefix: defaultDecisionHeaderPrefix,
+		filterState:  true,
+	}
+	if prefix := decision.Get("header_prefix"); prefix.Exists() {
+		config.headerPrefix = prefix.String()
+	}
+	if filterState := decision.Get("filter_state"); filterState.Exists() {
+		config.filterState = filterState.Bool()
+	}
+
+	var err error
+	decision.Get("score_buckets").ForEach(func(_, value gjson.Result) bool {
+		bound := int(value.Int())
+		if n := len(config.scoreBuckets); bound <= 0 || (n > 0 && bound <= config.scoreBuckets[n-1]) {
+			err = fmt.Errorf("score_buckets must be positive and increasing: %s", decision.Get("score_buckets").Raw)
+			return false
+		}
+		config.scoreBuckets = append(config.scoreBuckets, bound)
+		return true
+	})
+	if err != nil {
+		return config, err
+	}
+	if len(config.scoreBuckets) == 0 {
+		return config, errors.New("missing decision_metadata score_buckets")
+	}
+	return config, nil
+}
+
+// scoreBucket returns the name of the bucket the score falls into, e.g. "5-9" or "25+".
+func (c decisionMetadataConfig) scoreBucket(score int) string {
+	lower := 0
+	for _, upper := range c.scoreBuckets {
+		if score < upper {
+			return strconv.Itoa(lower) + "-" + strconv.Itoa(upper-1)
+		}
+		lower = upper
+	}
+	return strconv.Itoa(lower) + "+"
+}
+
+// publishDecision publishes the decision about the transaction so far.
+func (c decisionMetadataConfig) publishDecision(tx ctypes.Transaction) {
+	score, _ := anomalyScore(tx)
+	decision := [][2]string{
+		{"score_bucket", c.scoreBucket(score)},
+		{"offender", strconv.FormatBool(len(matchedRuleIDs(tx)) > 0)},
+	}
+
+	for _, d := range decision {
+		if c.headerPrefix != "" {
+			if err := proxywasm.ReplaceHttpRequestHeader(c.headerPrefix+strings.ReplaceAll(d[0], "_", "-"), d[1]); err != nil {
+				proxywasm.LogErrorf("Failed to add decision request header: %v", err)
+			}
+		}
+		if c.filterState {
+			if err := proxywasm.SetProperty([]string{"waf_" + d[0]}, []byte(d[1])); err != nil {
+				proxywasm.LogErrorf("Failed to set decision filter state: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,24 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScoreBucket(t *testing.T) {
+	c := decisionMetadataConfig{scoreBuckets: []int{5, 10, 25}}
+	for score, expected := range map[int]string{
+		0:   "0-4",
+		4:   "0-4",
+		5:   "5-9",
+		24:  "10-24",
+		25:  "25+",
+		100: "25+",
+	} {
+		require.Equal(t, expected, c.scoreBucket(score), "score %d", score)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+	"github.com/tidwall/gjson"
+)
+
+// defaultDecompressedBodyLimit is the default maximum size of a decompressed body.
+const defaultDecompressedBodyLimit = 10 << 20
+
+// decompressionChunkSize is the size of the chunks of the decompressed body written to the
+// transaction, the decompression stopping once the transaction does not accept more.
+const decompressionChunkSize = 32 << 10
+
+var errMaxSizeExceeded = errors.New("decompressed body exceeds the maximum size")
+
+// bodyDecompressionConfig configures the decompression of the bodies encoded with gzip or
+// deflate, inspected decompressed. The bodies are still forwarded encoded.
+type bodyDecompressionConfig struct {
+	// maxSize is the maximum size of a decompressed body, guarding against compression bombs.
+	maxSize int
+}
+
+func parseBodyDecompression(field string, decompression gjson.Result) (bodyDecompressionConfig, error) {
+	c := bodyDecompressionConfig{maxSize: defaultDecompressedBodyLimit}
+	if maxSize := decompression.Get("max_size"); maxSize.Exists() {
+		c.maxSize = int(maxSize.Int())
+		if maxSize.Type != gjson.Number || c.maxSize <= 0 {
+			return c, fmt.Errorf("invalid %s max_size: %s", field, maxSize.Raw)
+		}
+	}
+	return c, nil
+}
+
+func (c bodyDecompressionConfig) enabled() bool {
+	return c.maxSize > 0
+}
+
+// decompressibleEncoding returns the content-encoding header value if the body can be
+// decompressed, empty otherwise.
+func decompressibleEncoding(encoding string, err error) string {
+	if err != nil {
+		return ""
+	}
+	switch encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding {
+	case "gzip", "x-gzip", "deflate":
+		return encoding
+	default:
+		return ""
+	}
+}
+
+func newDecompressor(encoding string, body []byte) (io.Reader, error) {
+	if encoding == "deflate" {
+		// deflate is meant to be zlib wrapped, some clients send raw deflate data though
+		r, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return flate.NewReader(bytes.NewReader(body)), nil
+		}
+		return r, nil
+	}
+	return gzip.NewReader(bytes.NewReader(body))
+}
+
+// bufferCompressedRequestBody collects the encoded request body, decompressed and written
+// to the transaction at the end of the stream, when the phase 2 rules run.
+func (ctx *httpContext) bufferCompressedRequestBody(bodySize int, endOfStream bool) types.Action {
+	chunkSize := bodySize - ctx.bodyReadIndex
+	if chunkSize > 0 {
+		bodyChunk, err := proxywasm.GetHttpRequestBody(ctx.bodyReadIndex, chunkSize)
+		if err != nil {
+			ctx.logger.Error().Err(err).Msg("Failed to read request body")
+			return ctx.handleFailure(interruptionPhaseHttpRequestBody, failureEngineError)
+		}
+		// The encoded body is not expected to be larger than the decompressed one, it is truncated
+		// past the maximum size
+		room := ctx.bodyDecompression.maxSize - len(ctx.compressedBody)
+		ctx.compressedBody = append(ctx.compressedBody, bodyChunk[:min(len(bodyChunk), room)]...)
+		ctx.bodyReadIndex += len(bodyChunk)
+	}
+
+	if !endOfStream {
+		if ctx.requestBodyStreaming {
+			// The encoded chunk is kept by the filter only
+			ctx.bodyReadIndex = 0
+			return types.ActionContinue
+		}
+		return types.ActionPause
+	}
+
+	body := ctx.compressedBody
+	ctx.compressedBody = nil
+	failure, action, interrupted := ctx.writeDecompressedRequestBody(body)
+	if interrupted {
+		return action
+	}
+	if len(body) >= ctx.bodyDecompression.maxSize {
+		failure = failureBodyLimit
+	}
+	if action := ctx.processRequestBody(); ctx.interruptedAt.isInterrupted() || failure == "" {
+		return action
+	}
+	return ctx.handleFailure(interruptionPhaseHttpRequestBody, failure)
+}
+
+// writeDecompressedRequestBody writes the decompressed body to the transaction, returning
+// the failure preventing its complete inspection if any.
+func (ctx *httpContext) writeDecompressedRequestBody(body []byte) (failureClass, types.Action, bool) {
+	var (
+		action      types.Action
+		interrupted bool
+	)
+	err := decompressBody(ctx.requestBodyEncoding, body, ctx.bodyDecompression.maxSize, func(chunk []byte) bool {
+		chunk = ctx.requestCharset.convert(chunk)
+		interruption, writtenBytes, err := ctx.tx.WriteRequestBody(chunk)
+		switch {
+		case err != nil:
+			ctx.logger.Error().Err(err).Msg("Failed to write request body")
+			action, interrupted = ctx.handleFailure(interruptionPhaseHttpRequestBody, failureEngineError), true
+		case interruption != nil:
+			ctx.processedRequestBody = true
+			if isBodyLimitInterruption(interruption) {
+				action = ctx.handleBodyLimitInterruption(interruptionPhaseHttpRequestBody, interruption)
+			} else {
+				action = ctx.handleInterruption(interruptionPhaseHttpRequestBody, interruption)
+			}
+			interrupted = true
+		case writtenBytes < len(chunk):
+			// SecRequestBodyLimit reached with ProcessPartial, the partial body has been processed
+			ctx.processedRequestBody = true
+			action, interrupted = ctx.handleFailure(interruptionPhaseHttpRequestBody, failureBodyLimit), true
+		}
+		return !interrupted
+	})
+	switch {
+	case interrupted:
+		return "", action, true
+	case err == errMaxSizeExceeded:
+		ctx.logger.Info().
+			Int("max_size", ctx.bodyDecompression.maxSize).
+			Msg("Decompressed request body exceeds the maximum size, inspecting it partially")
+		return failureBodyLimit, types.ActionContinue, false
+	case err != nil:
+		ctx.logger.Info().Err(err).Str("content_encoding", ctx.requestBodyEncoding).Msg("Failed to decompress request body")
+		return failureParseError, types.ActionContinue, false
+	}
+	return "", types.ActionContinue, false
+}
+
+// decompressBody decompresses the body in chunks passed to write, until write returns false.
+// It returns errMaxSizeExceeded once maxSize bytes are decompressed, before the end of the body.
+func decompressBody(encoding string, body []byte, maxSize int, write func([]byte) bool) error {
+	r, err := newDecompressor(encoding, body)
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, decompressionChunkSize)
+	written := 0
+	for {
+		n, readErr := r.Read(chunk)
+		if written+n > maxSize {
+			n = maxSize - written
+			readErr = errMaxSizeExceeded
+		}
+		if n > 0 {
+			if !write(chunk[:n]) {
+				return nil
+			}
+			written += n
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// inspectCompressedResponseBody decompresses the encoded response body buffered until the end
+// of the stream and runs the phase 4 rules on it. A body failing to decompress is inspected
+// as it is, while the rules run on the body decompressed so far past the maximum size.
+func (ctx *httpContext) inspectCompressedResponseBody(bodySize int) types.Action {
+	ctx.processedResponseBody = true
+	// bodyReadIndex stores the body size that has to be replaced if the transaction is interrupted
+	ctx.bodyReadIndex = bodySize
+	body, err := proxywasm.GetHttpResponseBody(0, min(bodySize, ctx.responseBodyDecompression.maxSize))
+	if err != nil {
+		ctx.logger.Error().Int("body_size", bodySize).Err(err).Msg("Failed to read response body")
+		return types.ActionContinue
+	}
+
+	var interruption *ctypes.Interruption
+	write := func(chunk []byte) bool {
+		chunk = ctx.responseCharset.convert(chunk)
+		i, writtenBytes, err := ctx.tx.WriteResponseBody(chunk)
+		if err != nil {
+			ctx.logger.Error().Err(err).Msg("Failed to write response body")
+			return false
+		}
+		interruption = i
+		return interruption == nil && writtenBytes == len(chunk)
+	}
+	switch err := decompressBody(ctx.responseBodyEncoding, body, ctx.responseBodyDecompression.maxSize, write); {
+	case err == errMaxSizeExceeded:
+		ctx.logger.Info().
+			Int("max_size", ctx.responseBodyDecompression.maxSize).
+			Msg("Decompressed response body exceeds the maximum size, inspecting it partially")
+	case err != nil:
+		ctx.logger.Info().Err(err).Str("content_encoding", ctx.responseBodyEncoding).
+			Msg("Failed to decompress response body, inspecting it as it is")
+		if interruption == nil {
+			write(body)
+		}
+	}
+	if interruption != nil {
+		if isBodyLimitInterruption(interruption) {
+			return ctx.handleBodyLimitInterruption(interruptionPhaseHttpResponseBody, interruption)
+		}
+		return ctx.handleInterruption(interruptionPhaseHttpResponseBody, interruption)
+	}
+
+	ctx.finishCharsetConversion(ctx.responseCharset)
+	interruption, err = ctx.tx.ProcessResponseBody()
+	if err != nil {
+		ctx.logger.Error().Err(err).Msg("Failed to process response body")
+		return types.ActionContinue
+	}
+	if interruption != nil {
+		return ctx.handleInterruption(interruptionPhaseHttpResponseBody, interruption)
+	}
+	return types.ActionContinue
+}
@@ -0,0 +1,64 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDecompressor(t *testing.T) {
+	body := "user=pooh&food=honey"
+	compress := func(newWriter func(io.Writer) io.WriteCloser) []byte {
+		var buf bytes.Buffer
+		w := newWriter(&buf)
+		_, err := w.Write([]byte(body))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		encoding string
+		data     []byte
+	}{
+		{
+			name:     "gzip",
+			encoding: "gzip",
+			data:     compress(func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }),
+		},
+		{
+			name:     "zlib deflate",
+			encoding: "deflate",
+			data:     compress(func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }),
+		},
+		{
+			name:     "raw deflate",
+			encoding: "deflate",
+			data: compress(func(w io.Writer) io.WriteCloser {
+				fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+				return fw
+			}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newDecompressor(tt.encoding, tt.data)
+			require.NoError(t, err)
+			decompressed, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, body, string(decompressed))
+		})
+	}
+
+	_, err := newDecompressor("gzip", []byte(body))
+	require.Error(t, err)
+}
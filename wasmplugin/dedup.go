@@ -0,0 +1,104 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	ctypes "github.com/corazawaf/coraza/v3/types"
+)
+
+// matchDeduplicator collapses identical (client, rule, target) matches happening
+// within a window into a single aggregated event carrying the number of repetitions.
+// The first match of a window is logged straight away, the following ones are only
+// counted and reported once the window expires.
+type matchDeduplicator struct {
+	window time.Duration
+	// flushOnMatch makes expired windows be reported on the next match, for hosts
+	// not implementing ticks.
+	flushOnMatch bool
+	now          func() time.Time
+	log          func(severity ctypes.RuleSeverity, msg string)
+	entries      map[string]*dedupEntry
+}
+
+type dedupEntry struct {
+	start      time.Time
+	severity   ctypes.RuleSeverity
+	msg        string
+	suppressed int
+}
+
+func newMatchDeduplicator(window time.Duration, log func(ctypes.RuleSeverity, string)) *matchDeduplicator {
+	return &matchDeduplicator{
+		window:  window,
+		now:     time.Now,
+		log:     log,
+		entries: make(map[string]*dedupEntry),
+	}
+}
+
+func dedupKey(mr ctypes.MatchedRule) string {
+	var sb strings.Builder
+	sb.WriteString(mr.ClientIPAddress())
+	sb.WriteByte('|')
+	sb.WriteString(strconv.Itoa(mr.Rule().ID()))
+	for _, md := range mr.MatchedDatas() {
+		sb.WriteByte('|')
+		sb.WriteString(md.Variable().Name())
+		sb.WriteByte(':')
+		sb.WriteString(md.Key())
+	}
+	return sb.String()
+}
+
+// logMatchedRule is meant to be used as the WAF error callback.
+func (d *matchDeduplicator) logMatchedRule(mr ctypes.MatchedRule) {
+	if d.flushOnMatch {
+		d.flushExpired()
+	}
+
+	now := d.now()
+	key := dedupKey(mr)
+	if e, ok := d.entries[key]; ok {
+		if now.Sub(e.start) < d.window {
+			e.suppressed++
+			return
+		}
+		d.flushEntry(key, e)
+	}
+
+	severity := mr.Rule().Severity()
+	msg := mr.ErrorLog()
+	d.entries[key] = &dedupEntry{start: now, severity: severity, msg: msg}
+	d.log(severity, msg)
+}
+
+// flushExpired reports the matches suppressed within the windows that are over.
+func (d *matchDeduplicator) flushExpired() {
+	now := d.now()
+	for key, e := range d.entries {
+		if now.Sub(e.start) >= d.window {
+			d.flushEntry(key, e)
+		}
+	}
+}
+
+// flushAll reports all the suppressed matches, regardless of their windows.
+func (d *matchDeduplicator) flushAll() {
+	for key, e := range d.entries {
+		d.flushEntry(key, e)
+	}
+}
+
+func (d *matchDeduplicator) flushEntry(key string, e *dedupEntry) {
+	delete(d.entries, key)
+	if e.suppressed == 0 {
+		return
+	}
+	d.log(e.severity, fmt.Sprintf("%s [repeated %q] [window %q]", e.msg, strconv.Itoa(e.suppressed), d.window))
+}
@@ -0,0 +1,116 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/corazawaf/coraza/v3"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchDeduplicator(t *testing.T) {
+	var logs []string
+	d := newMatchDeduplicator(time.Minute, func(_ ctypes.RuleSeverity, msg string) {
+		logs = append(logs, msg)
+	})
+	now := time.Unix(0, 0)
+	d.now = func() time.Time { return now }
+
+	waf, err := coraza.NewWAF(coraza.NewWAFConfig().
+		WithErrorCallback(d.logMatchedRule).
+		WithDirectives(`SecRule ARGS:q "@contains attack" "id:1,phase:1,log,pass"`))
+	require.NoError(t, err)
+
+	match := func(client string) {
+		tx := waf.NewTransaction()
+		defer tx.Close()
+		tx.ProcessConnection(client, 1234, "127.0.0.1", 80)
+		tx.ProcessURI("/?q=attack", "GET", "HTTP/1.1")
+		tx.ProcessRequestHeaders()
+	}
+
+	match("10.0.0.1")
+	match("10.0.0.1")
+	match("10.0.0.1")
+	require.Len(t, logs, 1)
+
+	// A different client is not deduplicated
+	match("10.0.0.2")
+	require.Len(t, logs, 2)
+
+	// Nothing to flush before the window expires
+	d.flushExpired()
+	require.Len(t, logs, 2)
+
+	now = now.Add(time.Minute)
+	d.flushExpired()
+	require.Len(t, logs, 3)
+	require.Contains(t, logs[2], `[repeated "2"]`)
+	require.Empty(t, d.entries)
+}
+
+func TestMatchDeduplicatorFlushOnMatch(t *testing.T) {
+	var logs []string
+	d := newMatchDeduplicator(time.Minute, func(_ ctypes.RuleSeverity, msg string) {
+		logs = append(logs, msg)
+	})
+	d.flushOnMatch = true
+	now := time.Unix(0, 0)
+	d.now = func() time.Time { return now }
+
+	waf, err := coraza.NewWAF(coraza.NewWAFConfig().
+		WithErrorCallback(d.logMatchedRule).
+		WithDirectives(`SecRule ARGS:q "@contains attack" "id:1,phase:1,log,pass"`))
+	require.NoError(t, err)
+
+	match := func(client string) {
+		tx := waf.NewTransaction()
+		defer tx.Close()
+		tx.ProcessConnection(client, 1234, "127.0.0.1", 80)
+		tx.ProcessURI("/?q=attack", "GET", "HTTP/1.1")
+		tx.ProcessRequestHeaders()
+	}
+
+	match("10.0.0.1")
+	match("10.0.0.1")
+	require.Len(t, logs, 1)
+
+	// Without ticks, the expired window of another client is reported on the next match
+	now = now.Add(time.Minute)
+	match("10.0.0.2")
+	require.Len(t, logs, 3)
+	require.Contains(t, logs[1], `[repeated "1"]`)
+}
+
+func TestMatchDeduplicatorFlushAll(t *testing.T) {
+	var logs []string
+	d := newMatchDeduplicator(time.Hour, func(_ ctypes.RuleSeverity, msg string) {
+		logs = append(logs, msg)
+	})
+
+	waf, err := coraza.NewWAF(coraza.NewWAFConfig().
+		WithErrorCallback(d.logMatchedRule).
+		WithDirectives(`SecRule ARGS:q "@contains attack" "id:1,phase:1,log,pass"`))
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		tx := waf.NewTransaction()
+		tx.ProcessConnection("10.0.0.1", 1234, "127.0.0.1", 80)
+		tx.ProcessURI("/?q=attack", "GET", "HTTP/1.1")
+		tx.ProcessRequestHeaders()
+		require.NoError(t, tx.Close())
+	}
+	require.Len(t, logs, 1)
+
+	// Suppressed matches are reported before their window expires
+	d.flushAll()
+	require.Len(t, logs, 2)
+	require.Contains(t, logs[1], `[repeated "2"]`)
+
+	d.flushAll()
+	require.Len(t, logs, 2)
+}
@@ -0,0 +1,82 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/tidwall/gjson"
+)
+
+// mergeConfiguration merges the plugin configuration over the defaults given by the VM
+// configuration, shared by the plugins of the VM. The objects are merged field by field,
+// e.g. the rule sets of directives_map by name, any other value of the plugin replaces the
+// default one, and a null value removes it.
+func mergeConfiguration(defaults, data []byte) ([]byte, error) {
+	if len(bytes.TrimSpace(defaults)) == 0 {
+		return data, nil
+	}
+
+	defaultsJSON, err := configurationJSON(defaults)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VM configuration: %v", err)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return []byte(defaultsJSON.Raw), nil
+	}
+	dataJSON, err := configurationJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeJSON(json.RawMessage(defaultsJSON.Raw), json.RawMessage(dataJSON.Raw))
+}
+
+// configurationJSON returns the native configuration object of a plugin or VM configuration,
+// translating policy documents.
+func configurationJSON(data []byte) (gjson.Result, error) {
+	data = bytes.TrimSpace(data)
+	if !gjson.ValidBytes(data) {
+		return gjson.Result{}, fmt.Errorf("invalid json: %q", data)
+	}
+	jsonData := gjson.ParseBytes(data)
+	// Istio WasmPlugin pluginConfig might end up JSON encoded as a string
+	if jsonData.Type == gjson.String {
+		if !gjson.Valid(jsonData.String()) {
+			return gjson.Result{}, fmt.Errorf("invalid json: %q", jsonData.String())
+		}
+		jsonData = gjson.Parse(jsonData.String())
+	}
+	if isPolicy(jsonData) {
+		return translatePolicy(jsonData)
+	}
+	return jsonData, nil
+}
+
+func mergeJSON(defaults, override json.RawMessage) (json.RawMessage, error) {
+	var defaultFields, overrideFields map[string]json.RawMessage
+	if json.Unmarshal(defaults, &defaultFields) != nil || json.Unmarshal(override, &overrideFields) != nil ||
+		defaultFields == nil || overrideFields == nil {
+		// Not both objects, the override replaces the default
+		return override, nil
+	}
+
+	for name, value := range overrideFields {
+		if bytes.Equal(bytes.TrimSpace(value), []byte("null")) {
+			delete(defaultFields, name)
+			continue
+		}
+		if defaultValue, ok := defaultFields[name]; ok {
+			merged, err := mergeJSON(defaultValue, value)
+			if err != nil {
+				return nil, err
+			}
+			value = merged
+		}
+		defaultFields[name] = value
+	}
+	return json.Marshal(defaultFields)
+}
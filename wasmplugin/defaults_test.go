@@ -0,0 +1,74 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeConfiguration(t *testing.T) {
+	defaults := `{
+		"directives_map": {"default": ["SecRuleEngine On"], "strict": ["SecRuleEngine On"]},
+		"default_directives": "default",
+		"metric_labels": {"owner": "platform"},
+		"warmup": true
+	}`
+
+	tests := []struct {
+		name     string
+		defaults string
+		data     string
+		expected string
+	}{
+		{
+			name:     "no defaults",
+			data:     `{"warmup": true}`,
+			expected: `{"warmup": true}`,
+		},
+		{
+			name:     "no plugin configuration",
+			defaults: `{"warmup": true}`,
+			expected: `{"warmup": true}`,
+		},
+		{
+			name:     "extended and overridden",
+			defaults: defaults,
+			data: `{
+				"directives_map": {"strict": ["SecRuleEngine On", "Include @owasp_crs/*.conf"], "api": []},
+				"per_authority_directives": {"api.example.com": "api"},
+				"metric_labels": {"team": "api"},
+				"warmup": null
+			}`,
+			expected: `{
+				"directives_map": {
+					"default": ["SecRuleEngine On"],
+					"strict": ["SecRuleEngine On", "Include @owasp_crs/*.conf"],
+					"api": []
+				},
+				"default_directives": "default",
+				"per_authority_directives": {"api.example.com": "api"},
+				"metric_labels": {"owner": "platform", "team": "api"}
+			}`,
+		},
+		{
+			name:     "Istio string encoded",
+			defaults: `"{\"warmup\": true}"`,
+			data:     `"{\"validate\": true}"`,
+			expected: `{"warmup": true, "validate": true}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			merged, err := mergeConfiguration([]byte(tc.defaults), []byte(tc.data))
+			require.NoError(t, err)
+			require.JSONEq(t, tc.expected, string(merged))
+		})
+	}
+
+	_, err := mergeConfiguration([]byte(`{"warmup"`), []byte(`{}`))
+	require.EqualError(t, err, `invalid VM configuration: invalid json: "{\"warmup\""`)
+}
@@ -0,0 +1,122 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// denyPage is a body sent on interruption, to the clients accepting its content type. The
+// placeholders {{request_id}}, {{rule_id}} and {{status}} of the body are replaced by the ID
+// of the transaction, the ID of the interrupting rule and the status code, escaped as the
+// content type requires.
+type denyPage struct {
+	contentType string
+	mediaType   string
+	body        string
+}
+
+// denyPagesConfig are the bodies sent on interruption, the first one being sent to the clients
+// accepting none of them.
+type denyPagesConfig []denyPage
+
+func parseDenyPages(pages gjson.Result) (denyPagesConfig, error) {
+	if !pages.IsArray() {
+		return nil, fmt.Errorf("invalid deny_pages: %s", pages.Raw)
+	}
+	var c denyPagesConfig
+	for i, page := range pages.Array() {
+		contentType, body := page.Get("content_type"), page.Get("body")
+		mediaType, _, err := mime.ParseMediaType(contentType.String())
+		if contentType.Type != gjson.String || err != nil || !strings.Contains(mediaType, "/") {
+			return nil, fmt.Errorf("invalid deny_pages[%d] content_type: %s", i, contentType.Raw)
+		}
+		if body.Type != gjson.String {
+			return nil, fmt.Errorf("invalid deny_pages[%d] body: %s", i, body.Raw)
+		}
+		c = append(c, denyPage{contentType: contentType.String(), mediaType: mediaType, body: body.String()})
+	}
+	if len(c) == 0 {
+		return nil, errors.New("invalid deny_pages: no page")
+	}
+	return c, nil
+}
+
+// response returns the headers and body of the page best accepted by the accept header of the
+// request, nil if no page is configured.
+func (c denyPagesConfig) response(accept string, statusCode int, requestID string, ruleID int) ([][2]string, []byte) {
+	if len(c) == 0 {
+		return nil, nil
+	}
+	page, bestQ := c[0], 0.0
+	for _, p := range c {
+		if q := acceptedQuality(accept, p.mediaType); q > bestQ {
+			page, bestQ = p, q
+		}
+	}
+
+	escape := func(s string) string { return s }
+	switch {
+	case strings.HasSuffix(page.mediaType, "json"):
+		escape = jsonEscape
+	case strings.HasSuffix(page.mediaType, "html"), strings.HasSuffix(page.mediaType, "xml"):
+		escape = html.EscapeString
+	}
+	rule := ""
+	if ruleID != 0 {
+		rule = strconv.Itoa(ruleID)
+	}
+	body := strings.NewReplacer(
+		"{{request_id}}", escape(requestID),
+		"{{rule_id}}", rule,
+		"{{status}}", strconv.Itoa(statusCode),
+	).Replace(page.body)
+	return [][2]string{{"content-type", page.contentType}}, []byte(body)
+}
+
+// acceptedQuality returns the quality the accept header gives to the media type, from its most
+// specific range matching it, 0 if the media type is not accepted.
+func acceptedQuality(accept, mediaType string) float64 {
+	q, specificity := 0.0, 0
+	for _, r := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(r))
+		if err != nil {
+			continue
+		}
+		s := 0
+		switch {
+		case mediaRange == mediaType:
+			s = 3
+		case mediaRange == "*/*":
+			s = 1
+		case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+			s = 2
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, q = s, 1
+		if v, ok := params["q"]; ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+	}
+	return q
+}
+
+// jsonEscape escapes the string for a JSON string literal.
+func jsonEscape(s string) string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return ""
+	}
+	return string(b[1 : len(b)-1])
+}
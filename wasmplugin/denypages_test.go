@@ -0,0 +1,86 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+func TestDenyPages(t *testing.T) {
+	c, err := parseDenyPages(gjson.Parse(`[
+		{"content_type": "text/html; charset=utf-8", "body": "<p>Blocked by rule {{rule_id}}, ID {{request_id}}</p>"},
+		{"content_type": "application/json", "body": "{\"status\": {{status}}, \"request_id\": \"{{request_id}}\", \"rule_id\": \"{{rule_id}}\"}"}
+	]`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name                string
+		accept              string
+		requestID           string
+		ruleID              int
+		expectedContentType string
+		expectedBody        string
+	}{
+		{
+			name:                "no accept header",
+			requestID:           "abc",
+			ruleID:              101,
+			expectedContentType: "text/html; charset=utf-8",
+			expectedBody:        "<p>Blocked by rule 101, ID abc</p>",
+		},
+		{
+			name:                "json",
+			accept:              "application/json",
+			requestID:           "abc",
+			ruleID:              101,
+			expectedContentType: "application/json",
+			expectedBody:        `{"status": 403, "request_id": "abc", "rule_id": "101"}`,
+		},
+		{
+			name:                "browser",
+			accept:              "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			requestID:           "abc",
+			ruleID:              101,
+			expectedContentType: "text/html; charset=utf-8",
+			expectedBody:        "<p>Blocked by rule 101, ID abc</p>",
+		},
+		{
+			name:                "html excluded",
+			accept:              "text/html;q=0, */*",
+			requestID:           "abc",
+			expectedContentType: "application/json",
+			expectedBody:        `{"status": 403, "request_id": "abc", "rule_id": ""}`,
+		},
+		{
+			name:                "escaped html",
+			accept:              "text/*",
+			requestID:           "<script>",
+			ruleID:              101,
+			expectedContentType: "text/html; charset=utf-8",
+			expectedBody:        "<p>Blocked by rule 101, ID &lt;script&gt;</p>",
+		},
+		{
+			name:                "escaped json",
+			accept:              "application/*",
+			requestID:           `a"b`,
+			ruleID:              101,
+			expectedContentType: "application/json",
+			expectedBody:        `{"status": 403, "request_id": "a\"b", "rule_id": "101"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers, body := c.response(tt.accept, 403, tt.requestID, tt.ruleID)
+			require.Equal(t, [][2]string{{"content-type", tt.expectedContentType}}, headers)
+			require.Equal(t, tt.expectedBody, string(body))
+		})
+	}
+
+	headers, body := denyPagesConfig(nil).response("text/html", 403, "abc", 101)
+	require.Nil(t, headers)
+	require.Nil(t, body)
+}
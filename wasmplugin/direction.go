@@ -0,0 +1,44 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/hostadapter"
+)
+
+const (
+	directionInbound  = "inbound"
+	directionOutbound = "outbound"
+)
+
+func parseTrafficDirection(direction string) error {
+	switch direction {
+	case directionInbound, directionOutbound:
+		return nil
+	default:
+		return fmt.Errorf("unsupported traffic direction: %q", direction)
+	}
+}
+
+// trafficDirection returns the direction of the listener the request has been received
+// on, as configured on the sidecar listeners, or an empty string if unknown.
+// Ref: https://www.envoyproxy.io/docs/envoy/latest/api-v3/config/core/v3/base.proto#enum-config-core-v3-trafficdirection
+func trafficDirection(props hostadapter.Resolver) string {
+	raw, err := props.Property(hostadapter.ListenerDirection)
+	// listener_direction is populated as int64 (8 bytes)
+	if err != nil || len(raw) < 8 {
+		return ""
+	}
+	switch binary.LittleEndian.Uint64(raw) {
+	case 1:
+		return directionInbound
+	case 2:
+		return directionOutbound
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+// dropAction is the action of the interruptions raised by the drop action of the rules.
+const dropAction = "drop"
+
+// The proxy-wasm stream types, as expected by proxy_close_stream.
+const (
+	streamTypeRequest  uint32 = 0
+	streamTypeResponse uint32 = 1
+)
+
+// dropStream resets the stream interrupted by a drop action, the client receiving no response,
+// which is what scanners and slow clients deserve rather than a well-formed error. It returns
+// false if the host failed to reset the stream, the interruption being handled as a deny then.
+func (ctx *httpContext) dropStream(phase interruptionPhase) bool {
+	streamType := streamTypeRequest
+	if phase == interruptionPhaseHttpResponseHeaders || phase == interruptionPhaseHttpResponseBody {
+		streamType = streamTypeResponse
+	}
+	if err := closeStream(streamType); err != nil {
+		ctx.logger.Warn().Err(err).Msg("Failed to reset the stream on drop, denying it")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,16 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !tinygo
+
+package wasmplugin
+
+import (
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+// closeStream closes the stream through the host emulator, which implements no specific
+// stream type.
+func closeStream(uint32) error {
+	return proxywasm.CloseDownstream()
+}
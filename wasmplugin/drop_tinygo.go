@@ -0,0 +1,25 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build tinygo
+
+package wasmplugin
+
+import (
+	"fmt"
+)
+
+// proxyCloseStream is not exposed for the HTTP streams by the SDK, which closes the
+// downstream connection of the TCP streams only.
+//
+//export proxy_close_stream
+func proxyCloseStream(streamType uint32) uint32
+
+// closeStream resets the HTTP stream, Envoy closing it with a RST_STREAM for HTTP/2 and the
+// connection for HTTP/1.
+func closeStream(streamType uint32) error {
+	if status := proxyCloseStream(streamType); status != 0 {
+		return fmt.Errorf("proxy_close_stream failed with status %d", status)
+	}
+	return nil
+}
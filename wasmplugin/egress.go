@@ -0,0 +1,76 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tidwall/gjson"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/hostadapter"
+)
+
+// egressAllowlistRuleID is the ID of the rule generated for the egress destinations allowlist.
+const egressAllowlistRuleID = 99800
+
+// egressOutboundVar is the TX variable set to 1 for the outbound requests when the egress
+// destinations are restricted.
+const egressOutboundVar = "egress_outbound"
+
+var egressDestinationRx = regexp.MustCompile(`^(\*\.)?[a-z0-9-]+(\.[a-z0-9-]+)*$`)
+
+// appendEgressAllowlist translates the allowed egress destinations into a rule prepended
+// to every rule set, denying the outbound requests whose server name (the authority without
+// port) matches none of them, whichever rule set the stream selects. Destinations are either
+// hostnames, IP addresses or wildcards ("*.example.com") matching any subdomain.
+func appendEgressAllowlist(destinations gjson.Result, config *pluginConfiguration) error {
+	var (
+		alternatives []string
+		err          error
+	)
+	destinations.ForEach(func(_, value gjson.Result) bool {
+		destination := strings.ToLower(value.String())
+		if !egressDestinationRx.MatchString(destination) {
+			err = fmt.Errorf("invalid egress destination: %q", value.String())
+			return false
+		}
+		if suffix, ok := strings.CutPrefix(destination, "*."); ok {
+			alternatives = append(alternatives, `.+\.`+regexp.QuoteMeta(suffix))
+		} else {
+			alternatives = append(alternatives, regexp.QuoteMeta(destination))
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if len(alternatives) == 0 {
+		return nil
+	}
+
+	rules := []string{
+		fmt.Sprintf("SecRule TX:%s \"@eq 1\" \"id:%d,phase:1,t:none,deny,status:403,log,msg:'Egress destination not allowed',chain\"",
+			egressOutboundVar, egressAllowlistRuleID),
+		fmt.Sprintf("SecRule SERVER_NAME \"!@rx ^(?:%s)$\" \"t:lowercase\"", strings.Join(alternatives, "|")),
+	}
+	for name, directives := range config.directivesMap {
+		config.directivesMap[name] = append(rules[:len(rules):len(rules)], directives...)
+	}
+	config.egressAllowlist = true
+	return nil
+}
+
+// markOutbound flags the outbound requests for the egress destinations allowlist.
+func markOutbound(tx ctypes.Transaction, props hostadapter.Resolver) {
+	if trafficDirection(props) != directionOutbound {
+		return
+	}
+	if state, ok := tx.(plugintypes.TransactionState); ok {
+		state.Variables().TX().Set(egressOutboundVar, []string{flagValue(true)})
+	}
+}
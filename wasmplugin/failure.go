@@ -0,0 +1,166 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+	"github.com/tidwall/gjson"
+)
+
+// failureClass is a class of failures preventing the complete inspection of a request.
+type failureClass string
+
+const (
+	// failureEngineError is an error of the host or of Coraza while processing the request.
+	failureEngineError failureClass = "engine_error"
+	// failureBodyLimit is a request body exceeding SecRequestBodyLimit, only partially inspected.
+	failureBodyLimit failureClass = "body_limit"
+	// failureParseError is a request body the body processor failed to parse (REQBODY_ERROR).
+	failureParseError failureClass = "parse_error"
+	// failureDeadline is the evaluation of a phase exceeding evaluation_deadline.
+	failureDeadline failureClass = "deadline"
+	// failureRulesUnavailable is a request received before the remote rules are loaded.
+	failureRulesUnavailable failureClass = "rules_unavailable"
+	// failureMemoryPressure is a request received while the heap in use by the VM exceeds
+	// memory_pressure_threshold, no transaction being started for it.
+	failureMemoryPressure failureClass = "memory_pressure"
+)
+
+// failureStatusCodes are the status codes of the local responses of the fail-closed requests.
+var failureStatusCodes = map[failureClass]int{
+	failureEngineError:      http.StatusForbidden,
+	failureBodyLimit:        http.StatusRequestEntityTooLarge,
+	failureParseError:       http.StatusBadRequest,
+	failureDeadline:         http.StatusServiceUnavailable,
+	failureRulesUnavailable: http.StatusServiceUnavailable,
+	failureMemoryPressure:   http.StatusServiceUnavailable,
+}
+
+const (
+	failOpen   = "open"
+	failClosed = "closed"
+)
+
+// failurePolicy tells, per failure class, whether requests are let through (fail-open,
+// the default) or denied (fail-closed).
+type failurePolicy map[failureClass]string
+
+func parseFailurePolicy(policy gjson.Result) (failurePolicy, error) {
+	var (
+		p   failurePolicy
+		err error
+	)
+	policy.ForEach(func(key, value gjson.Result) bool {
+		if err = checkFailurePolicy(key.String(), value.String()); err != nil {
+			return false
+		}
+		if p == nil {
+			p = failurePolicy{}
+		}
+		p[failureClass(key.String())] = value.String()
+		return true
+	})
+	return p, err
+}
+
+// parseRouteFailurePolicy parses the failure policy of the route metadata, e.g.
+// "body_limit:closed,memory_pressure:open". Invalid entries are logged and ignored.
+func parseRouteFailurePolicy(policy string) failurePolicy {
+	p := failurePolicy{}
+	for _, entry := range strings.Split(policy, ",") {
+		class, v, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		if err := checkFailurePolicy(class, v); err != nil {
+			proxywasm.LogWarnf("Ignoring invalid failure_policy in route metadata: %v", err)
+			continue
+		}
+		p[failureClass(class)] = v
+	}
+	return p
+}
+
+func checkFailurePolicy(class string, policy string) error {
+	if _, ok := failureStatusCodes[failureClass(class)]; !ok {
+		return fmt.Errorf("unsupported failure class: %q", class)
+	}
+	if policy != failOpen && policy != failClosed {
+		return fmt.Errorf("unsupported failure policy for %s: %q", class, policy)
+	}
+	return nil
+}
+
+func (p failurePolicy) policy(class failureClass) string {
+	if v, ok := p[class]; ok {
+		return v
+	}
+	return failOpen
+}
+
+// override returns the policy with the classes of o overridden, p being shared by the streams.
+func (p failurePolicy) override(o failurePolicy) failurePolicy {
+	merged := make(failurePolicy, len(p)+len(o))
+	for class, v := range p {
+		merged[class] = v
+	}
+	for class, v := range o {
+		merged[class] = v
+	}
+	return merged
+}
+
+// heapInUse is the heap in use by the VM, in bytes, sampled at plugin start and at the end
+// of each transaction as the heap gauges are, compared to memory_pressure_threshold.
+var heapInUse uint64
+
+// readHeap reads the memory usage of the VM, sampling heapInUse.
+func readHeap() *runtime.MemStats {
+	ms := &runtime.MemStats{}
+	runtime.ReadMemStats(ms)
+	heapInUse = ms.HeapSys - ms.HeapIdle
+	return ms
+}
+
+// handleFailure applies the failure policy of the class, counting the failure. Fail-closed
+// requests receive a local response, as interrupted ones.
+func (ctx *httpContext) handleFailure(phase interruptionPhase, class failureClass) types.Action {
+	policy := ctx.failurePolicy.policy(class)
+	ctx.metrics.CountTXFailure(string(class), policy, ctx.metricLabelsKV)
+	if policy == failOpen || ctx.interruptedAt.isInterrupted() {
+		return types.ActionContinue
+	}
+
+	var txID string
+	if ctx.tx != nil {
+		txID = ctx.tx.ID()
+	}
+	ctx.logger.Info().
+		Str("failure", string(class)).
+		Str("phase", phase.String()).
+		Str("incident_id", txID).
+		Msg("Transaction denied by the failure policy")
+
+	ctx.interruptedAt = phase
+	statusCode := failureStatusCodes[class]
+	headers, body := ctx.interruptionResponse(statusCode, txID, 0)
+	if err := proxywasm.SendHttpResponse(uint32(statusCode), headers, body, noGRPCStream); err != nil {
+		panic(err)
+	}
+	return types.ActionPause
+}
+
+// hasRequestBodyError returns true if the request body processor failed.
+func hasRequestBodyError(tx ctypes.Transaction) bool {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return false
+	}
+	return state.Variables().RequestBodyError().Get() == "1"
+}
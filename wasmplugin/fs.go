@@ -4,21 +4,27 @@
 package wasmplugin
 
 import (
-	"embed"
 	"fmt"
 	"io/fs"
 	"strings"
 )
 
-var (
-	//go:embed rules
-	crs  embed.FS
-	root fs.FS
-)
+// customRulesAlias is the directory of the rule and data files of the operators,
+// embedded from rules/custom.
+const customRulesAlias = "@custom"
+
+// root is the filesystem the directives are read from, crs being embedded
+// according to the build profile.
+var root fs.FS
 
 func init() {
 	rules, _ := fs.Sub(crs, "rules")
-	root = &rulesFS{
+	root = newRulesFS(rules)
+}
+
+// newRulesFS returns the filesystem mapping the aliases of the directives to the files of rules.
+func newRulesFS(rules fs.FS) *rulesFS {
+	return &rulesFS{
 		rules,
 		map[string]string{
 			"@recommended-conf":    "coraza.conf-recommended.conf",
@@ -28,7 +34,9 @@ func init() {
 			"@crs-setup-conf":      "crs-setup.conf.example",
 		},
 		map[string]string{
-			"@owasp_crs": "crs",
+			"@owasp_crs":     "crs",
+			crsPluginsAlias:  "crs-plugins",
+			customRulesAlias: "custom",
 		},
 	}
 }
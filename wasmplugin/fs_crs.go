@@ -0,0 +1,11 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !no_crs
+
+package wasmplugin
+
+import "embed"
+
+//go:embed rules
+var crs embed.FS
@@ -0,0 +1,13 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build no_crs
+
+package wasmplugin
+
+import "embed"
+
+// crs only embeds the Coraza configurations and the custom rules, @owasp_crs being unavailable.
+//
+//go:embed rules/*.conf rules/*.example rules/custom
+var crs embed.FS
@@ -0,0 +1,49 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCustomRules(t *testing.T) {
+	rules := newRulesFS(fstest.MapFS{
+		"custom/admin.conf":       {Data: []byte(`SecRule REQUEST_URI "@streq /admin" "id:1001,phase:1,deny"`)},
+		"custom/bots.conf":        {Data: []byte(`SecRule REQUEST_HEADERS:User-Agent "@pmFromFile bad-bots.data" "id:1002,phase:1,deny"`)},
+		"custom/bad-bots.data":    {Data: []byte("evilbot\nbadcrawler")},
+		"custom/blocked-ips.data": {Data: []byte("192.0.2.0/24")},
+	})
+
+	waf, err := coraza.NewWAF(coraza.NewWAFConfig().
+		WithRootFS(rules).
+		WithDirectives(`
+			SecRuleEngine On
+			Include @custom/*.conf
+			SecRule REMOTE_ADDR "@ipMatchFromFile @custom/blocked-ips.data" "id:1003,phase:1,deny"
+		`))
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name, path, userAgent, clientIP string
+		denied                          bool
+	}{
+		{name: "allowed", path: "/", userAgent: "curl", clientIP: "198.51.100.1"},
+		{name: "included rule", path: "/admin", userAgent: "curl", clientIP: "198.51.100.1", denied: true},
+		{name: "data file relative to the rule file", path: "/", userAgent: "evilbot", clientIP: "198.51.100.1", denied: true},
+		{name: "data file of the alias", path: "/", userAgent: "curl", clientIP: "192.0.2.10", denied: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tx := waf.NewTransaction()
+			defer tx.Close()
+			tx.ProcessConnection(tc.clientIP, 12345, "203.0.113.1", 443)
+			tx.ProcessURI(tc.path, "GET", "HTTP/1.1")
+			tx.AddRequestHeader("User-Agent", tc.userAgent)
+			require.Equal(t, tc.denied, tx.ProcessRequestHeaders() != nil)
+		})
+	}
+}
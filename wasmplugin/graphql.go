@@ -0,0 +1,483 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tidwall/gjson"
+)
+
+// The IDs of the rules generated for the limits of the GraphQL queries.
+const (
+	graphqlMaxDepthRuleID  = 99600
+	graphqlMaxFieldsRuleID = 99601
+)
+
+// The TX variables set by the GraphQL body processor.
+const (
+	graphqlDepthVar         = "graphql_depth"
+	graphqlFieldsVar        = "graphql_fields"
+	graphqlOperationNameVar = "graphql_operation_name"
+	graphqlOperationTypeVar = "graphql_operation_type"
+)
+
+const defaultGraphQLPath = "/graphql"
+
+// graphqlMaxFields bounds the number of fields of the expanded operations, so that the sum
+// does not wrap on fragments spread exponentially, whatever the size of int.
+const graphqlMaxFields = math.MaxInt32
+
+// graphqlConfig enables the GraphQL body processor for the requests of type application/graphql,
+// and for the JSON requests to the GraphQL endpoints.
+type graphqlConfig struct {
+	paths     []string
+	maxDepth  int
+	maxFields int
+}
+
+func parseGraphQL(graphql gjson.Result) (graphqlConfig, error) {
+	c := graphqlConfig{paths: []string{defaultGraphQLPath}}
+	if paths := graphql.Get("paths"); paths.Exists() {
+		c.paths = nil
+		for _, path := range paths.Array() {
+			if !strings.HasPrefix(path.String(), "/") {
+				return c, fmt.Errorf("invalid graphql path: %q", path.String())
+			}
+			c.paths = append(c.paths, path.String())
+		}
+	}
+	for name, limit := range map[string]*int{"max_depth": &c.maxDepth, "max_fields": &c.maxFields} {
+		value := graphql.Get(name)
+		if !value.Exists() {
+			continue
+		}
+		*limit = int(value.Int())
+		if value.Type != gjson.Number || *limit <= 0 {
+			return c, fmt.Errorf("invalid graphql %s: %s", name, value.Raw)
+		}
+	}
+	return c, nil
+}
+
+func (c graphqlConfig) enabled() bool {
+	return c.paths != nil
+}
+
+// limitRules returns the rules denying the GraphQL queries exceeding the limits, prepended
+// to every rule set.
+func (c graphqlConfig) limitRules() []string {
+	var rules []string
+	if c.maxDepth > 0 {
+		rules = append(rules, fmt.Sprintf("SecRule TX:%s \"@gt %d\" \"id:%d,phase:2,deny,status:400,log,msg:'GraphQL query depth exceeds %d'\"",
+			graphqlDepthVar, c.maxDepth, graphqlMaxDepthRuleID, c.maxDepth))
+	}
+	if c.maxFields > 0 {
+		rules = append(rules, fmt.Sprintf("SecRule TX:%s \"@gt %d\" \"id:%d,phase:2,deny,status:400,log,msg:'GraphQL query fields exceed %d'\"",
+			graphqlFieldsVar, c.maxFields, graphqlMaxFieldsRuleID, c.maxFields))
+	}
+	return rules
+}
+
+// selectBodyProcessor selects the GraphQL body processor for the GraphQL requests, before the
+// phase 1 rules which may still select another one.
+func (c graphqlConfig) selectBodyProcessor(tx ctypes.Transaction, contentType string) {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok || !c.matches(state, contentType) {
+		return
+	}
+	if s, ok := state.Variables().RequestBodyProcessor().(interface{ Set(string) }); ok {
+		s.Set("GRAPHQL")
+	}
+}
+
+// reselectBodyProcessor selects the GraphQL body processor again for the GraphQL requests the
+// phase 1 rules switched to the JSON one, as rule 200001 of @recommended-conf does for every
+// request of type application/json.
+func (c graphqlConfig) reselectBodyProcessor(tx ctypes.Transaction, contentType string) {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok || state.Variables().RequestBodyProcessor().Get() != "JSON" {
+		return
+	}
+	c.selectBodyProcessor(tx, contentType)
+}
+
+// matches reports whether the request is a GraphQL one.
+func (c graphqlConfig) matches(state plugintypes.TransactionState, contentType string) bool {
+	if !c.enabled() {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/graphql":
+		return true
+	case "application/json":
+		path := state.Variables().RequestFilename().Get()
+		for _, p := range c.paths {
+			if p == path {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// graphqlBodyProcessor parses the GraphQL queries, either the body of type application/graphql
+// or the query of the JSON body, batched or not, into ARGS_POST:
+//
+//   - graphql.query, graphql.operation_name and graphql.fields, the names of the fields selected,
+//   - graphql.arguments, the string literals of the query, such as the values of the arguments,
+//   - graphql.variables, flattened as the JSON bodies are, e.g. graphql.variables.user.name,
+//
+// and into the TX variables graphql_depth, graphql_fields, the number of fields selected
+// once the fragments are expanded, graphql_operation_name and graphql_operation_type.
+type graphqlBodyProcessor struct{}
+
+func (graphqlBodyProcessor) ProcessRequest(reader io.Reader, v plugintypes.TransactionVariables, options plugintypes.BodyProcessorOptions) error {
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(options.Mime); mediaType == "application/graphql" {
+		return inspectGraphQLQuery(string(body), "", v)
+	}
+
+	if !gjson.ValidBytes(body) {
+		return errors.New("invalid JSON body")
+	}
+	requests := []gjson.Result{gjson.ParseBytes(body)}
+	if requests[0].IsArray() {
+		// Batched requests
+		requests = requests[0].Array()
+	}
+
+	for _, request := range requests {
+		if query := request.Get("query"); query.Exists() {
+			if err := inspectGraphQLQuery(query.String(), request.Get("operationName").String(), v); err != nil {
+				return err
+			}
+		}
+		variables := request.Get("variables")
+		if variables.Type == gjson.String && gjson.Valid(variables.Str) {
+			variables = gjson.Parse(variables.Str)
+		}
+		if variables.IsObject() {
+			f := jsonFlattener{
+				col:         v.ArgsPost(),
+				maxDepth:    txLimit(v, jsonMaxDepthVar),
+				maxElements: txLimit(v, jsonMaxElementsVar),
+			}
+			f.flatten(variables, []byte("graphql.variables"), 1)
+		}
+	}
+	return nil
+}
+
+// inspectGraphQLQuery adds the query to the variables of the transaction, the limits being
+// the maximum ones of the batched queries.
+func inspectGraphQLQuery(query, operationName string, v plugintypes.TransactionVariables) error {
+	doc, err := parseGraphQLDocument(query)
+	if err != nil {
+		return err
+	}
+	depth, fields, err := doc.limits()
+	if err != nil {
+		return err
+	}
+
+	col := v.ArgsPost()
+	col.Add("graphql.query", query)
+	if operationName != "" {
+		col.Add("graphql.operation_name", operationName)
+	}
+	for _, name := range doc.fieldNames {
+		col.Add("graphql.fields", name)
+	}
+	for _, argument := range doc.arguments {
+		col.Add("graphql.arguments", argument)
+	}
+	if op := doc.operation(operationName); op != nil {
+		v.TX().Set(graphqlOperationNameVar, []string{op.name})
+		v.TX().Set(graphqlOperationTypeVar, []string{op.typ})
+	}
+	depth, fields = max(depth, txLimit(v, graphqlDepthVar)), max(fields, txLimit(v, graphqlFieldsVar))
+	v.TX().Set(graphqlDepthVar, []string{strconv.Itoa(depth)})
+	v.TX().Set(graphqlFieldsVar, []string{strconv.Itoa(fields)})
+	return nil
+}
+
+func (graphqlBodyProcessor) ProcessResponse(io.Reader, plugintypes.TransactionVariables, plugintypes.BodyProcessorOptions) error {
+	return nil
+}
+
+// graphqlDefinition is an operation or fragment of a GraphQL document.
+type graphqlDefinition struct {
+	// typ is query, mutation or subscription for the operations, fragment for the fragments.
+	typ  string
+	name string
+	// depth is the maximum nesting of the selection sets, without the fragments spread.
+	depth int
+	// fields is the number of fields selected, without the fragments spread.
+	fields  int
+	spreads []graphqlSpread
+}
+
+type graphqlSpread struct {
+	fragment string
+	depth    int
+}
+
+type graphqlDocument struct {
+	definitions []*graphqlDefinition
+	fieldNames  []string
+	arguments   []string
+}
+
+// operation returns the operation executed for the operation name, nil if none.
+func (doc *graphqlDocument) operation(name string) *graphqlDefinition {
+	for _, def := range doc.definitions {
+		if def.typ != "fragment" && (name == "" || def.name == name) {
+			return def
+		}
+	}
+	return nil
+}
+
+// limits returns the maximum depth and number of fields of the operations, the fragments
+// being expanded.
+func (doc *graphqlDocument) limits() (int, int, error) {
+	fragments := map[string]*graphqlDefinition{}
+	for _, def := range doc.definitions {
+		if def.typ == "fragment" {
+			fragments[def.name] = def
+		}
+	}
+
+	type expanded struct{ depth, fields int }
+	memo := map[*graphqlDefinition]expanded{}
+	visiting := map[*graphqlDefinition]bool{}
+	var expand func(def *graphqlDefinition) (expanded, error)
+	expand = func(def *graphqlDefinition) (expanded, error) {
+		if e, ok := memo[def]; ok {
+			return e, nil
+		}
+		if visiting[def] {
+			return expanded{}, fmt.Errorf("GraphQL fragment cycle: %q", def.name)
+		}
+		visiting[def] = true
+		e := expanded{depth: def.depth, fields: def.fields}
+		for _, spread := range def.spreads {
+			fragment, ok := fragments[spread.fragment]
+			if !ok {
+				return expanded{}, fmt.Errorf("unknown GraphQL fragment: %q", spread.fragment)
+			}
+			f, err := expand(fragment)
+			if err != nil {
+				return expanded{}, err
+			}
+			// The selection set of the fragment replaces the spread
+			e.depth = max(e.depth, spread.depth+f.depth-1)
+			e.fields = min(e.fields+f.fields, graphqlMaxFields)
+		}
+		visiting[def] = false
+		memo[def] = e
+		return e, nil
+	}
+
+	var depth, fields int
+	for _, def := range doc.definitions {
+		if def.typ == "fragment" {
+			continue
+		}
+		e, err := expand(def)
+		if err != nil {
+			return 0, 0, err
+		}
+		depth, fields = max(depth, e.depth), max(fields, e.fields)
+	}
+	return depth, fields, nil
+}
+
+// parseGraphQLDocument parses the structure of a GraphQL document, without validating it
+// against the grammar beyond the balance of its brackets.
+func parseGraphQLDocument(query string) (*graphqlDocument, error) {
+	tokens, err := tokenizeGraphQL(query)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &graphqlDocument{}
+	var (
+		def         *graphqlDefinition
+		braceDepth  int
+		parenDepth  int
+		nameOfToken = func(i int) string {
+			if i < len(tokens) && tokens[i].kind == graphqlName {
+				return tokens[i].value
+			}
+			return ""
+		}
+	)
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok.kind == graphqlString {
+			doc.arguments = append(doc.arguments, tok.value)
+			continue
+		}
+		switch tok.value {
+		case "(":
+			parenDepth++
+			continue
+		case ")":
+			if parenDepth--; parenDepth < 0 {
+				return nil, errors.New("unbalanced GraphQL parentheses")
+			}
+			continue
+		}
+		if parenDepth > 0 {
+			// Arguments and variable definitions, the braces are object values
+			continue
+		}
+
+		if braceDepth == 0 {
+			switch {
+			case tok.kind == graphqlName && (tok.value == "query" || tok.value == "mutation" || tok.value == "subscription"):
+				def = &graphqlDefinition{typ: tok.value, name: nameOfToken(i + 1)}
+				doc.definitions = append(doc.definitions, def)
+			case tok.kind == graphqlName && tok.value == "fragment":
+				def = &graphqlDefinition{typ: "fragment", name: nameOfToken(i + 1)}
+				doc.definitions = append(doc.definitions, def)
+			case tok.value == "{":
+				if def == nil {
+					// Query shorthand
+					def = &graphqlDefinition{typ: "query"}
+					doc.definitions = append(doc.definitions, def)
+				}
+				braceDepth, def.depth = 1, max(def.depth, 1)
+			case tok.value == "}":
+				return nil, errors.New("unbalanced GraphQL braces")
+			}
+			continue
+		}
+
+		switch {
+		case tok.value == "{":
+			braceDepth++
+			def.depth = max(def.depth, braceDepth)
+		case tok.value == "}":
+			if braceDepth--; braceDepth == 0 {
+				def = nil
+			}
+		case tok.value == "...":
+			if name := nameOfToken(i + 1); name == "on" {
+				// Inline fragment, skipping its type condition
+				i += 2
+			} else if name != "" {
+				def.spreads = append(def.spreads, graphqlSpread{fragment: name, depth: braceDepth})
+				i++
+			}
+		case tok.value == "@":
+			// Directive name
+			i++
+		case tok.kind == graphqlName:
+			if i+1 < len(tokens) && tokens[i+1].value == ":" {
+				// Alias of the following field
+				i++
+				continue
+			}
+			def.fields++
+			doc.fieldNames = append(doc.fieldNames, tok.value)
+		}
+	}
+	if braceDepth != 0 || parenDepth != 0 {
+		return nil, errors.New("unbalanced GraphQL braces")
+	}
+	return doc, nil
+}
+
+// The kinds of the GraphQL tokens.
+const (
+	graphqlName = iota
+	graphqlString
+	graphqlPunctuator
+	graphqlNumber
+)
+
+type graphqlToken struct {
+	kind  int
+	value string
+}
+
+func tokenizeGraphQL(query string) ([]graphqlToken, error) {
+	var tokens []graphqlToken
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(query) && query[i] != '\n' && query[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(query[i:], `"""`):
+			end := strings.Index(strings.ReplaceAll(query[i+3:], `\"""`, `\xxx`), `"""`)
+			if end < 0 {
+				return nil, errors.New("unterminated GraphQL string")
+			}
+			tokens = append(tokens, graphqlToken{graphqlString, query[i+3 : i+3+end]})
+			i += 3 + end + 3
+		case c == '"':
+			end := i + 1
+			for ; end < len(query) && query[end] != '"'; end++ {
+				if query[end] == '\\' {
+					end++
+				} else if query[end] == '\n' || query[end] == '\r' {
+					break
+				}
+			}
+			if end >= len(query) || query[end] != '"' {
+				return nil, errors.New("unterminated GraphQL string")
+			}
+			value := query[i+1 : end]
+			if unquoted, err := strconv.Unquote(query[i : end+1]); err == nil {
+				value = unquoted
+			}
+			tokens = append(tokens, graphqlToken{graphqlString, value})
+			i = end + 1
+		case strings.HasPrefix(query[i:], "..."):
+			tokens = append(tokens, graphqlToken{graphqlPunctuator, "..."})
+			i += 3
+		case strings.IndexByte("!$&()[]{}:=@|", c) >= 0:
+			tokens = append(tokens, graphqlToken{graphqlPunctuator, string(c)})
+			i++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			end := i + 1
+			for end < len(query) && (query[end] == '_' || query[end] >= 'a' && query[end] <= 'z' ||
+				query[end] >= 'A' && query[end] <= 'Z' || query[end] >= '0' && query[end] <= '9') {
+				end++
+			}
+			tokens = append(tokens, graphqlToken{graphqlName, query[i:end]})
+			i = end
+		case c == '-' || c >= '0' && c <= '9':
+			end := i + 1
+			for end < len(query) && strings.IndexByte("0123456789.eE+-", query[end]) >= 0 {
+				end++
+			}
+			tokens = append(tokens, graphqlToken{graphqlNumber, query[i:end]})
+			i = end
+		default:
+			return nil, fmt.Errorf("unexpected character in GraphQL query: %q", c)
+		}
+	}
+	return tokens, nil
+}
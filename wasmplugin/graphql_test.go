@@ -0,0 +1,145 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphQLBodyProcessor(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		args        map[string][]string
+		tx          map[string]string
+	}{
+		{
+			name:        "application/graphql",
+			contentType: "application/graphql",
+			body:        `{ user(name: "pooh") { friends { name } } }`,
+			args: map[string][]string{
+				"graphql.query":     {`{ user(name: "pooh") { friends { name } } }`},
+				"graphql.fields":    {"user", "friends", "name"},
+				"graphql.arguments": {"pooh"},
+			},
+			tx: map[string]string{
+				graphqlDepthVar:         "3",
+				graphqlFieldsVar:        "3",
+				graphqlOperationNameVar: "",
+				graphqlOperationTypeVar: "query",
+			},
+		},
+		{
+			name:        "json with variables and fragments",
+			contentType: "application/json",
+			body: `{
+				"query": "query Friends($id: ID!) { user(id: $id) { best: friend { ...Names } } } fragment Names on User { name friends { name } }",
+				"operationName": "Friends",
+				"variables": {"id": "1' OR 1=1", "filter": {"active": true}}
+			}`,
+			args: map[string][]string{
+				"graphql.query":                   {"query Friends($id: ID!) { user(id: $id) { best: friend { ...Names } } } fragment Names on User { name friends { name } }"},
+				"graphql.operation_name":          {"Friends"},
+				"graphql.fields":                  {"user", "friend", "name", "friends", "name"},
+				"graphql.variables.id":            {"1' OR 1=1"},
+				"graphql.variables.filter.active": {"true"},
+			},
+			tx: map[string]string{
+				graphqlDepthVar:         "4",
+				graphqlFieldsVar:        "5",
+				graphqlOperationNameVar: "Friends",
+				graphqlOperationTypeVar: "query",
+			},
+		},
+		{
+			name:        "batched mutations",
+			contentType: "application/json",
+			body:        `[{"query": "mutation { login { token } }"}, {"query": "mutation { logout }"}]`,
+			args: map[string][]string{
+				"graphql.query":  {"mutation { login { token } }", "mutation { logout }"},
+				"graphql.fields": {"login", "token", "logout"},
+			},
+			tx: map[string]string{
+				graphqlDepthVar:         "2",
+				graphqlFieldsVar:        "2",
+				graphqlOperationTypeVar: "mutation",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waf, err := coraza.NewWAF(coraza.NewWAFConfig())
+			require.NoError(t, err)
+			v := waf.NewTransaction().(plugintypes.TransactionState).Variables()
+
+			err = graphqlBodyProcessor{}.ProcessRequest(strings.NewReader(tt.body), v, plugintypes.BodyProcessorOptions{Mime: tt.contentType})
+			require.NoError(t, err)
+
+			args := map[string][]string{}
+			for _, arg := range v.ArgsPost().FindAll() {
+				args[arg.Key()] = append(args[arg.Key()], arg.Value())
+			}
+			require.Equal(t, tt.args, args)
+			for name, value := range tt.tx {
+				require.Equal(t, value, firstValue(v.TX(), name), name)
+			}
+		})
+	}
+}
+
+func TestParseGraphQLDocument(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		err   error
+	}{
+		{name: "unbalanced braces", query: `{ user { name }`, err: errors.New("unbalanced GraphQL braces")},
+		{name: "unterminated string", query: `{ user(name: "pooh) { name } }`, err: errors.New("unterminated GraphQL string")},
+		{name: "block string", query: `{ user(bio: """likes "honey" """) { name } }`},
+		{name: "object argument", query: `{ users(filter: {name: "pooh"}) { name } }`},
+		{name: "comment", query: "# { unbalanced\n{ user { name } }"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parseGraphQLDocument(tt.query)
+			require.Equal(t, tt.err, err)
+			if err != nil {
+				return
+			}
+			depth, fields, err := doc.limits()
+			require.NoError(t, err)
+			require.Equal(t, 2, depth)
+			require.Equal(t, 2, fields)
+		})
+	}
+
+	t.Run("fragment cycle", func(t *testing.T) {
+		doc, err := parseGraphQLDocument(`{ ...A } fragment A on Query { ...B } fragment B on Query { ...A }`)
+		require.NoError(t, err)
+		_, _, err = doc.limits()
+		require.Equal(t, errors.New(`GraphQL fragment cycle: "A"`), err)
+	})
+
+	t.Run("fragments spread exponentially", func(t *testing.T) {
+		// Each fragment spreads the previous one twice, doubling the fields 64 times
+		query := strings.Builder{}
+		query.WriteString("{ ...F64 } fragment F0 on Query { name }")
+		for i := 1; i <= 64; i++ {
+			fmt.Fprintf(&query, " fragment F%d on Query { ...F%d ...F%d }", i, i-1, i-1)
+		}
+		doc, err := parseGraphQLDocument(query.String())
+		require.NoError(t, err)
+		_, fields, err := doc.limits()
+		require.NoError(t, err)
+		require.Equal(t, graphqlMaxFields, fields)
+	})
+}
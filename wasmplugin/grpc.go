@@ -0,0 +1,241 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/corazawaf/coraza/v3/collection"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tidwall/gjson"
+)
+
+// grpcDescriptorSetVar is the TX variable naming the descriptor set of the transaction.
+const grpcDescriptorSetVar = "grpc_descriptor_set"
+
+// grpcMaxDecompressedSizeVar is the TX variable read by the gRPC body processor as the
+// maximum size of the messages of a body once decompressed, set from the max_size of the
+// request body decompression.
+const grpcMaxDecompressedSizeVar = "grpc_max_decompressed_size"
+
+// grpcMaxDepth bounds the nesting of the messages decoded.
+const grpcMaxDepth = 32
+
+// grpcDescriptorSets are the descriptor sets of the plugins, keyed by their hash. The body
+// processors are shared by the plugins of the VM, a transaction names its descriptor set
+// with the grpc_descriptor_set TX variable.
+var grpcDescriptorSets = map[string]*protoDescriptors{}
+
+// grpcConfig enables the gRPC body processor for the requests of type application/grpc.
+type grpcConfig struct {
+	enabled bool
+	// descriptorSet is the key of the descriptor set decoding the messages, if any.
+	descriptorSet string
+	// maxDecompressedSize is the max_size of the request body decompression, if configured.
+	maxDecompressedSize int
+}
+
+func parseGRPC(grpc gjson.Result) (grpcConfig, error) {
+	c := grpcConfig{enabled: true}
+	descriptorSet := grpc.Get("descriptor_set")
+	if !descriptorSet.Exists() {
+		return c, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(descriptorSet.String())
+	if err != nil {
+		return c, fmt.Errorf("invalid grpc descriptor_set: %v", err)
+	}
+	descriptors, err := parseDescriptorSet(data)
+	if err != nil {
+		return c, fmt.Errorf("invalid grpc descriptor_set: %v", err)
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	c.descriptorSet = strconv.FormatUint(h.Sum64(), 16)
+	grpcDescriptorSets[c.descriptorSet] = descriptors
+	return c, nil
+}
+
+// selectBodyProcessor selects the gRPC body processor for the gRPC requests, before the
+// phase 1 rules which may still select another one.
+func (c grpcConfig) selectBodyProcessor(tx ctypes.Transaction, contentType string) {
+	if !c.enabled || !isGRPCContentType(contentType) {
+		return
+	}
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return
+	}
+	if s, ok := state.Variables().RequestBodyProcessor().(interface{ Set(string) }); ok {
+		s.Set("GRPC")
+	}
+	if c.descriptorSet != "" {
+		state.Variables().TX().Set(grpcDescriptorSetVar, []string{c.descriptorSet})
+	}
+	if c.maxDecompressedSize > 0 {
+		state.Variables().TX().Set(grpcMaxDecompressedSizeVar, []string{strconv.Itoa(c.maxDecompressedSize)})
+	}
+}
+
+func isGRPCContentType(contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+proto") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// grpcBodyProcessor decodes the messages of the gRPC frames into ARGS_POST. The string fields
+// are keyed by the path of their field names, e.g. grpc.user.name, if the descriptor set of
+// the transaction describes the method, by the path of their field numbers otherwise, e.g.
+// grpc.1.2. Without descriptors, the length delimited fields are exposed both as strings if
+// printable and decoded as messages if they can be.
+type grpcBodyProcessor struct{}
+
+func (grpcBodyProcessor) ProcessRequest(reader io.Reader, v plugintypes.TransactionVariables, _ plugintypes.BodyProcessorOptions) error {
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	var message *protoMessage
+	descriptors := grpcDescriptorSets[firstValue(v.TX(), grpcDescriptorSetVar)]
+	if descriptors != nil {
+		message = descriptors.messages[descriptors.inputTypes[v.RequestFilename().Get()]]
+	}
+	d := grpcDecoder{col: v.ArgsPost(), descriptors: descriptors}
+	// The compressed messages share the limit of the body, so that many small compression
+	// bombs cannot add up past it
+	room := txLimit(v, grpcMaxDecompressedSizeVar)
+	if room == 0 {
+		room = defaultDecompressedBodyLimit
+	}
+
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return errors.New("truncated gRPC frame")
+		}
+		compressed := body[0] == 1
+		length := binary.BigEndian.Uint32(body[1:5])
+		if uint64(length) > uint64(len(body)-5) {
+			return errors.New("truncated gRPC frame")
+		}
+		msg := body[5 : 5+length]
+		body = body[5+length:]
+
+		if compressed {
+			if msg, err = decompressGRPCMessage(firstValue(v.RequestHeaders(), "grpc-encoding"), msg, room); err != nil {
+				return err
+			}
+			room -= len(msg)
+		}
+		if err := d.decode(msg, []byte("grpc"), message, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (grpcBodyProcessor) ProcessResponse(io.Reader, plugintypes.TransactionVariables, plugintypes.BodyProcessorOptions) error {
+	return nil
+}
+
+// decompressGRPCMessage decompresses msg, returning errMaxSizeExceeded past maxSize bytes.
+func decompressGRPCMessage(encoding string, msg []byte, maxSize int) ([]byte, error) {
+	if decompressibleEncoding(encoding, nil) == "" {
+		return nil, fmt.Errorf("unsupported grpc-encoding: %q", encoding)
+	}
+	r, err := newDecompressor(encoding, msg)
+	if err != nil {
+		return nil, err
+	}
+	decompressed, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > maxSize {
+		return nil, errMaxSizeExceeded
+	}
+	return decompressed, nil
+}
+
+type grpcDecoder struct {
+	col         collection.Map
+	descriptors *protoDescriptors
+}
+
+// decode adds the string fields of the message under the prefix key, message describing
+// its fields if not nil.
+func (d grpcDecoder) decode(msg []byte, key []byte, message *protoMessage, depth int) error {
+	var err error
+	parseErr := readProtoFields(msg, func(num uint64, wireType int, value []byte, _ uint64) bool {
+		if wireType != protoLengthDelimited {
+			return true
+		}
+		// A single buffer is kept for the keys, each one appended to its parent
+		parentLen := len(key)
+		defer func() { key = key[:parentLen] }()
+
+		if field, ok := message.field(num); ok {
+			key = append(append(key, '.'), field.name...)
+			switch field.typ {
+			case protoTypeString:
+				d.col.Add(string(key), string(value))
+			case protoTypeMessage:
+				if depth < grpcMaxDepth {
+					err = d.decode(value, key, d.descriptors.messages[field.typeName], depth+1)
+				}
+			}
+			return err == nil
+		}
+
+		key = strconv.AppendUint(append(key, '.'), num, 10)
+		if isPrintable(value) {
+			d.col.Add(string(key), string(value))
+		}
+		if depth < grpcMaxDepth && len(value) > 0 && readProtoFields(value, func(uint64, int, []byte, uint64) bool { return true }) == nil {
+			err = d.decode(value, key, nil, depth+1)
+		}
+		return err == nil
+	})
+	if parseErr != nil {
+		return parseErr
+	}
+	return err
+}
+
+func (m *protoMessage) field(num uint64) (protoField, bool) {
+	if m == nil {
+		return protoField{}, false
+	}
+	f, ok := m.fields[num]
+	return f, ok
+}
+
+func isPrintable(value []byte) bool {
+	if !utf8.Valid(value) {
+		return false
+	}
+	for _, r := range string(value) {
+		if !unicode.IsPrint(r) && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+func firstValue(col collection.Keyed, key string) string {
+	if values := col.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,204 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+func protoBytesField(num uint64, value []byte) []byte {
+	b := binary.AppendUvarint(nil, num<<3|protoLengthDelimited)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func protoVarintField(num, value uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, num<<3|protoVarint), value)
+}
+
+func protoFieldDescriptor(name string, number, typ uint64, typeName string) []byte {
+	return bytes.Join([][]byte{
+		protoBytesField(1, []byte(name)),
+		protoVarintField(3, number),
+		protoVarintField(5, typ),
+		protoBytesField(6, []byte(typeName)),
+	}, nil)
+}
+
+// testDescriptorSet describes:
+//
+//	package shop;
+//	message Login {
+//	  message Profile { string bio = 1; }
+//	  string user = 1;
+//	  Profile profile = 2;
+//	}
+//	service Auth { rpc SignIn(Login) returns (Login); }
+func testDescriptorSet() []byte {
+	profile := bytes.Join([][]byte{
+		protoBytesField(1, []byte("Profile")),
+		protoBytesField(2, protoFieldDescriptor("bio", 1, protoTypeString, "")),
+	}, nil)
+	login := bytes.Join([][]byte{
+		protoBytesField(1, []byte("Login")),
+		protoBytesField(2, protoFieldDescriptor("user", 1, protoTypeString, "")),
+		protoBytesField(2, protoFieldDescriptor("profile", 2, protoTypeMessage, ".shop.Login.Profile")),
+		protoBytesField(3, profile),
+	}, nil)
+	service := bytes.Join([][]byte{
+		protoBytesField(1, []byte("Auth")),
+		protoBytesField(2, bytes.Join([][]byte{
+			protoBytesField(1, []byte("SignIn")),
+			protoBytesField(2, []byte(".shop.Login")),
+			protoBytesField(3, []byte(".shop.Login")),
+		}, nil)),
+	}, nil)
+	file := bytes.Join([][]byte{
+		protoBytesField(1, []byte("shop.proto")),
+		protoBytesField(2, []byte("shop")),
+		protoBytesField(4, login),
+		protoBytesField(6, service),
+	}, nil)
+	return protoBytesField(1, file)
+}
+
+func grpcFrame(message []byte) []byte {
+	frame := []byte{0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+func TestGRPCBodyProcessor(t *testing.T) {
+	login := bytes.Join([][]byte{
+		protoBytesField(1, []byte("pooh")),
+		protoBytesField(2, protoBytesField(1, []byte("likes honey"))),
+		protoVarintField(3, 42),
+	}, nil)
+	descriptorSet := base64.StdEncoding.EncodeToString(testDescriptorSet())
+
+	tests := []struct {
+		name     string
+		config   string
+		path     string
+		body     []byte
+		expected map[string][]string
+	}{
+		{
+			name:   "descriptors",
+			config: `{"descriptor_set": "` + descriptorSet + `"}`,
+			path:   "/shop.Auth/SignIn",
+			body:   grpcFrame(login),
+			expected: map[string][]string{
+				"grpc.user":        {"pooh"},
+				"grpc.profile.bio": {"likes honey"},
+			},
+		},
+		{
+			name:   "unknown method",
+			config: `{"descriptor_set": "` + descriptorSet + `"}`,
+			path:   "/shop.Auth/SignOut",
+			body:   grpcFrame(login),
+			expected: map[string][]string{
+				"grpc.1":   {"pooh"},
+				"grpc.2.1": {"likes honey"},
+			},
+		},
+		{
+			name:   "no descriptors with several messages",
+			config: `{}`,
+			path:   "/shop.Auth/SignIn",
+			body:   append(grpcFrame(login), grpcFrame(protoBytesField(1, []byte("piglet")))...),
+			expected: map[string][]string{
+				"grpc.1":   {"pooh", "piglet"},
+				"grpc.2.1": {"likes honey"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseGRPC(gjson.Parse(tt.config))
+			require.NoError(t, err)
+
+			waf, err := coraza.NewWAF(coraza.NewWAFConfig())
+			require.NoError(t, err)
+			tx := waf.NewTransaction()
+			tx.ProcessURI(tt.path, "POST", "HTTP/2.0")
+			c.selectBodyProcessor(tx, "application/grpc")
+			v := tx.(plugintypes.TransactionState).Variables()
+			require.Equal(t, "GRPC", v.RequestBodyProcessor().Get())
+
+			require.NoError(t, grpcBodyProcessor{}.ProcessRequest(bytes.NewReader(tt.body), v, plugintypes.BodyProcessorOptions{}))
+
+			args := map[string][]string{}
+			for _, arg := range v.ArgsPost().FindAll() {
+				args[arg.Key()] = append(args[arg.Key()], arg.Value())
+			}
+			require.Equal(t, tt.expected, args)
+		})
+	}
+
+	t.Run("truncated frame", func(t *testing.T) {
+		waf, err := coraza.NewWAF(coraza.NewWAFConfig())
+		require.NoError(t, err)
+		v := waf.NewTransaction().(plugintypes.TransactionState).Variables()
+		frame := grpcFrame(login)
+		err = grpcBodyProcessor{}.ProcessRequest(bytes.NewReader(frame[:len(frame)-1]), v, plugintypes.BodyProcessorOptions{})
+		require.Equal(t, errors.New("truncated gRPC frame"), err)
+	})
+}
+
+func TestGRPCBodyProcessorDecompressedSize(t *testing.T) {
+	gzipFrame := func(message []byte) []byte {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, _ = w.Write(message)
+		_ = w.Close()
+		frame := grpcFrame(buf.Bytes())
+		frame[0] = 1
+		return frame
+	}
+	// Each message is within the limit, not both
+	message := protoBytesField(1, []byte("pooh"))
+	c := grpcConfig{enabled: true, maxDecompressedSize: len(message) + 1}
+
+	tests := []struct {
+		name string
+		body []byte
+		err  error
+	}{
+		{name: "single message", body: gzipFrame(message)},
+		{name: "messages past the limit", body: append(gzipFrame(message), gzipFrame(message)...), err: errMaxSizeExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waf, err := coraza.NewWAF(coraza.NewWAFConfig())
+			require.NoError(t, err)
+			tx := waf.NewTransaction()
+			tx.AddRequestHeader("grpc-encoding", "gzip")
+			c.selectBodyProcessor(tx, "application/grpc")
+			v := tx.(plugintypes.TransactionState).Variables()
+
+			err = grpcBodyProcessor{}.ProcessRequest(bytes.NewReader(tt.body), v, plugintypes.BodyProcessorOptions{})
+			require.Equal(t, tt.err, err)
+		})
+	}
+}
+
+func TestParseGRPC(t *testing.T) {
+	_, err := parseGRPC(gjson.Parse(`{"descriptor_set": "not base64"}`))
+	require.Error(t, err)
+
+	_, err = parseGRPC(gjson.Parse(`{"descriptor_set": "` + base64.StdEncoding.EncodeToString([]byte{0xff}) + `"}`))
+	require.Equal(t, errors.New("invalid grpc descriptor_set: invalid protobuf message"), err)
+}
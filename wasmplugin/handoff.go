@@ -0,0 +1,62 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"strconv"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+const defaultBodyHandoffHeader = "x-coraza-handoff"
+
+// bodyHandoffConfig configures the handoff of requests whose body is too big to be
+// buffered by the proxy to a companion filter (e.g. an ext_proc service running Coraza),
+// instead of skipping their inspection. Those requests are marked with a header carrying
+// the verdict so far, the companion being enabled on them through e.g. an Envoy composite
+// filter matching the header.
+type bodyHandoffConfig struct {
+	header string
+	// limit is the maximum request body size, in bytes, inspected by the filter.
+	limit int
+}
+
+func (c bodyHandoffConfig) enabled() bool {
+	return c.limit > 0
+}
+
+// handoffOversizedBody hands the request off to the companion filter if its declared
+// body size exceeds the limit. The body inspection is skipped, although phase 2 rules
+// are still evaluated against the data available so far.
+func (ctx *httpContext) handoffOversizedBody() (types.Action, bool) {
+	contentLength, err := proxywasm.GetHttpRequestHeader("content-length")
+	if err != nil {
+		// Without a declared length the body can't be handed off before headers are sent upstream
+		return types.ActionContinue, false
+	}
+	size, err := strconv.Atoi(contentLength)
+	if err != nil || size <= ctx.bodyHandoff.limit {
+		return types.ActionContinue, false
+	}
+
+	ctx.processedRequestBody = true
+	interruption, err := ctx.tx.ProcessRequestBody()
+	if err != nil {
+		ctx.logger.Error().Err(err).Msg("Failed to process request body")
+		return types.ActionContinue, true
+	}
+	if interruption != nil {
+		return ctx.handleInterruption(interruptionPhaseHttpRequestBody, interruption), true
+	}
+
+	ctx.logger.Info().
+		Int("content_length", size).
+		Int("limit", ctx.bodyHandoff.limit).
+		Msg("Handing off oversized request body inspection")
+	if err := proxywasm.ReplaceHttpRequestHeader(ctx.bodyHandoff.header, buildVerdict(ctx.tx)); err != nil {
+		ctx.logger.Error().Err(err).Msg("Failed to add handoff request header")
+	}
+	return types.ActionContinue, true
+}
@@ -0,0 +1,120 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// problemJSONBody selects an RFC 7807 application/problem+json body for
+// interruptions happening before the response headers are sent downstream.
+const problemJSONBody = "problem+json"
+
+// problemDetails is the RFC 7807 document sent to the client. The incident ID
+// is the transaction ID, which is also the one reported in the audit log, so
+// that a blocked API consumer can hand it over to support for correlation.
+type problemDetails struct {
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Detail     string `json:"detail"`
+	IncidentID string `json:"incident_id"`
+}
+
+// interruptionHeadersConfig names the headers added to the local responses sent on
+// interruption, so that a blocked user can be correlated with the audit log. Empty names
+// leave the headers out.
+type interruptionHeadersConfig struct {
+	// eventID is the header carrying the transaction ID, as reported in the audit log.
+	eventID string
+	// ruleID is the header carrying the ID of the interrupting rule, left out if the
+	// transaction was not interrupted by a rule.
+	ruleID string
+}
+
+func parseInterruptionHeaders(headers gjson.Result) (interruptionHeadersConfig, error) {
+	var c interruptionHeadersConfig
+	for _, h := range []struct {
+		field string
+		name  *string
+	}{
+		{"event_id", &c.eventID},
+		{"rule_id", &c.ruleID},
+	} {
+		name := headers.Get(h.field)
+		if !name.Exists() {
+			continue
+		}
+		*h.name = strings.ToLower(name.String())
+		if name.Type != gjson.String || !isHeaderName(*h.name) {
+			return c, fmt.Errorf("invalid interruption_headers %s: %s", h.field, name.Raw)
+		}
+	}
+	return c, nil
+}
+
+// isHeaderName returns whether the name is a valid HTTP header name, pseudo-headers excluded.
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c >= 0x7f || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// headers returns the headers of the transaction interrupted by the given rule.
+func (c interruptionHeadersConfig) headers(eventID string, ruleID int) [][2]string {
+	var headers [][2]string
+	if c.eventID != "" && eventID != "" {
+		headers = append(headers, [2]string{c.eventID, eventID})
+	}
+	if c.ruleID != "" && ruleID != 0 {
+		headers = append(headers, [2]string{c.ruleID, strconv.Itoa(ruleID)})
+	}
+	return headers
+}
+
+// interruptionResponse returns the headers and body of the local response sent on
+// interruption, the deny page accepted by the client if any are configured.
+func (ctx *httpContext) interruptionResponse(statusCode int, incidentID string, ruleID int) ([][2]string, []byte) {
+	var headers [][2]string
+	var body []byte
+	if len(ctx.denyPages) > 0 {
+		headers, body = ctx.denyPages.response(ctx.requestAccept, statusCode, incidentID, ruleID)
+	} else {
+		headers, body = interruptionResponse(ctx.interruptionBody, statusCode, incidentID)
+	}
+	return append(headers, ctx.interruptionHeaders.headers(incidentID, ruleID)...), body
+}
+
+// interruptionResponse returns the headers and body of the local response sent
+// on interruption according to the configured interruption body format.
+func interruptionResponse(format string, statusCode int, incidentID string) ([][2]string, []byte) {
+	if format != problemJSONBody {
+		return nil, nil
+	}
+
+	body, err := json.Marshal(problemDetails{
+		Type:       "about:blank",
+		Title:      http.StatusText(statusCode),
+		Status:     statusCode,
+		Detail:     "The request was blocked by the web application firewall.",
+		IncidentID: incidentID,
+	})
+	if err != nil {
+		return nil, nil
+	}
+
+	return [][2]string{{"content-type", "application/problem+json"}}, body
+}
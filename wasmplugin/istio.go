@@ -0,0 +1,136 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"fmt"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tidwall/gjson"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/hostadapter"
+)
+
+// istioConfig scopes the rule sets and labels the metrics according to the Istio
+// node metadata of the proxy the plugin is loaded into.
+type istioConfig struct {
+	// perNamespaceDirectives and perWorkloadDirectives override the default directives
+	// for the proxies of the given namespaces and workloads, the workload taking precedence.
+	perNamespaceDirectives map[string]string
+	perWorkloadDirectives  map[string]string
+	// metricLabels adds the namespace, workload and mesh_id labels to the metrics.
+	metricLabels bool
+	// peerVariables exposes the metadata of the downstream workload as TX variables.
+	peerVariables bool
+}
+
+func (c istioConfig) enabled() bool {
+	return len(c.perNamespaceDirectives) > 0 || len(c.perWorkloadDirectives) > 0 || c.metricLabels
+}
+
+func parseIstioConfig(istio gjson.Result, directivesMap DirectivesMap) (istioConfig, error) {
+	config := istioConfig{
+		perNamespaceDirectives: make(map[string]string),
+		perWorkloadDirectives:  make(map[string]string),
+		metricLabels:           istio.Get("metric_labels").Bool(),
+		peerVariables:          istio.Get("peer_variables").Bool(),
+	}
+
+	for field, m := range map[string]map[string]string{
+		"per_namespace_directives": config.perNamespaceDirectives,
+		"per_workload_directives":  config.perWorkloadDirectives,
+	} {
+		var err error
+		istio.Get(field).ForEach(func(key, value gjson.Result) bool {
+			if _, ok := directivesMap[value.String()]; !ok {
+				err = fmt.Errorf("directive map not found for %s %s: %q", field, key.String(), value.String())
+				return false
+			}
+			m[key.String()] = value.String()
+			return true
+		})
+		if err != nil {
+			return config, err
+		}
+	}
+
+	return config, nil
+}
+
+// istioNode holds the Istio node metadata of the proxy.
+type istioNode struct {
+	namespace string
+	workload  string
+	meshID    string
+}
+
+func readIstioNode(host hostadapter.Adapter) istioNode {
+	get := func(p hostadapter.Property) string {
+		raw, err := hostadapter.GetProperty(host, p)
+		if err != nil {
+			return ""
+		}
+		return string(raw)
+	}
+	return istioNode{
+		namespace: get(hostadapter.IstioNamespace),
+		workload:  get(hostadapter.IstioWorkload),
+		meshID:    get(hostadapter.IstioMeshID),
+	}
+}
+
+// directives returns the directives scoped to the node, if any.
+func (c istioConfig) directives(node istioNode) (string, bool) {
+	if name, ok := c.perWorkloadDirectives[node.workload]; ok && node.workload != "" {
+		return name, true
+	}
+	if name, ok := c.perNamespaceDirectives[node.namespace]; ok && node.namespace != "" {
+		return name, true
+	}
+	return "", false
+}
+
+// appendMetricLabelsKV appends the labels describing the node, skipping the unknown ones.
+func (c istioConfig) appendMetricLabelsKV(labelsKV []string, node istioNode) []string {
+	if !c.metricLabels {
+		return labelsKV
+	}
+	for _, kv := range [][2]string{{"namespace", node.namespace}, {"workload", node.workload}, {"mesh_id", node.meshID}} {
+		if kv[1] != "" {
+			labelsKV = append(labelsKV, kv[0], kv[1])
+		}
+	}
+	return labelsKV
+}
+
+// istioPeerVariables are the TX variables populated with the metadata of the downstream workload.
+var istioPeerVariables = []struct {
+	name     string
+	property hostadapter.Property
+}{
+	{"peer_namespace", hostadapter.IstioPeerNamespace},
+	{"peer_workload", hostadapter.IstioPeerWorkload},
+	{"peer_app", hostadapter.IstioPeerApp},
+	{"peer_version", hostadapter.IstioPeerVersion},
+	{"peer_cluster", hostadapter.IstioPeerCluster},
+}
+
+// setPeerVariables exposes the metadata of the downstream workload, exchanged by the
+// sidecars of the mesh, as TX variables. They are missing for callers outside the mesh.
+func (c istioConfig) setPeerVariables(tx ctypes.Transaction, props hostadapter.Resolver) {
+	if !c.peerVariables {
+		return
+	}
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return
+	}
+	txVars := state.Variables().TX()
+	for _, v := range istioPeerVariables {
+		if value, err := props.Property(v.property); err == nil && len(value) > 0 {
+			txVars.Set(v.name, []string{string(value)})
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/collection"
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tidwall/gjson"
+)
+
+// The TX variables read by the JSON body processor as its limits, set from the json
+// configuration or by the rules of phase 1.
+const (
+	jsonMaxDepthVar    = "json_max_depth"
+	jsonMaxElementsVar = "json_max_elements"
+)
+
+// jsonRejectInvalidVar is the TX variable which, set to 1, has the JSON body processor report
+// the invalid bodies as errors.
+const jsonRejectInvalidVar = "json_reject_invalid"
+
+// jsonLimitExceeded is the TX variable set to 1 by the JSON body processor if a limit is exceeded.
+const jsonLimitExceeded = "json_limit_exceeded"
+
+func init() {
+	// Replaces the JSON body processor of Coraza
+	plugins.RegisterBodyProcessor("json", func() plugintypes.BodyProcessor {
+		return jsonBodyProcessor{}
+	})
+}
+
+// jsonConfig configures the limits of the JSON bodies, 0 meaning no limit.
+type jsonConfig struct {
+	// maxDepth is the maximum depth of the flattened values, the deeper values being kept
+	// as raw JSON by their ancestor at the maximum depth.
+	maxDepth int
+	// maxElements is the maximum number of values flattened, the following ones being ignored.
+	maxElements int
+	// rejectInvalid reports the bodies which are not valid JSON as errors, setting
+	// REQBODY_ERROR or RESBODY_ERROR, where Coraza flattens what it can parse of them.
+	rejectInvalid bool
+}
+
+func parseJSON(jsonJSON gjson.Result) (jsonConfig, error) {
+	var c jsonConfig
+	for name, limit := range map[string]*int{"max_depth": &c.maxDepth, "max_elements": &c.maxElements} {
+		value := jsonJSON.Get(name)
+		if !value.Exists() {
+			continue
+		}
+		*limit = int(value.Int())
+		if value.Type != gjson.Number || *limit <= 0 {
+			return c, fmt.Errorf("invalid json %s: %s", name, value.Raw)
+		}
+	}
+	if rejectInvalid := jsonJSON.Get("reject_invalid"); rejectInvalid.Exists() {
+		if !rejectInvalid.IsBool() {
+			return c, fmt.Errorf("invalid json reject_invalid: %s", rejectInvalid.Raw)
+		}
+		c.rejectInvalid = rejectInvalid.Bool()
+	}
+	return c, nil
+}
+
+// setJSONLimits sets the limits of the JSON body processor for the transaction.
+func setJSONLimits(tx ctypes.Transaction, c jsonConfig) {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return
+	}
+	if c.maxDepth > 0 {
+		state.Variables().TX().Set(jsonMaxDepthVar, []string{strconv.Itoa(c.maxDepth)})
+	}
+	if c.maxElements > 0 {
+		state.Variables().TX().Set(jsonMaxElementsVar, []string{strconv.Itoa(c.maxElements)})
+	}
+	if c.rejectInvalid {
+		state.Variables().TX().Set(jsonRejectInvalidVar, []string{flagValue(true)})
+	}
+}
+
+// jsonBodyProcessor flattens the JSON bodies into ARGS_POST, or RESPONSE_ARGS, as Coraza does:
+// the nested values are keyed by their dotted path, e.g. json.user.roles.0, and the arrays by
+// their length. Unlike Coraza, the flattening is bounded in depth and elements, and the invalid
+// bodies may be reported as errors.
+type jsonBodyProcessor struct{}
+
+func (jsonBodyProcessor) ProcessRequest(reader io.Reader, v plugintypes.TransactionVariables, _ plugintypes.BodyProcessorOptions) error {
+	return flattenJSON(reader, v, v.ArgsPost())
+}
+
+func (jsonBodyProcessor) ProcessResponse(reader io.Reader, v plugintypes.TransactionVariables, _ plugintypes.BodyProcessorOptions) error {
+	return flattenJSON(reader, v, v.ResponseArgs())
+}
+
+func flattenJSON(reader io.Reader, v plugintypes.TransactionVariables, col collection.Map) error {
+	var s strings.Builder
+	if _, err := io.Copy(&s, reader); err != nil {
+		return err
+	}
+	if firstValue(v.TX(), jsonRejectInvalidVar) == "1" && !gjson.Valid(s.String()) {
+		return errors.New("invalid JSON body")
+	}
+
+	f := jsonFlattener{
+		col:         col,
+		maxDepth:    txLimit(v, jsonMaxDepthVar),
+		maxElements: txLimit(v, jsonMaxElementsVar),
+	}
+	f.flatten(gjson.Parse(s.String()), []byte("json"), 1)
+	v.TX().Set(jsonLimitExceeded, []string{flagValue(f.limitExceeded)})
+	return nil
+}
+
+type jsonFlattener struct {
+	col           collection.Map
+	maxDepth      int
+	maxElements   int
+	elements      int
+	limitExceeded bool
+}
+
+// flatten sets the values of json under the prefix key, json being at the given depth.
+func (f *jsonFlattener) flatten(json gjson.Result, key []byte, depth int) {
+	arrayLen := 0
+	json.ForEach(func(k, value gjson.Result) bool {
+		if f.maxElements > 0 && f.elements >= f.maxElements {
+			f.limitExceeded = true
+			return false
+		}
+		// A single buffer is kept for the keys, each one appended to its parent
+		parentLen := len(key)
+		key = append(key, '.')
+		if k.Type == gjson.String {
+			key = append(key, k.Str...)
+		} else {
+			key = strconv.AppendInt(key, int64(k.Num), 10)
+			arrayLen++
+		}
+
+		var val string
+		switch {
+		case value.Type == gjson.JSON && (f.maxDepth == 0 || depth < f.maxDepth):
+			f.flatten(value, key, depth+1)
+			key = key[:parentLen]
+			return true
+		case value.Type == gjson.JSON:
+			// Too deep, the rules still inspect the raw value
+			f.limitExceeded = true
+			val = value.Raw
+		case value.Type == gjson.String:
+			val = value.Str
+		case value.Type == gjson.Null:
+			val = ""
+		default:
+			val = value.Raw
+		}
+		f.col.SetIndex(string(key), 0, val)
+		f.elements++
+		key = key[:parentLen]
+		return true
+	})
+	if arrayLen > 0 {
+		f.col.SetIndex(string(key), 0, strconv.Itoa(arrayLen))
+	}
+}
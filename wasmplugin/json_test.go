@@ -0,0 +1,105 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+func TestJSONBodyProcessor(t *testing.T) {
+	body := `{"user": {"name": "pooh", "roles": ["admin", {"scope": "honey"}]}, "count": 2, "note": null}`
+	tests := []struct {
+		name          string
+		config        jsonConfig
+		expected      map[string]string
+		limitExceeded string
+	}{
+		{
+			name: "unbounded",
+			expected: map[string]string{
+				"json.user.name":          "pooh",
+				"json.user.roles.0":       "admin",
+				"json.user.roles.1.scope": "honey",
+				"json.user.roles":         "2",
+				"json.count":              "2",
+				"json.note":               "",
+			},
+			limitExceeded: "0",
+		},
+		{
+			name:   "max depth",
+			config: jsonConfig{maxDepth: 2},
+			expected: map[string]string{
+				"json.user.name":  "pooh",
+				"json.user.roles": `["admin", {"scope": "honey"}]`,
+				"json.count":      "2",
+				"json.note":       "",
+			},
+			limitExceeded: "1",
+		},
+		{
+			name:   "max elements",
+			config: jsonConfig{maxElements: 2},
+			expected: map[string]string{
+				"json.user.name":    "pooh",
+				"json.user.roles.0": "admin",
+				"json.user.roles":   "1",
+			},
+			limitExceeded: "1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waf, err := coraza.NewWAF(coraza.NewWAFConfig())
+			require.NoError(t, err)
+			tx := waf.NewTransaction()
+			setJSONLimits(tx, tt.config)
+			v := tx.(plugintypes.TransactionState).Variables()
+
+			require.NoError(t, jsonBodyProcessor{}.ProcessRequest(strings.NewReader(body), v, plugintypes.BodyProcessorOptions{}))
+
+			args := map[string]string{}
+			for _, arg := range v.ArgsPost().FindAll() {
+				args[arg.Key()] = arg.Value()
+			}
+			require.Equal(t, tt.expected, args)
+			require.Equal(t, []string{tt.limitExceeded}, v.TX().Get(jsonLimitExceeded))
+		})
+	}
+
+	t.Run("invalid body", func(t *testing.T) {
+		// Accepted by Coraza, which flattens what it can parse
+		body := `{"user": "pooh",}`
+
+		waf, err := coraza.NewWAF(coraza.NewWAFConfig())
+		require.NoError(t, err)
+		v := waf.NewTransaction().(plugintypes.TransactionState).Variables()
+		require.NoError(t, jsonBodyProcessor{}.ProcessRequest(strings.NewReader(body), v, plugintypes.BodyProcessorOptions{}))
+		require.Equal(t, []string{"pooh"}, v.ArgsPost().Get("json.user"))
+
+		tx := waf.NewTransaction()
+		setJSONLimits(tx, jsonConfig{rejectInvalid: true})
+		v = tx.(plugintypes.TransactionState).Variables()
+		require.Error(t, jsonBodyProcessor{}.ProcessRequest(strings.NewReader(body), v, plugintypes.BodyProcessorOptions{}))
+	})
+}
+
+func TestParseJSON(t *testing.T) {
+	c, err := parseJSON(gjson.Parse(`{"max_depth": 8, "max_elements": 1000, "reject_invalid": true}`))
+	require.NoError(t, err)
+	require.Equal(t, jsonConfig{maxDepth: 8, maxElements: 1000, rejectInvalid: true}, c)
+
+	_, err = parseJSON(gjson.Parse(`{"max_depth": "8"}`))
+	require.Equal(t, errors.New(`invalid json max_depth: "8"`), err)
+
+	_, err = parseJSON(gjson.Parse(`{"reject_invalid": 1}`))
+	require.Equal(t, errors.New("invalid json reject_invalid: 1"), err)
+}
@@ -8,3 +8,11 @@ package wasmplugin
 func logMemStats() {
 	// no-op without build tag
 }
+
+func currentAllocs() uint64 {
+	return 0
+}
+
+func countAllocs(string, uint64) {
+	// no-op without build tag
+}
@@ -6,11 +6,19 @@
 package wasmplugin
 
 import (
+	"fmt"
 	"runtime"
+	"sort"
+	"strings"
 
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
 )
 
+// allocatedBytes accumulates the bytes allocated by each callback, breaking the allocations
+// down by processing step: request headers, request body, response headers, response body
+// and logging phase.
+var allocatedBytes = map[string]uint64{}
+
 func logMemStats() {
 	ms := runtime.MemStats{}
 	runtime.ReadMemStats(&ms)
@@ -21,4 +29,32 @@ func logMemStats() {
 		ms.HeapIdle,
 		ms.HeapReleased,
 		ms.TotalAlloc)
+
+	callbacks := make([]string, 0, len(allocatedBytes))
+	for callback := range allocatedBytes {
+		callbacks = append(callbacks, callback)
+	}
+	sort.Slice(callbacks, func(i, j int) bool {
+		return allocatedBytes[callbacks[i]] > allocatedBytes[callbacks[j]]
+	})
+	var sb strings.Builder
+	for i, callback := range callbacks {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(fmt.Sprintf("%s: %d", callback, allocatedBytes[callback]))
+	}
+	proxywasm.LogDebugf("Allocated bytes by callback: %s", sb.String())
+}
+
+func currentAllocs() uint64 {
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+	return ms.TotalAlloc
+}
+
+func countAllocs(callback string, start uint64) {
+	allocated := currentAllocs() - start
+	allocatedBytes[callback] += allocated
+	proxywasm.LogDebugf("%s allocated %d bytes", callback, allocated)
 }
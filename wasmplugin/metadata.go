@@ -0,0 +1,69 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tidwall/gjson"
+)
+
+// metadataVariable exposes a property produced by a previous filter (e.g. the jwt_authn
+// payload or the ext_authz labels stored in the dynamic metadata, or a filter state
+// object) as the TX:<name> variable, so that rules can combine identity context with
+// payload inspection.
+type metadataVariable struct {
+	name string
+	// path is the property path of a leaf value, e.g.
+	// ["metadata", "filter_metadata", "envoy.filters.http.jwt_authn", "jwt_payload", "sub"].
+	path []string
+}
+
+func parseMetadataVariables(variables gjson.Result) ([]metadataVariable, error) {
+	var (
+		vars []metadataVariable
+		err  error
+	)
+	variables.ForEach(func(_, value gjson.Result) bool {
+		v := metadataVariable{name: value.Get("name").String()}
+		if v.name == "" {
+			err = errors.New("missing metadata variable name")
+			return false
+		}
+		value.Get("path").ForEach(func(_, p gjson.Result) bool {
+			v.path = append(v.path, p.String())
+			return true
+		})
+		if len(v.path) == 0 {
+			err = fmt.Errorf("missing path for metadata variable %q", v.name)
+			return false
+		}
+		vars = append(vars, v)
+		return true
+	})
+	return vars, err
+}
+
+// setMetadataVariables populates the TX variables with the available metadata values.
+func setMetadataVariables(tx ctypes.Transaction, vars []metadataVariable) {
+	if len(vars) == 0 {
+		return
+	}
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return
+	}
+	txVars := state.Variables().TX()
+	for _, v := range vars {
+		raw, err := proxywasm.GetProperty(v.path)
+		if err != nil || len(raw) == 0 {
+			continue
+		}
+		txVars.Set(v.name, []string{string(raw)})
+	}
+}
@@ -5,35 +5,118 @@ package wasmplugin
 
 import (
 	"fmt"
+	"runtime"
 	"strings"
 
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/hostadapter"
 )
 
 type wafMetrics struct {
 	counters map[string]proxywasm.MetricCounter
+	gauges   map[string]proxywasm.MetricGauge
+	// gaugeValues are the values reported by this VM to the gauges, which are shared
+	// by all the VMs of the host: each VM adds the change of its own value so that the
+	// gauges report the sum across VMs (e.g. across Envoy workers).
+	gaugeValues map[string]int64
+	host        hostadapter.Adapter
+	// disabled is true if the host does not support metrics, only the
+	// counters mirrored below are then maintained.
+	disabled bool
+	// txTotal and interruptionsTotal mirror the counters of this VM,
+	// they are reported by the status endpoint.
+	txTotal            uint64
+	interruptionsTotal uint64
+	// txLive is the number of transactions not closed yet, a steadily growing
+	// value denotes leaking transactions.
+	txLive uint64
 }
 
-func NewWAFMetrics() *wafMetrics {
+func NewWAFMetrics(host hostadapter.Adapter) *wafMetrics {
 	return &wafMetrics{
-		counters: make(map[string]proxywasm.MetricCounter),
+		counters:    make(map[string]proxywasm.MetricCounter),
+		gauges:      make(map[string]proxywasm.MetricGauge),
+		gaugeValues: make(map[string]int64),
+		host:        host,
 	}
 }
 
 func (m *wafMetrics) incrementCounter(fqn string) {
 	// TODO(jcchavezs): figure out if we are OK with dynamic creation of metrics
 	// or we generate the metrics on before hand.
+	if m.disabled {
+		return
+	}
 	counter, ok := m.counters[fqn]
 	if !ok {
-		counter = proxywasm.DefineCounterMetric(fqn)
+		counter = proxywasm.DefineCounterMetric(m.host.MetricName(fqn))
 		m.counters[fqn] = counter
 	}
 	counter.Increment(1)
 }
 
+func (m *wafMetrics) setGauge(fqn string, value int64) {
+	if m.disabled {
+		return
+	}
+	gauge, ok := m.gauges[fqn]
+	if !ok {
+		gauge = proxywasm.DefineGaugeMetric(m.host.MetricName(fqn))
+		m.gauges[fqn] = gauge
+	}
+	gauge.Add(value - m.gaugeValues[fqn])
+	m.gaugeValues[fqn] = value
+}
+
 func (m *wafMetrics) CountTX() {
 	// This metric is processed as: waf_filter_tx_total
 	m.incrementCounter("waf_filter.tx.total")
+	m.txTotal++
+}
+
+// TXStarted accounts a new live transaction, released by TXFinished once the transaction is closed.
+func (m *wafMetrics) TXStarted() {
+	m.txLive++
+	m.setLiveTX()
+}
+
+func (m *wafMetrics) TXFinished() {
+	m.txLive--
+	m.setLiveTX()
+}
+
+func (m *wafMetrics) setLiveTX() {
+	// This metric is processed as: waf_filter_tx_live
+	m.setGauge("waf_filter.tx.live", int64(m.txLive))
+}
+
+func (m *wafMetrics) CountGC() {
+	// This metric is processed as: waf_filter_gc_idle_collections
+	m.incrementCounter("waf_filter.gc.idle_collections")
+}
+
+func (m *wafMetrics) CountConfigError() {
+	// This metric is processed as: waf_filter_config_errors
+	m.incrementCounter("waf_filter.config.errors")
+}
+
+func (m *wafMetrics) CountRulesRefresh(result string) {
+	// This metric is processed as: waf_filter_rules_refreshes{result="loaded"}
+	m.incrementCounter(fmt.Sprintf("waf_filter.rules.refreshes_result=%s", result))
+}
+
+// ReportHeap exposes the memory usage of the VM as reported by the garbage collector.
+func (m *wafMetrics) ReportHeap(ms *runtime.MemStats) {
+	if m.disabled {
+		return
+	}
+	// These metrics are processed as: waf_filter_heap_size, waf_filter_heap_free...
+	m.setGauge("waf_filter.heap.size", int64(ms.HeapSys))
+	m.setGauge("waf_filter.heap.free", int64(ms.HeapIdle))
+	m.setGauge("waf_filter.heap.released", int64(ms.HeapReleased))
+	m.setGauge("waf_filter.heap.allocated_total", int64(ms.TotalAlloc))
+	m.setGauge("waf_filter.memory.sys", int64(ms.Sys))
 }
 
 func (m *wafMetrics) CountTXInterruption(phase string, ruleID int, metricLabelsKV []string) {
@@ -49,4 +132,118 @@ func (m *wafMetrics) CountTXInterruption(phase string, ruleID int, metricLabelsK
 
 	fqn := sb.String()
 	m.incrementCounter(fqn)
+	m.interruptionsTotal++
+}
+
+func (m *wafMetrics) CountTXFailure(class string, policy string, metricLabelsKV []string) {
+	// This metric is processed as: waf_filter_tx_failures{class="body_limit",policy="open",identifier="foo"}.
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("waf_filter.tx.failures_class=%s_policy=%s", class, policy))
+
+	for i := 0; i < len(metricLabelsKV); i += 2 {
+		sb.WriteString(fmt.Sprintf("_%s=%s", metricLabelsKV[i], metricLabelsKV[i+1]))
+	}
+
+	m.incrementCounter(sb.String())
+}
+
+func (m *wafMetrics) CountTXSampling(decision string, metricLabelsKV []string) {
+	// This metric is processed as: waf_filter_tx_sampling{decision="headers_only",identifier="foo"}.
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("waf_filter.tx.sampling_decision=%s", decision))
+
+	for i := 0; i < len(metricLabelsKV); i += 2 {
+		sb.WriteString(fmt.Sprintf("_%s=%s", metricLabelsKV[i], metricLabelsKV[i+1]))
+	}
+
+	m.incrementCounter(sb.String())
+}
+
+func (m *wafMetrics) CountCharsetFailure(reason string, metricLabelsKV []string) {
+	// This metric is processed as: waf_filter_tx_charset_failures{reason="invalid",identifier="foo"}.
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("waf_filter.tx.charset_failures_reason=%s", reason))
+
+	for i := 0; i < len(metricLabelsKV); i += 2 {
+		sb.WriteString(fmt.Sprintf("_%s=%s", metricLabelsKV[i], metricLabelsKV[i+1]))
+	}
+
+	m.incrementCounter(sb.String())
+}
+
+// otherMetricLabelValue is the bucket used for the values of a dynamic metric
+// label observed after reaching its maximum number of distinct values.
+const otherMetricLabelValue = "other"
+
+const defaultMaxMetricLabelValues = 100
+
+// dynamicMetricLabel is a metric label whose value is resolved per request.
+// Supported sources are "authority", "route_name" and "header:<name>".
+type dynamicMetricLabel struct {
+	name      string
+	source    string
+	maxValues int
+}
+
+func parseDynamicMetricLabelSource(source string) error {
+	switch {
+	case source == "authority", source == "route_name":
+		return nil
+	case strings.HasPrefix(source, "header:") && len(source) > len("header:"):
+		return nil
+	default:
+		return fmt.Errorf("unsupported metric label source: %q", source)
+	}
+}
+
+// metricLabelsCardinality caps the distinct values used by each dynamic metric label
+// in order to avoid exploding the number of time series exposed by the proxy.
+type metricLabelsCardinality struct {
+	labels []dynamicMetricLabel
+	seen   []map[string]struct{}
+}
+
+func newMetricLabelsCardinality(labels []dynamicMetricLabel) *metricLabelsCardinality {
+	seen := make([]map[string]struct{}, len(labels))
+	for i := range labels {
+		seen[i] = make(map[string]struct{})
+	}
+	return &metricLabelsCardinality{labels: labels, seen: seen}
+}
+
+// value returns the value to be used for the i-th label, falling back to the
+// "other" bucket once the maximum number of distinct values has been reached.
+func (c *metricLabelsCardinality) value(i int, v string) string {
+	seen := c.seen[i]
+	if _, ok := seen[v]; ok {
+		return v
+	}
+	if len(seen) >= c.labels[i].maxValues {
+		return otherMetricLabelValue
+	}
+	seen[v] = struct{}{}
+	return v
+}
+
+// appendLabelsKV appends the dynamic labels resolved for the current request to
+// the given labels key-value pairs.
+func (c *metricLabelsCardinality) appendLabelsKV(labelsKV []string, authority string, props hostadapter.Resolver) []string {
+	for i, label := range c.labels {
+		var v string
+		switch {
+		case label.source == "authority":
+			v = authority
+		case label.source == "route_name":
+			if raw, err := props.Property(hostadapter.RouteName); err == nil {
+				v = string(raw)
+			}
+		case strings.HasPrefix(label.source, "header:"):
+			v, _ = proxywasm.GetHttpRequestHeader(label.source[len("header:"):])
+		}
+		if v == "" {
+			continue
+		}
+		labelsKV = append(labelsKV, label.name, c.value(i, v))
+	}
+	return labelsKV
 }
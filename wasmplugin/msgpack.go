@@ -0,0 +1,134 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+)
+
+var errInvalidMsgpack = errors.New("invalid MessagePack body")
+
+// msgpackBodyProcessor flattens the MessagePack bodies into ARGS_POST, or RESPONSE_ARGS, as the
+// JSON body processor does, under the msgpack prefix, e.g. msgpack.user.name. The binary and
+// extension values are exposed as strings.
+type msgpackBodyProcessor struct{}
+
+func (msgpackBodyProcessor) ProcessRequest(reader io.Reader, v plugintypes.TransactionVariables, _ plugintypes.BodyProcessorOptions) error {
+	return flattenBinary(reader, newMsgpackReader, "msgpack", v, v.ArgsPost())
+}
+
+func (msgpackBodyProcessor) ProcessResponse(reader io.Reader, v plugintypes.TransactionVariables, _ plugintypes.BodyProcessorOptions) error {
+	return flattenBinary(reader, newMsgpackReader, "msgpack", v, v.ResponseArgs())
+}
+
+type msgpackReader struct {
+	binaryBuffer
+}
+
+func newMsgpackReader(b []byte) binaryReader {
+	return &msgpackReader{binaryBuffer{b: b}}
+}
+
+// readBreak returns false, the MessagePack arrays and maps having a known length.
+func (*msgpackReader) readBreak() bool {
+	return false
+}
+
+func (r *msgpackReader) readItem() (binaryItem, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return binaryItem{}, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return scalarItem(strconv.Itoa(int(c)))
+	case c >= 0xe0:
+		return scalarItem(strconv.Itoa(int(int8(c))))
+	case c <= 0x8f:
+		return r.container(binaryMap, uint64(c&0x0f))
+	case c <= 0x9f:
+		return r.container(binaryArray, uint64(c&0x0f))
+	case c <= 0xbf:
+		return r.str(uint64(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return scalarItem("")
+	case 0xc2:
+		return scalarItem("false")
+	case 0xc3:
+		return scalarItem("true")
+	case 0xc4, 0xc5, 0xc6: // bin 8, 16, 32
+		return r.sizedStr(1 << (c - 0xc4))
+	case 0xc7, 0xc8, 0xc9: // ext 8, 16, 32
+		n, err := r.uint(1 << (c - 0xc7))
+		if err != nil {
+			return binaryItem{}, err
+		}
+		return r.ext(n)
+	case 0xca:
+		u, err := r.uint(4)
+		return binaryItem{kind: binaryScalar, value: strconv.FormatFloat(float64(math.Float32frombits(uint32(u))), 'g', -1, 32)}, err
+	case 0xcb:
+		u, err := r.uint(8)
+		return binaryItem{kind: binaryScalar, value: strconv.FormatFloat(math.Float64frombits(u), 'g', -1, 64)}, err
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8, 16, 32, 64
+		u, err := r.uint(1 << (c - 0xcc))
+		return binaryItem{kind: binaryScalar, value: strconv.FormatUint(u, 10)}, err
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int 8, 16, 32, 64
+		size := 1 << (c - 0xd0)
+		u, err := r.uint(size)
+		shift := 64 - 8*size
+		return binaryItem{kind: binaryScalar, value: strconv.FormatInt(int64(u<<shift)>>shift, 10)}, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext 1, 2, 4, 8, 16
+		return r.ext(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb: // str 8, 16, 32
+		return r.sizedStr(1 << (c - 0xd9))
+	case 0xdc, 0xdd: // array 16, 32
+		n, err := r.uint(2 << (c - 0xdc))
+		if err != nil {
+			return binaryItem{}, err
+		}
+		return r.container(binaryArray, n)
+	case 0xde, 0xdf: // map 16, 32
+		n, err := r.uint(2 << (c - 0xde))
+		if err != nil {
+			return binaryItem{}, err
+		}
+		return r.container(binaryMap, n)
+	}
+	return binaryItem{}, errInvalidMsgpack
+}
+
+// sizedStr reads a string, or binary, value preceded by its length on size bytes.
+func (r *msgpackReader) sizedStr(size int) (binaryItem, error) {
+	n, err := r.uint(size)
+	if err != nil {
+		return binaryItem{}, err
+	}
+	return r.str(n)
+}
+
+func (r *msgpackReader) str(n uint64) (binaryItem, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return binaryItem{}, err
+	}
+	return scalarItem(string(b))
+}
+
+// ext reads the n bytes of an extension value following its type, which is ignored.
+func (r *msgpackReader) ext(n uint64) (binaryItem, error) {
+	if _, err := r.next(1); err != nil {
+		return binaryItem{}, err
+	}
+	return r.str(n)
+}
@@ -0,0 +1,18 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !no_body_processor_msgpack
+
+package wasmplugin
+
+import (
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+)
+
+func init() {
+	plugins.RegisterBodyProcessor("msgpack", func() plugintypes.BodyProcessor {
+		return msgpackBodyProcessor{}
+	})
+	optionalBodyProcessors["MSGPACK"] = true
+}
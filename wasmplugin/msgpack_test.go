@@ -0,0 +1,112 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMsgpackBodyProcessor(t *testing.T) {
+	// {"user": {"name": "pooh", "roles": ["admin", {"scope": "honey"}]}, "count": 2, "note": nil}
+	body := "\x83\xa4user\x82\xa4name\xa4pooh\xa5roles\x92\xa5admin\x81\xa5scope\xa5honey\xa5count\x02\xa4note\xc0"
+	tests := []struct {
+		name          string
+		body          string
+		config        jsonConfig
+		expected      map[string]string
+		limitExceeded string
+	}{
+		{
+			name: "unbounded",
+			body: body,
+			expected: map[string]string{
+				"msgpack.user.name":          "pooh",
+				"msgpack.user.roles.0":       "admin",
+				"msgpack.user.roles.1.scope": "honey",
+				"msgpack.user.roles":         "2",
+				"msgpack.count":              "2",
+				"msgpack.note":               "",
+			},
+			limitExceeded: "0",
+		},
+		{
+			name:   "max depth",
+			body:   body,
+			config: jsonConfig{maxDepth: 2},
+			expected: map[string]string{
+				"msgpack.user.name":  "pooh",
+				"msgpack.user.roles": "\x92\xa5admin\x81\xa5scope\xa5honey",
+				"msgpack.count":      "2",
+				"msgpack.note":       "",
+			},
+			limitExceeded: "1",
+		},
+		{
+			name:   "max elements",
+			body:   body,
+			config: jsonConfig{maxElements: 2},
+			expected: map[string]string{
+				"msgpack.user.name":    "pooh",
+				"msgpack.user.roles.0": "admin",
+				"msgpack.user.roles":   "1",
+			},
+			limitExceeded: "1",
+		},
+		{
+			name: "scalars",
+			// {"neg": -3, "i16": -300, "u32": 70000, "f64": 1.5, "bin": <0x01 0x02>, "ok": true, "ext": <1: "x">}
+			body: "\x87\xa3neg\xfd\xa3i16\xd1\xfe\xd4\xa3u32\xce\x00\x01\x11\x70\xa3f64\xcb\x3f\xf8\x00\x00\x00\x00\x00\x00" +
+				"\xa3bin\xc4\x02\x01\x02\xa2ok\xc3\xa3ext\xd4\x01x",
+			expected: map[string]string{
+				"msgpack.neg": "-3",
+				"msgpack.i16": "-300",
+				"msgpack.u32": "70000",
+				"msgpack.f64": "1.5",
+				"msgpack.bin": "\x01\x02",
+				"msgpack.ok":  "true",
+				"msgpack.ext": "x",
+			},
+			limitExceeded: "0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waf, err := coraza.NewWAF(coraza.NewWAFConfig())
+			require.NoError(t, err)
+			tx := waf.NewTransaction()
+			setJSONLimits(tx, tt.config)
+			v := tx.(plugintypes.TransactionState).Variables()
+
+			require.NoError(t, msgpackBodyProcessor{}.ProcessRequest(strings.NewReader(tt.body), v, plugintypes.BodyProcessorOptions{}))
+
+			args := map[string]string{}
+			for _, arg := range v.ArgsPost().FindAll() {
+				args[arg.Key()] = arg.Value()
+			}
+			require.Equal(t, tt.expected, args)
+			require.Equal(t, []string{tt.limitExceeded}, v.TX().Get(jsonLimitExceeded))
+		})
+	}
+
+	for name, body := range map[string]string{
+		"truncated":         "\x82\xa4user",
+		"huge array":        "\xdd\xff\xff\xff\xff\x01",
+		"trailing data":     "\x01\x02",
+		"never used":        "\xc1",
+		"map key":           "\x81\x90\x01",
+		"too deeply nested": strings.Repeat("\x91", binaryBodyMaxDepth+1) + "\x01",
+	} {
+		t.Run(name, func(t *testing.T) {
+			waf, err := coraza.NewWAF(coraza.NewWAFConfig())
+			require.NoError(t, err)
+			v := waf.NewTransaction().(plugintypes.TransactionState).Variables()
+			require.Error(t, msgpackBodyProcessor{}.ProcessRequest(strings.NewReader(body), v, plugintypes.BodyProcessorOptions{}))
+		})
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tidwall/gjson"
+)
+
+// The TX variables read by the multipart body processor as its limits, set from the multipart
+// configuration or by the rules of phase 1.
+const (
+	multipartMaxPartSizeVar = "multipart_max_part_size"
+	multipartMaxFilesVar    = "multipart_max_files"
+)
+
+// The TX variables set to 0 or 1 by the multipart body processor, standing for the
+// MULTIPART_* flags of ModSecurity that Coraza does not populate.
+const (
+	multipartBoundaryQuoted     = "multipart_boundary_quoted"
+	multipartBoundaryWhitespace = "multipart_boundary_whitespace"
+	multipartDataBefore         = "multipart_data_before"
+	multipartDataAfter          = "multipart_data_after"
+	multipartLFLine             = "multipart_lf_line"
+	multipartInvalidPart        = "multipart_invalid_part"
+	multipartUnmatchedBoundary  = "multipart_unmatched_boundary"
+	multipartFileLimitExceeded  = "multipart_file_limit_exceeded"
+	multipartPartLimitExceeded  = "multipart_part_limit_exceeded"
+	// multipartStrictError is set if any of the flags above is.
+	multipartStrictError = "multipart_strict_error"
+)
+
+var multipartFlagNames = []string{
+	multipartBoundaryQuoted,
+	multipartBoundaryWhitespace,
+	multipartDataBefore,
+	multipartDataAfter,
+	multipartLFLine,
+	multipartInvalidPart,
+	multipartUnmatchedBoundary,
+	multipartFileLimitExceeded,
+	multipartPartLimitExceeded,
+}
+
+func init() {
+	// Replaces the multipart body processor of Coraza
+	plugins.RegisterBodyProcessor("multipart", func() plugintypes.BodyProcessor {
+		return multipartBodyProcessor{}
+	})
+}
+
+// multipartConfig configures the limits of the multipart request bodies, 0 meaning no limit.
+type multipartConfig struct {
+	// maxPartSize is the maximum size of a part, the fields being truncated past it.
+	maxPartSize int
+	// maxFiles is the maximum number of files of a body.
+	maxFiles int
+}
+
+func parseMultipart(multipartJSON gjson.Result) (multipartConfig, error) {
+	var c multipartConfig
+	for name, limit := range map[string]*int{"max_part_size": &c.maxPartSize, "max_files": &c.maxFiles} {
+		value := multipartJSON.Get(name)
+		if !value.Exists() {
+			continue
+		}
+		*limit = int(value.Int())
+		if value.Type != gjson.Number || *limit <= 0 {
+			return c, fmt.Errorf("invalid multipart %s: %s", name, value.Raw)
+		}
+	}
+	return c, nil
+}
+
+// setMultipartLimits sets the limits of the multipart body processor for the transaction.
+func setMultipartLimits(tx ctypes.Transaction, c multipartConfig) {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return
+	}
+	if c.maxPartSize > 0 {
+		state.Variables().TX().Set(multipartMaxPartSizeVar, []string{strconv.Itoa(c.maxPartSize)})
+	}
+	if c.maxFiles > 0 {
+		state.Variables().TX().Set(multipartMaxFilesVar, []string{strconv.Itoa(c.maxFiles)})
+	}
+}
+
+// multipartBodyProcessor populates the same variables as the multipart body processor of
+// Coraza, along with MULTIPART_NAME, MULTIPART_FILENAME, MULTIPART_DATA_AFTER and the flags
+// of the strict validation. Files are never stored, only their sizes are recorded.
+type multipartBodyProcessor struct{}
+
+func (multipartBodyProcessor) ProcessRequest(reader io.Reader, v plugintypes.TransactionVariables, options plugintypes.BodyProcessorOptions) error {
+	mediaType, params, err := mime.ParseMediaType(options.Mime)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return errors.New("not a multipart body")
+	}
+	boundary := params["boundary"]
+
+	// The body is streamed to the parts reader, the scanner flagging its deviations on the way
+	scanner := newMultipartScanner(options.Mime, boundary)
+	body := io.TeeReader(reader, scanner)
+	flags := map[string]bool{}
+	err = readMultipartParts(body, boundary, v, flags)
+	if err != nil {
+		flags[multipartInvalidPart] = true
+	}
+	// The parts reader stops at the closing delimiter, the epilogue is read for the flags only
+	if _, drainErr := io.Copy(io.Discard, body); err == nil {
+		err = drainErr
+	}
+	for name, set := range scanner.flags() {
+		flags[name] = flags[name] || set
+	}
+
+	strict := false
+	for _, name := range multipartFlagNames {
+		strict = strict || flags[name]
+		v.TX().Set(name, []string{flagValue(flags[name])})
+	}
+	v.TX().Set(multipartStrictError, []string{flagValue(strict)})
+	if s, ok := v.MultipartDataAfter().(interface{ Set(string) }); ok {
+		s.Set(flagValue(flags[multipartDataAfter]))
+	}
+	return err
+}
+
+func (multipartBodyProcessor) ProcessResponse(io.Reader, plugintypes.TransactionVariables, plugintypes.BodyProcessorOptions) error {
+	return nil
+}
+
+// multipartScanner flags the deviations of a body from a strict multipart encoding as it is
+// written, line by line. Only the beginning of each line is retained, enough to match the
+// delimiter, so that the body is never held twice.
+type multipartScanner struct {
+	boundaryQuoted     bool
+	boundaryWhitespace bool
+	delimiter          []byte
+
+	// head holds the beginning of the current line.
+	head []byte
+	// tail is set if the current line has text past its head.
+	tail bool
+	// cr is set if the last byte of the current line is a CR.
+	cr bool
+	// lf is set if the previous line ended with a bare LF.
+	lf bool
+
+	opened     bool
+	closed     bool
+	dataBefore bool
+	dataAfter  bool
+	lfLine     bool
+}
+
+func newMultipartScanner(contentType, boundary string) *multipartScanner {
+	delimiter := []byte("--" + boundary)
+	return &multipartScanner{
+		boundaryQuoted:     strings.Contains(strings.ToLower(contentType), `boundary="`),
+		boundaryWhitespace: strings.ContainsAny(boundary, " \t"),
+		delimiter:          delimiter,
+		head:               make([]byte, 0, len(delimiter)+2),
+	}
+}
+
+func (s *multipartScanner) Write(p []byte) (int, error) {
+	n := len(p)
+	for {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			s.scan(p)
+			return n, nil
+		}
+		s.scan(p[:i])
+		s.endLine()
+		p = p[i+1:]
+	}
+}
+
+// scan adds b to the current line.
+func (s *multipartScanner) scan(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	s.cr = b[len(b)-1] == '\r'
+	if room := cap(s.head) - len(s.head); room > 0 {
+		n := min(room, len(b))
+		s.head = append(s.head, b[:n]...)
+		b = b[n:]
+	}
+	s.tail = s.tail || len(bytes.TrimSpace(b)) > 0
+}
+
+func (s *multipartScanner) endLine() {
+	text := s.tail || len(bytes.TrimSpace(s.head)) > 0
+	switch {
+	case s.closed:
+		s.dataAfter = s.dataAfter || text
+	case bytes.HasPrefix(s.head, s.delimiter):
+		// Each delimiter but the first one is expected to follow a CRLF
+		s.lfLine = s.lfLine || (s.opened && s.lf)
+		s.opened = true
+		if bytes.HasPrefix(s.head[len(s.delimiter):], []byte("--")) {
+			s.closed = true
+			s.dataAfter = s.tail
+		}
+	case !s.opened:
+		s.dataBefore = s.dataBefore || text
+	}
+	s.lf = !s.cr
+	s.head = s.head[:0]
+	s.tail = false
+	s.cr = false
+}
+
+// flags returns the deviations found in the body written so far.
+func (s *multipartScanner) flags() map[string]bool {
+	if len(s.head) > 0 || s.tail {
+		s.endLine()
+	}
+	flags := map[string]bool{
+		multipartBoundaryQuoted:     s.boundaryQuoted,
+		multipartBoundaryWhitespace: s.boundaryWhitespace,
+	}
+	if len(s.delimiter) == 2 || !s.opened || !s.closed {
+		flags[multipartUnmatchedBoundary] = true
+		return flags
+	}
+	flags[multipartDataBefore] = s.dataBefore
+	flags[multipartDataAfter] = s.dataAfter
+	flags[multipartLFLine] = s.lfLine
+	return flags
+}
+
+// readMultipartParts populates the variables of the fields and files of the body.
+func readMultipartParts(body io.Reader, boundary string, v plugintypes.TransactionVariables, flags map[string]bool) error {
+	maxPartSize := txLimit(v, multipartMaxPartSizeVar)
+	maxFiles := txLimit(v, multipartMaxFilesVar)
+
+	mr := multipart.NewReader(body, boundary)
+	files := 0
+	combinedSize := int64(0)
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := p.FormName()
+		for key, values := range p.Header {
+			for _, value := range values {
+				v.MultipartPartHeaders().Add(name, fmt.Sprintf("%s: %s", key, value))
+			}
+		}
+		v.MultipartName().Add(name, name)
+
+		size, err := readMultipartPart(p, name, v, flags, maxPartSize, maxFiles, &files)
+		if err != nil {
+			return err
+		}
+		// As in Coraza, the combined size counts the fields along with the files and is set
+		// once a part is read
+		combinedSize += size
+		if s, ok := v.FilesCombinedSize().(interface{ Set(string) }); ok {
+			s.Set(strconv.FormatInt(combinedSize, 10))
+		}
+	}
+}
+
+// readMultipartPart populates the variables of a field or file, returning its size.
+func readMultipartPart(p *multipart.Part, name string, v plugintypes.TransactionVariables, flags map[string]bool, maxPartSize, maxFiles int, files *int) (int64, error) {
+	if filename := multipartFileName(p); filename != "" {
+		size, err := io.Copy(io.Discard, p)
+		if err != nil {
+			return 0, err
+		}
+		*files++
+		if maxFiles > 0 && *files > maxFiles {
+			flags[multipartFileLimitExceeded] = true
+		}
+		if maxPartSize > 0 && size > int64(maxPartSize) {
+			flags[multipartPartLimitExceeded] = true
+		}
+		v.MultipartFilename().Add(name, filename)
+		v.Files().Add("", filename)
+		v.FilesSizes().SetIndex(filename, 0, strconv.FormatInt(size, 10))
+		v.FilesNames().Add("", name)
+		return size, nil
+	}
+
+	if maxPartSize <= 0 {
+		value, err := io.ReadAll(p)
+		if err != nil {
+			return 0, err
+		}
+		v.ArgsPost().Add(name, string(value))
+		return int64(len(value)), nil
+	}
+	value, err := io.ReadAll(io.LimitReader(p, int64(maxPartSize)))
+	if err != nil {
+		return 0, err
+	}
+	rest, err := io.Copy(io.Discard, p)
+	if err != nil {
+		return 0, err
+	}
+	flags[multipartPartLimitExceeded] = flags[multipartPartLimitExceeded] || rest > 0
+	v.ArgsPost().Add(name, string(value))
+	return int64(len(value)) + rest, nil
+}
+
+// multipartFileName returns the filename parameter of the Content-Disposition header of the part.
+func multipartFileName(p *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
+
+func txLimit(v plugintypes.TransactionVariables, name string) int {
+	limit, _ := strconv.Atoi(firstValue(v.TX(), name))
+	return limit
+}
+
+func flagValue(set bool) string {
+	if set {
+		return "1"
+	}
+	return "0"
+}
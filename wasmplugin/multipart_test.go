@@ -0,0 +1,120 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+func TestMultipartScanner(t *testing.T) {
+	part := "Content-Disposition: form-data; name=\"a\"\r\n\r\nb\r\n"
+	tests := []struct {
+		name        string
+		contentType string
+		boundary    string
+		body        string
+		expected    []string
+	}{
+		{
+			name:        "strict",
+			contentType: "multipart/form-data; boundary=x",
+			boundary:    "x",
+			body:        "--x\r\n" + part + "--x--\r\n",
+		},
+		{
+			name:        "quoted boundary",
+			contentType: "multipart/form-data; boundary=\"x y\"",
+			boundary:    "x y",
+			body:        "--x y\r\n" + part + "--x y--\r\n",
+			expected:    []string{multipartBoundaryQuoted, multipartBoundaryWhitespace},
+		},
+		{
+			name:        "data before and after",
+			contentType: "multipart/form-data; boundary=x",
+			boundary:    "x",
+			body:        "preamble\r\n--x\r\n" + part + "--x--\r\nepilogue",
+			expected:    []string{multipartDataBefore, multipartDataAfter},
+		},
+		{
+			name:        "lf line",
+			contentType: "multipart/form-data; boundary=x",
+			boundary:    "x",
+			body:        "--x\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nb\n--x--\r\n",
+			expected:    []string{multipartLFLine},
+		},
+		{
+			name:        "unmatched boundary",
+			contentType: "multipart/form-data; boundary=x",
+			boundary:    "x",
+			body:        "--x\r\n" + part,
+			expected:    []string{multipartUnmatchedBoundary},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The body is written a few bytes at a time, as read by the parts reader
+			scanner := newMultipartScanner(tt.contentType, tt.boundary)
+			for body := []byte(tt.body); len(body) > 0; {
+				n := min(3, len(body))
+				_, err := scanner.Write(body[:n])
+				require.NoError(t, err)
+				body = body[n:]
+			}
+			var flagged []string
+			for name, set := range scanner.flags() {
+				if set {
+					flagged = append(flagged, name)
+				}
+			}
+			require.ElementsMatch(t, tt.expected, flagged)
+		})
+	}
+}
+
+func TestMultipartBodyProcessorDefaults(t *testing.T) {
+	body := "--x\r\n" +
+		"Content-Disposition: form-data; name=\"a\"\r\n\r\n" +
+		"b\r\n" +
+		"--x\r\n" +
+		"Content-Disposition: form-data; name=\"f\"; filename=\"f.txt\"\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"hello\r\n" +
+		"--x--\r\n"
+
+	waf, err := coraza.NewWAF(coraza.NewWAFConfig())
+	require.NoError(t, err)
+	v := waf.NewTransaction().(plugintypes.TransactionState).Variables()
+	err = multipartBodyProcessor{}.ProcessRequest(strings.NewReader(body), v, plugintypes.BodyProcessorOptions{Mime: "multipart/form-data; boundary=x"})
+	require.NoError(t, err)
+
+	// The variables populated by the multipart body processor of Coraza, without a multipart
+	// configuration
+	require.Equal(t, []string{"b"}, v.ArgsPost().Get("a"))
+	require.Equal(t, []string{"f.txt"}, v.Files().Get(""))
+	require.Equal(t, []string{"f"}, v.FilesNames().Get(""))
+	require.Equal(t, []string{"5"}, v.FilesSizes().Get("f.txt"))
+	require.Equal(t, "6", v.FilesCombinedSize().Get())
+	require.Equal(t, []string{`Content-Disposition: form-data; name="a"`}, v.MultipartPartHeaders().Get("a"))
+	require.ElementsMatch(t, []string{`Content-Disposition: form-data; name="f"; filename="f.txt"`, "Content-Type: text/plain"}, v.MultipartPartHeaders().Get("f"))
+	require.Empty(t, v.FilesTmpNames().Get(""))
+
+	require.Equal(t, "0", v.MultipartDataAfter().Get())
+	require.Equal(t, []string{"0"}, v.TX().Get(multipartStrictError))
+}
+
+func TestParseMultipart(t *testing.T) {
+	c, err := parseMultipart(gjson.Parse(`{"max_part_size": 1024, "max_files": 2}`))
+	require.NoError(t, err)
+	require.Equal(t, multipartConfig{maxPartSize: 1024, maxFiles: 2}, c)
+
+	_, err = parseMultipart(gjson.Parse(`{"max_files": 0}`))
+	require.Equal(t, errors.New("invalid multipart max_files: 0"), err)
+}
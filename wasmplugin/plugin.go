@@ -5,44 +5,83 @@ package wasmplugin
 
 import (
 	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
-	"math"
+	"io/fs"
 	"net"
 	"net/http"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/corazawaf/coraza/v3"
 	"github.com/corazawaf/coraza/v3/debuglog"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
 	ctypes "github.com/corazawaf/coraza/v3/types"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/hostadapter"
 )
 
 type vmContext struct {
 	// Embed the default VM context here,
 	// so that we don't need to reimplement all the methods.
 	types.DefaultVMContext
+	// defaults is the VM configuration, the defaults of the configuration of the plugins.
+	defaults []byte
 }
 
 func NewVMContext() types.VMContext {
 	return &vmContext{}
 }
 
-func (*vmContext) NewPluginContext(contextID uint32) types.PluginContext {
-	return &corazaPlugin{}
+func (vm *vmContext) OnVMStart(vmConfigurationSize int) types.OnVMStartStatus {
+	data, err := proxywasm.GetVMConfiguration()
+	if err != nil && err != types.ErrorStatusNotFound {
+		proxywasm.LogCriticalf("Failed to read VM configuration: %v", err)
+		return types.OnVMStartStatusFailed
+	}
+	vm.defaults = data
+	return types.OnVMStartStatusOK
+}
+
+func (vm *vmContext) NewPluginContext(contextID uint32) types.PluginContext {
+	// The plugin context is created before the start of the VM
+	return &corazaPlugin{vm: vm}
 }
 
 type wafMap struct {
-	kv         map[string]coraza.WAF
+	kv map[string]coraza.WAF
+	// wildcards are the WAFs of the authorities given as "*.<domain>", matching any
+	// subdomain, the longest domain first.
+	wildcards    []wildcardWAF
+	perDirection map[string]coraza.WAF
+	// perServerName are the WAFs of the TLS server names, matched as the authorities.
+	perServerName *wafMap
+	// byName are the WAFs selectable by the name of their rule set.
+	byName     map[string]coraza.WAF
 	defaultWAF coraza.WAF
+	// headersOnly inspects the requests not sampled for full inspection, if any.
+	headersOnly coraza.WAF
+}
+
+type wildcardWAF struct {
+	// suffix is the domain of the wildcard, including the leading dot.
+	suffix string
+	waf    coraza.WAF
 }
 
 func newWAFMap(capacity int) wafMap {
 	return wafMap{
-		kv: make(map[string]coraza.WAF, capacity),
+		kv:           make(map[string]coraza.WAF, capacity),
+		perDirection: make(map[string]coraza.WAF),
+		perServerName: &wafMap{
+			kv: make(map[string]coraza.WAF),
+		},
+		byName: make(map[string]coraza.WAF),
 	}
 }
 
@@ -51,10 +90,38 @@ func (m *wafMap) put(key string, waf coraza.WAF) error {
 		return errors.New("empty WAF key")
 	}
 
+	key = strings.ToLower(key)
+	if domain, ok := strings.CutPrefix(key, "*."); ok {
+		m.wildcards = append(m.wildcards, wildcardWAF{suffix: "." + domain, waf: waf})
+		sort.SliceStable(m.wildcards, func(i, j int) bool {
+			return len(m.wildcards[i].suffix) > len(m.wildcards[j].suffix)
+		})
+		return nil
+	}
 	m.kv[key] = waf
 	return nil
 }
 
+// getDirectionWAF returns the WAF overriding the default one for the given traffic direction.
+func (m *wafMap) getDirectionWAF(direction string) (coraza.WAF, bool) {
+	w, ok := m.perDirection[direction]
+	return w, ok
+}
+
+func (m *wafMap) hasServerNameWAFs() bool {
+	return m.perServerName != nil && len(m.perServerName.kv)+len(m.perServerName.wildcards) > 0
+}
+
+// getServerNameWAF returns the WAF overriding the default one for the given TLS server name.
+func (m *wafMap) getServerNameWAF(serverName string) (coraza.WAF, bool) {
+	if !m.hasServerNameWAFs() || serverName == "" {
+		return nil, false
+	}
+	// The server names have no default WAF
+	w, _, err := m.perServerName.getWAFOrDefault(serverName)
+	return w, err == nil
+}
+
 func (m *wafMap) setDefaultWAF(w coraza.WAF) {
 	if w == nil {
 		panic("nil WAF set as default")
@@ -62,11 +129,27 @@ func (m *wafMap) setDefaultWAF(w coraza.WAF) {
 	m.defaultWAF = w
 }
 
+// getWAFOrDefault returns the WAF of the authority, matched exactly, then without its port
+// and finally against the wildcards, or the default WAF.
 func (m *wafMap) getWAFOrDefault(key string) (coraza.WAF, bool, error) {
+	key = strings.ToLower(key)
 	if w, ok := m.kv[key]; ok {
 		return w, false, nil
 	}
 
+	host := key
+	if h, _, err := net.SplitHostPort(key); err == nil {
+		host = h
+		if w, ok := m.kv[host]; ok {
+			return w, false, nil
+		}
+	}
+	for _, wildcard := range m.wildcards {
+		if strings.HasSuffix(host, wildcard.suffix) {
+			return wildcard.waf, false, nil
+		}
+	}
+
 	if m.defaultWAF == nil {
 		return nil, false, errors.New("no default WAF")
 	}
@@ -78,9 +161,58 @@ type corazaPlugin struct {
 	// Embed the default plugin context here,
 	// so that we don't need to reimplement all the methods.
 	types.DefaultPluginContext
-	perAuthorityWAFs wafMap
-	metricLabelsKV   []string
-	metrics          *wafMetrics
+	vm                        *vmContext
+	perAuthorityWAFs          wafMap
+	metricLabelsKV            []string
+	metrics                   *wafMetrics
+	interruptionBody          string
+	denyPages                 denyPagesConfig
+	interruptionHeaders       interruptionHeadersConfig
+	responseBodyInterruption  responseBodyInterruptionConfig
+	verdictHeader             verdictHeaderConfig
+	dynamicLabels             *metricLabelsCardinality
+	matchDedup                *matchDeduplicator
+	statusEndpoint            statusEndpointConfig
+	status                    *pluginStatus
+	host                      hostadapter.Adapter
+	bodyHandoff               bodyHandoffConfig
+	metadataVariables         []metadataVariable
+	decisionMetadata          decisionMetadataConfig
+	verdictContract           verdictContractConfig
+	istio                     istioConfig
+	failurePolicy             failurePolicy
+	memoryPressureThreshold   uint64
+	evaluationDeadline        time.Duration
+	internalRedirects         internalRedirectsMode
+	responseOnly              bool
+	sampling                  samplingConfig
+	gcWhenIdle                bool
+	requestBodyStreaming      bool
+	bodyDecompression         bodyDecompressionConfig
+	responseBodyDecompression bodyDecompressionConfig
+	charsetConversion         charsetConversionConfig
+	multipart                 multipartConfig
+	json                      jsonConfig
+	urlencoded                urlencodedConfig
+	grpc                      grpcConfig
+	graphql                   graphqlConfig
+	bodyProcessors            bodyProcessorsConfig
+	routeMetadata             routeMetadataConfig
+	directivesHeader          directivesHeaderConfig
+	egressAllowlist           bool
+	// rulesPending is true until the remote rules are loaded, no rule set is compiled before.
+	rulesPending bool
+	// remoteRules is the state of the remote rules, nil if disabled.
+	remoteRules *remoteRulesState
+	// newUniqueID generates the transaction IDs, Coraza generates them if nil.
+	newUniqueID func() string
+	// inflight tracks the HTTP contexts whose stream is not done yet.
+	inflight map[uint32]*httpContext
+}
+
+// capabilityDependents describes how the plugin degrades when the host lacks a capability.
+var capabilityDependents = map[string]string{
+	"metrics": "metrics are disabled",
 }
 
 func (ctx *corazaPlugin) OnPluginStart(pluginConfigurationSize int) types.OnPluginStartStatus {
@@ -89,12 +221,213 @@ func (ctx *corazaPlugin) OnPluginStart(pluginConfigurationSize int) types.OnPlug
 		proxywasm.LogCriticalf("Failed to read plugin configuration: %v", err)
 		return types.OnPluginStartStatusFailed
 	}
+	var defaults []byte
+	if ctx.vm != nil {
+		defaults = ctx.vm.defaults
+	}
+	data, err = mergeConfiguration(defaults, data)
+	if err != nil {
+		proxywasm.LogCriticalf("Failed to parse plugin configuration: %v", err)
+		NewWAFMetrics(hostadapter.Envoy).CountConfigError()
+		return types.OnPluginStartStatusFailed
+	}
 	config, err := parsePluginConfiguration(data, proxywasm.LogInfo)
 	if err != nil {
 		proxywasm.LogCriticalf("Failed to parse plugin configuration: %v", err)
+		NewWAFMetrics(config.host).CountConfigError()
 		return types.OnPluginStartStatusFailed
 	}
 
+	capabilities := hostadapter.Probe(config.host)
+	for _, missing := range capabilities.Missing() {
+		if subsystem, ok := capabilityDependents[missing]; ok {
+			proxywasm.LogWarnf("Host %q does not support %s: %s", config.host.Name(), missing, subsystem)
+		} else {
+			proxywasm.LogInfof("Host %q does not support %s", config.host.Name(), missing)
+		}
+	}
+
+	var node istioNode
+	if config.istio.enabled() {
+		node = readIstioNode(config.host)
+		if name, ok := config.istio.directives(node); ok {
+			proxywasm.LogInfof("Using directives %q scoped to Istio workload %q in namespace %q", name, node.workload, node.namespace)
+			config.defaultDirectives = name
+		}
+	}
+
+	ctx.metrics = NewWAFMetrics(config.host)
+	ctx.metrics.disabled = !capabilities.Metrics
+
+	errorCallback := logError
+	if config.matchLogDedupWindow > 0 {
+		ctx.matchDedup = newMatchDeduplicator(config.matchLogDedupWindow, logWithSeverity)
+		errorCallback = ctx.matchDedup.logMatchedRule
+		if !capabilities.Ticks {
+			proxywasm.LogWarn("Host does not support ticks, repeated matches will be reported on the next match")
+			ctx.matchDedup.flushOnMatch = true
+		} else if err := proxywasm.SetTickPeriodMilliSeconds(uint32(config.matchLogDedupWindow.Milliseconds())); err != nil {
+			proxywasm.LogWarnf("Failed to set tick period, repeated matches will be reported on the next match: %v", err)
+			ctx.matchDedup.flushOnMatch = true
+		}
+	}
+
+	if config.remoteRules.enabled() {
+		// The requests received until the remote rules are loaded follow the failure policy
+		// of rules_unavailable.
+		ctx.rulesPending = true
+		ctx.remoteRules = &remoteRulesState{config: config, errorCallback: errorCallback}
+		if err := ctx.fetchRemoteRules(); err != nil {
+			proxywasm.LogCriticalf("Failed to fetch remote rules: %v", err)
+			return types.OnPluginStartStatusFailed
+		}
+		if interval := config.remoteRules.refreshInterval; interval > 0 {
+			ctx.remoteRules.nextRefresh = time.Now().Add(interval)
+			// The tick period set for the deduplication is kept if shorter, the refreshes
+			// being scheduled by the ticks anyway.
+			if !capabilities.Ticks {
+				proxywasm.LogWarn("Host does not support ticks, remote rules will not be refreshed")
+			} else if config.matchLogDedupWindow == 0 || interval < config.matchLogDedupWindow {
+				if err := proxywasm.SetTickPeriodMilliSeconds(uint32(interval.Milliseconds())); err != nil {
+					proxywasm.LogWarnf("Failed to set tick period, remote rules will not be refreshed: %v", err)
+				}
+			}
+		}
+	} else {
+		if config.validate && !ctx.validateDirectives(config.directivesMap, config.crsVersions, root) {
+			return types.OnPluginStartStatusFailed
+		}
+		perAuthorityWAFs, err := buildWAFs(config, root, errorCallback)
+		if err != nil {
+			proxywasm.LogCriticalf("Failed to load rule sets: %v", err)
+			return types.OnPluginStartStatusFailed
+		}
+		ctx.perAuthorityWAFs = perAuthorityWAFs
+	}
+
+	for k, v := range config.metricLabels {
+		ctx.metricLabelsKV = append(ctx.metricLabelsKV, k, v)
+	}
+	ctx.metricLabelsKV = config.istio.appendMetricLabelsKV(ctx.metricLabelsKV, node)
+	ctx.host = config.host
+	ctx.bodyHandoff = config.bodyHandoff
+	ctx.metadataVariables = config.metadataVariables
+	ctx.decisionMetadata = config.decisionMetadata
+	ctx.verdictContract = config.verdictContract
+	ctx.istio = config.istio
+	ctx.failurePolicy = config.failurePolicy
+	ctx.memoryPressureThreshold = config.memoryPressureThreshold
+	if ctx.memoryPressureThreshold > 0 {
+		readHeap()
+	}
+	ctx.evaluationDeadline = config.evaluationDeadline
+	ctx.internalRedirects = config.internalRedirects
+	ctx.internalRedirects.declareRequestInspected()
+	ctx.responseOnly = config.responseOnly
+	ctx.gcWhenIdle = config.gcWhenIdle
+	ctx.requestBodyStreaming = config.requestBodyStreaming
+	ctx.bodyDecompression = config.bodyDecompression
+	ctx.responseBodyDecompression = config.responseBodyDecompression
+	ctx.charsetConversion = config.charsetConversion
+	ctx.multipart = config.multipart
+	ctx.json = config.json
+	ctx.urlencoded = config.urlencoded
+	ctx.grpc = config.grpc
+	ctx.graphql = config.graphql
+	ctx.bodyProcessors = config.bodyProcessors
+	ctx.routeMetadata = config.routeMetadata
+	ctx.directivesHeader = config.directivesHeader
+	ctx.egressAllowlist = config.egressAllowlist
+	ctx.sampling = config.sampling
+	ctx.newUniqueID = config.uniqueID.newGenerator(config.host, capabilities.SharedData)
+	ctx.dynamicLabels = newMetricLabelsCardinality(config.dynamicMetricLabels)
+	ctx.statusEndpoint = config.statusEndpoint
+	ctx.status = newPluginStatus(data, config, ctx.metrics, time.Now())
+	ctx.interruptionBody = config.interruptionBody
+	ctx.denyPages = config.denyPages
+	ctx.interruptionHeaders = config.interruptionHeaders
+	ctx.responseBodyInterruption = config.responseBodyInterruption
+	ctx.verdictHeader = config.verdictHeader
+
+	return types.OnPluginStartStatusOK
+}
+
+// validateDirectives compiles all the rule sets, logging the location of every error, and
+// returns true if they are all valid.
+func (ctx *corazaPlugin) validateDirectives(directivesMap DirectivesMap, crsVersions map[string]string, rootFS fs.FS) bool {
+	errs := validateDirectives(directivesMap, crsVersions, rootFS)
+	for _, err := range errs {
+		proxywasm.LogCriticalf("Failed to validate rule sets: %v", err)
+		ctx.metrics.CountConfigError()
+	}
+	return len(errs) == 0
+}
+
+// fetchRemoteRules dispatches the request of the remote rules, unless one is in flight.
+func (ctx *corazaPlugin) fetchRemoteRules() error {
+	state := ctx.remoteRules
+	if state.fetching {
+		return nil
+	}
+	err := state.config.remoteRules.fetch(state.version, func(bundle remoteRulesBundle, err error) {
+		state.fetching = false
+		ctx.loadRemoteRules(bundle, err)
+	})
+	state.fetching = err == nil
+	return err
+}
+
+// loadRemoteRules compiles the rule sets once the remote rules are fetched, appending the
+// directives of the bundle to the configured rule set. The new rule sets are swapped in for
+// the transactions started afterwards, the in-flight ones keep theirs. The current rules
+// are kept if the bundle cannot be fetched or compiled.
+func (ctx *corazaPlugin) loadRemoteRules(bundle remoteRulesBundle, err error) {
+	state := ctx.remoteRules
+	if errors.Is(err, errRemoteRulesNotModified) || (err == nil && bundle.digest == state.digest) {
+		// Servers without conditional requests send the same bundle back
+		ctx.metrics.CountRulesRefresh("not_modified")
+		return
+	}
+
+	var perAuthorityWAFs wafMap
+	if err == nil {
+		// The directives map of the configuration is left untouched
+		config := state.config
+		directivesMap := make(DirectivesMap, len(config.directivesMap))
+		for name, directives := range config.directivesMap {
+			directivesMap[name] = directives
+		}
+		name := config.remoteRules.directives
+		directivesMap[name] = append(append([]string{}, directivesMap[name]...), bundle.directives...)
+		config.directivesMap = directivesMap
+		rootFS := remoteFS{base: root, files: bundle.files}
+		if config.validate && !ctx.validateDirectives(directivesMap, config.crsVersions, rootFS) {
+			err = fmt.Errorf("invalid remote rules with sha256 %s", bundle.digest)
+		} else {
+			perAuthorityWAFs, err = buildWAFs(config, rootFS, state.errorCallback)
+		}
+	}
+	if err != nil {
+		ctx.metrics.CountRulesRefresh("failed")
+		if ctx.rulesPending {
+			proxywasm.LogCriticalf("Failed to load remote rules: %v", err)
+		} else {
+			proxywasm.LogWarnf("Failed to load remote rules, keeping the rules with sha256 %s: %v", state.digest, err)
+		}
+		return
+	}
+	ctx.perAuthorityWAFs = perAuthorityWAFs
+	ctx.rulesPending = false
+	state.version = bundle.version
+	state.digest = bundle.digest
+	ctx.status.remoteRulesDigest = bundle.digest
+	ctx.metrics.CountRulesRefresh("loaded")
+	proxywasm.LogInfof("Loaded remote rules with sha256 %s", bundle.digest)
+}
+
+// buildWAFs compiles the rule sets of the configuration referenced by the default rule set,
+// an authority, a direction, the sampling or the routes, reading the included files from rootFS.
+func buildWAFs(config pluginConfiguration, rootFS fs.FS, errorCallback func(ctypes.MatchedRule)) (wafMap, error) {
 	// directivesAuthoritesMap is a map of directives name to the list of
 	// authorities that reference those directives. This is used to
 	// initialize the WAFs only for the directives that are referenced
@@ -102,10 +435,22 @@ func (ctx *corazaPlugin) OnPluginStart(pluginConfigurationSize int) types.OnPlug
 	for authority, directivesName := range config.perAuthorityDirectives {
 		directivesAuthoritiesMap[directivesName] = append(directivesAuthoritiesMap[directivesName], authority)
 	}
+	directivesDirectionsMap := map[string][]string{}
+	for direction, directivesName := range config.perDirectionDirectives {
+		directivesDirectionsMap[directivesName] = append(directivesDirectionsMap[directivesName], direction)
+	}
+
+	directivesServerNamesMap := map[string][]string{}
+	for serverName, directivesName := range config.perServerNameDirectives {
+		directivesServerNamesMap[directivesName] = append(directivesServerNamesMap[directivesName], serverName)
+	}
 
 	perAuthorityWAFs := newWAFMap(len(config.directivesMap))
 	for name, directives := range config.directivesMap {
 		var authorities []string
+		directions := directivesDirectionsMap[name]
+		serverNames := directivesServerNamesMap[name]
+		_, selectableByHeader := config.directivesHeader.allowed[name]
 
 		// if the name of the directives is the default directives, we
 		// initialize the WAF despite the fact that it is not associated
@@ -114,7 +459,9 @@ func (ctx *corazaPlugin) OnPluginStart(pluginConfigurationSize int) types.OnPlug
 		if name != config.defaultDirectives {
 			var directivesFound bool
 			authorities, directivesFound = directivesAuthoritiesMap[name]
-			if !directivesFound {
+			// Any rule set can be selected by the route metadata
+			if !directivesFound && len(directions) == 0 && len(serverNames) == 0 && !selectableByHeader &&
+				name != config.sampling.headersOnlyDirectives && !config.routeMetadata.enabled() {
 				// if no directives found as key, no authority references
 				// these directives and hence we won't initialize them as
 				// it will be a waste of resources.
@@ -124,33 +471,49 @@ func (ctx *corazaPlugin) OnPluginStart(pluginConfigurationSize int) types.OnPlug
 
 		// First we initialize our waf and our seclang parser
 		conf := coraza.NewWAFConfig().
-			WithErrorCallback(logError).
+			WithErrorCallback(errorCallback).
 			WithDebugLogger(debuglog.DefaultWithPrinterFactory(logPrinterFactory)).
 			// TODO(anuraaga): Make this configurable in plugin configuration.
 			// WithRequestBodyLimit(1024 * 1024 * 1024).
 			// WithRequestBodyInMemoryLimit(1024 * 1024 * 1024).
 			// Limit equal to MemoryLimit: TinyGo compilation will prevent
 			// buffering request body to files anyways.
-			WithRootFS(root)
+			WithRootFS(crsRootFS(rootFS, config.crsVersions, name))
 
 		waf, err := coraza.NewWAF(conf.WithDirectives(strings.Join(directives, "\n")))
 		if err != nil {
-			proxywasm.LogCriticalf("Failed to parse directives: %v", err)
-			return types.OnPluginStartStatusFailed
+			return wafMap{}, fmt.Errorf("failed to parse directives %q: %v", name, err)
+		}
+
+		if config.warmup {
+			warmUp(waf)
 		}
+		runBenchmark(name, waf)
 
-		if len(authorities) == 0 {
-			// if no authorities are associated directly with this WAF
-			// but we still initialize it, it means this is the default
-			// one.
+		if name == config.defaultDirectives {
 			perAuthorityWAFs.setDefaultWAF(waf)
 		}
 
+		if name == config.sampling.headersOnlyDirectives {
+			perAuthorityWAFs.headersOnly = waf
+		}
+
+		perAuthorityWAFs.byName[name] = waf
+
+		for _, direction := range directions {
+			perAuthorityWAFs.perDirection[direction] = waf
+		}
+
+		for _, serverName := range serverNames {
+			if err = perAuthorityWAFs.perServerName.put(serverName, waf); err != nil {
+				return wafMap{}, fmt.Errorf("failed to register server name WAF: %v", err)
+			}
+		}
+
 		for _, authority := range authorities {
 			err = perAuthorityWAFs.put(authority, waf)
 			if err != nil {
-				proxywasm.LogCriticalf("Failed to register authority WAF: %v", err)
-				return types.OnPluginStartStatusFailed
+				return wafMap{}, fmt.Errorf("failed to register authority WAF: %v", err)
 			}
 		}
 
@@ -160,29 +523,97 @@ func (ctx *corazaPlugin) OnPluginStart(pluginConfigurationSize int) types.OnPlug
 	if len(directivesAuthoritiesMap) > 0 {
 		// if there are directives remaining in the directivesAuthoritiesMap, means
 		// those directives weren't part of the directivesMap and hence not declared.
-		for unknownDirective := range directivesAuthoritiesMap {
-			proxywasm.LogCriticalf("Unknown directives %q", unknownDirective)
+		unknownDirectives := make([]string, 0, len(directivesAuthoritiesMap))
+		for name := range directivesAuthoritiesMap {
+			unknownDirectives = append(unknownDirectives, name)
 		}
-
-		return types.OnPluginStartStatusFailed
+		sort.Strings(unknownDirectives)
+		return wafMap{}, fmt.Errorf("unknown directives %q", unknownDirectives)
 	}
 
-	ctx.perAuthorityWAFs = perAuthorityWAFs
-	for k, v := range config.metricLabels {
-		ctx.metricLabelsKV = append(ctx.metricLabelsKV, k, v)
+	return perAuthorityWAFs, nil
+
+}
+
+// OnPluginDone finishes the in-flight transactions, so that their logging phase runs and
+// their audit logs are written, and reports the matches suppressed by the deduplication
+// before the plugin is torn down, e.g. on configuration changes.
+func (ctx *corazaPlugin) OnPluginDone() bool {
+	if len(ctx.inflight) > 0 {
+		proxywasm.LogInfof("Finishing %d in-flight transactions", len(ctx.inflight))
 	}
-	ctx.metrics = NewWAFMetrics()
+	for id, httpCtx := range ctx.inflight {
+		if httpCtx.tx != nil {
+			httpCtx.finish()
+		}
+		delete(ctx.inflight, id)
+	}
+	if ctx.matchDedup != nil {
+		ctx.matchDedup.flushAll()
+	}
+	return true
+}
 
-	return types.OnPluginStartStatusOK
+func (ctx *corazaPlugin) OnTick() {
+	if ctx.matchDedup != nil {
+		ctx.matchDedup.flushExpired()
+	}
+	if ctx.remoteRules != nil && ctx.remoteRules.refreshDue(time.Now()) {
+		if err := ctx.fetchRemoteRules(); err != nil {
+			proxywasm.LogWarnf("Failed to refresh remote rules: %v", err)
+		}
+	}
 }
 
 func (ctx *corazaPlugin) NewHttpContext(contextID uint32) types.HttpContext {
-	return &httpContext{
-		contextID:        contextID,
-		metrics:          ctx.metrics,
-		metricLabelsKV:   ctx.metricLabelsKV,
-		perAuthorityWAFs: ctx.perAuthorityWAFs,
+	if ctx.inflight == nil {
+		ctx.inflight = make(map[uint32]*httpContext)
+	}
+	httpCtx := &httpContext{
+		contextID:                 contextID,
+		metrics:                   ctx.metrics,
+		metricLabelsKV:            ctx.metricLabelsKV,
+		perAuthorityWAFs:          ctx.perAuthorityWAFs,
+		interruptionBody:          ctx.interruptionBody,
+		denyPages:                 ctx.denyPages,
+		interruptionHeaders:       ctx.interruptionHeaders,
+		responseBodyInterruption:  ctx.responseBodyInterruption,
+		verdictHeader:             ctx.verdictHeader,
+		dynamicLabels:             ctx.dynamicLabels,
+		statusEndpoint:            ctx.statusEndpoint,
+		status:                    ctx.status,
+		props:                     hostadapter.NewResolver(ctx.host),
+		bodyHandoff:               ctx.bodyHandoff,
+		metadataVariables:         ctx.metadataVariables,
+		decisionMetadata:          ctx.decisionMetadata,
+		verdictContract:           ctx.verdictContract,
+		istio:                     ctx.istio,
+		failurePolicy:             ctx.failurePolicy,
+		memoryPressureThreshold:   ctx.memoryPressureThreshold,
+		evaluationDeadline:        ctx.evaluationDeadline,
+		internalRedirects:         ctx.internalRedirects,
+		responseOnly:              ctx.responseOnly,
+		sampling:                  ctx.sampling,
+		gcWhenIdle:                ctx.gcWhenIdle,
+		requestBodyStreaming:      ctx.requestBodyStreaming,
+		bodyDecompression:         ctx.bodyDecompression,
+		responseBodyDecompression: ctx.responseBodyDecompression,
+		charsetConversion:         ctx.charsetConversion,
+		multipart:                 ctx.multipart,
+		json:                      ctx.json,
+		urlencoded:                ctx.urlencoded,
+		grpc:                      ctx.grpc,
+		graphql:                   ctx.graphql,
+		bodyProcessors:            ctx.bodyProcessors,
+		routeMetadata:             ctx.routeMetadata,
+		directivesHeader:          ctx.directivesHeader,
+		egressAllowlist:           ctx.egressAllowlist,
+		rulesPending:              ctx.rulesPending,
+		newUniqueID:               ctx.newUniqueID,
+		inflight:                  ctx.inflight,
 	}
+	ctx.inflight[contextID] = httpCtx
+	return httpCtx
 }
 
 type interruptionPhase int8
@@ -229,17 +660,104 @@ type httpContext struct {
 	interruptedAt         interruptionPhase
 	logger                debuglog.Logger
 	metricLabelsKV        []string
+	interruptionBody      string
+	denyPages             denyPagesConfig
+	interruptionHeaders   interruptionHeadersConfig
+	// requestAccept is the accept header of the request, selecting the deny page.
+	requestAccept            string
+	responseBodyInterruption responseBodyInterruptionConfig
+	// responseBodyReplaced is true once the body of the interrupted response was replaced.
+	responseBodyReplaced bool
+	verdictHeader        verdictHeaderConfig
+	dynamicLabels        *metricLabelsCardinality
+	statusEndpoint       statusEndpointConfig
+	status               *pluginStatus
+	props                hostadapter.Resolver
+	bodyHandoff          bodyHandoffConfig
+	metadataVariables    []metadataVariable
+	decisionMetadata     decisionMetadataConfig
+	verdictContract      verdictContractConfig
+	istio                istioConfig
+	failurePolicy        failurePolicy
+	evaluationDeadline   time.Duration
+	internalRedirects    internalRedirectsMode
+	// responseOnly skips the request phases, only the response is inspected.
+	responseOnly bool
+	sampling     samplingConfig
+	// headersOnly skips the inspection of the bodies of the requests not sampled for full inspection.
+	headersOnly bool
+	newUniqueID func() string
+	// gcWhenIdle runs a garbage collection once no stream is in flight anymore.
+	gcWhenIdle bool
+	// memoryPressureThreshold is the heap in use above which the requests are failures of
+	// the memory_pressure class, 0 if disabled.
+	memoryPressureThreshold uint64
+	// requestBodyStreaming releases each chunk of the request body once written to the
+	// transaction, rather than buffering the body until phase 2.
+	requestBodyStreaming bool
+	bodyDecompression    bodyDecompressionConfig
+	// requestBodyEncoding is the encoding of the request body inspected decompressed, if any.
+	requestBodyEncoding       string
+	responseBodyDecompression bodyDecompressionConfig
+	charsetConversion         charsetConversionConfig
+	multipart                 multipartConfig
+	json                      jsonConfig
+	urlencoded                urlencodedConfig
+	grpc                      grpcConfig
+	graphql                   graphqlConfig
+	bodyProcessors            bodyProcessorsConfig
+	// responseBodyEncoding is the encoding of the response body inspected decompressed, if any.
+	responseBodyEncoding string
+	// requestCharset and responseCharset convert the bodies inspected to UTF-8, if needed.
+	requestCharset  *charsetDecoder
+	responseCharset *charsetDecoder
+	// compressedBody buffers the encoded request body until the end of the stream.
+	compressedBody []byte
+	// requestBodySize and responseBodySize are the sizes of the bodies buffered by the proxy,
+	// inspected as the last chunk once the trailers end the stream.
+	requestBodySize  int
+	responseBodySize int
+	routeMetadata    routeMetadataConfig
+	directivesHeader directivesHeaderConfig
+	egressAllowlist  bool
+	// rulesPending is true if the remote rules were not loaded when the stream started.
+	rulesPending bool
+	// inspectionStopped is true if the following phases are not inspected anymore.
+	inspectionStopped bool
+	// skippedPhases are the phases whose rules were skipped as the evaluation deadline
+	// was exceeded.
+	skippedPhases []string
+	inflight      map[uint32]*httpContext
 }
 
 func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) types.Action {
 	defer logTime("OnHttpRequestHeaders", currentTime())
+	defer countAllocs("OnHttpRequestHeaders", currentAllocs())
+
+	if ctx.statusEndpoint.enabled() {
+		if path, err := proxywasm.GetHttpRequestHeader(":path"); err == nil {
+			if p, _, _ := strings.Cut(path, "?"); p == ctx.statusEndpoint.path {
+				return ctx.serveStatus(p)
+			}
+		}
+	}
 
 	ctx.metrics.CountTX()
 
+	if len(ctx.denyPages) > 0 {
+		ctx.requestAccept, _ = proxywasm.GetHttpRequestHeader("accept")
+	}
+
+	if ctx.rulesPending {
+		// No transaction is started, there is no rule set to start it from
+		ctx.logger = debuglog.Noop()
+		return ctx.handleFailure(interruptionPhaseHttpRequestHeaders, failureRulesUnavailable)
+	}
+
 	authority, err := proxywasm.GetHttpRequestHeader(":authority")
 	if err != nil {
 		proxywasm.LogDebugf("Failed to get the :authority pseudo-header: %v", err)
-		propHostRaw, propHostErr := proxywasm.GetProperty([]string{"request", "host"})
+		propHostRaw, propHostErr := ctx.props.Property(hostadapter.RequestHost)
 		if propHostErr != nil {
 			proxywasm.LogWarnf("Failed to get the :authority pseudo-header or property of host of the request: %v", propHostErr)
 			return types.ActionContinue
@@ -247,20 +765,115 @@ func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) t
 		authority = string(propHostRaw)
 	}
 	if waf, isDefault, resolveWAFErr := ctx.perAuthorityWAFs.getWAFOrDefault(authority); resolveWAFErr == nil {
-		ctx.tx = waf.NewTransaction()
+		// Rule sets scoped to an authority take precedence over the ones scoped to a TLS server
+		// name, themselves taking precedence over the ones scoped to a direction
+		var serverName, direction string
+		if isDefault && ctx.perAuthorityWAFs.hasServerNameWAFs() {
+			if sni, err := ctx.props.Property(hostadapter.TLSServerName); err == nil {
+				if w, ok := ctx.perAuthorityWAFs.getServerNameWAF(string(sni)); ok {
+					waf, serverName = w, string(sni)
+				}
+			}
+		}
+		if isDefault && serverName == "" && len(ctx.perAuthorityWAFs.perDirection) > 0 {
+			if d := trafficDirection(ctx.props); d != "" {
+				if w, ok := ctx.perAuthorityWAFs.getDirectionWAF(d); ok {
+					waf, direction = w, d
+				}
+			}
+		}
+
+		// As the clients may set the header, it only replaces the default rule set, never the
+		// ones selected by the stream
+		var headerDirectives string
+		if isDefault && serverName == "" && direction == "" {
+			if headerDirectives = ctx.directivesHeader.directives(); headerDirectives != "" {
+				waf = ctx.perAuthorityWAFs.byName[headerDirectives]
+			}
+		}
+
+		// The rule set selected by the route takes precedence over all the others
+		routeOverrides := ctx.routeMetadata.readRouteOverrides()
+		if routeOverrides.directives != "" {
+			if w, ok := ctx.perAuthorityWAFs.byName[routeOverrides.directives]; ok {
+				waf = w
+			} else {
+				proxywasm.LogWarnf("Ignoring unknown directives in route metadata: %q", routeOverrides.directives)
+				routeOverrides.directives = ""
+			}
+		}
+		if routeOverrides.failurePolicy != nil {
+			ctx.failurePolicy = ctx.failurePolicy.override(routeOverrides.failurePolicy)
+		}
+
+		if ctx.memoryPressureThreshold > 0 && heapInUse > ctx.memoryPressureThreshold {
+			// No transaction is started, the memory it would take being short
+			ctx.logger = debuglog.Noop()
+			return ctx.handleFailure(interruptionPhaseHttpRequestHeaders, failureMemoryPressure)
+		}
+
+		var samplingDecision string
+		if ctx.sampling.enabled() {
+			samplingDecision = ctx.sampling.sample()
+			ctx.headersOnly = samplingDecision == samplingDecisionHeadersOnly
+			if ctx.headersOnly && ctx.perAuthorityWAFs.headersOnly != nil {
+				waf = ctx.perAuthorityWAFs.headersOnly
+			}
+		}
+
+		if ctx.newUniqueID != nil {
+			ctx.tx = waf.NewTransactionWithID(ctx.newUniqueID())
+		} else {
+			ctx.tx = waf.NewTransaction()
+		}
+		ctx.metrics.TXStarted()
 
 		logFields := []debuglog.ContextField{debuglog.Uint("context_id", uint(ctx.contextID))}
 		if !isDefault {
 			logFields = append(logFields, debuglog.Str("authority", authority))
 		}
+		if direction != "" {
+			logFields = append(logFields, debuglog.Str("direction", direction))
+		}
+		if serverName != "" {
+			logFields = append(logFields, debuglog.Str("server_name", serverName))
+		}
+		if headerDirectives != "" {
+			logFields = append(logFields, debuglog.Str("header_directives", headerDirectives))
+		}
+		if routeOverrides.directives != "" {
+			logFields = append(logFields, debuglog.Str("route_directives", routeOverrides.directives))
+		}
 		ctx.logger = ctx.tx.DebugLogger().With(logFields...)
+		routeOverrides.apply(ctx.tx)
+		if ctx.egressAllowlist {
+			markOutbound(ctx.tx, ctx.props)
+		}
 
-		// CRS rules tend to expect Host even with HTTP/2
-		ctx.tx.AddRequestHeader("Host", authority)
-		ctx.tx.SetServerName(parseServerName(ctx.logger, authority))
+		if !ctx.responseOnly {
+			// CRS rules tend to expect Host even with HTTP/2
+			ctx.tx.AddRequestHeader("Host", authority)
+			ctx.tx.SetServerName(parseServerName(ctx.logger, authority))
+		}
 
+		// metricLabelsKV is shared with the plugin context, labels specific to
+		// this request are appended to a copy of it.
+		labelsKV := append([]string{}, ctx.metricLabelsKV...)
 		if !isDefault {
-			ctx.metricLabelsKV = append(ctx.metricLabelsKV, "authority", authority)
+			labelsKV = append(labelsKV, "authority", authority)
+		}
+		if direction != "" {
+			labelsKV = append(labelsKV, "direction", direction)
+		}
+		ctx.metricLabelsKV = ctx.dynamicLabels.appendLabelsKV(labelsKV, authority, ctx.props)
+
+		setMultipartLimits(ctx.tx, ctx.multipart)
+		setJSONLimits(ctx.tx, ctx.json)
+		setURLEncodedOptions(ctx.tx, ctx.urlencoded)
+
+		if samplingDecision != "" {
+			setSamplingDecision(ctx.tx, samplingDecision)
+			ctx.metrics.CountTXSampling(samplingDecision, ctx.metricLabelsKV)
 		}
 	} else {
 		proxywasm.LogWarnf("Failed to resolve WAF for authority %q: %v", authority, resolveWAFErr)
@@ -276,18 +889,33 @@ func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) t
 		return types.ActionContinue
 	}
 
+	if ctx.responseOnly {
+		// Neither the request headers nor the request body are copied into the transaction,
+		// OnHttpRequestBody is a no-op.
+		ctx.processedRequestBody = true
+		return types.ActionContinue
+	}
+
+	if ctx.bodyDecompression.enabled() {
+		ctx.requestBodyEncoding = decompressibleEncoding(proxywasm.GetHttpRequestHeader("content-encoding"))
+	}
+	ctx.requestCharset = ctx.newCharsetDecoder(proxywasm.GetHttpRequestHeader("content-type"))
+
 	// OnHttpRequestHeaders does not terminate if IP/Port retrieve goes wrong
-	srcIP, srcPort := retrieveAddressInfo(ctx.logger, "source")
-	dstIP, dstPort := retrieveAddressInfo(ctx.logger, "destination")
+	srcIP, srcPort := retrieveAddressInfo(ctx.logger, ctx.props, "source")
+	dstIP, dstPort := retrieveAddressInfo(ctx.logger, ctx.props, "destination")
 
 	tx.ProcessConnection(srcIP, srcPort, dstIP, dstPort)
+	setTLSVariables(tx, ctx.props)
+	ctx.istio.setPeerVariables(tx, ctx.props)
+	setMetadataVariables(tx, ctx.metadataVariables)
 
 	method, err := proxywasm.GetHttpRequestHeader(":method")
 	if err != nil {
 		ctx.logger.Error().
 			Err(err).
 			Msg("Failed to get :method")
-		propMethodRaw, propMethodErr := proxywasm.GetProperty([]string{"request", "method"})
+		propMethodRaw, propMethodErr := ctx.props.Property(hostadapter.RequestMethod)
 		if propMethodErr != nil {
 			ctx.logger.Error().
 				Err(propMethodErr).
@@ -309,7 +937,7 @@ func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) t
 			ctx.logger.Error().
 				Err(err).
 				Msg("Failed to get :path")
-			propPathRaw, propPathErr := proxywasm.GetProperty([]string{"request", "path"})
+			propPathRaw, propPathErr := ctx.props.Property(hostadapter.RequestPath)
 			if propPathErr != nil {
 				ctx.logger.Error().
 					Err(propPathErr).
@@ -320,7 +948,7 @@ func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) t
 		}
 	}
 
-	protocol, err := proxywasm.GetProperty([]string{"request", "protocol"})
+	protocol, err := ctx.props.Property(hostadapter.RequestProtocol)
 	if err != nil {
 		// TODO(anuraaga): HTTP protocol is commonly required in WAF rules, we should probably
 		// fail fast here, but proxytest does not support properties yet.
@@ -334,24 +962,61 @@ func (ctx *httpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) t
 	hs, err := proxywasm.GetHttpRequestHeaders()
 	if err != nil {
 		ctx.logger.Error().Err(err).Msg("Failed to get request headers")
-		return types.ActionContinue
+		return ctx.handleFailure(interruptionPhaseHttpRequestHeaders, failureEngineError)
 	}
 
 	for _, h := range hs {
 		tx.AddRequestHeader(h[0], h[1])
 	}
+	contentType := ""
+	if len(ctx.bodyProcessors) > 0 || ctx.grpc.enabled || ctx.graphql.enabled() {
+		contentType, _ = proxywasm.GetHttpRequestHeader("content-type")
+		ctx.bodyProcessors.selectBodyProcessor(tx, contentType)
+		ctx.grpc.selectBodyProcessor(tx, contentType)
+		ctx.graphql.selectBodyProcessor(tx, contentType)
+	}
+
+	if ctx.internalRedirects.skipsRequest() {
+		ctx.logger.Debug().Msg("Skipping the request phases of the internal redirect")
+		ctx.processedRequestBody = true
+		return types.ActionContinue
+	}
 
+	start := ctx.phaseStart()
 	interruption := tx.ProcessRequestHeaders()
 	if interruption != nil {
 		return ctx.handleInterruption(interruptionPhaseHttpRequestHeaders, interruption)
 	}
+	if action, exceeded := ctx.checkDeadline(interruptionPhaseHttpRequestHeaders, start); exceeded {
+		return action
+	}
+	ctx.internalRedirects.markRequestInspected(tx.ID())
+	ctx.graphql.reselectBodyProcessor(tx, contentType)
+
+	if ctx.bodyHandoff.enabled() && tx.IsRequestBodyAccessible() && !ctx.headersOnly {
+		if action, handedOff := ctx.handoffOversizedBody(); handedOff {
+			return action
+		}
+	}
+
+	if ctx.verdictHeader.request {
+		if err := proxywasm.ReplaceHttpRequestHeader(ctx.verdictHeader.name, buildVerdict(tx)); err != nil {
+			ctx.logger.Error().Err(err).Msg("Failed to add verdict request header")
+		}
+	}
+
+	if ctx.decisionMetadata.enabled() {
+		ctx.decisionMetadata.publishDecision(tx)
+	}
 
 	return types.ActionContinue
 }
 
 func (ctx *httpContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.Action {
 	defer logTime("OnHttpRequestBody", currentTime())
+	defer countAllocs("OnHttpRequestBody", currentAllocs())
 
+	ctx.requestBodySize = bodySize
 	if ctx.interruptedAt.isInterrupted() {
 		ctx.logger.Error().
 			Str("interruption_handled_phase", ctx.interruptedAt.String()).
@@ -369,19 +1034,22 @@ func (ctx *httpContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.
 
 	tx := ctx.tx
 
-	if tx.IsRuleEngineOff() {
+	if tx.IsRuleEngineOff() || ctx.inspectionStopped {
 		return types.ActionContinue
 	}
 
 	// Do not perform any action related to request body data if SecRequestBodyAccess is set to false
-	if !tx.IsRequestBodyAccessible() {
-		ctx.logger.Debug().Msg("Skipping request body inspection, SecRequestBodyAccess is off.")
+	// or if the request is not sampled for full inspection
+	if !tx.IsRequestBodyAccessible() || ctx.headersOnly {
+		ctx.logger.Debug().Bool("SecRequestBodyAccess", tx.IsRequestBodyAccessible()).
+			Bool("headers_only", ctx.headersOnly).
+			Msg("Skipping request body inspection")
 		// ProcessRequestBody is still performed for phase 2 rules, checking already populated variables
 		ctx.processedRequestBody = true
 		interruption, err := tx.ProcessRequestBody()
 		if err != nil {
 			ctx.logger.Error().Err(err).Msg("Failed to process request body")
-			return types.ActionContinue
+			return ctx.handleFailure(interruptionPhaseHttpRequestBody, failureEngineError)
 		}
 
 		if interruption != nil {
@@ -391,6 +1059,10 @@ func (ctx *httpContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.
 		return types.ActionContinue
 	}
 
+	if ctx.requestBodyEncoding != "" {
+		return ctx.bufferCompressedRequestBody(bodySize, endOfStream)
+	}
+
 	// bodySize is the size of the whole body received so far, not the size of the current chunk
 	chunkSize := bodySize - ctx.bodyReadIndex
 	// OnHttpRequestBody might be called more than once with the same data, we check if there is new data available to be read
@@ -402,55 +1074,105 @@ func (ctx *httpContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.
 				Int("body_read_index", ctx.bodyReadIndex).
 				Int("chunk_size", chunkSize).
 				Msg("Failed to read request body")
-			return types.ActionContinue
+			return ctx.handleFailure(interruptionPhaseHttpRequestBody, failureEngineError)
 		}
 		readchunkSize := len(bodyChunk)
 		if readchunkSize != chunkSize {
 			ctx.logger.Warn().Int("read_chunk_size", readchunkSize).Int("chunk_size", chunkSize).Msg("Request chunk size read is different from the computed one")
 		}
-		interruption, writtenBytes, err := tx.WriteRequestBody(bodyChunk)
+		inspectedChunk := ctx.requestCharset.convert(bodyChunk)
+		interruption, writtenBytes, err := tx.WriteRequestBody(inspectedChunk)
 		if err != nil {
 			ctx.logger.Error().Err(err).Msg("Failed to write request body")
-			return types.ActionContinue
+			return ctx.handleFailure(interruptionPhaseHttpRequestBody, failureEngineError)
 		}
 		if interruption != nil {
+			if isBodyLimitInterruption(interruption) {
+				ctx.processedRequestBody = true
+				return ctx.handleBodyLimitInterruption(interruptionPhaseHttpRequestBody, interruption)
+			}
 			return ctx.handleInterruption(interruptionPhaseHttpRequestBody, interruption)
 		}
 
 		// If not the whole chunk has been written, it implicitly means that we reached the waf request body limit.
 		// Internally ProcessRequestBody has been called and it did not raise any interruption (just checked in the condition above).
-		if writtenBytes < readchunkSize {
+		if writtenBytes < len(inspectedChunk) {
 			// No further body data will be processed
 			// Setting processedRequestBody avoid to call more than once ProcessRequestBody
 			ctx.processedRequestBody = true
-			return types.ActionContinue
+			return ctx.handleFailure(interruptionPhaseHttpRequestBody, failureBodyLimit)
 		}
 
 		ctx.bodyReadIndex += readchunkSize
 	}
 
 	if endOfStream {
-		ctx.processedRequestBody = true
-		ctx.bodyReadIndex = 0 // cleaning for further usage
-		interruption, err := tx.ProcessRequestBody()
-		if err != nil {
-			ctx.logger.Error().
-				Err(err).
-				Msg("Failed to process request body")
-			return types.ActionContinue
-		}
-		if interruption != nil {
-			return ctx.handleInterruption(interruptionPhaseHttpRequestBody, interruption)
-		}
+		return ctx.processRequestBody()
+	}
 
+	if ctx.requestBodyStreaming {
+		// The chunk is sent upstream, the next call only receives the following chunks
+		ctx.bodyReadIndex = 0
+		ctx.requestBodySize = 0
 		return types.ActionContinue
 	}
-
 	return types.ActionPause
 }
 
+// processRequestBody runs the phase 2 rules once the whole request body was written to the transaction.
+func (ctx *httpContext) processRequestBody() types.Action {
+	ctx.processedRequestBody = true
+	ctx.bodyReadIndex = 0 // cleaning for further usage
+	ctx.finishCharsetConversion(ctx.requestCharset)
+	start := ctx.phaseStart()
+	interruption, err := ctx.tx.ProcessRequestBody()
+	if err != nil {
+		ctx.logger.Error().
+			Err(err).
+			Msg("Failed to process request body")
+		return ctx.handleFailure(interruptionPhaseHttpRequestBody, failureEngineError)
+	}
+	if interruption != nil {
+		return ctx.handleInterruption(interruptionPhaseHttpRequestBody, interruption)
+	}
+	if hasRequestBodyError(ctx.tx) {
+		return ctx.handleFailure(interruptionPhaseHttpRequestBody, failureParseError)
+	}
+	if action, exceeded := ctx.checkDeadline(interruptionPhaseHttpRequestBody, start); exceeded {
+		return action
+	}
+
+	return types.ActionContinue
+}
+
+func (ctx *httpContext) OnHttpRequestTrailers(numTrailers int) types.Action {
+	defer logTime("OnHttpRequestTrailers", currentTime())
+	defer countAllocs("OnHttpRequestTrailers", currentAllocs())
+
+	if ctx.interruptedAt.isInterrupted() {
+		return types.ActionPause
+	}
+	if ctx.tx == nil || ctx.tx.IsRuleEngineOff() || ctx.inspectionStopped {
+		return types.ActionContinue
+	}
+
+	trailers, err := proxywasm.GetHttpRequestTrailers()
+	if err != nil {
+		ctx.logger.Error().Err(err).Msg("Failed to get request trailers")
+		return ctx.handleFailure(interruptionPhaseHttpRequestBody, failureEngineError)
+	}
+	addTrailers(ctx.tx, requestTrailerPrefix, trailers)
+
+	if ctx.processedRequestBody {
+		return types.ActionContinue
+	}
+	// The trailers end the stream, the last body callback did not see its end
+	return ctx.OnHttpRequestBody(ctx.requestBodySize, true)
+}
+
 func (ctx *httpContext) OnHttpResponseHeaders(numHeaders int, endOfStream bool) types.Action {
 	defer logTime("OnHttpResponseHeaders", currentTime())
+	defer countAllocs("OnHttpResponseHeaders", currentAllocs())
 
 	if ctx.interruptedAt.isInterrupted() {
 		// Handling the interruption (see handleInterruption) generates a HttpResponse with the required interruption status code.
@@ -470,7 +1192,7 @@ func (ctx *httpContext) OnHttpResponseHeaders(numHeaders int, endOfStream bool)
 
 	tx := ctx.tx
 
-	if tx.IsRuleEngineOff() {
+	if tx.IsRuleEngineOff() || ctx.inspectionStopped {
 		return types.ActionContinue
 	}
 
@@ -494,7 +1216,7 @@ func (ctx *httpContext) OnHttpResponseHeaders(numHeaders int, endOfStream bool)
 		ctx.logger.Error().
 			Err(err).
 			Msg("Failed to get :status")
-		propCodeRaw, propCodeErr := proxywasm.GetProperty([]string{"response", "code"})
+		propCodeRaw, propCodeErr := ctx.props.Property(hostadapter.ResponseCode)
 		if propCodeErr != nil {
 			ctx.logger.Error().
 				Err(propCodeErr).
@@ -520,17 +1242,41 @@ func (ctx *httpContext) OnHttpResponseHeaders(numHeaders int, endOfStream bool)
 		tx.AddResponseHeader(h[0], h[1])
 	}
 
+	start := ctx.phaseStart()
 	interruption := tx.ProcessResponseHeaders(code, ctx.httpProtocol)
 	if interruption != nil {
 		return ctx.handleInterruption(interruptionPhaseHttpResponseHeaders, interruption)
 	}
+	if action, exceeded := ctx.checkDeadline(interruptionPhaseHttpResponseHeaders, start); exceeded {
+		return action
+	}
+
+	if ctx.verdictHeader.response {
+		if err := proxywasm.ReplaceHttpResponseHeader(ctx.verdictHeader.name, buildVerdict(tx)); err != nil {
+			ctx.logger.Error().Err(err).Msg("Failed to add verdict response header")
+		}
+	}
+
+	if ctx.responseBodyDecompression.enabled() {
+		ctx.responseBodyEncoding = decompressibleEncoding(proxywasm.GetHttpResponseHeader("content-encoding"))
+	}
+	ctx.responseCharset = ctx.newCharsetDecoder(proxywasm.GetHttpResponseHeader("content-type"))
+
+	// The body may be replaced by a late interruption once the headers are sent downstream
+	if ctx.responseBodyInterruption.changesLength() && !endOfStream {
+		if err := proxywasm.RemoveHttpResponseHeader("content-length"); err != nil {
+			ctx.logger.Error().Err(err).Msg("Failed to remove content-length response header")
+		}
+	}
 
 	return types.ActionContinue
 }
 
 func (ctx *httpContext) OnHttpResponseBody(bodySize int, endOfStream bool) types.Action {
 	defer logTime("OnHttpResponseBody", currentTime())
+	defer countAllocs("OnHttpResponseBody", currentAllocs())
 
+	ctx.responseBodySize = bodySize
 	if ctx.interruptedAt.isInterrupted() {
 		// At response body phase, proxy-wasm currently relies on emptying the response body as a way of
 		// interruption the response. See https://github.com/corazawaf/coraza-proxy-wasm/issues/26.
@@ -541,7 +1287,7 @@ func (ctx *httpContext) OnHttpResponseBody(bodySize int, endOfStream bool) types
 			Str("interruption_handled_phase", ctx.interruptedAt.String()).
 			Msg("Response body interruption already handled, keeping replacing the body")
 		// Interruption happened, we don't want to send response body data
-		return replaceResponseBodyWhenInterrupted(ctx.logger, bodySize)
+		return ctx.replaceResponseBody(bodySize)
 	}
 
 	if ctx.processedResponseBody {
@@ -554,14 +1300,16 @@ func (ctx *httpContext) OnHttpResponseBody(bodySize int, endOfStream bool) types
 
 	tx := ctx.tx
 
-	if tx.IsRuleEngineOff() {
+	if tx.IsRuleEngineOff() || ctx.inspectionStopped {
 		return types.ActionContinue
 	}
 
 	// Do not perform any action related to response body data if SecResponseBodyAccess is set to false
-	if !tx.IsResponseBodyAccessible() || !tx.IsResponseBodyProcessable() {
+	// or if the request is not sampled for full inspection
+	if !tx.IsResponseBodyAccessible() || !tx.IsResponseBodyProcessable() || ctx.headersOnly {
 		ctx.logger.Debug().Bool("SecResponseBodyAccess", tx.IsResponseBodyAccessible()).
 			Bool("IsResponseBodyProcessable", tx.IsResponseBodyProcessable()).
+			Bool("headers_only", ctx.headersOnly).
 			Msg("Skipping response body inspection")
 		// ProcessResponseBody is performed for phase 4 rules, checking already populated variables
 		if !ctx.processedResponseBody {
@@ -581,6 +1329,14 @@ func (ctx *httpContext) OnHttpResponseBody(bodySize int, endOfStream bool) types
 		return types.ActionContinue
 	}
 
+	if ctx.responseBodyEncoding != "" {
+		if !endOfStream {
+			// The encoded body is buffered by the proxy until the end of the stream
+			return types.ActionPause
+		}
+		return ctx.inspectCompressedResponseBody(bodySize)
+	}
+
 	chunkSize := bodySize - ctx.bodyReadIndex
 	if chunkSize > 0 {
 		bodyChunk, err := proxywasm.GetHttpResponseBody(ctx.bodyReadIndex, chunkSize)
@@ -598,7 +1354,8 @@ func (ctx *httpContext) OnHttpResponseBody(bodySize int, endOfStream bool) types
 		if readchunkSize != chunkSize {
 			ctx.logger.Warn().Int("read_chunk_size", readchunkSize).Int("chunk_size", chunkSize).Msg("Response chunk size read is different from the computed one")
 		}
-		interruption, writtenBytes, err := tx.WriteResponseBody(bodyChunk)
+		inspectedChunk := ctx.responseCharset.convert(bodyChunk)
+		interruption, writtenBytes, err := tx.WriteResponseBody(inspectedChunk)
 		if err != nil {
 			ctx.logger.Error().Err(err).Msg("Failed to write response body")
 			return types.ActionContinue
@@ -607,11 +1364,15 @@ func (ctx *httpContext) OnHttpResponseBody(bodySize int, endOfStream bool) types
 		// it is internally needed to replace the full body if the transaction is interrupted
 		ctx.bodyReadIndex += readchunkSize
 		if interruption != nil {
+			if isBodyLimitInterruption(interruption) {
+				ctx.processedResponseBody = true
+				return ctx.handleBodyLimitInterruption(interruptionPhaseHttpResponseBody, interruption)
+			}
 			return ctx.handleInterruption(interruptionPhaseHttpResponseBody, interruption)
 		}
 		// If not the whole chunk has been written, it implicitly means that we reached the waf response body limit,
 		// internally ProcessResponseBody has been called and it did not raise any interruption (just checked in the condition above).
-		if writtenBytes < readchunkSize {
+		if writtenBytes < len(inspectedChunk) {
 			// no further body data will be processed
 			ctx.processedResponseBody = true
 			return types.ActionContinue
@@ -623,6 +1384,7 @@ func (ctx *httpContext) OnHttpResponseBody(bodySize int, endOfStream bool) types
 		// but we can still drop the response body to prevent leaking sensitive content.
 		// The error will also be logged by Coraza.
 		ctx.processedResponseBody = true
+		ctx.finishCharsetConversion(ctx.responseCharset)
 		interruption, err := tx.ProcessResponseBody()
 		if err != nil {
 			ctx.logger.Error().
@@ -640,12 +1402,35 @@ func (ctx *httpContext) OnHttpResponseBody(bodySize int, endOfStream bool) types
 	return types.ActionPause
 }
 
+func (ctx *httpContext) OnHttpResponseTrailers(numTrailers int) types.Action {
+	defer logTime("OnHttpResponseTrailers", currentTime())
+	defer countAllocs("OnHttpResponseTrailers", currentAllocs())
+
+	if ctx.interruptedAt.isInterrupted() || ctx.tx == nil || ctx.tx.IsRuleEngineOff() || ctx.inspectionStopped {
+		return types.ActionContinue
+	}
+
+	trailers, err := proxywasm.GetHttpResponseTrailers()
+	if err != nil {
+		ctx.logger.Error().Err(err).Msg("Failed to get response trailers")
+		return types.ActionContinue
+	}
+	addTrailers(ctx.tx, responseTrailerPrefix, trailers)
+
+	if ctx.processedResponseBody {
+		return types.ActionContinue
+	}
+	// The trailers end the stream, the buffered body is inspected before being released
+	return ctx.OnHttpResponseBody(ctx.responseBodySize, true)
+}
+
 func (ctx *httpContext) OnHttpStreamDone() {
 	defer logTime("OnHttpStreamDone", currentTime())
+	defer countAllocs("OnHttpStreamDone", currentAllocs())
 	tx := ctx.tx
 
 	if tx != nil {
-		if !tx.IsRuleEngineOff() && !ctx.interruptedAt.isInterrupted() {
+		if !tx.IsRuleEngineOff() && !ctx.interruptedAt.isInterrupted() && !ctx.inspectionStopped {
 			// Responses without body won't call OnHttpResponseBody, but there are rules in the response body
 			// phase that still need to be executed. If they haven't been executed yet, and there has not been a previous
 			// interruption, now is the time.
@@ -661,17 +1446,37 @@ func (ctx *httpContext) OnHttpStreamDone() {
 			}
 		}
 
-		// ProcessLogging is still called even if RuleEngine is off for potential logs generated before the engine is turned off.
-		// Internally, if the engine is off, no log phase rules are evaluated
-		ctx.tx.ProcessLogging()
-
-		err := ctx.tx.Close()
-		if err != nil {
-			ctx.logger.Error().Err(err).Msg("Failed to close transaction")
-		}
-		ctx.logger.Info().Msg("Finished")
+		ctx.finish()
+		ctx.metrics.ReportHeap(readHeap())
 		logMemStats()
 	}
+	delete(ctx.inflight, ctx.contextID)
+
+	if ctx.gcWhenIdle && len(ctx.inflight) == 0 {
+		// The collection is paid between requests rather than within the processing of the next one
+		runtime.GC()
+		ctx.metrics.CountGC()
+	}
+}
+
+// finish runs the logging phase and closes the transaction. The transaction is released
+// so that it is finished once, either by OnHttpStreamDone or by OnPluginDone.
+func (ctx *httpContext) finish() {
+	// ProcessLogging is still called even if RuleEngine is off for potential logs generated before the engine is turned off.
+	// Internally, if the engine is off, no log phase rules are evaluated
+	ctx.tx.ProcessLogging()
+
+	if ctx.verdictContract.enabled() {
+		ctx.verdictContract.publishVerdict(ctx.tx, ctx.interruptedAt, ctx.skippedPhases)
+	}
+
+	err := ctx.tx.Close()
+	if err != nil {
+		ctx.logger.Error().Err(err).Msg("Failed to close transaction")
+	}
+	ctx.tx = nil
+	ctx.metrics.TXFinished()
+	ctx.logger.Info().Msg("Finished")
 }
 
 const noGRPCStream int32 = -1
@@ -688,18 +1493,27 @@ func (ctx *httpContext) handleInterruption(phase interruptionPhase, interruption
 	ctx.logger.Info().
 		Str("action", interruption.Action).
 		Str("phase", phase.String()).
+		Str("incident_id", ctx.tx.ID()).
 		Msg("Transaction interrupted")
 
 	ctx.interruptedAt = phase
+	if interruption.Action == dropAction && ctx.dropStream(phase) {
+		// The stream being reset, nothing is sent downstream anymore
+		return types.ActionPause
+	}
 	if phase == interruptionPhaseHttpResponseBody {
-		return replaceResponseBodyWhenInterrupted(ctx.logger, ctx.bodyReadIndex)
+		return ctx.replaceResponseBody(ctx.bodyReadIndex)
 	}
 
 	statusCode := interruption.Status
 	if statusCode == 0 {
 		statusCode = defaultInterruptionStatusCode
 	}
-	if err := proxywasm.SendHttpResponse(uint32(statusCode), nil, nil, noGRPCStream); err != nil {
+	headers, body := ctx.interruptionResponse(statusCode, ctx.tx.ID(), interruption.RuleID)
+	if ctx.verdictHeader.response {
+		headers = append(headers, [2]string{ctx.verdictHeader.name, buildVerdict(ctx.tx)})
+	}
+	if err := proxywasm.SendHttpResponse(uint32(statusCode), headers, body, noGRPCStream); err != nil {
 		panic(err)
 	}
 
@@ -708,8 +1522,11 @@ func (ctx *httpContext) handleInterruption(phase interruptionPhase, interruption
 }
 
 func logError(error ctypes.MatchedRule) {
-	msg := error.ErrorLog()
-	switch error.Rule().Severity() {
+	logWithSeverity(error.Rule().Severity(), error.ErrorLog())
+}
+
+func logWithSeverity(severity ctypes.RuleSeverity, msg string) {
+	switch severity {
 	case ctypes.RuleSeverityEmergency:
 		proxywasm.LogCritical(msg)
 	case ctypes.RuleSeverityAlert:
@@ -732,14 +1549,22 @@ func logError(error ctypes.MatchedRule) {
 // retrieveAddressInfo retrieves address properties from the proxy
 // Expected targets are "source" or "destination"
 // Envoy ref: https://www.envoyproxy.io/docs/envoy/latest/intro/arch_overview/advanced/attributes#connection-attributes
-func retrieveAddressInfo(logger debuglog.Logger, target string) (string, int) {
+func retrieveAddressInfo(logger debuglog.Logger, props hostadapter.Resolver, target string) (string, int) {
+	addressProperty, portProperty := hostadapter.SourceAddress, hostadapter.SourcePort
+	if target == "destination" {
+		addressProperty, portProperty = hostadapter.DestinationAddress, hostadapter.DestinationPort
+	}
+
 	var targetIP, targetPortStr string
 	var targetPort int
-	targetAddressRaw, err := proxywasm.GetProperty([]string{target, "address"})
+	targetAddressRaw, err := props.Property(addressProperty)
 	if err != nil {
 		logger.Debug().
 			Err(err).
 			Msg(fmt.Sprintf("Failed to get %s address", target))
+	} else if net.ParseIP(string(targetAddressRaw)) != nil {
+		// Some hosts (e.g. nginx) expose the bare IP, without port
+		targetIP = string(targetAddressRaw)
 	} else {
 		targetIP, targetPortStr, err = net.SplitHostPort(string(targetAddressRaw))
 		if err != nil {
@@ -748,9 +1573,9 @@ func retrieveAddressInfo(logger debuglog.Logger, target string) (string, int) {
 				Msg(fmt.Sprintf("Failed to parse %s address", target))
 		}
 	}
-	targetPortRaw, err := proxywasm.GetProperty([]string{target, "port"})
+	targetPortRaw, err := props.Property(portProperty)
 	if err == nil {
-		targetPort, err = parsePort(targetPortRaw)
+		targetPort, err = props.ParsePort(targetPortRaw)
 		if err != nil {
 			logger.Debug().
 				Err(err).
@@ -770,35 +1595,36 @@ func retrieveAddressInfo(logger debuglog.Logger, target string) (string, int) {
 	return targetIP, targetPort
 }
 
-// parsePort converts port, retrieved as little-endian bytes, into int
-func parsePort(b []byte) (int, error) {
-	// Port attribute ({"source", "port"}) is populated as uint64 (8 byte)
-	// Ref: https://github.com/envoyproxy/envoy/blob/1b3da361279a54956f01abba830fc5d3a5421828/source/common/network/utility.cc#L201
-	if len(b) < 8 {
-		return 0, errors.New("port bytes not found")
-	}
-	// 0 < Port number <= 65535, therefore the retrieved value should never exceed 16 bits
-	// and correctly fit int (at least 32 bits in size)
-	unsignedInt := binary.LittleEndian.Uint64(b)
-	if unsignedInt > math.MaxInt32 {
-		return 0, errors.New("port conversion error")
-	}
-	return int(unsignedInt), nil
+// tlsVariables are the TX variables populated with the TLS attributes of the connection.
+var tlsVariables = []struct {
+	name     string
+	property hostadapter.Property
+}{
+	{"tls_version", hostadapter.TLSVersion},
+	{"tls_server_name", hostadapter.TLSServerName},
+	{"client_cert_subject", hostadapter.PeerCertSubject},
+	{"client_cert_uri_san", hostadapter.PeerCertURISAN},
+	{"client_cert_dns_san", hostadapter.PeerCertDNSSAN},
+	{"client_cert_fingerprint", hostadapter.PeerCertFingerprint},
 }
 
-// replaceResponseBodyWhenInterrupted address an interruption raised during phase 4.
-// At this phase, response headers are already sent downstream, therefore an interruption
-// can not change anymore the status code, but only tweak the response body
-func replaceResponseBodyWhenInterrupted(logger debuglog.Logger, bodySize int) types.Action {
-	// TODO(M4tteoP): Update response body interruption logic after https://github.com/corazawaf/coraza-proxy-wasm/issues/26
-	// Currently returns a body filled with null bytes that replaces the sensitive data potentially leaked
-	err := proxywasm.ReplaceHttpResponseBody(bytes.Repeat([]byte("\x00"), bodySize))
-	if err != nil {
-		logger.Error().Err(err).Msg("Failed to replace response body")
-		return types.ActionContinue
+// setTLSVariables exposes the TLS attributes of the connection, when available, as TX
+// variables. For mTLS connections, the SPIFFE ID of the client workload is exposed as
+// TX:client_spiffe_id.
+func setTLSVariables(tx ctypes.Transaction, props hostadapter.Resolver) {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return
+	}
+	txVars := state.Variables().TX()
+	for _, v := range tlsVariables {
+		if value, err := props.Property(v.property); err == nil && len(value) > 0 {
+			txVars.Set(v.name, []string{string(value)})
+		}
+	}
+	if uriSAN, err := props.Property(hostadapter.PeerCertURISAN); err == nil && bytes.HasPrefix(uriSAN, []byte("spiffe://")) {
+		txVars.Set("client_spiffe_id", []string{string(uriSAN)})
 	}
-	logger.Warn().Msg("Response body intervention occurred: body replaced")
-	return types.ActionContinue
 }
 
 // parseServerName parses :authority pseudo-header in order to retrieve the
@@ -11,6 +11,8 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/proxytest"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/hostadapter"
 )
 
 func TestRetrieveAddressInfo(t *testing.T) {
@@ -62,7 +64,7 @@ func TestRetrieveAddressInfo(t *testing.T) {
 						require.NoError(t, err)
 					}
 
-					targetIP, port := retrieveAddressInfo(debuglog.Noop(), target)
+					targetIP, port := retrieveAddressInfo(debuglog.Noop(), hostadapter.NewResolver(hostadapter.Envoy), target)
 					assert.Equal(t, tCase.expectedTargetIP, targetIP)
 					assert.Equal(t, tCase.expectedPort, port)
 
@@ -72,3 +74,25 @@ func TestRetrieveAddressInfo(t *testing.T) {
 		})
 	}
 }
+
+func TestRetrieveAddressInfoNginx(t *testing.T) {
+	opt := proxytest.
+		NewEmulatorOption().
+		WithVMContext(NewVMContext())
+
+	host, reset := proxytest.NewHostEmulator(opt)
+	defer reset()
+
+	require.Equal(t, types.OnPluginStartStatusOK, host.StartPlugin())
+
+	id := host.InitializeHttpContext()
+
+	require.NoError(t, host.SetProperty([]string{"ngx", "remote_addr"}, []byte("127.0.0.10")))
+	require.NoError(t, host.SetProperty([]string{"ngx", "remote_port"}, []byte("8080")))
+
+	targetIP, port := retrieveAddressInfo(debuglog.Noop(), hostadapter.NewResolver(hostadapter.Nginx), "source")
+	assert.Equal(t, "127.0.0.10", targetIP)
+	assert.Equal(t, 8080, port)
+
+	host.CompleteHttpContext(id)
+}
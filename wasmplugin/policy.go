@@ -0,0 +1,218 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	policyAPIVersion = "waf.coraza.io/v1alpha1"
+	policyKind       = "WAFPolicy"
+	// policyExceptionFirstRuleID is the ID of the rule generated for the first path
+	// scoped exception, the following ones being numbered sequentially.
+	policyExceptionFirstRuleID = 99900
+	policyMaxExceptions        = 100
+)
+
+// policyModes maps the policy modes to the corresponding SecRuleEngine values.
+var policyModes = map[string]string{
+	"Enforce": "On",
+	"Detect":  "DetectionOnly",
+	"Off":     "Off",
+}
+
+// isPolicy returns true if the configuration is a Kubernetes-style policy document.
+func isPolicy(jsonData gjson.Result) bool {
+	return jsonData.Get("apiVersion").Exists() || jsonData.Get("kind").Exists()
+}
+
+// translatePolicy translates a WAFPolicy document into the native plugin configuration:
+//
+//	apiVersion: waf.coraza.io/v1alpha1
+//	kind: WAFPolicy
+//	spec:
+//	  ruleSets:
+//	  - name: default
+//	    mode: Enforce # Enforce, Detect or Off
+//	    directives: [...]
+//	  defaultRuleSet: default
+//	  hosts:
+//	  - hostname: example.com
+//	    ruleSet: default
+//	  egress:
+//	    ruleSet: egress # applied to the outbound traffic
+//	    allowedDestinations: [api.example.com, "*.googleapis.com"]
+//	  exceptions:
+//	  - ruleSet: default # all the rule sets if omitted
+//	    ruleIDs: [942100]
+//	    pathPrefix: /upload # the whole traffic if omitted
+//	  options: {...} # any other native configuration field
+func translatePolicy(jsonData gjson.Result) (gjson.Result, error) {
+	if v := jsonData.Get("apiVersion").String(); v != policyAPIVersion {
+		return gjson.Result{}, fmt.Errorf("unsupported policy apiVersion: %q", v)
+	}
+	if k := jsonData.Get("kind").String(); k != policyKind {
+		return gjson.Result{}, fmt.Errorf("unsupported policy kind: %q", k)
+	}
+	spec := jsonData.Get("spec")
+
+	native := map[string]json.RawMessage{}
+	spec.Get("options").ForEach(func(key, value gjson.Result) bool {
+		native[key.String()] = json.RawMessage(value.Raw)
+		return true
+	})
+
+	directivesMap := map[string][]string{}
+	var err error
+	spec.Get("ruleSets").ForEach(func(_, ruleSet gjson.Result) bool {
+		name := ruleSet.Get("name").String()
+		if name == "" {
+			err = errors.New("missing rule set name")
+			return false
+		}
+		if _, ok := directivesMap[name]; ok {
+			err = fmt.Errorf("duplicated rule set: %q", name)
+			return false
+		}
+
+		var directives []string
+		if mode := ruleSet.Get("mode"); mode.Exists() {
+			engine, ok := policyModes[mode.String()]
+			if !ok {
+				err = fmt.Errorf("unsupported mode for rule set %q: %q", name, mode.String())
+				return false
+			}
+			directives = append(directives, "SecRuleEngine "+engine)
+		}
+		ruleSet.Get("directives").ForEach(func(_, d gjson.Result) bool {
+			if d.IsObject() {
+				var rule string
+				if rule, err = parseStructuredRule(d); err != nil {
+					err = fmt.Errorf("invalid structured rule in rule set %q: %v", name, err)
+					return false
+				}
+				directives = append(directives, rule)
+				return true
+			}
+			directives = append(directives, d.String())
+			return true
+		})
+		directivesMap[name] = directives
+		return err == nil
+	})
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	if err := appendPolicyExceptions(spec.Get("exceptions"), directivesMap); err != nil {
+		return gjson.Result{}, err
+	}
+
+	perAuthorityDirectives := map[string]string{}
+	spec.Get("hosts").ForEach(func(_, host gjson.Result) bool {
+		perAuthorityDirectives[host.Get("hostname").String()] = host.Get("ruleSet").String()
+		return true
+	})
+
+	for key, value := range map[string]interface{}{
+		"directives_map":           directivesMap,
+		"per_authority_directives": perAuthorityDirectives,
+	} {
+		if native[key], err = json.Marshal(value); err != nil {
+			return gjson.Result{}, err
+		}
+	}
+	if egress := spec.Get("egress"); egress.Exists() {
+		if native["per_direction_directives"], err = json.Marshal(map[string]string{
+			directionOutbound: egress.Get("ruleSet").String(),
+		}); err != nil {
+			return gjson.Result{}, err
+		}
+		if allowed := egress.Get("allowedDestinations"); allowed.Exists() {
+			native["egress_allowed_destinations"] = json.RawMessage(allowed.Raw)
+		}
+	}
+	if defaultRuleSet := spec.Get("defaultRuleSet"); defaultRuleSet.Exists() {
+		native["default_directives"] = json.RawMessage(defaultRuleSet.Raw)
+	}
+
+	raw, err := json.Marshal(native)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return gjson.ParseBytes(raw), nil
+}
+
+// appendPolicyExceptions translates the policy exceptions into directives appended to
+// the rule sets they apply to: unconditional exceptions remove the rules at configuration
+// time, path scoped ones at runtime through a generated rule that is prepended in order
+// to be evaluated before the rules it removes.
+func appendPolicyExceptions(exceptions gjson.Result, directivesMap map[string][]string) error {
+	var (
+		err    error
+		scoped int
+	)
+	exceptions.ForEach(func(_, exception gjson.Result) bool {
+		var ids []string
+		exception.Get("ruleIDs").ForEach(func(_, id gjson.Result) bool {
+			ids = append(ids, strconv.Itoa(int(id.Int())))
+			return true
+		})
+		if len(ids) == 0 {
+			err = errors.New("missing ruleIDs in exception")
+			return false
+		}
+
+		var (
+			directive string
+			prepend   bool
+		)
+		if pathPrefix := exception.Get("pathPrefix").String(); pathPrefix != "" {
+			if scoped == policyMaxExceptions {
+				err = fmt.Errorf("too many path scoped exceptions, at most %d are supported", policyMaxExceptions)
+				return false
+			}
+			var ctls []string
+			for _, id := range ids {
+				ctls = append(ctls, "ctl:ruleRemoveById="+id)
+			}
+			directive = fmt.Sprintf("SecRule REQUEST_FILENAME \"@beginsWith %s\" \"id:%d,phase:1,pass,nolog,%s\"",
+				pathPrefix, policyExceptionFirstRuleID+scoped, strings.Join(ctls, ","))
+			scoped++
+			prepend = true
+		} else {
+			directive = "SecRuleRemoveById " + strings.Join(ids, " ")
+		}
+
+		add := func(name string) {
+			if prepend {
+				directivesMap[name] = append([]string{directive}, directivesMap[name]...)
+			} else {
+				directivesMap[name] = append(directivesMap[name], directive)
+			}
+		}
+
+		ruleSet := exception.Get("ruleSet").String()
+		if ruleSet == "" {
+			for name := range directivesMap {
+				add(name)
+			}
+			return true
+		}
+		if _, ok := directivesMap[ruleSet]; !ok {
+			err = fmt.Errorf("rule set not found for exception: %q", ruleSet)
+			return false
+		}
+		add(ruleSet)
+		return true
+	})
+	return err
+}
@@ -0,0 +1,103 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// crsExclusionDirectives are the directives updating or removing the rules loaded before
+// them, moved after the CRS rules by the include_crs preset.
+var crsExclusionDirectives = []string{
+	"secruleremovebyid",
+	"secruleremovebytag",
+	"secruleremovebymsg",
+	"secruleupdatetargetbyid",
+	"secruleupdatetargetbytag",
+	"secruleupdatetargetbymsg",
+	"secruleupdateactionbyid",
+}
+
+// parsePresetRuleSets returns the rule sets a preset applies to: all of them if set to
+// true, the listed ones if set to an array.
+func parsePresetRuleSets(preset gjson.Result, key string, directivesMap DirectivesMap) ([]string, error) {
+	switch {
+	case preset.IsBool():
+		if !preset.Bool() {
+			return nil, nil
+		}
+		names := make([]string, 0, len(directivesMap))
+		for name := range directivesMap {
+			names = append(names, name)
+		}
+		return names, nil
+	case preset.IsArray():
+		var names []string
+		for _, name := range preset.Array() {
+			if _, ok := directivesMap[name.String()]; !ok {
+				return nil, fmt.Errorf("directive map not found for %s: %q", key, name.String())
+			}
+			names = append(names, name.String())
+		}
+		return names, nil
+	default:
+		return nil, fmt.Errorf("invalid %s: %s", key, preset.Raw)
+	}
+}
+
+// applyRecommendedPreset prepends the recommended Coraza configuration to the directives,
+// unless they include it already. It sets SecRuleEngine DetectionOnly, which the directives
+// can override.
+func applyRecommendedPreset(directives []string) []string {
+	if includesAny(directives, "@recommended-conf") {
+		return directives
+	}
+	return append([]string{"Include @recommended-conf"}, directives...)
+}
+
+// applyCRSPreset wraps the directives with the CRS setup and rules, unless they include the
+// CRS already. The directives configure the CRS between both, except the rule exclusions
+// which are moved after the CRS rules as they only apply to the rules loaded before them.
+func applyCRSPreset(directives []string) []string {
+	if includesAny(directives, "@crs-setup-conf", "@crs-setup-demo-conf", "@owasp_crs/") {
+		return directives
+	}
+
+	preset := []string{"Include @crs-setup-conf"}
+	var exclusions []string
+	for _, d := range directives {
+		if isCRSExclusion(d) {
+			exclusions = append(exclusions, d)
+		} else {
+			preset = append(preset, d)
+		}
+	}
+	preset = append(preset, "Include @owasp_crs/*.conf")
+	return append(preset, exclusions...)
+}
+
+func isCRSExclusion(directive string) bool {
+	name, _, _ := strings.Cut(strings.TrimSpace(directive), " ")
+	name = strings.ToLower(name)
+	for _, d := range crsExclusionDirectives {
+		if name == d {
+			return true
+		}
+	}
+	return false
+}
+
+func includesAny(directives []string, aliases ...string) bool {
+	for _, d := range directives {
+		for _, a := range aliases {
+			if strings.Contains(d, a) {
+				return true
+			}
+		}
+	}
+	return false
+}
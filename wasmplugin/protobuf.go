@@ -0,0 +1,225 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The wire types of the protobuf encoding, groups being unsupported.
+const (
+	protoVarint          = 0
+	protoFixed64         = 1
+	protoLengthDelimited = 2
+	protoFixed32         = 5
+)
+
+// The types of FieldDescriptorProto inspected.
+const (
+	protoTypeString  = 9
+	protoTypeMessage = 11
+)
+
+var errInvalidProto = errors.New("invalid protobuf message")
+
+// readProtoFields calls f with the fields of the protobuf encoded message, the value being
+// the bytes of the length delimited fields and nil otherwise, until f returns false.
+func readProtoFields(b []byte, f func(num uint64, wireType int, value []byte, varint uint64) bool) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 || tag>>3 == 0 {
+			return errInvalidProto
+		}
+		b = b[n:]
+
+		num, wireType := tag>>3, int(tag&7)
+		var (
+			value  []byte
+			varint uint64
+		)
+		switch wireType {
+		case protoVarint:
+			if varint, n = binary.Uvarint(b); n <= 0 {
+				return errInvalidProto
+			}
+		case protoFixed64:
+			n = 8
+		case protoFixed32:
+			n = 4
+		case protoLengthDelimited:
+			length, l := binary.Uvarint(b)
+			if l <= 0 || length > uint64(len(b)-l) {
+				return errInvalidProto
+			}
+			value = b[l : l+int(length)]
+			n = l + int(length)
+		default:
+			return errInvalidProto
+		}
+		if n > len(b) {
+			return errInvalidProto
+		}
+		b = b[n:]
+
+		if !f(num, wireType, value, varint) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// protoDescriptors are the message types and RPC methods of a FileDescriptorSet.
+type protoDescriptors struct {
+	// messages are keyed by their fully qualified name, e.g. .pkg.Message.
+	messages map[string]*protoMessage
+	// inputTypes are the fully qualified names of the request messages, keyed by the gRPC
+	// path of their method, e.g. /pkg.Service/Method.
+	inputTypes map[string]string
+}
+
+type protoMessage struct {
+	fields map[uint64]protoField
+}
+
+type protoField struct {
+	name     string
+	typ      uint64
+	typeName string
+}
+
+// parseDescriptorSet parses a FileDescriptorSet, as produced by protoc --descriptor_set_out.
+func parseDescriptorSet(data []byte) (*protoDescriptors, error) {
+	d := &protoDescriptors{messages: map[string]*protoMessage{}, inputTypes: map[string]string{}}
+	var err error
+	parseErr := readProtoFields(data, func(num uint64, _ int, file []byte, _ uint64) bool {
+		if num == 1 {
+			err = d.parseFile(file)
+		}
+		return err == nil
+	})
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return d, err
+}
+
+func (d *protoDescriptors) parseFile(file []byte) error {
+	var pkg string
+	var messageTypes, services [][]byte
+	if err := readProtoFields(file, func(num uint64, _ int, value []byte, _ uint64) bool {
+		switch num {
+		case 2:
+			pkg = string(value)
+		case 4:
+			messageTypes = append(messageTypes, value)
+		case 6:
+			services = append(services, value)
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+
+	prefix := ""
+	if pkg != "" {
+		prefix = "." + pkg
+	}
+	for _, m := range messageTypes {
+		if err := d.parseMessage(prefix, m); err != nil {
+			return err
+		}
+	}
+	for _, s := range services {
+		if err := d.parseService(pkg, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *protoDescriptors) parseMessage(prefix string, message []byte) error {
+	var name string
+	var fields, nested [][]byte
+	if err := readProtoFields(message, func(num uint64, _ int, value []byte, _ uint64) bool {
+		switch num {
+		case 1:
+			name = string(value)
+		case 2:
+			fields = append(fields, value)
+		case 3:
+			nested = append(nested, value)
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+
+	fullName := prefix + "." + name
+	m := &protoMessage{fields: map[uint64]protoField{}}
+	for _, field := range fields {
+		var f protoField
+		var number uint64
+		if err := readProtoFields(field, func(num uint64, _ int, value []byte, varint uint64) bool {
+			switch num {
+			case 1:
+				f.name = string(value)
+			case 3:
+				number = varint
+			case 5:
+				f.typ = varint
+			case 6:
+				f.typeName = string(value)
+			}
+			return true
+		}); err != nil {
+			return err
+		}
+		m.fields[number] = f
+	}
+	d.messages[fullName] = m
+
+	for _, n := range nested {
+		if err := d.parseMessage(fullName, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *protoDescriptors) parseService(pkg string, service []byte) error {
+	var name string
+	var methods [][]byte
+	if err := readProtoFields(service, func(num uint64, _ int, value []byte, _ uint64) bool {
+		switch num {
+		case 1:
+			name = string(value)
+		case 2:
+			methods = append(methods, value)
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+
+	if pkg != "" {
+		name = pkg + "." + name
+	}
+	for _, method := range methods {
+		var methodName, inputType string
+		if err := readProtoFields(method, func(num uint64, _ int, value []byte, _ uint64) bool {
+			switch num {
+			case 1:
+				methodName = string(value)
+			case 2:
+				inputType = string(value)
+			}
+			return true
+		}); err != nil {
+			return err
+		}
+		d.inputTypes["/"+name+"/"+methodName] = inputType
+	}
+	return nil
+}
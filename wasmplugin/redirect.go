@@ -0,0 +1,83 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+// requestInspectedProperty is the filter state object (wasm.coraza_request_inspected in
+// Envoy) set by the streams whose request passed the request headers phase. Unlike the
+// x-envoy-original-url header, the downstream can not set it.
+const requestInspectedProperty = "coraza_request_inspected"
+
+// declarePropertyLifeSpanRequest is the DownstreamRequest life span of the arguments of the
+// declare_property foreign function of Envoy. Envoy only carries the filter state objects of
+// the request life span over to the streams recreated by internal redirects, the ones set
+// without being declared living as long as the filter chain.
+const declarePropertyLifeSpanRequest = 1
+
+// internalRedirectsMode tells how the requests recreated by internal redirects are inspected.
+// Upstream retries are performed by the router, below the filter, hence the request
+// is inspected once and the response of the last attempt only.
+type internalRedirectsMode string
+
+const (
+	// internalRedirectsReinspect runs all the phases on a fresh transaction, as for any
+	// other stream. It is the default.
+	internalRedirectsReinspect internalRedirectsMode = "reinspect"
+	// internalRedirectsSkipRequest skips the request phases, already run by the
+	// transaction of the original stream, only the response phases are run.
+	internalRedirectsSkipRequest internalRedirectsMode = "skip_request"
+)
+
+func parseInternalRedirectsMode(mode string) (internalRedirectsMode, error) {
+	switch m := internalRedirectsMode(mode); m {
+	case "", internalRedirectsReinspect, internalRedirectsSkipRequest:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unsupported internal_redirects mode: %q", mode)
+	}
+}
+
+// declareRequestInspected declares requestInspectedProperty with the request life span, at
+// plugin start. If it fails, the internal redirects are inspected as any other stream.
+func (m internalRedirectsMode) declareRequestInspected() {
+	if m != internalRedirectsSkipRequest {
+		return
+	}
+	// envoy.source.extensions.common.wasm.DeclarePropertyArguments, with the name (1) and the
+	// span (5) set, the property being read-write bytes
+	args := []byte{1<<3 | 2}
+	args = binary.AppendUvarint(args, uint64(len(requestInspectedProperty)))
+	args = append(args, requestInspectedProperty...)
+	args = append(args, 5<<3, declarePropertyLifeSpanRequest)
+	if _, err := proxywasm.CallForeignFunction("declare_property", args); err != nil {
+		proxywasm.LogWarnf("Failed to declare %s, the internal redirects will be inspected: %v", requestInspectedProperty, err)
+	}
+}
+
+// skipsRequest returns true if the request phases of the current stream are skipped, the
+// stream being recreated by an internal redirect of a stream whose request was inspected.
+func (m internalRedirectsMode) skipsRequest() bool {
+	if m != internalRedirectsSkipRequest {
+		return false
+	}
+	_, err := proxywasm.GetProperty([]string{requestInspectedProperty})
+	return err == nil
+}
+
+// markRequestInspected records that the request of the transaction was inspected, for the
+// streams recreated by the internal redirects of the current one.
+func (m internalRedirectsMode) markRequestInspected(txID string) {
+	if m != internalRedirectsSkipRequest {
+		return
+	}
+	if err := proxywasm.SetProperty([]string{requestInspectedProperty}, []byte(txID)); err != nil {
+		proxywasm.LogWarnf("Failed to mark the request as inspected, its internal redirects will be inspected: %v", err)
+	}
+}
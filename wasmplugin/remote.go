@@ -0,0 +1,269 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tidwall/gjson"
+)
+
+// remoteRulesAlias is the directory the files of the remote rules bundle are served from.
+const remoteRulesAlias = "@remote"
+
+const defaultRemoteRulesTimeout = 5 * time.Second
+
+// errRemoteRulesNotModified is returned by the refreshes when the bundle did not change.
+var errRemoteRulesNotModified = errors.New("remote rules not modified")
+
+// remoteRulesConfig describes the bundle of rules fetched at plugin start through an HTTP
+// callout to a cluster of the host, and refreshed periodically if refreshInterval is set. The bundle is a JSON document:
+//
+//	{
+//	  "directives": ["Include @remote/*.conf"],
+//	  "files": {"rules.conf": "SecRule ...", "bad-ips.data": "..."}
+//	}
+//
+// Its directives are appended to the configured rule set and its files are served under
+// @remote, so that they can be included and read by the operators loading data files.
+type remoteRulesConfig struct {
+	cluster   string
+	authority string
+	path      string
+	timeout   time.Duration
+	// refreshInterval is the period of the refreshes, disabled if zero.
+	refreshInterval time.Duration
+	// sha256 is the expected digest of the bundle, not verified if nil.
+	sha256 []byte
+	// directives is the rule set the remote directives are appended to.
+	directives string
+}
+
+func parseRemoteRules(remote gjson.Result, config *pluginConfiguration) (remoteRulesConfig, error) {
+	c := remoteRulesConfig{
+		cluster:    remote.Get("cluster").String(),
+		authority:  remote.Get("authority").String(),
+		path:       remote.Get("path").String(),
+		timeout:    defaultRemoteRulesTimeout,
+		directives: remote.Get("directives").String(),
+	}
+	if c.cluster == "" {
+		return c, errors.New("missing rules_remote cluster")
+	}
+	if c.authority == "" {
+		c.authority = c.cluster
+	}
+	if !strings.HasPrefix(c.path, "/") {
+		return c, fmt.Errorf("invalid rules_remote path: %q", c.path)
+	}
+	if timeout := remote.Get("timeout"); timeout.Exists() {
+		d, err := time.ParseDuration(timeout.String())
+		if err != nil || d <= 0 {
+			return c, fmt.Errorf("invalid rules_remote timeout: %q", timeout.String())
+		}
+		c.timeout = d
+	}
+	if interval := remote.Get("refresh_interval"); interval.Exists() {
+		d, err := time.ParseDuration(interval.String())
+		if err != nil || d < time.Millisecond {
+			return c, fmt.Errorf("invalid rules_remote refresh_interval: %q", interval.String())
+		}
+		c.refreshInterval = d
+	}
+	if sum := remote.Get("sha256"); sum.Exists() {
+		digest, err := hex.DecodeString(sum.String())
+		if err != nil || len(digest) != sha256.Size {
+			return c, fmt.Errorf("invalid rules_remote sha256: %q", sum.String())
+		}
+		c.sha256 = digest
+	}
+	if c.directives == "" {
+		c.directives = config.defaultDirectives
+	}
+	if _, ok := config.directivesMap[c.directives]; !ok {
+		return c, fmt.Errorf("directive map not found for rules_remote: %q", c.directives)
+	}
+	return c, nil
+}
+
+func (c remoteRulesConfig) enabled() bool {
+	return c.cluster != ""
+}
+
+// remoteRulesVersion identifies the loaded bundle in the conditional requests of the refreshes.
+type remoteRulesVersion struct {
+	etag         string
+	lastModified string
+}
+
+// fetch dispatches the HTTP callout, the callback being called with the bundle or the
+// reason why it could not be fetched. The bundle is only sent back by the server if it
+// differs from the given version, errRemoteRulesNotModified being returned otherwise.
+func (c remoteRulesConfig) fetch(version remoteRulesVersion, callback func(remoteRulesBundle, error)) error {
+	headers := [][2]string{
+		{":method", "GET"},
+		{":path", c.path},
+		{":authority", c.authority},
+		{"accept", "application/json"},
+	}
+	if version.etag != "" {
+		headers = append(headers, [2]string{"if-none-match", version.etag})
+	}
+	if version.lastModified != "" {
+		headers = append(headers, [2]string{"if-modified-since", version.lastModified})
+	}
+	_, err := proxywasm.DispatchHttpCall(c.cluster, headers, nil, nil, uint32(c.timeout.Milliseconds()),
+		func(_, bodySize, _ int) {
+			callback(c.readResponse(bodySize))
+		})
+	return err
+}
+
+func (c remoteRulesConfig) readResponse(bodySize int) (remoteRulesBundle, error) {
+	headers, err := proxywasm.GetHttpCallResponseHeaders()
+	if err != nil || len(headers) == 0 {
+		// The callout failed, e.g. timed out or the cluster is unknown
+		return remoteRulesBundle{}, errors.New("no response from the rules server")
+	}
+	var (
+		status  string
+		version remoteRulesVersion
+	)
+	for _, h := range headers {
+		switch strings.ToLower(h[0]) {
+		case ":status":
+			status = h[1]
+		case "etag":
+			version.etag = h[1]
+		case "last-modified":
+			version.lastModified = h[1]
+		}
+	}
+	if status == "304" {
+		return remoteRulesBundle{}, errRemoteRulesNotModified
+	}
+	if status != "200" {
+		return remoteRulesBundle{}, fmt.Errorf("unexpected status from the rules server: %s", status)
+	}
+	body, err := proxywasm.GetHttpCallResponseBody(0, bodySize)
+	if err != nil {
+		return remoteRulesBundle{}, fmt.Errorf("failed to read the remote rules: %v", err)
+	}
+	bundle, err := parseRemoteRulesBundle(body, c.sha256)
+	bundle.version = version
+	return bundle, err
+}
+
+// remoteRulesState tracks the remote rules loaded by the plugin.
+type remoteRulesState struct {
+	// config is the plugin configuration the rule sets are compiled from.
+	config        pluginConfiguration
+	errorCallback func(ctypes.MatchedRule)
+	// version and digest identify the loaded bundle, empty until loaded.
+	version     remoteRulesVersion
+	digest      string
+	fetching    bool
+	nextRefresh time.Time
+}
+
+// refreshDue returns true if the remote rules are to be refreshed, scheduling the next refresh.
+func (s *remoteRulesState) refreshDue(now time.Time) bool {
+	interval := s.config.remoteRules.refreshInterval
+	if interval == 0 || now.Before(s.nextRefresh) {
+		return false
+	}
+	s.nextRefresh = now.Add(interval)
+	return true
+}
+
+type remoteRulesBundle struct {
+	directives []string
+	files      map[string][]byte
+	// digest is the sha256 of the bundle, identifying it in the logs.
+	digest  string
+	version remoteRulesVersion
+}
+
+func parseRemoteRulesBundle(body []byte, expectedSHA256 []byte) (remoteRulesBundle, error) {
+	sum := sha256.Sum256(body)
+	bundle := remoteRulesBundle{digest: hex.EncodeToString(sum[:]), files: map[string][]byte{}}
+	if expectedSHA256 != nil && !bytes.Equal(sum[:], expectedSHA256) {
+		return bundle, fmt.Errorf("remote rules checksum mismatch: %s", bundle.digest)
+	}
+	if !gjson.ValidBytes(body) {
+		return bundle, errors.New("invalid remote rules bundle: invalid json")
+	}
+
+	data := gjson.ParseBytes(body)
+	data.Get("directives").ForEach(func(_, value gjson.Result) bool {
+		bundle.directives = append(bundle.directives, value.String())
+		return true
+	})
+	var err error
+	data.Get("files").ForEach(func(key, value gjson.Result) bool {
+		name := key.String()
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\*?[`) {
+			err = fmt.Errorf("invalid remote rules file name: %q", name)
+			return false
+		}
+		bundle.files[name] = []byte(value.String())
+		return true
+	})
+	return bundle, err
+}
+
+// remoteFS serves the files of the remote rules bundle under @remote, the other files
+// being read from the base filesystem. Coraza only reads files through fs.ReadFile and
+// lists them through fs.ReadDir, the files of the bundle cannot be opened.
+type remoteFS struct {
+	base  fs.FS
+	files map[string][]byte
+}
+
+func (r remoteFS) Open(name string) (fs.File, error) {
+	if strings.HasPrefix(name, remoteRulesAlias+"/") {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return r.base.Open(name)
+}
+
+func (r remoteFS) ReadFile(name string) ([]byte, error) {
+	if file, ok := strings.CutPrefix(name, remoteRulesAlias+"/"); ok {
+		content, ok := r.files[file]
+		if !ok {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		return content, nil
+	}
+	return fs.ReadFile(r.base, name)
+}
+
+func (r remoteFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != remoteRulesAlias {
+		return fs.ReadDir(r.base, name)
+	}
+	entries := make([]fs.DirEntry, 0, len(r.files))
+	for file := range r.files {
+		entries = append(entries, remoteFileEntry(file))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+type remoteFileEntry string
+
+func (e remoteFileEntry) Name() string               { return string(e) }
+func (e remoteFileEntry) IsDir() bool                { return false }
+func (e remoteFileEntry) Type() fs.FileMode          { return 0 }
+func (e remoteFileEntry) Info() (fs.FileInfo, error) { return nil, fs.ErrInvalid }
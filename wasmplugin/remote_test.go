@@ -0,0 +1,75 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteRulesBundle(t *testing.T) {
+	body := []byte(`
+	{
+		"directives": ["Include @remote/*.conf"],
+		"files": {
+			"admin.conf": "SecRule REQUEST_URI \"@streq /admin\" \"id:101,phase:1,deny\"",
+			"bots.conf": "SecRule REQUEST_HEADERS:User-Agent \"@pmFromFile bots.data\" \"id:102,phase:1,deny\"",
+			"bots.data": "evilbot\nbadcrawler"
+		}
+	}`)
+	sum := sha256.Sum256(body)
+
+	bundle, err := parseRemoteRulesBundle(body, sum[:])
+	require.NoError(t, err)
+	require.Equal(t, []string{"Include @remote/*.conf"}, bundle.directives)
+	require.Len(t, bundle.files, 3)
+	require.Equal(t, fmt.Sprintf("%x", sum), bundle.digest)
+
+	_, err = parseRemoteRulesBundle(append(body, ' '), sum[:])
+	require.ErrorContains(t, err, "remote rules checksum mismatch")
+
+	_, err = parseRemoteRulesBundle([]byte(`{"files": {"../rules.conf": ""}}`), nil)
+	require.Equal(t, errors.New(`invalid remote rules file name: "../rules.conf"`), err)
+
+	_, err = parseRemoteRulesBundle([]byte(`{"files":`), nil)
+	require.Error(t, err)
+
+	rootFS := remoteFS{
+		base:  fstest.MapFS{"rules/local.conf": {Data: []byte("SecRuleEngine On")}},
+		files: bundle.files,
+	}
+	content, err := fs.ReadFile(rootFS, "rules/local.conf")
+	require.NoError(t, err)
+	require.Equal(t, "SecRuleEngine On", string(content))
+	_, err = fs.ReadFile(rootFS, "@remote/missing.conf")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	waf, err := coraza.NewWAF(coraza.NewWAFConfig().
+		WithRootFS(rootFS).
+		WithDirectives("Include rules/local.conf\n" + bundle.directives[0]))
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		path, userAgent string
+		denied          bool
+	}{
+		{path: "/", userAgent: "curl"},
+		{path: "/admin", userAgent: "curl", denied: true},
+		{path: "/", userAgent: "evilbot", denied: true},
+	} {
+		tx := waf.NewTransaction()
+		tx.ProcessURI(tc.path, "GET", "HTTP/1.1")
+		tx.AddRequestHeader("User-Agent", tc.userAgent)
+		it := tx.ProcessRequestHeaders()
+		require.Equal(t, tc.denied, it != nil, "%s with %s", tc.path, tc.userAgent)
+		require.NoError(t, tx.Close())
+	}
+}
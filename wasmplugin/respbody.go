@@ -0,0 +1,89 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+	"github.com/tidwall/gjson"
+)
+
+// The actions on the body of a response interrupted once its headers were sent downstream,
+// where the response cannot be denied anymore.
+const (
+	// responseBodyZero replaces the body with as many null bytes, keeping its length.
+	responseBodyZero = "zero"
+	// responseBodyReplace replaces the body with the configured one.
+	responseBodyReplace = "replace"
+	// responseBodyTruncate drops the body.
+	responseBodyTruncate = "truncate"
+)
+
+type responseBodyInterruptionConfig struct {
+	action string
+	body   []byte
+}
+
+func parseResponseBodyInterruption(interruption gjson.Result) (responseBodyInterruptionConfig, error) {
+	c := responseBodyInterruptionConfig{action: interruption.Get("action").String()}
+	switch c.action {
+	case responseBodyZero, responseBodyTruncate:
+		if interruption.Get("body").Exists() {
+			return c, fmt.Errorf("response_body_interruption body is only supported by the %q action", responseBodyReplace)
+		}
+	case responseBodyReplace:
+		c.body = []byte(interruption.Get("body").String())
+		if len(c.body) == 0 {
+			return c, errors.New("missing response_body_interruption body")
+		}
+	default:
+		return c, fmt.Errorf("unsupported response_body_interruption action: %q", c.action)
+	}
+	return c, nil
+}
+
+// changesLength returns whether the action changes the length of the body, the
+// content-length header of the inspected responses being removed then.
+func (c responseBodyInterruptionConfig) changesLength() bool {
+	return c.action == responseBodyReplace || c.action == responseBodyTruncate
+}
+
+// replaceResponseBody addresses an interruption raised during phase 4. At this phase, response
+// headers are already sent downstream, therefore an interruption can not change anymore the
+// status code, but only tweak the response body. The configured body replaces the first
+// chunk, the following ones are dropped.
+func (ctx *httpContext) replaceResponseBody(bodySize int) types.Action {
+	var body []byte
+	switch ctx.responseBodyInterruption.action {
+	case responseBodyReplace:
+		if !ctx.responseBodyReplaced {
+			body = ctx.responseBodyInterruption.body
+		}
+	case responseBodyTruncate:
+	default:
+		// TODO(M4tteoP): Update response body interruption logic after https://github.com/corazawaf/coraza-proxy-wasm/issues/26
+		// Currently returns a body filled with null bytes that replaces the sensitive data potentially leaked
+		body = bytes.Repeat([]byte("\x00"), bodySize)
+	}
+	ctx.responseBodyReplaced = true
+
+	if err := proxywasm.ReplaceHttpResponseBody(body); err != nil {
+		ctx.logger.Error().Err(err).Msg("Failed to replace response body")
+		return types.ActionContinue
+	}
+	ctx.logger.Warn().Str("response_body_action", ctx.responseBodyInterruption.actionName()).
+		Msg("Response body intervention occurred: body replaced")
+	return types.ActionContinue
+}
+
+func (c responseBodyInterruptionConfig) actionName() string {
+	if c.action == "" {
+		return responseBodyZero
+	}
+	return c.action
+}
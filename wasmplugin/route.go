@@ -0,0 +1,168 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tidwall/gjson"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/hostadapter"
+)
+
+const defaultRouteMetadataNamespace = "coraza"
+
+// routeModeVariable is the TX variable carrying the enforcement mode of the route, applied
+// by the rules generated with routeModeRules.
+const routeModeVariable = "route_mode"
+
+// routeModes maps the enforcement modes accepted in the route metadata to the rule engine
+// status set for the transaction, in the order of the IDs of the generated rules.
+var routeModes = [][2]string{
+	{"enforce", "On"},
+	{"detect", "DetectionOnly"},
+	{"off", "Off"},
+}
+
+// routeModeRuleID is the ID of the first rule generated to apply the enforcement mode of the route.
+const routeModeRuleID = 99700
+
+// routeMetadataConfig reads the overrides of the settings of the rule set from the Envoy
+// route metadata, under filter_metadata.<namespace>:
+//
+//	metadata:
+//	  filter_metadata:
+//	    coraza:
+//	      directives: api
+//	      paranoia_level: 2
+//	      mode: detect
+//	      failure_policy: "body_limit:closed,memory_pressure:open"
+type routeMetadataConfig struct {
+	// path is the property path of the metadata of the plugin, nil if disabled.
+	path []string
+}
+
+func parseRouteMetadata(routeMetadata gjson.Result, host hostadapter.Adapter) (routeMetadataConfig, error) {
+	routeMetadataPath := host.PropertyPath(hostadapter.RouteMetadata)
+	if routeMetadataPath == nil {
+		return routeMetadataConfig{}, fmt.Errorf("route_metadata is not supported by host %q", host.Name())
+	}
+	namespace := routeMetadata.Get("namespace").String()
+	if namespace == "" {
+		namespace = defaultRouteMetadataNamespace
+	}
+	path := append(append([]string{}, routeMetadataPath...), "filter_metadata", namespace)
+	return routeMetadataConfig{path: path}, nil
+}
+
+func (c routeMetadataConfig) enabled() bool {
+	return c.path != nil
+}
+
+// routeModeRules returns the rules switching the rule engine according to the enforcement
+// mode of the route, prepended to every rule set. The mode cannot turn on a rule set
+// whose rule engine is off.
+func routeModeRules() []string {
+	rules := make([]string, 0, len(routeModes))
+	for i, mode := range routeModes {
+		rules = append(rules, fmt.Sprintf("SecRule TX:%s \"@streq %s\" \"id:%d,phase:1,pass,nolog,ctl:ruleEngine=%s\"",
+			routeModeVariable, mode[0], routeModeRuleID+i, mode[1]))
+	}
+	return rules
+}
+
+func parseRouteMode(mode string) error {
+	for _, m := range routeModes {
+		if m[0] == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported route mode: %q", mode)
+}
+
+// routeOverrides are the settings of the rule set overridden by the route.
+type routeOverrides struct {
+	directives    string
+	paranoiaLevel int
+	mode          string
+	failurePolicy failurePolicy
+}
+
+// readRouteOverrides reads the overrides from the metadata of the route of the request.
+// Invalid values are logged and ignored.
+func (c routeMetadataConfig) readRouteOverrides() routeOverrides {
+	var overrides routeOverrides
+	if !c.enabled() {
+		return overrides
+	}
+	get := func(key string) []byte {
+		raw, err := proxywasm.GetProperty(append(append([]string{}, c.path...), key))
+		if err != nil {
+			return nil
+		}
+		return raw
+	}
+
+	overrides.directives = string(get("directives"))
+	if raw := get("paranoia_level"); len(raw) > 0 {
+		level, err := parseMetadataNumber(raw)
+		if err != nil || level < 1 || level > 4 {
+			proxywasm.LogWarnf("Ignoring invalid paranoia_level in route metadata: %q", raw)
+		} else {
+			overrides.paranoiaLevel = level
+		}
+	}
+	if mode := strings.ToLower(string(get("mode"))); mode != "" {
+		if err := parseRouteMode(mode); err != nil {
+			proxywasm.LogWarnf("Ignoring invalid mode in route metadata: %v", err)
+		} else {
+			overrides.mode = mode
+		}
+	}
+	if policy := get("failure_policy"); len(policy) > 0 {
+		overrides.failurePolicy = parseRouteFailurePolicy(string(policy))
+	}
+	return overrides
+}
+
+// parseMetadataNumber parses a metadata number, either given as a string or serialized
+// by the host as a little-endian double.
+func parseMetadataNumber(raw []byte) (int, error) {
+	if n, err := strconv.Atoi(string(raw)); err == nil {
+		return n, nil
+	}
+	if len(raw) == 8 {
+		f := math.Float64frombits(binary.LittleEndian.Uint64(raw))
+		if f == math.Trunc(f) && f >= math.MinInt32 && f <= math.MaxInt32 {
+			return int(f), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid number: %q", raw)
+}
+
+// apply sets the TX variables implementing the overrides: the CRS paranoia level, which
+// the CRS keeps if already set, and the enforcement mode.
+func (o routeOverrides) apply(tx ctypes.Transaction) {
+	if o.paranoiaLevel == 0 && o.mode == "" {
+		return
+	}
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return
+	}
+	txVars := state.Variables().TX()
+	if o.paranoiaLevel > 0 {
+		txVars.Set("blocking_paranoia_level", []string{strconv.Itoa(o.paranoiaLevel)})
+	}
+	if o.mode != "" {
+		txVars.Set(routeModeVariable, []string{o.mode})
+	}
+}
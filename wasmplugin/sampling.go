@@ -0,0 +1,73 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	samplingDecisionFull        = "full"
+	samplingDecisionHeadersOnly = "headers_only"
+)
+
+// samplingConfig trades coverage for CPU on high throughput services: only a share of
+// the requests is fully inspected, the bodies of the others are not inspected and
+// their headers are optionally inspected by a lighter rule set.
+type samplingConfig struct {
+	configured bool
+	// fullInspectionRatio is the ratio of requests fully inspected.
+	fullInspectionRatio float64
+	// headersOnlyDirectives is the rule set inspecting the requests not fully inspected,
+	// the resolved one is used if empty.
+	headersOnlyDirectives string
+}
+
+func (c samplingConfig) enabled() bool {
+	return c.configured
+}
+
+func parseSampling(sampling gjson.Result, directivesMap DirectivesMap) (samplingConfig, error) {
+	var config samplingConfig
+
+	percentage := sampling.Get("full_inspection_percentage")
+	if !percentage.Exists() {
+		return config, errors.New("missing sampling full_inspection_percentage")
+	}
+	if p := percentage.Float(); p < 0 || p > 100 {
+		return config, fmt.Errorf("sampling full_inspection_percentage must be between 0 and 100: %s", percentage.Raw)
+	}
+	config.configured = true
+	config.fullInspectionRatio = percentage.Float() / 100
+
+	if directives := sampling.Get("headers_only_directives"); directives.Exists() {
+		if _, ok := directivesMap[directives.String()]; !ok {
+			return config, fmt.Errorf("directive map not found for sampling headers_only_directives: %q", directives.String())
+		}
+		config.headersOnlyDirectives = directives.String()
+	}
+
+	return config, nil
+}
+
+// sample returns the sampling decision for a new request.
+func (c samplingConfig) sample() string {
+	if rand.Float64() < c.fullInspectionRatio {
+		return samplingDecisionFull
+	}
+	return samplingDecisionHeadersOnly
+}
+
+// setSamplingDecision exposes the sampling decision as the TX:sampling_decision variable.
+func setSamplingDecision(tx ctypes.Transaction, decision string) {
+	if state, ok := tx.(plugintypes.TransactionState); ok {
+		state.Variables().TX().Set("sampling_decision", []string{decision})
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/tidwall/gjson"
+)
+
+// configSchema maps the fields of an object of the plugin configuration to the schema of
+// their values, nil for the values whose fields are not checked (e.g. the maps keyed by rule
+// set). The schema of an array of objects applies to each of its objects.
+type configSchema map[string]configSchema
+
+var pluginConfigurationSchema = configSchema{
+	"body_processors": nil,
+	"charset_conversion": {
+		"default_charset": nil,
+	},
+	"crs_plugins": nil,
+	"crs_version": nil,
+	"decision_metadata": {
+		"header_prefix": nil,
+		"filter_state":  nil,
+		"score_buckets": nil,
+	},
+	"default_directives": nil,
+	"deny_pages": {
+		"content_type": nil,
+		"body":         nil,
+	},
+	"directives_header": {
+		"name":    nil,
+		"allowed": nil,
+	},
+	"directives_map":      nil,
+	"directives_map_gzip": nil,
+	"dynamic_metric_labels": {
+		"name":       nil,
+		"source":     nil,
+		"max_values": nil,
+	},
+	"egress_allowed_destinations": nil,
+	"evaluation_deadline":         nil,
+	"failure_policy":              nil,
+	"gc_when_idle":                nil,
+	"graphql": {
+		"paths":      nil,
+		"max_depth":  nil,
+		"max_fields": nil,
+	},
+	"grpc": {
+		"descriptor_set": nil,
+	},
+	"host":                nil,
+	"include_crs":         nil,
+	"include_recommended": nil,
+	"internal_redirects":  nil,
+	"interruption_body":   nil,
+	"interruption_headers": {
+		"event_id": nil,
+		"rule_id":  nil,
+	},
+	"istio": {
+		"per_namespace_directives": nil,
+		"per_workload_directives":  nil,
+		"metric_labels":            nil,
+		"peer_variables":           nil,
+	},
+	"json": {
+		"max_depth":      nil,
+		"max_elements":   nil,
+		"reject_invalid": nil,
+	},
+	"match_log_dedup_window":    nil,
+	"memory_pressure_threshold": nil,
+	"metadata_variables": {
+		"name": nil,
+		"path": nil,
+	},
+	"metric_labels": nil,
+	"multipart": {
+		"max_part_size": nil,
+		"max_files":     nil,
+	},
+	"oversized_body_handoff": {
+		"limit":  nil,
+		"header": nil,
+	},
+	"per_authority_directives": nil,
+	"per_direction_directives": nil,
+	"per_sni_directives":       nil,
+	"request_body_decompression": {
+		"max_size": nil,
+	},
+	"request_body_streaming": nil,
+	"response_body_decompression": {
+		"max_size": nil,
+	},
+	"response_body_interruption": {
+		"action": nil,
+		"body":   nil,
+	},
+	"response_only": nil,
+	"route_metadata": {
+		"namespace": nil,
+	},
+	// rules is the deprecated field of the default rule set
+	"rules": nil,
+	"rules_remote": {
+		"cluster":          nil,
+		"authority":        nil,
+		"path":             nil,
+		"timeout":          nil,
+		"refresh_interval": nil,
+		"sha256":           nil,
+		"directives":       nil,
+	},
+	"sampling": {
+		"full_inspection_percentage": nil,
+		"headers_only_directives":    nil,
+	},
+	"status_endpoint": {
+		"path":        nil,
+		"hmac_secret": nil,
+		"header":      nil,
+	},
+	"unique_id": {
+		"generator": nil,
+		"node_id":   nil,
+	},
+	"urlencoded": {
+		"nested_fields": nil,
+	},
+	"validate": nil,
+	"verdict_contract": {
+		"log":          nil,
+		"filter_state": nil,
+	},
+	"verdict_header": {
+		"target": nil,
+		"name":   nil,
+	},
+	"warmup": nil,
+}
+
+// checkSchema rejects the fields of the value unknown to the schema, a typo in a field name
+// otherwise silently leaving the setting to its default, e.g. the filter without rules.
+func checkSchema(value gjson.Result, schema configSchema, path string) error {
+	if value.IsArray() {
+		var err error
+		value.ForEach(func(index, item gjson.Result) bool {
+			err = checkSchema(item, schema, fmt.Sprintf("%s[%d]", path, index.Int()))
+			return err == nil
+		})
+		return err
+	}
+	if !value.IsObject() {
+		return nil
+	}
+
+	var err error
+	value.ForEach(func(key, field gjson.Result) bool {
+		name := key.String()
+		fieldSchema, ok := schema[name]
+		if !ok {
+			if suggestion := closestField(name, schema); suggestion != "" {
+				err = fmt.Errorf("unknown field %q, did you mean %q?", fieldPath(path, name), fieldPath(path, suggestion))
+			} else {
+				err = fmt.Errorf("unknown field %q", fieldPath(path, name))
+			}
+			return false
+		}
+		if fieldSchema != nil {
+			err = checkSchema(field, fieldSchema, fieldPath(path, name))
+		}
+		return err == nil
+	})
+	return err
+}
+
+func fieldPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// closestField returns the field of the schema the closest to the unknown name, empty if
+// none is close enough to be a typo.
+func closestField(name string, schema configSchema) string {
+	fields := make([]string, 0, len(schema))
+	for field := range schema {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	// Up to a third of the name may be mistyped
+	closest, closestDistance := "", len(name)/3+2
+	for _, field := range fields {
+		if d := editDistance(name, field); d < closestDistance {
+			closest, closestDistance = field, d
+		}
+	}
+	return closest
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
@@ -0,0 +1,68 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tidwall/gjson"
+)
+
+// directivesHeaderConfig selects the rule set of the requests by the value of a request
+// header, among the allowed rule sets only and in place of the default rule set only, as the
+// header may be set by the clients.
+type directivesHeaderConfig struct {
+	name    string
+	allowed map[string]struct{}
+}
+
+func parseDirectivesHeader(header gjson.Result, directivesMap DirectivesMap) (directivesHeaderConfig, error) {
+	c := directivesHeaderConfig{name: strings.ToLower(header.Get("name").String())}
+	if c.name == "" {
+		return c, errors.New("missing directives_header name")
+	}
+	var err error
+	header.Get("allowed").ForEach(func(_, value gjson.Result) bool {
+		if _, ok := directivesMap[value.String()]; !ok {
+			err = fmt.Errorf("directive map not found for directives_header: %q", value.String())
+			return false
+		}
+		if c.allowed == nil {
+			c.allowed = make(map[string]struct{})
+		}
+		c.allowed[value.String()] = struct{}{}
+		return true
+	})
+	if err != nil {
+		return c, err
+	}
+	if len(c.allowed) == 0 {
+		return c, errors.New("missing directives_header allowed rule sets")
+	}
+	return c, nil
+}
+
+func (c directivesHeaderConfig) enabled() bool {
+	return c.name != ""
+}
+
+// directives returns the rule set requested by the header of the request, empty if the
+// header is missing or requests a rule set not allowed.
+func (c directivesHeaderConfig) directives() string {
+	if !c.enabled() {
+		return ""
+	}
+	name, err := proxywasm.GetHttpRequestHeader(c.name)
+	if err != nil || name == "" {
+		return ""
+	}
+	if _, ok := c.allowed[name]; !ok {
+		proxywasm.LogDebugf("Ignoring rule set not allowed in header %s: %q", c.name, name)
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,227 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+const (
+	defaultStatusSignatureHeader = "x-coraza-status-signature"
+	// statusSignatureMaxSkew bounds the age of a signed status request to prevent replays.
+	statusSignatureMaxSkew = 5 * time.Minute
+)
+
+// statusEndpointConfig configures the authenticated status endpoint. Requests to path
+// are answered by the filter itself, provided that they carry a valid signature header
+// in the form "t=<unix timestamp>,sig=<hex HMAC-SHA256(secret, "<timestamp>:<path>")>".
+type statusEndpointConfig struct {
+	path   string
+	secret []byte
+	header string
+}
+
+func (c statusEndpointConfig) enabled() bool {
+	return c.path != ""
+}
+
+// verifyStatusSignature validates the signature header of a status request.
+func verifyStatusSignature(cfg statusEndpointConfig, path string, signature string, now time.Time) error {
+	var ts, sig string
+	for _, part := range strings.Split(signature, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "sig":
+			sig = v
+		}
+	}
+	if ts == "" || sig == "" {
+		return errors.New("malformed signature")
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("malformed signature timestamp")
+	}
+	if skew := now.Sub(time.Unix(unix, 0)); skew > statusSignatureMaxSkew || skew < -statusSignatureMaxSkew {
+		return errors.New("expired signature")
+	}
+
+	expected, err := hex.DecodeString(sig)
+	if err != nil {
+		return errors.New("malformed signature digest")
+	}
+
+	mac := hmac.New(sha256.New, cfg.secret)
+	mac.Write([]byte(ts + ":" + path))
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+type statusDocument struct {
+	RulesetVersion string   `json:"ruleset_version"`
+	UptimeSeconds  int64    `json:"uptime_seconds"`
+	RuleSets       []string `json:"rule_sets"`
+	// RuleEngines are the SecRuleEngine modes of the compiled rule sets, by name.
+	RuleEngines    map[string]string `json:"rule_engines"`
+	DefaultRuleSet string            `json:"default_rule_set,omitempty"`
+	// RemoteRulesSHA256 is the digest of the loaded remote rules bundle, if any.
+	RemoteRulesSHA256 string         `json:"remote_rules_sha256,omitempty"`
+	Counters          statusCounters `json:"counters"`
+	Heap              statusHeap     `json:"heap"`
+}
+
+type statusCounters struct {
+	Transactions  uint64 `json:"transactions"`
+	Interruptions uint64 `json:"interruptions"`
+	// LiveTransactions is the number of transactions not finished yet.
+	LiveTransactions uint64 `json:"live_transactions"`
+}
+
+type statusHeap struct {
+	Sys          uint64 `json:"sys"`
+	HeapSys      uint64 `json:"heap_sys"`
+	HeapIdle     uint64 `json:"heap_idle"`
+	HeapReleased uint64 `json:"heap_released"`
+	// FreeRatio is the share of the heap not in use: a high ratio on a VM running
+	// out of memory denotes a fragmented heap.
+	FreeRatio  float64 `json:"free_ratio"`
+	TotalAlloc uint64  `json:"total_alloc"`
+	Mallocs    uint64  `json:"mallocs"`
+	Frees      uint64  `json:"frees"`
+}
+
+// rulesetVersion identifies the loaded rule sets by hashing the plugin configuration and
+// the digest of the loaded remote rules bundle, if any.
+func rulesetVersion(config []byte, remoteRulesDigest string) string {
+	h := sha256.New()
+	h.Write(config)
+	h.Write([]byte(remoteRulesDigest))
+	return hex.EncodeToString(h.Sum(nil)[:6])
+}
+
+// pluginStatus holds the plugin details reported by the status endpoint.
+type pluginStatus struct {
+	startTime      time.Time
+	rawConfig      []byte
+	ruleSets       []string
+	defaultRuleSet string
+	// remoteRulesDigest is the digest of the loaded remote rules bundle, updated on refresh.
+	remoteRulesDigest string
+	metrics           *wafMetrics
+}
+
+func newPluginStatus(rawConfig []byte, config pluginConfiguration, metrics *wafMetrics, now time.Time) *pluginStatus {
+	ruleSets := make([]string, 0, len(config.directivesMap))
+	for name := range config.directivesMap {
+		ruleSets = append(ruleSets, name)
+	}
+	sort.Strings(ruleSets)
+
+	return &pluginStatus{
+		startTime:      now,
+		rawConfig:      rawConfig,
+		ruleSets:       ruleSets,
+		defaultRuleSet: config.defaultDirectives,
+		metrics:        metrics,
+	}
+}
+
+// ruleEngineModes returns the SecRuleEngine modes of the compiled rule sets, probed on a
+// transaction of each one.
+func ruleEngineModes(wafs wafMap) map[string]string {
+	modes := make(map[string]string, len(wafs.byName))
+	for name, waf := range wafs.byName {
+		tx := waf.NewTransaction()
+		switch {
+		case tx.IsRuleEngineOff():
+			modes[name] = "Off"
+		case enforcesInterruptions(tx):
+			modes[name] = "On"
+		default:
+			modes[name] = "DetectionOnly"
+		}
+		_ = tx.Close()
+	}
+	return modes
+}
+
+// document returns the status document, the rule engine modes being the ones of wafs.
+func (s *pluginStatus) document(now time.Time, wafs wafMap) ([]byte, error) {
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+	var freeRatio float64
+	if ms.HeapSys > 0 {
+		freeRatio = float64(ms.HeapIdle) / float64(ms.HeapSys)
+	}
+
+	return json.Marshal(statusDocument{
+		RulesetVersion:    rulesetVersion(s.rawConfig, s.remoteRulesDigest),
+		UptimeSeconds:     int64(now.Sub(s.startTime) / time.Second),
+		RuleSets:          s.ruleSets,
+		RuleEngines:       ruleEngineModes(wafs),
+		DefaultRuleSet:    s.defaultRuleSet,
+		RemoteRulesSHA256: s.remoteRulesDigest,
+		Counters: statusCounters{
+			Transactions:     s.metrics.txTotal,
+			Interruptions:    s.metrics.interruptionsTotal,
+			LiveTransactions: s.metrics.txLive,
+		},
+		Heap: statusHeap{
+			Sys:          ms.Sys,
+			HeapSys:      ms.HeapSys,
+			HeapIdle:     ms.HeapIdle,
+			HeapReleased: ms.HeapReleased,
+			FreeRatio:    freeRatio,
+			TotalAlloc:   ms.TotalAlloc,
+			Mallocs:      ms.Mallocs,
+			Frees:        ms.Frees,
+		},
+	})
+}
+
+// serveStatus answers a request to the status endpoint with the status document,
+// or with 401 if the request is not properly signed.
+func (ctx *httpContext) serveStatus(path string) types.Action {
+	signature, _ := proxywasm.GetHttpRequestHeader(ctx.statusEndpoint.header)
+	now := time.Now()
+	if err := verifyStatusSignature(ctx.statusEndpoint, path, signature, now); err != nil {
+		proxywasm.LogWarnf("Rejected status endpoint request: %v", err)
+		if err := proxywasm.SendHttpResponse(401, nil, nil, noGRPCStream); err != nil {
+			proxywasm.LogErrorf("Failed to send status endpoint response: %v", err)
+		}
+		return types.ActionPause
+	}
+
+	body, err := ctx.status.document(now, ctx.perAuthorityWAFs)
+	if err != nil {
+		proxywasm.LogErrorf("Failed to build status document: %v", err)
+		if err := proxywasm.SendHttpResponse(500, nil, nil, noGRPCStream); err != nil {
+			proxywasm.LogErrorf("Failed to send status endpoint response: %v", err)
+		}
+		return types.ActionPause
+	}
+
+	headers := [][2]string{{"content-type", "application/json"}, {"cache-control", "no-store"}}
+	if err := proxywasm.SendHttpResponse(200, headers, body, noGRPCStream); err != nil {
+		proxywasm.LogErrorf("Failed to send status endpoint response: %v", err)
+	}
+	return types.ActionPause
+}
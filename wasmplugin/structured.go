@@ -0,0 +1,123 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// parseStructuredRule compiles a rule given as a JSON object into SecLang, sparing the
+// escaping of multi-line SecLang embedded in JSON:
+//
+//	{
+//	  "id": 101,
+//	  "phase": 1,
+//	  "variables": ["REQUEST_URI", "ARGS:path"],
+//	  "operator": "@beginsWith /admin",
+//	  "actions": ["deny", "status:403", "msg:'Admin access'"],
+//	  "chain": {"variables": [...], "operator": "...", "actions": [...]}
+//	}
+//
+// A rule without variables nor operator compiles into a SecAction.
+func parseStructuredRule(rule gjson.Result) (string, error) {
+	id := rule.Get("id")
+	if id.Type != gjson.Number || id.Int() <= 0 || float64(id.Int()) != id.Num {
+		return "", fmt.Errorf("invalid rule id: %s", id.Raw)
+	}
+	actions := []string{"id:" + strconv.FormatInt(id.Int(), 10)}
+	if phase := rule.Get("phase"); phase.Exists() {
+		if p := phase.Int(); phase.Type != gjson.Number || p < 1 || p > 5 {
+			return "", fmt.Errorf("invalid phase of rule %d: %s", id.Int(), phase.Raw)
+		}
+		actions = append(actions, "phase:"+phase.String())
+	}
+
+	directive, err := structuredRuleDirective(rule, actions)
+	if err != nil {
+		return "", fmt.Errorf("invalid rule %d: %v", id.Int(), err)
+	}
+	return directive, nil
+}
+
+// structuredRuleDirective returns the directive of the rule, followed by the ones of its
+// chained rules, prefixing the given actions to the actions of the rule.
+func structuredRuleDirective(rule gjson.Result, actions []string) (string, error) {
+	for _, key := range []string{"variables", "operator", "actions"} {
+		if !rule.Get(key).Exists() {
+			continue
+		}
+		if key == "operator" && rule.Get(key).Type != gjson.String {
+			return "", errors.New("operator must be a string")
+		}
+		if key != "operator" && !rule.Get(key).IsArray() {
+			return "", fmt.Errorf("%s must be an array", key)
+		}
+	}
+
+	var variables []string
+	for _, v := range rule.Get("variables").Array() {
+		variables = append(variables, v.String())
+	}
+	operator := rule.Get("operator").String()
+	for _, a := range rule.Get("actions").Array() {
+		actions = append(actions, a.String())
+	}
+
+	chain := rule.Get("chain")
+	if chain.Exists() {
+		if !chain.IsObject() {
+			return "", errors.New("chain must be an object")
+		}
+		if chain.Get("id").Exists() || chain.Get("phase").Exists() {
+			return "", errors.New("chained rules cannot set id nor phase")
+		}
+		actions = append(actions, "chain")
+	}
+
+	for _, field := range append(append([]string{operator}, variables...), actions...) {
+		if strings.ContainsAny(field, "\r\n") {
+			return "", fmt.Errorf("unexpected line break: %q", field)
+		}
+	}
+
+	var directive string
+	switch {
+	case len(variables) == 0 && operator == "":
+		if chain.Exists() {
+			return "", errors.New("a SecAction cannot be chained")
+		}
+		directive = fmt.Sprintf("SecAction %s", quoteSecLang(strings.Join(actions, ",")))
+	case len(variables) == 0:
+		return "", errors.New("missing variables")
+	case operator == "":
+		return "", errors.New("missing operator")
+	default:
+		directive = fmt.Sprintf("SecRule %s %s", strings.Join(variables, "|"), quoteSecLang(operator))
+		if len(actions) > 0 {
+			directive += " " + quoteSecLang(strings.Join(actions, ","))
+		}
+	}
+
+	if chain.Exists() {
+		chained, err := structuredRuleDirective(chain, nil)
+		if err != nil {
+			return "", fmt.Errorf("chained rule: %v", err)
+		}
+		if strings.HasPrefix(chained, "SecAction") {
+			return "", errors.New("chained rule: missing variables and operator")
+		}
+		directive += "\n" + chained
+	}
+	return directive, nil
+}
+
+// quoteSecLang quotes an operator or a list of actions, escaping its double quotes.
+func quoteSecLang(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
@@ -0,0 +1,30 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+)
+
+// The prefixes of the TX variables holding the trailers, e.g. TX:response_trailer_grpc-status.
+// Coraza has no collection for the trailers, and the multiphase evaluation only evaluates
+// the header collections in the phases of the headers, before the trailers are received.
+const (
+	requestTrailerPrefix  = "request_trailer_"
+	responseTrailerPrefix = "response_trailer_"
+)
+
+// addTrailers adds the trailers to the TX variables of the transaction.
+func addTrailers(tx ctypes.Transaction, prefix string, trailers [][2]string) {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return
+	}
+	for _, t := range trailers {
+		state.Variables().TX().Add(prefix+strings.ToLower(t[0]), t[1])
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+	"github.com/tidwall/gjson"
+
+	"github.com/corazawaf/coraza-proxy-wasm/internal/hostadapter"
+)
+
+const (
+	uniqueIDUUIDv4    = "uuidv4"
+	uniqueIDUUIDv7    = "uuidv7"
+	uniqueIDSnowflake = "snowflake"
+)
+
+// snowflakeMaxNodeID is the highest node ID fitting the 10 bits reserved to it.
+const snowflakeMaxNodeID = 1<<10 - 1
+
+// uniqueIDConfig configures the generator of the transaction IDs, exposed as the
+// UNIQUE_ID variable and reported by the audit logs and the verdicts. Coraza generates
+// random IDs when no generator is set.
+type uniqueIDConfig struct {
+	generator string
+	// nodeID is the base of the snowflake node IDs, derived from the host node ID property
+	// if unset (-1). Each VM of the proxy (e.g. each Envoy worker) adds its own index to it.
+	nodeID int64
+}
+
+func parseUniqueID(uniqueID gjson.Result) (uniqueIDConfig, error) {
+	config := uniqueIDConfig{generator: uniqueID.Get("generator").String(), nodeID: -1}
+	switch config.generator {
+	case uniqueIDUUIDv4, uniqueIDUUIDv7, uniqueIDSnowflake:
+	default:
+		return config, fmt.Errorf("unsupported unique_id generator: %q", config.generator)
+	}
+
+	if nodeID := uniqueID.Get("node_id"); nodeID.Exists() {
+		if config.generator != uniqueIDSnowflake {
+			return config, fmt.Errorf("unique_id node_id is only supported by the snowflake generator, got %q", config.generator)
+		}
+		if n := nodeID.Int(); n < 0 || n > snowflakeMaxNodeID {
+			return config, fmt.Errorf("unique_id node_id must be between 0 and %d: %s", snowflakeMaxNodeID, nodeID.Raw)
+		}
+		config.nodeID = nodeID.Int()
+	}
+	return config, nil
+}
+
+// newGenerator returns the function generating the transaction IDs, nil if Coraza
+// generates them. sharedData tells whether the VMs of the proxy can coordinate through
+// shared data to get distinct snowflake node IDs.
+func (c uniqueIDConfig) newGenerator(host hostadapter.Adapter, sharedData bool) func() string {
+	switch c.generator {
+	case uniqueIDUUIDv4:
+		return newUUIDv4
+	case uniqueIDUUIDv7:
+		return func() string { return newUUIDv7(time.Now()) }
+	case uniqueIDSnowflake:
+		nodeID := c.nodeID
+		if nodeID < 0 {
+			nodeID = snowflakeNodeID(host)
+		}
+		if sharedData {
+			nodeID = (nodeID + allocateVMIndex()) & snowflakeMaxNodeID
+		}
+		return newSnowflake(nodeID, time.Now).next
+	default:
+		return nil
+	}
+}
+
+// snowflakeNodeID derives the node ID from the host node ID property, falling back to
+// a random one if the host does not expose it.
+func snowflakeNodeID(host hostadapter.Adapter) int64 {
+	id, err := hostadapter.GetProperty(host, hostadapter.NodeID)
+	if err != nil || len(id) == 0 {
+		nodeID := rand.Int63n(snowflakeMaxNodeID + 1)
+		proxywasm.LogWarnf("Failed to get the node ID, using the random snowflake node ID %d", nodeID)
+		return nodeID
+	}
+	h := fnv.New32a()
+	h.Write(id)
+	return int64(h.Sum32() % (snowflakeMaxNodeID + 1))
+}
+
+// snowflakeVMIndexKey is the shared data key of the counter handing out the VM indexes.
+const snowflakeVMIndexKey = "coraza.snowflake.vm_index"
+
+// allocateVMIndex returns an index distinct from the ones of the other VMs of the proxy,
+// falling back to 0 if the shared data is not available.
+func allocateVMIndex() int64 {
+	// Retry a few times on CAS mismatches, i.e. on VMs starting concurrently
+	for i := 0; i < 10; i++ {
+		data, cas, err := proxywasm.GetSharedData(snowflakeVMIndexKey)
+		if err != nil && !errors.Is(err, types.ErrorStatusNotFound) {
+			break
+		}
+		var index uint64
+		if len(data) == 8 {
+			index = binary.LittleEndian.Uint64(data)
+		}
+		next := make([]byte, 8)
+		binary.LittleEndian.PutUint64(next, index+1)
+		err = proxywasm.SetSharedData(snowflakeVMIndexKey, next, cas)
+		if err == nil {
+			return int64(index & snowflakeMaxNodeID)
+		}
+		if !errors.Is(err, types.ErrorStatusCasMismatch) {
+			break
+		}
+	}
+	proxywasm.LogWarn("Failed to allocate the snowflake VM index, IDs generated by the VMs of the proxy may collide")
+	return 0
+}
+
+func randomBytes(b []byte) {
+	if _, err := crand.Read(b); err != nil {
+		// Host not providing randomness, the math/rand generator is good enough
+		// as long as the IDs are not used as secrets.
+		for i := range b {
+			b[i] = byte(rand.Intn(256))
+		}
+	}
+}
+
+func newUUIDv4() string {
+	var u [16]byte
+	randomBytes(u[:])
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return formatUUID(u)
+}
+
+// newUUIDv7 returns a UUID prefixed by the unix time in milliseconds, hence
+// sortable by time, see RFC 9562.
+func newUUIDv7(now time.Time) string {
+	var u [16]byte
+	randomBytes(u[6:])
+	ms := uint64(now.UnixMilli())
+	u[0], u[1], u[2], u[3], u[4], u[5] = byte(ms>>40), byte(ms>>32), byte(ms>>24), byte(ms>>16), byte(ms>>8), byte(ms)
+	u[6] = u[6]&0x0f | 0x70
+	u[8] = u[8]&0x3f | 0x80
+	return formatUUID(u)
+}
+
+func formatUUID(u [16]byte) string {
+	var b [36]byte
+	hex.Encode(b[0:8], u[0:4])
+	b[8] = '-'
+	hex.Encode(b[9:13], u[4:6])
+	b[13] = '-'
+	hex.Encode(b[14:18], u[6:8])
+	b[18] = '-'
+	hex.Encode(b[19:23], u[8:10])
+	b[23] = '-'
+	hex.Encode(b[24:], u[10:])
+	return string(b[:])
+}
+
+// snowflakeEpoch is the origin of the snowflake timestamps.
+var snowflakeEpoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// snowflake generates 63 bits IDs made of 41 bits of milliseconds since snowflakeEpoch,
+// 10 bits of node ID and 12 bits of sequence. IDs generated by the same node (the VM)
+// are increasing, IDs of nodes with distinct node IDs never collide.
+type snowflake struct {
+	nodeID   int64
+	now      func() time.Time
+	lastTime int64
+	sequence int64
+}
+
+func newSnowflake(nodeID int64, now func() time.Time) *snowflake {
+	return &snowflake{nodeID: nodeID, now: now}
+}
+
+func (s *snowflake) next() string {
+	ts := s.now().Sub(snowflakeEpoch).Milliseconds()
+	if ts <= s.lastTime {
+		// Same millisecond or clock going backwards, keep increasing from the last timestamp
+		ts = s.lastTime
+		s.sequence = (s.sequence + 1) & 0xfff
+		if s.sequence == 0 {
+			// Sequence exhausted, borrow the next millisecond
+			ts++
+		}
+	} else {
+		s.sequence = 0
+	}
+	s.lastTime = ts
+
+	return strconv.FormatInt(ts<<22|s.nodeID<<12|s.sequence, 10)
+}
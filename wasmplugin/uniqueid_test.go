@@ -0,0 +1,53 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUUIDs(t *testing.T) {
+	require.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, newUUIDv4())
+
+	now := time.UnixMilli(0x0123456789ab)
+	id := newUUIDv7(now)
+	require.Regexp(t, `^01234567-89ab-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, id)
+	// IDs sort by time
+	require.Less(t, id, newUUIDv7(now.Add(time.Millisecond)))
+}
+
+func TestSnowflake(t *testing.T) {
+	now := snowflakeEpoch.Add(time.Second)
+	s := newSnowflake(5, func() time.Time { return now })
+
+	parse := func(id string) (ts int64, nodeID int64, sequence int64) {
+		n, err := strconv.ParseInt(id, 10, 64)
+		require.NoError(t, err)
+		return n >> 22, n >> 12 & 0x3ff, n & 0xfff
+	}
+
+	ts, nodeID, sequence := parse(s.next())
+	require.Equal(t, int64(1000), ts)
+	require.Equal(t, int64(5), nodeID)
+	require.Equal(t, int64(0), sequence)
+
+	_, _, sequence = parse(s.next())
+	require.Equal(t, int64(1), sequence)
+
+	// The sequence is exhausted, the next millisecond is borrowed
+	s.sequence = 0xfff
+	ts, _, sequence = parse(s.next())
+	require.Equal(t, int64(1001), ts)
+	require.Equal(t, int64(0), sequence)
+
+	// The clock going backwards does not break the ordering
+	now = now.Add(-time.Second)
+	ts, _, sequence = parse(s.next())
+	require.Equal(t, int64(1001), ts)
+	require.Equal(t, int64(1), sequence)
+}
@@ -0,0 +1,177 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tidwall/gjson"
+)
+
+// urlencodedNestedFieldsVar is the TX variable enabling the parsing of the nested fields by the
+// urlencoded body processor, set from the urlencoded configuration or by the rules of phase 1.
+const urlencodedNestedFieldsVar = "urlencoded_nested_fields"
+
+func init() {
+	// Replaces the urlencoded body processor of Coraza
+	plugins.RegisterBodyProcessor("urlencoded", func() plugintypes.BodyProcessor {
+		return urlencodedBodyProcessor{}
+	})
+}
+
+// urlencodedConfig configures the parsing of the urlencoded request bodies.
+type urlencodedConfig struct {
+	// nestedFields names the fields as PHP resolves them, e.g. a[b][] as a[b][0].
+	nestedFields bool
+}
+
+func parseURLEncoded(urlencoded gjson.Result) (urlencodedConfig, error) {
+	var c urlencodedConfig
+	if nestedFields := urlencoded.Get("nested_fields"); nestedFields.Exists() {
+		if !nestedFields.IsBool() {
+			return c, fmt.Errorf("invalid urlencoded nested_fields: %s", nestedFields.Raw)
+		}
+		c.nestedFields = nestedFields.Bool()
+	}
+	return c, nil
+}
+
+// setURLEncodedOptions sets the options of the urlencoded body processor for the transaction.
+func setURLEncodedOptions(tx ctypes.Transaction, c urlencodedConfig) {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return
+	}
+	if c.nestedFields {
+		state.Variables().TX().Set(urlencodedNestedFieldsVar, []string{"1"})
+	}
+}
+
+// urlencodedBodyProcessor populates the same variables as the urlencoded body processor of
+// Coraza. With TX:urlencoded_nested_fields, the names of the fields are the ones PHP resolves:
+// the nested fields have their appended indices numbered, a[b][]=x&a[b][]=y adding a[b][0]
+// and a[b][1], and the names are normalized, a.b and a[b standing for a_b.
+type urlencodedBodyProcessor struct{}
+
+func (urlencodedBodyProcessor) ProcessRequest(reader io.Reader, v plugintypes.TransactionVariables, _ plugintypes.BodyProcessorOptions) error {
+	var s strings.Builder
+	if _, err := io.Copy(&s, reader); err != nil {
+		return err
+	}
+	body := s.String()
+
+	var indices map[string]int
+	if firstValue(v.TX(), urlencodedNestedFieldsVar) == "1" {
+		indices = map[string]int{}
+	}
+	for query := body; query != ""; {
+		var field string
+		field, query, _ = strings.Cut(query, "&")
+		if field == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(field, "=")
+		name = queryUnescape(name)
+		if indices != nil {
+			if name = phpFieldName(name, indices); name == "" {
+				continue
+			}
+		}
+		v.ArgsPost().Add(name, queryUnescape(value))
+	}
+
+	if s, ok := v.RequestBody().(interface{ Set(string) }); ok {
+		s.Set(body)
+	}
+	if s, ok := v.RequestBodyLength().(interface{ Set(string) }); ok {
+		s.Set(strconv.Itoa(len(body)))
+	}
+	return nil
+}
+
+func (urlencodedBodyProcessor) ProcessResponse(io.Reader, plugintypes.TransactionVariables, plugintypes.BodyProcessorOptions) error {
+	return nil
+}
+
+// phpNameReplacer replaces the characters PHP does not allow in the names of the fields.
+var phpNameReplacer = strings.NewReplacer(".", "_", " ", "_")
+
+// phpFieldName returns the name PHP resolves for the field, or an empty name if PHP ignores
+// the field. indices holds the next index appended to each array, keyed by its name.
+func phpFieldName(name string, indices map[string]int) string {
+	name = strings.TrimLeft(name, " ")
+	base, rest, nested := strings.Cut(name, "[")
+	if base == "" {
+		return ""
+	}
+	base = phpNameReplacer.Replace(base)
+	if nested && !strings.Contains(rest, "]") {
+		// Not an index, the bracket is replaced as well
+		base, nested = base+"_"+rest, false
+	}
+
+	var b strings.Builder
+	b.WriteString(base)
+	for nested {
+		index, after, closed := strings.Cut(rest, "]")
+		if !closed {
+			// The unterminated indices are ignored
+			break
+		}
+		parent := b.String()
+		if index == "" {
+			index = strconv.Itoa(indices[parent])
+			indices[parent]++
+		} else if n, err := strconv.Atoi(index); err == nil && strconv.Itoa(n) == index && n >= indices[parent] {
+			indices[parent] = n + 1
+		}
+		b.WriteByte('[')
+		b.WriteString(index)
+		b.WriteByte(']')
+		// Anything following the indices is ignored
+		rest, nested = strings.CutPrefix(after, "[")
+	}
+	return b.String()
+}
+
+// queryUnescape decodes the field as Coraza does, the invalid escapes being kept.
+func queryUnescape(s string) string {
+	if !strings.ContainsAny(s, "%+") {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '+':
+			b.WriteByte(' ')
+		case c == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c >= 'a':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
@@ -0,0 +1,71 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/stretchr/testify/require"
+)
+
+func TestURLEncodedBodyProcessor(t *testing.T) {
+	body := "a[b][]=x&a[b][]=y&a[b][5]=z&a[b][]=w&user.name=pooh&x[y=1&%20pad[c]=2&list[0][k]=v&m[a]junk=3&[]=4&q=%27%2B+%zz"
+	tests := []struct {
+		name     string
+		config   urlencodedConfig
+		expected map[string][]string
+	}{
+		{
+			name: "raw names",
+			expected: map[string][]string{
+				"a[b][]":     {"x", "y", "w"},
+				"a[b][5]":    {"z"},
+				"user.name":  {"pooh"},
+				"x[y":        {"1"},
+				" pad[c]":    {"2"},
+				"list[0][k]": {"v"},
+				"m[a]junk":   {"3"},
+				"[]":         {"4"},
+				"q":          {"'+ %zz"},
+			},
+		},
+		{
+			name:   "nested fields",
+			config: urlencodedConfig{nestedFields: true},
+			expected: map[string][]string{
+				"a[b][0]":    {"x"},
+				"a[b][1]":    {"y"},
+				"a[b][5]":    {"z"},
+				"a[b][6]":    {"w"},
+				"user_name":  {"pooh"},
+				"x_y":        {"1"},
+				"pad[c]":     {"2"},
+				"list[0][k]": {"v"},
+				"m[a]":       {"3"},
+				"q":          {"'+ %zz"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waf, err := coraza.NewWAF(coraza.NewWAFConfig())
+			require.NoError(t, err)
+			tx := waf.NewTransaction()
+			setURLEncodedOptions(tx, tt.config)
+			v := tx.(plugintypes.TransactionState).Variables()
+
+			require.NoError(t, urlencodedBodyProcessor{}.ProcessRequest(strings.NewReader(body), v, plugintypes.BodyProcessorOptions{}))
+
+			args := map[string][]string{}
+			for _, arg := range v.ArgsPost().FindAll() {
+				args[arg.Key()] = append(args[arg.Key()], arg.Value())
+			}
+			require.Equal(t, tt.expected, args)
+			require.Equal(t, body, v.RequestBody().Get())
+		})
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3"
+)
+
+var ruleIDRegex = regexp.MustCompile(`\bid:['"]?(\d+)`)
+
+// directivesError is an error of a rule set, located by the entry of directives_map and the
+// line of the entry failing to compile.
+type directivesError struct {
+	directives string
+	// entry is the index of the failing entry, -1 if unknown.
+	entry int
+	// line is the line of the entry, starting from 1.
+	line int
+	// ruleID is the ID of the failing rule, 0 if unknown.
+	ruleID int
+	err    error
+}
+
+func (e directivesError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "invalid directives %q", e.directives)
+	if e.entry >= 0 {
+		fmt.Fprintf(&sb, ", entry %d, line %d", e.entry, e.line)
+	}
+	if e.ruleID > 0 {
+		fmt.Fprintf(&sb, ", rule %d", e.ruleID)
+	}
+	fmt.Fprintf(&sb, ": %v", e.err)
+	return sb.String()
+}
+
+// validateDirectives compiles every rule set of the configuration, referenced or not, and
+// returns the errors of all the rule sets failing to compile.
+func validateDirectives(directivesMap DirectivesMap, crsVersions map[string]string, rootFS fs.FS) []directivesError {
+	names := make([]string, 0, len(directivesMap))
+	for name := range directivesMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []directivesError
+	for _, name := range names {
+		ruleSetFS := crsRootFS(rootFS, crsVersions, name)
+		if err := compileDirectives(directivesMap[name], ruleSetFS); err != nil {
+			errs = append(errs, locateDirectivesError(name, directivesMap[name], ruleSetFS, err))
+		}
+	}
+	return errs
+}
+
+func compileDirectives(directives []string, rootFS fs.FS) error {
+	_, err := coraza.NewWAF(coraza.NewWAFConfig().
+		WithRootFS(rootFS).
+		WithDirectives(strings.Join(directives, "\n")))
+	return err
+}
+
+// locateDirectivesError finds the entry, then the line of the entry, whose addition makes
+// the rule set fail to compile, Coraza not reporting where the errors are.
+func locateDirectivesError(name string, directives []string, rootFS fs.FS, err error) directivesError {
+	dErr := directivesError{directives: name, entry: -1, err: trimCorazaError(err)}
+
+	entry := sort.Search(len(directives), func(i int) bool {
+		return compileDirectives(directives[:i+1], rootFS) != nil
+	})
+	if entry == len(directives) {
+		return dErr
+	}
+
+	// Lines continued with a backslash are only compiled along with the following ones
+	var (
+		lines      []string
+		firstLines []int
+		current    strings.Builder
+		first      = 1
+	)
+	for i, l := range strings.Split(directives[entry], "\n") {
+		current.WriteString(l)
+		if strings.HasSuffix(strings.TrimRight(l, " \t\r"), "\\") {
+			current.WriteString("\n")
+			continue
+		}
+		lines = append(lines, current.String())
+		firstLines = append(firstLines, first)
+		current.Reset()
+		first = i + 2
+	}
+	if current.Len() > 0 {
+		lines = append(lines, current.String())
+		firstLines = append(firstLines, first)
+	}
+
+	prefix := append([]string{}, directives[:entry]...)
+	line := sort.Search(len(lines), func(i int) bool {
+		return compileDirectives(append(prefix, strings.Join(lines[:i+1], "\n")), rootFS) != nil
+	})
+	dErr.entry = entry
+	dErr.line = 1
+	if line < len(lines) {
+		dErr.line = firstLines[line]
+		if m := ruleIDRegex.FindStringSubmatch(lines[line]); m != nil {
+			dErr.ruleID, _ = strconv.Atoi(m[1])
+		}
+	}
+	return dErr
+}
+
+// trimCorazaError removes the context Coraza prefixes the parsing errors with.
+func trimCorazaError(err error) error {
+	msg := err.Error()
+	for _, prefix := range []string{"invalid WAF config from string: ", "failed to parse string: "} {
+		msg = strings.TrimPrefix(msg, prefix)
+	}
+	return errors.New(msg)
+}
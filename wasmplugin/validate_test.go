@@ -0,0 +1,42 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateDirectives(t *testing.T) {
+	rootFS := fstest.MapFS{
+		"invalid.conf": {Data: []byte("SecRuleEngine On\nSecRule ARGS \"@rx (\" \"id:300,deny\"")},
+	}
+
+	errs := validateDirectives(DirectivesMap{
+		"valid": {"SecRuleEngine On", `SecRule ARGS "@rx foo" "id:100,phase:1,deny"`},
+		"unknown operator": {
+			"SecRuleEngine On",
+			"SecRule ARGS \"@rx foo\" \\\n  \"id:100,phase:1,deny\"\nSecRule ARGS \\\n  \"@foo bar\" \\\n  \"id:101,phase:1,deny\"",
+		},
+		"duplicated id": {
+			`SecRule ARGS "@rx foo" "id:200,deny"`,
+			`SecRule ARGS "@rx bar" "id:200,deny"`,
+		},
+		"invalid include":   {"SecRuleEngine On", "Include invalid.conf"},
+		"unknown directive": {"SecFoo bar"},
+	}, nil, rootFS)
+
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	require.Equal(t, []string{
+		`invalid directives "duplicated id", entry 1, line 1, rule 200: failed to compile the directive "secrule": there is a another rule with id 200`,
+		`invalid directives "invalid include", entry 1, line 1: failed to compile the directive "secrule": error parsing regexp: missing closing ): ` + "`(?sm)(`",
+		`invalid directives "unknown directive", entry 0, line 1: unknown directive "secfoo"`,
+		`invalid directives "unknown operator", entry 1, line 3, rule 101: failed to compile the directive "secrule": operator foo not found`,
+	}, messages)
+}
@@ -0,0 +1,215 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+)
+
+const defaultVerdictHeaderName = "x-coraza-verdict"
+
+// verdictHeaderConfig configures the compact verdict header, e.g.
+// "x-coraza-verdict: block;950100,942100;score=15", meant to be picked up by
+// access logs of the upstream (request) or of the downstream (response).
+type verdictHeaderConfig struct {
+	name     string
+	request  bool
+	response bool
+}
+
+func (c verdictHeaderConfig) enabled() bool {
+	return c.request || c.response
+}
+
+func parseVerdictHeaderTarget(target string) (request bool, response bool, err error) {
+	switch target {
+	case "request":
+		return true, false, nil
+	case "response", "":
+		return false, true, nil
+	case "both":
+		return true, true, nil
+	default:
+		return false, false, fmt.Errorf("unsupported verdict header target: %q", target)
+	}
+}
+
+// loggedRule is implemented by the matched rules returned by Coraza, it allows to
+// leave out of the verdict rules that are not meant to be logged (e.g. CRS initialization rules)
+// unless they are the ones that interrupted the transaction.
+type loggedRule interface {
+	Log() bool
+}
+
+// anomalyScoreVariables are the CRS variables holding the anomaly score that
+// contributes to the blocking decision.
+var anomalyScoreVariables = []string{"blocking_inbound_anomaly_score", "blocking_outbound_anomaly_score"}
+
+// buildVerdict renders the outcome of the transaction so far as
+// "<outcome>[;<rule ids>][;score=<anomaly score>]". The outcome is "block" if the
+// transaction has been interrupted, "detect" if logged rules matched and "pass" otherwise.
+func buildVerdict(tx ctypes.Transaction) string {
+	ids := matchedRuleIDs(tx)
+
+	var sb strings.Builder
+	switch {
+	case tx.IsInterrupted():
+		sb.WriteString("block")
+	case len(ids) > 0:
+		sb.WriteString("detect")
+	default:
+		sb.WriteString("pass")
+	}
+
+	for i, id := range ids {
+		if i == 0 {
+			sb.WriteByte(';')
+		} else {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.Itoa(id))
+	}
+
+	if score, ok := anomalyScore(tx); ok {
+		sb.WriteString(";score=")
+		sb.WriteString(strconv.Itoa(score))
+	}
+
+	return sb.String()
+}
+
+// matchedRuleIDs returns the IDs of the logged rules that matched so far, and of the
+// interrupting one.
+func matchedRuleIDs(tx ctypes.Transaction) []int {
+	interruptingRuleID := 0
+	if interruption := tx.Interruption(); interruption != nil {
+		interruptingRuleID = interruption.RuleID
+	}
+
+	var ids []int
+	seen := map[int]struct{}{}
+	for _, mr := range tx.MatchedRules() {
+		id := mr.Rule().ID()
+		if lr, ok := mr.(loggedRule); ok && !lr.Log() && id != interruptingRuleID {
+			continue
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// anomalyScore returns the CRS blocking anomaly score of the transaction, if any.
+func anomalyScore(tx ctypes.Transaction) (int, bool) {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok {
+		return 0, false
+	}
+
+	var (
+		score int
+		found bool
+	)
+	txVars := state.Variables().TX()
+	for _, name := range anomalyScoreVariables {
+		for _, v := range txVars.Get(name) {
+			if n, err := strconv.Atoi(v); err == nil {
+				score += n
+				found = true
+			}
+		}
+	}
+	return score, found
+}
+
+// verdictContractVersion versions the verdict document, shared with the other Coraza
+// connectors so that downstream automation does not depend on the connector in front.
+const verdictContractVersion = "coraza.verdict/v1"
+
+// verdictContractConfig configures where the verdict document is emitted once the
+// transaction is over.
+type verdictContractConfig struct {
+	// log emits the document as an info log prefixed by "coraza-verdict: ".
+	log bool
+	// filterState stores the document as the coraza_verdict filter state object
+	// (wasm.coraza_verdict in Envoy), e.g. to be picked up by access logs.
+	filterState bool
+}
+
+func (c verdictContractConfig) enabled() bool {
+	return c.log || c.filterState
+}
+
+type verdictDocument struct {
+	Version       string `json:"version"`
+	Connector     string `json:"connector"`
+	TransactionID string `json:"transaction_id"`
+	// Action is "block", "detect" or "pass", as in the verdict header.
+	Action       string `json:"action"`
+	Status       int    `json:"status,omitempty"`
+	Phase        string `json:"phase,omitempty"`
+	RuleIDs      []int  `json:"rule_ids"`
+	AnomalyScore *int   `json:"anomaly_score,omitempty"`
+	// SkippedPhases are the phases whose rules were skipped, the evaluation deadline
+	// being exceeded.
+	SkippedPhases []string `json:"skipped_phases,omitempty"`
+}
+
+func buildVerdictDocument(tx ctypes.Transaction, interruptedAt interruptionPhase, skippedPhases []string) verdictDocument {
+	doc := verdictDocument{
+		Version:       verdictContractVersion,
+		Connector:     "coraza-proxy-wasm",
+		TransactionID: tx.ID(),
+		Action:        "pass",
+		RuleIDs:       matchedRuleIDs(tx),
+		SkippedPhases: skippedPhases,
+	}
+	if doc.RuleIDs == nil {
+		doc.RuleIDs = []int{}
+	}
+	if len(doc.RuleIDs) > 0 {
+		doc.Action = "detect"
+	}
+	if tx.IsInterrupted() {
+		doc.Action = "block"
+		doc.Status = tx.Interruption().Status
+		if doc.Status == 0 {
+			doc.Status = defaultInterruptionStatusCode
+		}
+		if interruptedAt.isInterrupted() {
+			doc.Phase = interruptedAt.String()
+		}
+	}
+	if score, ok := anomalyScore(tx); ok {
+		doc.AnomalyScore = &score
+	}
+	return doc
+}
+
+// publishVerdict emits the verdict document of the finished transaction.
+func (c verdictContractConfig) publishVerdict(tx ctypes.Transaction, interruptedAt interruptionPhase, skippedPhases []string) {
+	doc, err := json.Marshal(buildVerdictDocument(tx, interruptedAt, skippedPhases))
+	if err != nil {
+		proxywasm.LogErrorf("Failed to marshal verdict: %v", err)
+		return
+	}
+	if c.log {
+		proxywasm.LogInfof("coraza-verdict: %s", doc)
+	}
+	if c.filterState {
+		if err := proxywasm.SetProperty([]string{"coraza_verdict"}, doc); err != nil {
+			proxywasm.LogErrorf("Failed to set verdict filter state: %v", err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"strconv"
+
+	"github.com/corazawaf/coraza/v3"
+)
+
+// warmupRequest is a benign synthetic request run through the rule sets at plugin start.
+type warmupRequest struct {
+	method      string
+	uri         string
+	contentType string
+	body        string
+}
+
+// warmupRequests cover every phase and request body processor, so that the code paths,
+// caches and heap are exercised before the first real request.
+var warmupRequests = []warmupRequest{
+	{method: "GET", uri: "/warmup?page=1&sort=name"},
+	{method: "POST", uri: "/warmup", contentType: "application/x-www-form-urlencoded", body: "name=warmup&quantity=1"},
+	{method: "POST", uri: "/warmup", contentType: "application/json", body: `{"name":"warmup","items":[1,2,3]}`},
+	{method: "POST", uri: "/warmup", contentType: "text/xml", body: "<warmup><name>warmup</name></warmup>"},
+	{
+		method:      "POST",
+		uri:         "/warmup",
+		contentType: "multipart/form-data; boundary=warmup",
+		body:        "--warmup\r\nContent-Disposition: form-data; name=\"name\"\r\n\r\nwarmup\r\n--warmup--\r\n",
+	},
+}
+
+const warmupResponseBody = `{"status":"ok"}`
+
+// warmUp runs the synthetic requests through the WAF, processing all the phases.
+func warmUp(waf coraza.WAF) {
+	for _, r := range warmupRequests {
+		tx := waf.NewTransaction()
+		tx.ProcessConnection("127.0.0.1", 32000, "127.0.0.1", 8080)
+		tx.ProcessURI(r.uri, r.method, "HTTP/1.1")
+		tx.AddRequestHeader("Host", "warmup.local")
+		tx.AddRequestHeader("User-Agent", "coraza-warmup")
+		tx.AddRequestHeader("Accept", "*/*")
+		if r.contentType != "" {
+			tx.AddRequestHeader("Content-Type", r.contentType)
+			tx.AddRequestHeader("Content-Length", strconv.Itoa(len(r.body)))
+		}
+		if tx.ProcessRequestHeaders() == nil {
+			if r.body != "" && tx.IsRequestBodyAccessible() {
+				_, _, _ = tx.WriteRequestBody([]byte(r.body))
+			}
+			if it, err := tx.ProcessRequestBody(); it == nil && err == nil {
+				tx.AddResponseHeader("Content-Type", "application/json")
+				tx.AddResponseHeader("Content-Length", strconv.Itoa(len(warmupResponseBody)))
+				if tx.ProcessResponseHeaders(200, "HTTP/1.1") == nil {
+					if tx.IsResponseBodyAccessible() && tx.IsResponseBodyProcessable() {
+						_, _, _ = tx.WriteResponseBody([]byte(warmupResponseBody))
+					}
+					_, _ = tx.ProcessResponseBody()
+				}
+			}
+		}
+		tx.ProcessLogging()
+		_ = tx.Close()
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+)
+
+func init() {
+	// Replaces the XML body processor of Coraza
+	plugins.RegisterBodyProcessor("xml", func() plugintypes.BodyProcessor {
+		return xmlBodyProcessor{}
+	})
+}
+
+// errXMLEntity is returned for the bodies declaring entities, which could be expanded into
+// payloads out of sight of the rules or exhaust the VM memory.
+var errXMLEntity = errors.New("XML entity declarations are not allowed")
+
+// The limits of the XML bodies when the JSON ones are not set, the keys of the values growing
+// with the depth of their element.
+const (
+	xmlDefaultMaxDepth  = 64
+	xmlDefaultMaxValues = 10000
+)
+
+// xmlBodyProcessor populates the XML variable as Coraza does, with the text contents under
+// XML:/* and the attribute values under XML://@*, along with the keys of the XPath expressions
+// addressing each element and attribute: the absolute paths, e.g. XML:/Envelope/Body/login/user
+// and XML:/Envelope/Body/login/@id, and the descendant ones, e.g. XML://user and XML://@id.
+// Rules look the keys up literally, the XPath expressions are not evaluated. The namespace
+// prefixes are dropped from the names. The bodies deeper or with more values than the limits
+// of the JSON bodies are reported as errors.
+type xmlBodyProcessor struct{}
+
+func (xmlBodyProcessor) ProcessRequest(reader io.Reader, v plugintypes.TransactionVariables, _ plugintypes.BodyProcessorOptions) error {
+	maxDepth := txLimit(v, jsonMaxDepthVar)
+	if maxDepth == 0 {
+		maxDepth = xmlDefaultMaxDepth
+	}
+	maxValues := txLimit(v, jsonMaxElementsVar)
+	if maxValues == 0 {
+		maxValues = xmlDefaultMaxValues
+	}
+	values, err := readXMLPaths(reader, maxDepth, maxValues)
+	if err != nil {
+		return err
+	}
+	col := v.RequestXML()
+	for _, kv := range values {
+		col.Add(kv[0], kv[1])
+	}
+	return nil
+}
+
+func (xmlBodyProcessor) ProcessResponse(io.Reader, plugintypes.TransactionVariables, plugintypes.BodyProcessorOptions) error {
+	return nil
+}
+
+// readXMLPaths returns the text contents and attribute values of the document, in order,
+// each one under all the keys addressing it. The document is rejected past maxDepth nested
+// elements or maxValues text contents and attribute values.
+func readXMLPaths(reader io.Reader, maxDepth, maxValues int) ([][2]string, error) {
+	dec := xml.NewDecoder(reader)
+	dec.Strict = false
+	dec.AutoClose = xml.HTMLAutoClose
+	dec.Entity = xml.HTMLEntity
+
+	var (
+		values [][2]string
+		count  int
+		// names and paths are the stacks of the open elements, the path of an element being
+		// built once and shared by its values
+		names []string
+		paths []string
+	)
+	addValue := func(kvs ...[2]string) error {
+		if count++; count > maxValues {
+			return fmt.Errorf("XML body has more than %d values", maxValues)
+		}
+		values = append(values, kvs...)
+		return nil
+	}
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tok := token.(type) {
+		case xml.Directive:
+			if bytes.Contains(tok, []byte("ENTITY")) {
+				return nil, errXMLEntity
+			}
+		case xml.StartElement:
+			if len(names) >= maxDepth {
+				return nil, fmt.Errorf("XML body nested deeper than %d elements", maxDepth)
+			}
+			elementPath := "/" + tok.Name.Local
+			if len(paths) > 0 {
+				elementPath = paths[len(paths)-1] + elementPath
+			}
+			names = append(names, tok.Name.Local)
+			paths = append(paths, elementPath)
+			for _, attr := range tok.Attr {
+				err := addValue(
+					[2]string{"//@*", attr.Value},
+					[2]string{elementPath + "/@" + attr.Name.Local, attr.Value},
+					[2]string{"//@" + attr.Name.Local, attr.Value},
+				)
+				if err != nil {
+					return nil, err
+				}
+			}
+		case xml.EndElement:
+			if len(names) > 0 {
+				names = names[:len(names)-1]
+				paths = paths[:len(paths)-1]
+			}
+		case xml.CharData:
+			c := strings.TrimSpace(string(tok))
+			if c == "" {
+				continue
+			}
+			kvs := [][2]string{{"/*", c}}
+			if len(names) > 0 {
+				kvs = append(kvs,
+					[2]string{paths[len(paths)-1], c},
+					[2]string{"//" + names[len(names)-1], c},
+				)
+			}
+			if err := addValue(kvs...); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
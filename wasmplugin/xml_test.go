@@ -0,0 +1,65 @@
+// Copyright The OWASP Coraza contributors
+// SPDX-License-Identifier: Apache-2.0
+
+package wasmplugin
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadXMLPaths(t *testing.T) {
+	body := `<?xml version="1.0"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+  <soap:Body>
+    <login id="7"><user>pooh</user><pass>honey</pass></login>
+  </soap:Body>
+</soap:Envelope>`
+
+	values, err := readXMLPaths(strings.NewReader(body), xmlDefaultMaxDepth, xmlDefaultMaxValues)
+	require.NoError(t, err)
+	require.Equal(t, [][2]string{
+		{"//@*", "http://schemas.xmlsoap.org/soap/envelope/"},
+		{"/Envelope/@soap", "http://schemas.xmlsoap.org/soap/envelope/"},
+		{"//@soap", "http://schemas.xmlsoap.org/soap/envelope/"},
+		{"//@*", "7"},
+		{"/Envelope/Body/login/@id", "7"},
+		{"//@id", "7"},
+		{"/*", "pooh"},
+		{"/Envelope/Body/login/user", "pooh"},
+		{"//user", "pooh"},
+		{"/*", "honey"},
+		{"/Envelope/Body/login/pass", "honey"},
+		{"//pass", "honey"},
+	}, values)
+}
+
+func TestReadXMLPathsEntities(t *testing.T) {
+	body := `<?xml version="1.0"?>
+<!DOCTYPE lolz [<!ENTITY lol "lol"><!ENTITY lol2 "&lol;&lol;&lol;">]>
+<lolz>&lol2;</lolz>`
+
+	_, err := readXMLPaths(strings.NewReader(body), xmlDefaultMaxDepth, xmlDefaultMaxValues)
+	require.Equal(t, errXMLEntity, err)
+}
+
+func TestReadXMLPathsLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  error
+	}{
+		{name: "within the limits", body: `<a>x<a>x<a id="1"></a></a></a>`},
+		{name: "too deep", body: `<a>x<a>x<a>x<a>x</a></a></a></a>`, err: errors.New("XML body nested deeper than 3 elements")},
+		{name: "too many values", body: `<a>x<b id="1" name="2">x</b></a>`, err: errors.New("XML body has more than 3 values")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readXMLPaths(strings.NewReader(tt.body), 3, 3)
+			require.Equal(t, tt.err, err)
+		})
+	}
+}